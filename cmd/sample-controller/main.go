@@ -1,47 +1,89 @@
 package main
 
 import (
+	"errors"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"log"
+	"net/http"
 	"os"
 	"os/user"
 	"sample-controller/pkg/controller"
+	"sample-controller/pkg/health"
 	"sample-controller/pkg/kubeapi"
+	"sample-controller/pkg/metrics"
 	"sample-controller/pkg/ratelimit"
 )
 
-func main() {
+// healthAddr is where the liveness and readiness probes are served,
+// see health.NewHandler, together with the metrics at /metrics.
+const healthAddr = ":8081"
+
+// kubeconfigClient returns a client configured by ~/.kube/config.
+func kubeconfigClient() (*kubeapi.KubeClient, error) {
 	usr, err := user.Current()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	config, err := clientcmd.BuildConfigFromFlags("", usr.HomeDir+"/.kube/config")
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	transport, err := rest.TransportFor(config)
 	if err != nil {
+		return nil, err
+	}
+
+	return kubeapi.NewClient(config.Host, transport)
+}
+
+// handleErrors logs the ownership conflicts sent on errs, which only
+// affect one Foo, and panics on any other error.
+func handleErrors(errs <-chan error) {
+	for err := range errs {
+		var conflict *controller.OwnershipConflictError
+		if errors.As(err, &conflict) {
+			log.Print(err)
+			continue
+		}
 		panic(err)
 	}
+}
 
-	client, err := kubeapi.NewClient(config.Host, transport)
+func main() {
+	var client *kubeapi.KubeClient
+	var err error
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		client, err = kubeapi.NewInClusterClient()
+	} else {
+		client, err = kubeconfigClient()
+	}
 	if err != nil {
 		panic(err)
 	}
 
+	pdbs := controller.NewPDBController(client, ratelimit.AfterOneSecondIdle(), "default")
+	services := controller.NewServiceController(client, ratelimit.AfterOneSecondIdle(),
+		"default")
 	controller := controller.NewController(client, ratelimit.AfterOneSecondIdle(), "default")
 
-	done := make(chan struct{})
+	go handleErrors(controller.Errors)
+	go handleErrors(pdbs.Errors)
+	go handleErrors(services.Errors)
+	mux := http.NewServeMux()
+	mux.Handle("/", health.NewHandler(controller, pdbs, services))
+	mux.Handle("/metrics", metrics.Handler())
 	go func() {
-		for err := range controller.Errors {
-			panic(err)
-		}
-		close(done)
+		log.Print(http.ListenAndServe(healthAddr, mux))
 	}()
 
 	var v [1]byte
 	os.Stdin.Read(v[:])
 	controller.RequestStop()
-	<-done
+	pdbs.RequestStop()
+	services.RequestStop()
+	controller.Wait()
+	pdbs.Wait()
+	services.Wait()
 }
@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"context"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"net/url"
+	"sample-controller/pkg/events"
+	"sample-controller/pkg/kubeapi"
+)
+
+// Client is the part of *kubeapi.KubeClient used by NewController and
+// FooConfig, so that they can be given a mock. A mock can embed Client
+// and only implement the methods it expects to be called.
+type Client interface {
+	events.Recorder
+
+	Context() context.Context
+	FieldManager() string
+
+	AddCustomResourceDefinition(crd *apiextensionsv1.CustomResourceDefinition) error
+	GetCustomResourceDefinition(name string, crd *apiextensionsv1.CustomResourceDefinition) error
+	UpdateCustomResourceDefinition(crd *apiextensionsv1.CustomResourceDefinition) error
+	GetCustomResourceDefinitions(name string) (<-chan kubeapi.WatchEvent, chan<- struct{})
+
+	GetResources(group, version, namespace, path string, query url.Values,
+		v interface{}) (<-chan kubeapi.WatchEvent, chan<- struct{})
+	ListAndWatch(group, version, namespace, path string, query url.Values,
+		v interface{}) (<-chan kubeapi.WatchEvent, chan<- struct{})
+	GetResource(group, version, namespace, path string, obj interface{}) error
+	UpdateResource(group, version, namespace, path string, obj interface{}) error
+	UpdateResourceStatus(group, version, namespace, path string, obj interface{}) error
+
+	GetNamespace(name string) (*corev1.Namespace, error)
+	AddNamespace(namespace *corev1.Namespace) error
+
+	GetDeployment(namespace, name string) (*appsv1.Deployment, error)
+	AddDeployment(deployment *appsv1.Deployment) error
+	UpdateDeployment(deployment *appsv1.Deployment) error
+	ApplyDeployment(deployment *appsv1.Deployment, fieldManager string) error
+	PatchDeployment(namespace, name string, patchType types.PatchType, data []byte) error
+	DeleteDeployment(deployment *appsv1.Deployment) error
+}
+
+// withContext returns client with its requests made with ctx. Other
+// Clients than *kubeapi.KubeClient are returned as is.
+func withContext[C Client](client C, ctx context.Context) C {
+	if kc, ok := any(client).(*kubeapi.KubeClient); ok {
+		return any(kc.WithContext(ctx)).(C)
+	}
+	return client
+}
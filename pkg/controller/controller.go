@@ -1,22 +1,98 @@
 package controller
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"log"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"net/http"
+	"net/url"
+	"reflect"
 	"sample-controller/pkg/kubeapi"
+	"sample-controller/pkg/leaderelection"
 	"sample-controller/pkg/ratelimit"
+	"sample-controller/pkg/workqueue"
+	"strings"
+	"time"
 )
 
 const Version = "v1alpha1"
+
+// FooVersions are the versions of the Foo API served by the CRD. They
+// have the same schema, so the api server converts between them by
+// changing the apiVersion. Objects are stored in, and the controller
+// uses, the version of its FooNames.
+var FooVersions = []string{Version, "v1beta1"}
+
 const Group = "samplecontroller.example.com"
 const Kind = "Foo"
 
-func addCRD(client *kubeapi.KubeClient, spec apiextensionsv1.CustomResourceDefinitionSpec) error {
+// FooFinalizer is kept on Foos until the controller cleaned up after
+// them.
+const FooFinalizer = Group + "/cleanup"
+
+var fooGVK = schema.GroupVersionKind{
+	Group:   Group,
+	Version: Version,
+	Kind:    Kind,
+}
+
+// FooNames identify the custom resource managed as a Foo. Running
+// controllers with different FooNames lets several CRDs with the Foo
+// schema be managed from one binary.
+type FooNames struct {
+	GVK schema.GroupVersionKind
+	// Plural is the name of the resource in the api paths.
+	Plural string
+}
+
+// DefaultFooNames are Group, Version and Kind, which NewController
+// and FooConfig use.
+var DefaultFooNames = FooNames{GVK: fooGVK, Plural: "foos"}
+
+// orDefault returns DefaultFooNames if names is the zero value.
+func (names FooNames) orDefault() FooNames {
+	if names == (FooNames{}) {
+		return DefaultFooNames
+	}
+	return names
+}
+
+// checkNamespace returns an error if namespace doesn't exist, unless
+// create is set, in which case it is added.
+func checkNamespace(client Client, namespace string, create bool) error {
+	_, err := client.GetNamespace(namespace)
+	var re *kubeapi.RequestError
+	if !errors.As(err, &re) || re.StatusCode != http.StatusNotFound {
+		return err
+	}
+	if !create {
+		return fmt.Errorf("Namespace %s does not exist: %w", namespace, err)
+	}
+	err = client.AddNamespace(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}})
+	if errors.As(err, &re) && re.StatusCode == http.StatusConflict {
+		// Someone else just added it.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Could not add namespace %s: %w", namespace, err)
+	}
+	return nil
+}
+
+func addCRD(client Client, spec apiextensionsv1.CustomResourceDefinitionSpec) error {
 	name := spec.Names.Plural + "." + spec.Group
 	crd := apiextensionsv1.CustomResourceDefinition{
 		ObjectMeta: metav1.ObjectMeta{Name: name},
@@ -24,321 +100,1400 @@ func addCRD(client *kubeapi.KubeClient, spec apiextensionsv1.CustomResourceDefin
 	}
 
 	err := client.AddCustomResourceDefinition(&crd)
-
-	// Ignore 409 (Conflict)
-	// FIXME: Update with a PUT with a metadata.resourceVersion.
-	if re, ok := err.(*kubeapi.RequestError); ok && re.StatusCode != 409 {
+	var re *kubeapi.RequestError
+	if errors.As(err, &re) && re.StatusCode == http.StatusConflict {
+		// It already exists, possibly with an older schema.
+		existing := apiextensionsv1.CustomResourceDefinition{}
+		if err := client.GetCustomResourceDefinition(name, &existing); err != nil {
+			return fmt.Errorf("Could not get CustomResourceDefinition %s: %w", name, err)
+		}
+		crd.ResourceVersion = existing.ResourceVersion
+		err = client.UpdateCustomResourceDefinition(&crd)
+		if err != nil {
+			return fmt.Errorf("Could not update CustomResourceDefinition %s: %w", name, err)
+		}
+	} else if re != nil {
 		return re
 	}
 
-	resources, stop := client.GetCustomResourceDefinitions(name)
-	defer close(stop)
-Outer:
-	for res := range resources {
-		if res.Err != nil {
-			return res.Err
+	return waitEstablished(client, name, crdEstablishTimeout)
+}
+
+// crdEstablishTimeout is how long addCRD waits for the CRD to be
+// established.
+const crdEstablishTimeout = time.Minute
+
+// The delay before watching a CRD again after its watch ended early.
+// It doubles each time, up to maxCRDRewatchDelay.
+const (
+	crdRewatchDelay    = 100 * time.Millisecond
+	maxCRDRewatchDelay = 5 * time.Second
+)
+
+// waitEstablished waits for the CustomResourceDefinition name to be
+// established. The watch is started again if it ends before, as the
+// api server might just have closed it.
+func waitEstablished(client Client, name string, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	timedOut := func(ends int) error {
+		return fmt.Errorf("CustomResourceDefinition %s was not established within %s, "+
+			"its watch ended %d times", name, timeout, ends)
+	}
+	done := client.Context().Done()
+	for ends := 0; ; ends++ {
+		if ends > 0 {
+			delay := time.NewTimer(workqueue.ExponentialDelay(crdRewatchDelay,
+				maxCRDRewatchDelay, ends-1))
+			select {
+			case <-delay.C:
+			case <-deadline.C:
+				delay.Stop()
+				return timedOut(ends)
+			case <-done:
+				delay.Stop()
+				return client.Context().Err()
+			}
 		}
-		if res.IsDelete {
-			continue
+		established, err := watchEstablished(client, name, deadline.C)
+		if err == errCRDTimeout {
+			return timedOut(ends)
+		}
+		if err != nil || established {
+			return err
 		}
-		item := res.Item.(apiextensionsv1.CustomResourceDefinition)
-		for _, cond := range item.Status.Conditions {
-			if cond.Type == "Established" &&
-				cond.Status == apiextensionsv1.ConditionTrue {
-				break Outer
+	}
+}
+
+var errCRDTimeout = errors.New("timed out")
+
+// watchEstablished watches the CustomResourceDefinition name until it
+// is established, the watch ends or timeout, in which case it returns
+// errCRDTimeout. A CRD whose names were not accepted, for example
+// because another CRD has the same plural, is never established, and
+// is reported as an error.
+func watchEstablished(client Client, name string,
+	timeout <-chan time.Time) (bool, error) {
+	resources, stop := client.GetCustomResourceDefinitions(name)
+	defer close(stop)
+	for {
+		select {
+		case <-timeout:
+			return false, errCRDTimeout
+		case res, ok := <-resources:
+			if !ok {
+				return false, nil
+			}
+			if res.Err != nil {
+				return false, res.Err
+			}
+			crd, ok := res.Item.(apiextensionsv1.CustomResourceDefinition)
+			if res.IsDelete || !ok {
+				continue
+			}
+			for _, cond := range crd.Status.Conditions {
+				if cond.Type == apiextensionsv1.Established &&
+					cond.Status == apiextensionsv1.ConditionTrue {
+					return true, nil
+				}
+				if cond.Type == apiextensionsv1.NamesAccepted &&
+					cond.Status == apiextensionsv1.ConditionFalse {
+					return false, fmt.Errorf("CustomResourceDefinition %s cannot be "+
+						"established, its names were not accepted: %s: %s", name,
+						cond.Reason, cond.Message)
+				}
 			}
 		}
 	}
+}
+
+// MaxFooReplicas is the most replicas the CRD accepts in a Foo.
+const MaxFooReplicas = 1000
+
+// dns1123SubdomainPattern matches the names of Deployments, whose
+// length is also limited.
+const dns1123SubdomainPattern = `^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`
+
+// quantityPattern matches the strings resource.Quantity parses, as in
+// the schemas Kubernetes publishes for its own types.
+const quantityPattern = `^(\+|-)?(([0-9]+(\.[0-9]*)?)|(\.[0-9]+))(([KMGTPE]i)|[numkMGTPE]|([eE](\+|-)?(([0-9]+(\.[0-9]*)?)|(\.[0-9]+))))?$`
+
+// FooValidator returns the Config.Validate of FooConfig, with at most
+// maxReplicas. It rejects the Foos the CRD schema would, as the api
+// server might not enforce it, for example if the CRD was created by
+// an older version of the controller.
+func FooValidator(maxReplicas int32) func(*Foo) error {
+	return func(foo *Foo) error {
+		return validateFoo(foo, maxReplicas)
+	}
+}
+
+func validateFoo(foo *Foo, maxReplicas int32) error {
+	if errs := validation.IsDNS1123Subdomain(foo.Spec.DeploymentName); len(errs) != 0 {
+		return fmt.Errorf("Invalid deploymentName %q: %s", foo.Spec.DeploymentName,
+			strings.Join(errs, ", "))
+	}
+	if replicas := foo.Spec.Replicas; !foo.Spec.ExternalReplicas &&
+		(replicas < 0 || replicas > maxReplicas) {
+		return fmt.Errorf("Invalid replicas %d: must be between 0 and %d", replicas,
+			maxReplicas)
+	}
 	return nil
 }
 
-func addFooCRD(client *kubeapi.KubeClient) error {
+func addFooCRD(client Client, names FooNames) error {
 	crdNames := apiextensionsv1.CustomResourceDefinitionNames{
-		Kind:   Kind,
-		Plural: "foos",
+		Kind:   names.GVK.Kind,
+		Plural: names.Plural,
+	}
+	// The api server rejects Foos we could not synchronize.
+	minReplicas := float64(0)
+	maxReplicas := float64(MaxFooReplicas)
+	maxNameLength := int64(validation.DNS1123SubdomainMaxLength)
+	minPort, maxPort := float64(1), float64(65535)
+	// The names of Secrets and ServiceAccounts.
+	objectName := apiextensionsv1.JSONSchemaProps{
+		Type:      "string",
+		MaxLength: &maxNameLength,
+		Pattern:   dns1123SubdomainPattern,
+	}
+	// Resource quantities by name, such as cpu: 500m.
+	quantities := apiextensionsv1.JSONSchemaProps{
+		Type: "object",
+		AdditionalProperties: &apiextensionsv1.JSONSchemaPropsOrBool{
+			Schema: &apiextensionsv1.JSONSchemaProps{
+				XIntOrString: true,
+				AnyOf: []apiextensionsv1.JSONSchemaProps{
+					{Type: "integer"},
+					{Type: "string"},
+				},
+				Pattern: quantityPattern,
+			},
+		},
 	}
 	crdSchemaSpec := apiextensionsv1.JSONSchemaProps{
+		Type:     "object",
+		Required: []string{"deploymentName"},
+		Properties: map[string]apiextensionsv1.JSONSchemaProps{
+			"deploymentName": apiextensionsv1.JSONSchemaProps{
+				Type:      "string",
+				MaxLength: &maxNameLength,
+				Pattern:   dns1123SubdomainPattern,
+			},
+			"replicas": apiextensionsv1.JSONSchemaProps{
+				Type:    "integer",
+				Minimum: &minReplicas,
+				Maximum: &maxReplicas,
+				Default: &apiextensionsv1.JSON{Raw: []byte("1")},
+			},
+			"externalReplicas": apiextensionsv1.JSONSchemaProps{Type: "boolean"},
+			"port": apiextensionsv1.JSONSchemaProps{
+				Type:    "integer",
+				Minimum: &minPort,
+				Maximum: &maxPort,
+			},
+			"service":       apiextensionsv1.JSONSchemaProps{Type: "boolean"},
+			"image":         apiextensionsv1.JSONSchemaProps{Type: "string"},
+			"containerName": apiextensionsv1.JSONSchemaProps{Type: "string"},
+			"imagePullSecrets": apiextensionsv1.JSONSchemaProps{
+				Type: "array",
+				Items: &apiextensionsv1.JSONSchemaPropsOrArray{
+					Schema: &objectName,
+				},
+			},
+			"serviceAccountName": objectName,
+			"podLabels": apiextensionsv1.JSONSchemaProps{
+				Type: "object",
+				AdditionalProperties: &apiextensionsv1.JSONSchemaPropsOrBool{
+					Schema: &apiextensionsv1.JSONSchemaProps{Type: "string"},
+				},
+			},
+			"podAnnotations": apiextensionsv1.JSONSchemaProps{
+				Type: "object",
+				AdditionalProperties: &apiextensionsv1.JSONSchemaPropsOrBool{
+					Schema: &apiextensionsv1.JSONSchemaProps{Type: "string"},
+				},
+			},
+			"resources": apiextensionsv1.JSONSchemaProps{
+				Type: "object",
+				Properties: map[string]apiextensionsv1.JSONSchemaProps{
+					"limits":   quantities,
+					"requests": quantities,
+				},
+			},
+			"pdb": apiextensionsv1.JSONSchemaProps{
+				Type: "object",
+				Properties: map[string]apiextensionsv1.JSONSchemaProps{
+					"minAvailable":   apiextensionsv1.JSONSchemaProps{XIntOrString: true},
+					"maxUnavailable": apiextensionsv1.JSONSchemaProps{XIntOrString: true},
+				},
+			},
+		},
+	}
+	preserveUnknown := true
+	crdSchemaStatus := apiextensionsv1.JSONSchemaProps{
 		Type: "object",
+		// Newer versions of the controller might add fields, see
+		// FooStatus.
+		XPreserveUnknownFields: &preserveUnknown,
 		Properties: map[string]apiextensionsv1.JSONSchemaProps{
-			"deploymentName": apiextensionsv1.JSONSchemaProps{Type: "string"},
-			"replicas":       apiextensionsv1.JSONSchemaProps{Type: "integer"},
+			"availableReplicas": apiextensionsv1.JSONSchemaProps{Type: "integer"},
+			"conditions": apiextensionsv1.JSONSchemaProps{
+				Type: "array",
+				Items: &apiextensionsv1.JSONSchemaPropsOrArray{
+					Schema: &apiextensionsv1.JSONSchemaProps{
+						Type:                   "object",
+						XPreserveUnknownFields: &preserveUnknown,
+					},
+				},
+			},
 		},
 	}
 	crdSchema := &apiextensionsv1.JSONSchemaProps{
-		Type:       "object",
-		Properties: map[string]apiextensionsv1.JSONSchemaProps{"spec": crdSchemaSpec},
+		Type: "object",
+		Properties: map[string]apiextensionsv1.JSONSchemaProps{
+			"spec":   crdSchemaSpec,
+			"status": crdSchemaStatus,
+		},
 	}
 	crdVersion := apiextensionsv1.CustomResourceDefinitionVersion{
-		Name:    Version,
+		Name:    names.GVK.Version,
 		Schema:  &apiextensionsv1.CustomResourceValidation{OpenAPIV3Schema: crdSchema},
 		Served:  true,
 		Storage: true,
+		Subresources: &apiextensionsv1.CustomResourceSubresources{
+			Status: &apiextensionsv1.CustomResourceSubresourceStatus{},
+		},
+		AdditionalPrinterColumns: []apiextensionsv1.CustomResourceColumnDefinition{
+			{Name: "Deployment", Type: "string", JSONPath: ".spec.deploymentName"},
+			{Name: "Replicas", Type: "integer", JSONPath: ".spec.replicas"},
+			{Name: "Ready", Type: "string",
+				JSONPath: `.status.conditions[?(@.type=="Ready")].status`},
+			{Name: "Reason", Type: "string",
+				JSONPath: `.status.conditions[?(@.type=="Ready")].reason`},
+			{Name: "Available", Type: "integer", JSONPath: ".status.availableReplicas"},
+			{Name: "Age", Type: "date", JSONPath: ".metadata.creationTimestamp"},
+		},
 	}
 	crdSpec := apiextensionsv1.CustomResourceDefinitionSpec{
-		Group:    Group,
+		Group:    names.GVK.Group,
 		Names:    crdNames,
 		Scope:    "Namespaced",
-		Versions: []apiextensionsv1.CustomResourceDefinitionVersion{crdVersion},
+		Versions: fooCRDVersions(crdVersion),
+		Conversion: &apiextensionsv1.CustomResourceConversion{
+			Strategy: apiextensionsv1.NoneConverter,
+		},
 	}
 	return addCRD(client, crdSpec)
 }
 
+// fooCRDVersions returns storage, which has the version of the
+// FooNames, followed by the other FooVersions, which are only served.
+// A version that is not one of FooVersions is the only one.
+func fooCRDVersions(
+	storage apiextensionsv1.CustomResourceDefinitionVersion) []apiextensionsv1.CustomResourceDefinitionVersion {
+	known := false
+	var served []apiextensionsv1.CustomResourceDefinitionVersion
+	for _, v := range FooVersions {
+		if v == storage.Name {
+			known = true
+			continue
+		}
+		version := storage
+		version.Name = v
+		version.Storage = false
+		served = append(served, version)
+	}
+	if !known {
+		return []apiextensionsv1.CustomResourceDefinitionVersion{storage}
+	}
+	return append([]apiextensionsv1.CustomResourceDefinitionVersion{storage}, served...)
+}
+
 type FooSpec struct {
 	DeploymentName string `json:"deploymentName"`
 	Replicas       int32  `json:"replicas"`
+	// Image is the image of the container of the pods, DefaultImage
+	// if empty.
+	Image string `json:"image,omitempty"`
+	// ContainerName is the name of that container,
+	// DefaultContainerName if empty.
+	ContainerName string `json:"containerName,omitempty"`
+	// PodLabels are added to the pod template of the Deployment.
+	// They cannot replace the labels of podSelector.
+	PodLabels map[string]string `json:"podLabels,omitempty"`
+	// PodAnnotations are added to the pod template of the
+	// Deployment, for example prometheus.io/scrape.
+	PodAnnotations map[string]string `json:"podAnnotations,omitempty"`
+	// Resources, if set, are the requests and limits of the
+	// container of the pods.
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+	// ImagePullSecrets, if set, are the names of the Secrets the pods
+	// pull their image with, for example from a private registry.
+	ImagePullSecrets []string `json:"imagePullSecrets,omitempty"`
+	// ServiceAccountName, if set, is the ServiceAccount the pods run
+	// as.
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+	// ExternalReplicas leaves the replicas of the Deployment, or
+	// ReplicaSet, to someone else, such as a
+	// HorizontalPodAutoscaler. Replicas is then ignored, and a new
+	// Deployment starts with one.
+	ExternalReplicas bool `json:"externalReplicas,omitempty"`
+	// Port, if set, is the TCP port the container listens on.
+	Port int32 `json:"port,omitempty"`
+	// Service makes the controller returned by
+	// NewServiceController create a ClusterIP Service for Port.
+	Service bool `json:"service,omitempty"`
+	// PDB, if set, makes the controller returned by
+	// NewPDBController create a PodDisruptionBudget for the pods of
+	// the Deployment.
+	PDB *PDBSpec `json:"pdb,omitempty"`
 }
 
-type Foo struct {
-	metav1.ObjectMeta `json:"metadata"`
-	Spec              FooSpec `json:"spec"`
+// PDBSpec has the fields of a PodDisruptionBudget. Only one of them
+// can be set.
+type PDBSpec struct {
+	MinAvailable   *intstr.IntOrString `json:"minAvailable,omitempty"`
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
 }
 
-type Controller struct {
-	Namespace       string
-	Errors          chan error
-	stopFoos        chan<- struct{}
-	stopDeployments chan<- struct{}
+type FooStatus struct {
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// AvailableReplicas is that of the Deployment when it last
+	// matched the Foo.
+	AvailableReplicas int32 `json:"availableReplicas,omitempty"`
+
+	// unknown has the fields we don't know about, which a newer
+	// version of the controller might have written. They are
+	// preserved when we write the status back.
+	unknown map[string]json.RawMessage
+}
 
-	rl ratelimit.RateLimiter
+// fooStatusFields are the json names of the fields of FooStatus.
+var fooStatusFields = jsonFieldNames(reflect.TypeOf(FooStatus{}))
 
-	client *kubeapi.KubeClient
+func jsonFieldNames(ty reflect.Type) map[string]bool {
+	ret := make(map[string]bool)
+	for i := 0; i < ty.NumField(); i++ {
+		name := strings.Split(ty.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			ret[name] = true
+		}
+	}
+	return ret
 }
 
-// It is done once c.Errors is closed
-func (c *Controller) RequestStop() {
-	if c.stopFoos != nil {
-		close(c.stopFoos)
+// knownFooStatus has the fields of FooStatus but not its methods.
+type knownFooStatus FooStatus
+
+func (status *FooStatus) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*knownFooStatus)(status)); err != nil {
+		return err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	for name := range all {
+		if fooStatusFields[name] {
+			delete(all, name)
+		}
 	}
-	if c.stopDeployments != nil {
-		close(c.stopDeployments)
+	status.unknown = nil
+	if len(all) != 0 {
+		status.unknown = all
 	}
+	return nil
 }
 
-type controllerStatus struct {
-	// Map from name to spec
-	foos map[string]Foo
+func (status FooStatus) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(knownFooStatus(status))
+	if err != nil || len(status.unknown) == 0 {
+		return data, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	for name, value := range status.unknown {
+		all[name] = value
+	}
+	return json.Marshal(all)
+}
 
-	// Map from the name to deployment
-	deployments map[string]appsv1.Deployment
+type Foo struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              FooSpec   `json:"spec"`
+	Status            FooStatus `json:"status,omitempty"`
+}
 
-	// Set of names of Foos we have to check
-	todo map[string]struct{}
+// Controller is the GenericController instantiation that creates a
+// Deployment for each Foo.
+type Controller = GenericController[*Foo, *appsv1.Deployment]
 
-	// Set of names of deployments that might be orphans
-	orphans map[string]struct{}
+func newDeployment(foo *Foo) *appsv1.Deployment {
+	return newDeploymentFor(foo, fooGVK)
 }
 
-func newDeployment(foo *Foo) appsv1.Deployment {
-	ref := metav1.NewControllerRef(foo, schema.GroupVersionKind{
-		Group:   Group,
-		Version: Version,
-		Kind:    Kind,
-	})
+// newDeploymentFor returns the Deployment of foo, whose kind is gvk.
+func newDeploymentFor(foo *Foo, gvk schema.GroupVersionKind) *appsv1.Deployment {
+	ref := metav1.NewControllerRef(foo, gvk)
 	meta := metav1.ObjectMeta{
 		Name:            foo.Spec.DeploymentName,
 		Namespace:       foo.Namespace,
 		OwnerReferences: []metav1.OwnerReference{*ref},
 	}
-	labels := map[string]string{
-		"controller": foo.Name,
-	}
-	container := corev1.Container{
-		Name:  "nginx",
-		Image: "nginx:latest",
-	}
-	template := corev1.PodTemplateSpec{
-		ObjectMeta: metav1.ObjectMeta{Labels: labels},
-		Spec:       corev1.PodSpec{Containers: []corev1.Container{container}},
-	}
+	template := newPodTemplate(foo)
 	spec := appsv1.DeploymentSpec{
-		Selector: &metav1.LabelSelector{MatchLabels: labels},
+		Selector: podSelector(foo),
 		Template: template,
-		Replicas: &foo.Spec.Replicas,
+		Replicas: fooReplicas(foo),
 	}
-	ret := appsv1.Deployment{
+	ret := &appsv1.Deployment{
 		ObjectMeta: meta,
 		Spec:       spec,
 	}
+	ret.Labels = propagatedMeta(foo.Labels)
+	ret.Annotations = propagatedMeta(foo.Annotations)
+	if ret.Annotations == nil {
+		ret.Annotations = make(map[string]string)
+	}
+	ret.Annotations[SpecHashAnnotation] = specHash(ret)
 	return ret
 }
 
-func synchronize(client *kubeapi.KubeClient, status *controllerStatus) error {
-	for item := range status.todo {
-		// FIXME: Split a processsOneItem
-		foo, has_foo := status.foos[item]
-		if !has_foo {
-			// There is nothing for us to do. The Kubernetes garbage collector will
-			// delete the deployment for us.
-			delete(status.todo, item)
+// propagatedMeta returns the labels or annotations of a Foo that are
+// copied to its Deployment: all of them but the reserved ones, which
+// belong to us or to kubectl, such as SpecHashAnnotation and the
+// labels of podSelector.
+func propagatedMeta(m map[string]string) map[string]string {
+	var ret map[string]string
+	for k, v := range m {
+		if reservedMeta(k) {
 			continue
 		}
-
-		dep, has_dep := status.deployments[foo.Spec.DeploymentName]
-		if has_dep {
-			if !metav1.IsControlledBy(&dep, &foo) {
-				log.Printf("Deployment %s:%s is not owned by us.", dep.Namespace,
-					dep.Name)
-				// Don't delete from todo so we try again
-				continue
-			}
-			if foo.Spec.Replicas == *dep.Spec.Replicas {
-				delete(status.todo, item)
-				continue
-			}
+		if ret == nil {
+			ret = make(map[string]string)
 		}
+		ret[k] = v
+	}
+	return ret
+}
 
-		newDep := newDeployment(&foo)
-		var err error
-		if has_dep {
-			newDep.ResourceVersion = dep.ResourceVersion
-			err = client.UpdateDeployment(&newDep)
-		} else {
-			err = client.AddDeployment(&newDep)
-		}
-		if err != nil {
-			return err
+func reservedMeta(key string) bool {
+	if _, ok := podSelector(&Foo{}).MatchLabels[key]; ok {
+		return true
+	}
+	return strings.HasPrefix(key, Group+"/") ||
+		strings.HasPrefix(key, "kubectl.kubernetes.io/")
+}
+
+// FieldManager is the field manager of the server-side applies of
+// FooConfig, see UpdateApply, unless the client has another one, see
+// kubeapi.KubeClient.WithFieldManager.
+const FieldManager = "sample-controller"
+
+// fieldManager returns the field manager of the applies of client.
+func fieldManager(client Client) string {
+	if m := client.FieldManager(); m != "" {
+		return m
+	}
+	return FieldManager
+}
+
+// SpecHashAnnotation is set on the Deployments we write to the hash of
+// the parts of their spec we manage, see deploymentsEqual.
+const SpecHashAnnotation = Group + "/spec-hash"
+
+// specHash returns the hash of the replicas and pod template of
+// deployment.
+func specHash(deployment *appsv1.Deployment) string {
+	data, err := json.Marshal(struct {
+		Replicas *int32                 `json:"replicas"`
+		Template corev1.PodTemplateSpec `json:"template"`
+	}{deployment.Spec.Replicas, deployment.Spec.Template})
+	if err != nil {
+		// These types always marshal.
+		panic(err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// The container of the pods of a Foo that doesn't set FooSpec.Image or
+// FooSpec.ContainerName.
+const (
+	DefaultImage         = "nginx:latest"
+	DefaultContainerName = "nginx"
+)
+
+// FooUIDLabel is set on the pods of a Foo to its UID, so that the
+// pods of two Foos with the same name are never selected together.
+const FooUIDLabel = Group + "/foo-uid"
+
+// podSelector returns the selector of the pods of foo. The selector of
+// a Deployment cannot be changed, so existing ones keep theirs, see
+// preserveDeployment.
+func podSelector(foo *Foo) *metav1.LabelSelector {
+	return &metav1.LabelSelector{MatchLabels: map[string]string{
+		"controller": foo.Name,
+		FooUIDLabel:  string(foo.UID),
+	}}
+}
+
+// newPodTemplate returns the template of the pods of foo. Its labels
+// are FooSpec.PodLabels and those of podSelector.
+func newPodTemplate(foo *Foo) corev1.PodTemplateSpec {
+	labels := make(map[string]string)
+	for k, v := range foo.Spec.PodLabels {
+		labels[k] = v
+	}
+	for k, v := range podSelector(foo).MatchLabels {
+		labels[k] = v
+	}
+	container := corev1.Container{
+		Name:  foo.Spec.ContainerName,
+		Image: foo.Spec.Image,
+	}
+	if container.Name == "" {
+		container.Name = DefaultContainerName
+	}
+	if container.Image == "" {
+		container.Image = DefaultImage
+	}
+	if foo.Spec.Resources != nil {
+		container.Resources = *foo.Spec.Resources.DeepCopy()
+	}
+	if foo.Spec.Port != 0 {
+		container.Ports = []corev1.ContainerPort{{ContainerPort: foo.Spec.Port,
+			Protocol: corev1.ProtocolTCP}}
+	}
+	var annotations map[string]string
+	if len(foo.Spec.PodAnnotations) != 0 {
+		annotations = make(map[string]string)
+		for k, v := range foo.Spec.PodAnnotations {
+			annotations[k] = v
 		}
-		delete(status.todo, item)
 	}
+	spec := corev1.PodSpec{
+		Containers:         []corev1.Container{container},
+		ServiceAccountName: foo.Spec.ServiceAccountName,
+	}
+	for _, name := range foo.Spec.ImagePullSecrets {
+		spec.ImagePullSecrets = append(spec.ImagePullSecrets,
+			corev1.LocalObjectReference{Name: name})
+	}
+	return corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: labels, Annotations: annotations},
+		Spec:       spec,
+	}
+}
+
+// ignoredPodAnnotations are set on pod templates by others and must be
+// left alone. kubectl rollout restart sets restartedAt, for example.
+var ignoredPodAnnotations = map[string]bool{
+	"kubectl.kubernetes.io/restartedAt": true,
+}
 
-	for name := range status.orphans {
-		dep, has_dep := status.deployments[name]
-		if !has_dep {
+func podAnnotationsEqual(existing, desired map[string]string) bool {
+	n := 0
+	for k, v := range desired {
+		if ignoredPodAnnotations[k] {
 			continue
 		}
-		cont := metav1.GetControllerOfNoCopy(&dep)
-		if cont == nil {
-			continue
+		if existing[k] != v {
+			return false
 		}
-		foo, ok := status.foos[cont.Name]
-		if !ok || foo.Spec.DeploymentName == dep.Name {
-			continue
+		n++
+	}
+	for k := range existing {
+		if !ignoredPodAnnotations[k] {
+			n--
 		}
-		client.DeleteDeployment(&dep)
-		delete(status.orphans, name)
 	}
+	return n == 0
+}
 
-	return nil
+// labelsContain reports whether existing has every label of desired.
+// Labels others added to existing are ignored.
+func labelsContain(existing, desired map[string]string) bool {
+	for k, v := range desired {
+		if existing[k] != v {
+			return false
+		}
+	}
+	return true
 }
 
-// processResources goes over the existing Foos and Deployments
-// and synchronizes them.
-func processResources(c *Controller, deploymentsCh <-chan kubeapi.WatchEvent,
-	foosCh <-chan kubeapi.WatchEvent) {
-	defer close(c.Errors)
-
-	status := controllerStatus{make(map[string]Foo), make(map[string]appsv1.Deployment),
-		make(map[string]struct{}), make(map[string]struct{})}
-
-	addTODO := func(deployment *appsv1.Deployment) {
-		// Only add to TODO if we own it
-		for _, o := range deployment.OwnerReferences {
-			// It is OK to not be supper strict in
-			// here. We will just try to synchronize more
-			// often.
-			if o.Kind == Kind {
-				c.rl.AskTick()
-				status.todo[o.Name] = struct{}{}
-				return
+// containersEqual reports whether every desired container is in
+// existing with the same image and, if the desired one has any, the
+// same resources. Containers others added to existing are ignored.
+func containersEqual(existing, desired []corev1.Container) bool {
+Containers:
+	for _, container := range desired {
+		for _, e := range existing {
+			if e.Name == container.Name {
+				if e.Image != container.Image {
+					return false
+				}
+				if !resourcesEqual(e.Resources, container.Resources) {
+					return false
+				}
+				// As with the resources, ports we don't set are
+				// left alone.
+				if len(container.Ports) != 0 &&
+					!apiequality.Semantic.DeepEqual(e.Ports, container.Ports) {
+					return false
+				}
+				continue Containers
 			}
 		}
+		return false
 	}
+	return true
+}
 
-	for {
-		select {
-		case d, ok := <-deploymentsCh:
-			if d.Err != nil {
-				c.Errors <- fmt.Errorf("Reading deployments: %w", d.Err)
-				return
-			}
-			if !ok {
-				deploymentsCh = nil
-				break
-			}
-			newDeployment := d.Item.(appsv1.Deployment)
-			oldDeployment, ok := status.deployments[newDeployment.Name]
-			if d.IsDelete {
-				delete(status.deployments, newDeployment.Name)
-			} else {
-				status.deployments[newDeployment.Name] = newDeployment
-			}
+// podSpecEqual compares the service account and image pull secrets of
+// an existing pod spec with the desired ones. As with the resources,
+// those we don't set are left alone.
+func podSpecEqual(existing, desired corev1.PodSpec) bool {
+	if desired.ServiceAccountName != "" &&
+		existing.ServiceAccountName != desired.ServiceAccountName {
+		return false
+	}
+	return len(desired.ImagePullSecrets) == 0 ||
+		reflect.DeepEqual(existing.ImagePullSecrets, desired.ImagePullSecrets)
+}
 
-			addTODO(&newDeployment)
-			if ok {
-				addTODO(&oldDeployment)
-			}
+// resourcesEqual compares the resources of an existing container with
+// the desired ones. Without desired resources, those others set, for
+// example with a mutating webhook, are left alone. Quantities are
+// compared by value, as the api server might write 0.5 as 500m.
+func resourcesEqual(existing, desired corev1.ResourceRequirements) bool {
+	if len(desired.Limits) == 0 && len(desired.Requests) == 0 {
+		return true
+	}
+	return apiequality.Semantic.DeepEqual(existing, desired)
+}
 
-		case f, ok := <-foosCh:
-			if f.Err != nil {
-				c.Errors <- fmt.Errorf("Reading Foos: %w", f.Err)
-				return
-			}
-			if !ok {
-				foosCh = nil
-				break
-			}
-			newFoo := f.Item.(Foo)
-			oldFoo, ok := status.foos[newFoo.Name]
-			c.rl.AskTick()
+// fooReplicas returns the replicas foo asks for. The CRD rejects a
+// negative count, but Foos stored before it did might have one, which
+// is taken as 0.
+func fooReplicas(foo *Foo) *int32 {
+	if foo.Spec.ExternalReplicas {
+		return nil
+	}
+	if foo.Spec.Replicas < 0 {
+		zero := int32(0)
+		return &zero
+	}
+	return &foo.Spec.Replicas
+}
 
-			if ok && oldFoo.Spec.DeploymentName != newFoo.Spec.DeploymentName {
-				status.orphans[oldFoo.Spec.DeploymentName] = struct{}{}
-			}
+// replicasEqual compares the replicas of an existing resource with the
+// desired ones. Replicas set by someone else might be nil, which we
+// take as different so that ours are written. Without desired
+// replicas, they are not ours to compare, see FooSpec.ExternalReplicas.
+func replicasEqual(existing, desired *int32) bool {
+	if desired == nil {
+		return true
+	}
+	return existing != nil && *existing == *desired
+}
 
-			if f.IsDelete {
-				delete(status.foos, newFoo.Name)
-			} else {
-				status.foos[newFoo.Name] = newFoo
-			}
-			status.todo[newFoo.Name] = struct{}{}
+// deploymentsEqual reports whether existing was written for the same
+// spec as desired, according to their SpecHashAnnotation, and still
+// has the controller reference, labels, annotations, replicas, pod
+// annotations, service account, image pull secrets and containers we
+// set. Labels and annotations others
+// added are ignored, and so are those no longer propagated from the
+// Foo.
+func deploymentsEqual(existing, desired *appsv1.Deployment) bool {
+	return controllerRefEqual(existing, desired) &&
+		labelsContain(existing.Labels, desired.Labels) &&
+		labelsContain(existing.Annotations, desired.Annotations) &&
+		replicasEqual(existing.Spec.Replicas, desired.Spec.Replicas) &&
+		podAnnotationsEqual(existing.Spec.Template.Annotations,
+			desired.Spec.Template.Annotations) &&
+		podSpecEqual(existing.Spec.Template.Spec, desired.Spec.Template.Spec) &&
+		containersEqual(existing.Spec.Template.Spec.Containers,
+			desired.Spec.Template.Spec.Containers)
+}
+
+// controllerRefEqual reports whether existing has the controller
+// reference of desired, with the same BlockOwnerDeletion, so that the
+// garbage collector deletes the Deployment only after the Foo. Any
+// version of the Foo API matches, see isPrimaryRef.
+func controllerRefEqual(existing, desired *appsv1.Deployment) bool {
+	want := metav1.GetControllerOfNoCopy(desired)
+	if want == nil {
+		return true
+	}
+	ref := metav1.GetControllerOfNoCopy(existing)
+	return ref != nil && ref.UID == want.UID && ref.Kind == want.Kind &&
+		ref.Name == want.Name &&
+		reflect.DeepEqual(ref.BlockOwnerDeletion, want.BlockOwnerDeletion)
+}
+
+// preserveDeployment keeps the ignored pod annotations of an existing
+// Deployment, and its replicas if we don't manage them. Since the
+// selector of a Deployment cannot be changed, it also keeps it,
+// together with the pod template labels it uses that we don't set. For
+// Deployments we created this changes nothing, but it is needed when
+// adopting one, see adoptableDeployment. The rollout settings desired
+// leaves unset, like the strategy, are kept too, so that an update
+// doesn't reset them to the defaults.
+func preserveDeployment(existing, desired *appsv1.Deployment) {
+	desired.Spec.Selector = existing.Spec.Selector
+	if desired.Spec.Replicas == nil {
+		// Not ours, and they would be reset to 1 otherwise.
+		desired.Spec.Replicas = existing.Spec.Replicas
+	}
+	if desired.Spec.Strategy.Type == "" {
+		desired.Spec.Strategy = existing.Spec.Strategy
+	}
+	if desired.Spec.RevisionHistoryLimit == nil {
+		desired.Spec.RevisionHistoryLimit = existing.Spec.RevisionHistoryLimit
+	}
+	if desired.Spec.ProgressDeadlineSeconds == nil {
+		desired.Spec.ProgressDeadlineSeconds = existing.Spec.ProgressDeadlineSeconds
+	}
+	if desired.Spec.MinReadySeconds == 0 {
+		desired.Spec.MinReadySeconds = existing.Spec.MinReadySeconds
+	}
+	podLabels := desired.Spec.Template.Labels
+	for k, v := range existing.Spec.Template.Labels {
+		if _, ok := podLabels[k]; !ok && selectorUses(existing.Spec.Selector, k) {
+			podLabels[k] = v
+		}
+	}
+
+	for k, v := range existing.Spec.Template.Annotations {
+		if !ignoredPodAnnotations[k] {
+			continue
+		}
+		if desired.Spec.Template.Annotations == nil {
+			desired.Spec.Template.Annotations = make(map[string]string)
+		}
+		desired.Spec.Template.Annotations[k] = v
+	}
+}
+
+// mergeDeployment is the Config.Merge of FooConfig. It only sets the
+// replicas, the controller reference, the labels and annotations, the pod
+// template labels and annotations of desired, its service account and
+// image pull secrets and the images and resources of its containers, so
+// everything else others added to live, like sidecars and volumes,
+// is kept. The selector cannot be changed, so it is kept too.
+func mergeDeployment(live, desired *appsv1.Deployment) *appsv1.Deployment {
+	merged := live.DeepCopy()
 
-		case <-c.rl.GetChan():
-			if err := synchronize(c.client, &status); err != nil {
-				log.Printf("Synchronize failed, will retry: %s", err)
-				c.rl.AskTick()
+	refs := []metav1.OwnerReference{*metav1.GetControllerOfNoCopy(desired)}
+	for _, ref := range merged.OwnerReferences {
+		if ref.Controller == nil || !*ref.Controller {
+			refs = append(refs, ref)
+		}
+	}
+	merged.OwnerReferences = refs
+	for k, v := range desired.Labels {
+		if merged.Labels == nil {
+			merged.Labels = make(map[string]string)
+		}
+		merged.Labels[k] = v
+	}
+	for k, v := range desired.Annotations {
+		if merged.Annotations == nil {
+			merged.Annotations = make(map[string]string)
+		}
+		merged.Annotations[k] = v
+	}
+
+	if desired.Spec.Replicas != nil {
+		merged.Spec.Replicas = desired.Spec.Replicas
+	}
+	template := &merged.Spec.Template
+	for k, v := range desired.Spec.Template.Labels {
+		if template.Labels == nil {
+			template.Labels = make(map[string]string)
+		}
+		template.Labels[k] = v
+	}
+	for k, v := range desired.Spec.Template.Annotations {
+		if template.Annotations == nil {
+			template.Annotations = make(map[string]string)
+		}
+		template.Annotations[k] = v
+	}
+	if name := desired.Spec.Template.Spec.ServiceAccountName; name != "" {
+		template.Spec.ServiceAccountName = name
+	}
+	if secrets := desired.Spec.Template.Spec.ImagePullSecrets; len(secrets) != 0 {
+		template.Spec.ImagePullSecrets = secrets
+	}
+
+Containers:
+	for _, container := range desired.Spec.Template.Spec.Containers {
+		for i := range template.Spec.Containers {
+			if template.Spec.Containers[i].Name == container.Name {
+				template.Spec.Containers[i].Image = container.Image
+				if len(container.Resources.Limits) != 0 ||
+					len(container.Resources.Requests) != 0 {
+					template.Spec.Containers[i].Resources = container.Resources
+				}
+				if len(container.Ports) != 0 {
+					template.Spec.Containers[i].Ports = container.Ports
+				}
+				continue Containers
 			}
 		}
+		template.Spec.Containers = append(template.Spec.Containers, container)
+	}
+	return merged
+}
 
-		// We are done if both channels were closed
-		if deploymentsCh == nil && foosCh == nil {
-			return
+// ReplicasPatch is a Config.MinimalPatch for FooConfig, which doesn't
+// use one by default. When existing differs from desired only in its
+// replicas, it returns the merge patch that sets them, together with
+// the SpecHashAnnotation.
+func ReplicasPatch(existing, desired *appsv1.Deployment) ([]byte, bool) {
+	if desired.Spec.Replicas == nil {
+		return nil, false
+	}
+	// existing was written for the same template as desired.
+	unscaled := desired.DeepCopy()
+	unscaled.Spec.Replicas = existing.Spec.Replicas
+	hash := desired.Annotations[SpecHashAnnotation]
+	if existing.Annotations[SpecHashAnnotation] != specHash(unscaled) {
+		return nil, false
+	}
+	scaled := existing.DeepCopy()
+	scaled.Spec.Replicas = desired.Spec.Replicas
+	if scaled.Annotations == nil {
+		scaled.Annotations = make(map[string]string)
+	}
+	scaled.Annotations[SpecHashAnnotation] = hash
+	if !deploymentsEqual(scaled, desired) {
+		return nil, false
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{SpecHashAnnotation: hash},
+		},
+		"spec": map[string]interface{}{"replicas": *desired.Spec.Replicas},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		// These types always marshal.
+		panic(err)
+	}
+	return data, true
+}
+
+// ScaleStep returns a Config.Progress function that changes the
+// replicas of an existing Deployment by at most step at a time. Use
+// Config.ProgressInterval to wait between steps. New Deployments, and
+// existing ones without replicas, are still set to the replicas of the
+// Foo.
+func ScaleStep(step int32) func(existing, desired *appsv1.Deployment) (*appsv1.Deployment,
+	bool) {
+	return func(existing, desired *appsv1.Deployment) (*appsv1.Deployment, bool) {
+		if existing.Spec.Replicas == nil {
+			return desired, true
+		}
+		current := *existing.Spec.Replicas
+		target := *desired.Spec.Replicas
+		var next int32
+		switch {
+		case target > current+step:
+			next = current + step
+		case target < current-step:
+			next = current - step
+		default:
+			return desired, true
 		}
+		// Don't modify the replicas of the Foo desired points to.
+		desired.Spec.Replicas = &next
+		return desired, false
 	}
 }
 
-func NewController(client *kubeapi.KubeClient, rl ratelimit.RateLimiter,
+func selectorUses(sel *metav1.LabelSelector, key string) bool {
+	if sel == nil {
+		return false
+	}
+	if _, ok := sel.MatchLabels[key]; ok {
+		return true
+	}
+	for _, req := range sel.MatchExpressions {
+		if req.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// adoptableDeployment is the Config.CanAdopt of FooConfig. As the
+// selector of a Deployment cannot be changed, we only adopt a
+// Deployment if its selector matches the pod template we would
+// write. Otherwise its pods could not be told apart from those of
+// other Deployments.
+func adoptableDeployment(foo *Foo, existing *appsv1.Deployment) error {
+	return checkDeploymentSelector(existing, newDeployment(foo))
+}
+
+// checkDeploymentSelector is the Config.CheckSelector of FooConfig. The
+// selector of existing, which is kept by preserveDeployment, must
+// match the pod template of desired.
+func checkDeploymentSelector(existing, desired *appsv1.Deployment) error {
+	desired = desired.DeepCopy()
+	preserveDeployment(existing, desired)
+	sel, err := metav1.LabelSelectorAsSelector(existing.Spec.Selector)
+	if err != nil {
+		return fmt.Errorf("Invalid selector: %w", err)
+	}
+	if sel.Empty() || !sel.Matches(labels.Set(desired.Spec.Template.Labels)) {
+		return fmt.Errorf("The selector %q of Deployment %s doesn't match the pod labels %v, "+
+			"and selectors cannot be changed", sel, existing.Name, desired.Spec.Template.Labels)
+	}
+	return nil
+}
+
+// watchQuery returns the query of a watch that starts after
+// resourceVersion, if not empty.
+func watchQuery(resourceVersion string) url.Values {
+	if resourceVersion == "" {
+		return nil
+	}
+	return url.Values{"resourceVersion": []string{resourceVersion}}
+}
+
+// FooConfig returns the configuration used by NewController. It can
+// be modified, for example to scale gradually with ScaleStep, to
+// compute readiness with FooStatusUpdater, to coexist with mutating
+// webhooks with UpdateMergeManaged or with other controllers with
+// UpdateApply, and passed to NewGenericController.
+func FooConfig(client Client) Config[*Foo, *appsv1.Deployment] {
+	return FooConfigFor(client, DefaultFooNames)
+}
+
+// FooConfigFor is like FooConfig, but for the Foos identified by
+// names. A FooStatusUpdater replacing UpdateStatus must be given the
+// same names.
+func FooConfigFor(client Client, names FooNames) Config[*Foo,
+	*appsv1.Deployment] {
+	names = names.orDefault()
+	gv := names.GVK.GroupVersion()
+	return Config[*Foo, *appsv1.Deployment]{
+		GVK:       names.GVK,
+		OwnedKind: "Deployment",
+		AddCRD: func() error {
+			return addFooCRD(client, names)
+		},
+		Primary: Resource[*Foo]{
+			Watch: func(namespace, resourceVersion string) (<-chan kubeapi.WatchEvent,
+				chan<- struct{}) {
+				return client.GetResources(gv.Group, gv.Version, namespace, names.Plural,
+					watchQuery(resourceVersion), &Foo{})
+			},
+			Get: func(namespace, name string) (*Foo, error) {
+				foo := &Foo{}
+				err := client.GetResource(gv.Group, gv.Version, namespace,
+					names.Plural+"/"+name, foo)
+				return foo, err
+			},
+			Update: func(foo *Foo) error {
+				return client.UpdateResource(gv.Group, gv.Version, foo.Namespace,
+					names.Plural+"/"+foo.Name, foo)
+			},
+		},
+		Owned: Resource[*appsv1.Deployment]{
+			Watch: func(namespace, resourceVersion string) (<-chan kubeapi.WatchEvent,
+				chan<- struct{}) {
+				return client.GetResources("apps", "v1", namespace, "deployments",
+					watchQuery(resourceVersion), &appsv1.Deployment{})
+			},
+			Add:    client.AddDeployment,
+			Update: client.UpdateDeployment,
+			Delete: client.DeleteDeployment,
+			Apply: func(deployment *appsv1.Deployment) error {
+				return client.ApplyDeployment(deployment, fieldManager(client))
+			},
+			Patch: func(deployment *appsv1.Deployment, patch []byte) error {
+				return client.PatchDeployment(deployment.Namespace, deployment.Name,
+					types.MergePatchType, patch)
+			},
+			Get: client.GetDeployment,
+		},
+		OwnedName: func(foo *Foo) string {
+			return foo.Spec.DeploymentName
+		},
+		NewOwned: func(foo *Foo) *appsv1.Deployment {
+			return newDeploymentFor(foo, names.GVK)
+		},
+		Equal:            deploymentsEqual,
+		Preserve:         preserveDeployment,
+		Merge:            mergeDeployment,
+		CanAdopt:         adoptableDeployment,
+		CheckSelector:    checkDeploymentSelector,
+		UpdateStatus:     FooStatusUpdater(client, FooStatusOptions{Names: names}),
+		ReportCollision:  reportFooCollision(client, names),
+		ReportConflict:   reportFooConflict(client, names),
+		Validate:         FooValidator(MaxFooReplicas),
+		ReportInvalid:    reportFooInvalid(client, names),
+		ReportError:      reportFooError(client, names),
+		ReportDeadLetter: reportFooDeadLetter(client, names),
+		Recorder:         client,
+		Finalizer:        FooFinalizer,
+	}
+}
+
+// FooList is the body of a list of Foos.
+type FooList struct {
+	Items []Foo `json:"items"`
+}
+
+// PollOnlyFooConfig is like FooConfigFor, but lists the Foos and the
+// Deployments every interval instead of watching them, see PollWatch.
+// Use a WebhookTrigger to synchronize a Foo sooner.
+func PollOnlyFooConfig(client Client, names FooNames,
+	interval time.Duration) Config[*Foo, *appsv1.Deployment] {
+	config := FooConfigFor(client, names)
+	names = names.orDefault()
+	config.Primary.Watch = PollWatch(func(namespace string) ([]*Foo, error) {
+		list := FooList{}
+		err := client.GetResource(names.GVK.Group, names.GVK.Version, namespace, names.Plural,
+			&list)
+		ret := make([]*Foo, len(list.Items))
+		for i := range list.Items {
+			ret[i] = &list.Items[i]
+		}
+		return ret, err
+	}, interval)
+	config.Owned.Watch = PollWatch(func(namespace string) ([]*appsv1.Deployment, error) {
+		list := appsv1.DeploymentList{}
+		err := client.GetResource("apps", "v1", namespace, "deployments", &list)
+		ret := make([]*appsv1.Deployment, len(list.Items))
+		for i := range list.Items {
+			ret[i] = &list.Items[i]
+		}
+		return ret, err
+	}, interval)
+	return config
+}
+
+// SelectedFooConfig is like FooConfigFor, but only watches the Foos
+// matching foos and the Deployments matching deployments, for example
+// to split the Foos among several controllers by label. The
+// Deployments the controller creates have no labels of their own, so
+// a label selector in deployments should usually be empty.
+func SelectedFooConfig(client Client, names FooNames, foos,
+	deployments kubeapi.ListOptions) Config[*Foo, *appsv1.Deployment] {
+	config := FooConfigFor(client, names)
+	names = names.orDefault()
+	config.Primary.Watch = func(namespace, resourceVersion string) (<-chan kubeapi.WatchEvent,
+		chan<- struct{}) {
+		return client.GetResources(names.GVK.Group, names.GVK.Version, namespace, names.Plural,
+			foos.Query(watchQuery(resourceVersion)), &Foo{})
+	}
+	config.Owned.Watch = func(namespace, resourceVersion string) (<-chan kubeapi.WatchEvent,
+		chan<- struct{}) {
+		return client.GetResources("apps", "v1", namespace, "deployments",
+			deployments.Query(watchQuery(resourceVersion)), &appsv1.Deployment{})
+	}
+	return config
+}
+
+// ListWatchFooConfig is like FooConfigFor, but lists the Foos and
+// the Deployments before watching them, and lists them again instead
+// of failing if the watch cannot be resumed. See
+// kubeapi.KubeClient.ListAndWatch.
+func ListWatchFooConfig(client Client, names FooNames) Config[*Foo,
+	*appsv1.Deployment] {
+	config := FooConfigFor(client, names)
+	names = names.orDefault()
+	config.Primary.Watch = func(namespace, resourceVersion string) (<-chan kubeapi.WatchEvent,
+		chan<- struct{}) {
+		return client.ListAndWatch(names.GVK.Group, names.GVK.Version, namespace, names.Plural,
+			watchQuery(resourceVersion), &Foo{})
+	}
+	config.Owned.Watch = func(namespace, resourceVersion string) (<-chan kubeapi.WatchEvent,
+		chan<- struct{}) {
+		return client.ListAndWatch("apps", "v1", namespace, "deployments",
+			watchQuery(resourceVersion), &appsv1.Deployment{})
+	}
+	return config
+}
+
+// FooCache has the Foos and Deployments watched by a Config of
+// CachedFooConfig.
+type FooCache struct {
+	Foos        *kubeapi.Cache[*Foo]
+	Deployments *kubeapi.Cache[*appsv1.Deployment]
+
+	client Client
+	names  FooNames
+}
+
+// GetCachedFoo returns the cached Foo namespace/name, which must not be
+// modified, or, if it is not cached, the one the api server has.
+func (c *FooCache) GetCachedFoo(namespace, name string) (*Foo, error) {
+	if foo, ok := c.Foos.Get(namespace, name); ok {
+		return foo, nil
+	}
+	foo := &Foo{}
+	err := c.client.GetResource(c.names.GVK.Group, c.names.GVK.Version, namespace,
+		c.names.Plural+"/"+name, foo)
+	return foo, err
+}
+
+// GetCachedDeployment returns the cached Deployment namespace/name or,
+// if it is not cached, the one the api server has.
+func (c *FooCache) GetCachedDeployment(namespace, name string) (*appsv1.Deployment, error) {
+	if deployment, ok := c.Deployments.Get(namespace, name); ok {
+		return deployment.DeepCopy(), nil
+	}
+	return c.client.GetDeployment(namespace, name)
+}
+
+// CachedFooConfig is like FooConfigFor, but Primary.Get and Owned.Get
+// read the Foos and Deployments of its watches from the returned
+// cache, and only make a request for those not cached. This saves the
+// requests that check a Foo still exists before creating its
+// Deployment, but after a conflict the cached Deployment might still
+// be the one that conflicted, in which case the update fails and is
+// retried.
+func CachedFooConfig(client Client, names FooNames) (Config[*Foo, *appsv1.Deployment],
+	*FooCache) {
+	config := FooConfigFor(client, names)
+	cache := &FooCache{Foos: kubeapi.NewCache[*Foo](),
+		Deployments: kubeapi.NewCache[*appsv1.Deployment](), client: client,
+		names: names.orDefault()}
+	watchFoos, watchDeployments := config.Primary.Watch, config.Owned.Watch
+	config.Primary.Watch = func(namespace, resourceVersion string) (<-chan kubeapi.WatchEvent,
+		chan<- struct{}) {
+		return cache.Foos.Watch(watchFoos(namespace, resourceVersion))
+	}
+	config.Owned.Watch = func(namespace, resourceVersion string) (<-chan kubeapi.WatchEvent,
+		chan<- struct{}) {
+		return cache.Deployments.Watch(watchDeployments(namespace, resourceVersion))
+	}
+	config.Primary.Get = cache.GetCachedFoo
+	config.Owned.Get = cache.GetCachedDeployment
+	return config, cache
+}
+
+func NewController(client Client, rl ratelimit.RateLimiter,
 	namespace string) *Controller {
-	ret := &Controller{}
+	return NewControllerContext(context.Background(), client, rl, namespace)
+}
 
-	errors := make(chan error)
-	ret.Errors = errors
+// Options configures the controller of NewControllerWithOptions. Each
+// zero field has the default documented, so that the zero Options
+// gives the controller of NewController in the default namespace, with
+// ratelimit.AfterOneSecondIdle.
+type Options struct {
+	// Context is that of the requests of the controller, see
+	// NewControllerContext. context.Background() by default.
+	Context context.Context
+	// RateLimiter is ratelimit.AfterOneSecondIdle() by default.
+	RateLimiter ratelimit.RateLimiter
+	// Namespace is the one watched, "default" by default.
+	Namespace string
+	// AllNamespaces watches every namespace instead of Namespace.
+	AllNamespaces bool
+	// Names are those of the CRD, DefaultFooNames by default.
+	Names FooNames
+	// Foos and Deployments restrict the ones watched, see
+	// SelectedFooConfig. All of them by default.
+	Foos        kubeapi.ListOptions
+	Deployments kubeapi.ListOptions
+	// Reconciler computes the Deployments, see
+	// NewControllerWithReconciler. The nginx ones by default.
+	Reconciler Reconciler
+	// Workers is Config.Workers, one by default.
+	Workers int
+	// ResyncPeriod is Config.ResyncPeriod, no resyncs by default.
+	ResyncPeriod time.Duration
+	// MaxRetries is Config.MaxRetries, retrying forever by default.
+	MaxRetries int
+	// DryRun is Config.DryRun, false by default.
+	DryRun bool
+	// Logger is Config.Logger, StdLogger by default.
+	Logger Logger
+	// CheckNamespace stops the controller at start if Namespace
+	// doesn't exist, instead of failing to create Deployments in it.
+	// CreateNamespace adds it instead, except with DryRun.
+	CheckNamespace  bool
+	CreateNamespace bool
+}
 
-	ret.rl = rl
-	ret.client = client
-	ret.Namespace = namespace
+// NewControllerWithOptions starts a controller that manages the
+// Deployments of Foos as configured by opts.
+func NewControllerWithOptions(client Client, opts Options) *Controller {
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	rl := opts.RateLimiter
+	if rl == nil {
+		rl = ratelimit.AfterOneSecondIdle()
+	}
+	namespace := opts.Namespace
+	if opts.AllNamespaces {
+		namespace = ""
+	} else if namespace == "" {
+		namespace = "default"
+	}
+	newConfig := func(client Client) Config[*Foo, *appsv1.Deployment] {
+		var config Config[*Foo, *appsv1.Deployment]
+		if opts.Foos == (kubeapi.ListOptions{}) && opts.Deployments == (kubeapi.ListOptions{}) {
+			config = FooConfigFor(client, opts.Names)
+		} else {
+			config = SelectedFooConfig(client, opts.Names, opts.Foos, opts.Deployments)
+		}
+		if opts.Reconciler != nil {
+			config.Desired = reconcilerDesired(opts.Reconciler, opts.Names.orDefault().GVK)
+		}
+		config.Workers = opts.Workers
+		config.ResyncPeriod = opts.ResyncPeriod
+		config.MaxRetries = opts.MaxRetries
+		config.DryRun = opts.DryRun
+		config.Logger = opts.Logger
+		if opts.CheckNamespace || opts.CreateNamespace {
+			create := opts.CreateNamespace && !opts.DryRun
+			config.CheckNamespace = func(namespace string) error {
+				return checkNamespace(client, namespace, create)
+			}
+		}
+		return config
+	}
+	return newClientController(ctx, client, newConfig, rl, namespace)
+}
+
+// Reconciler computes the Deployment a Foo wants, in place of the
+// nginx one of NewController, see NewControllerWithReconciler. existing
+// is the current Deployment of foo, or nil if there is none; it must
+// not be changed. The name, namespace and controller reference of the
+// returned Deployment are set for it. An error is retried.
+type Reconciler interface {
+	Reconcile(ctx context.Context, foo *Foo, existing *appsv1.Deployment) (*appsv1.Deployment,
+		error)
+}
 
-	ret.start()
+// ReconcilerFunc adapts a function to a Reconciler.
+type ReconcilerFunc func(ctx context.Context, foo *Foo,
+	existing *appsv1.Deployment) (*appsv1.Deployment, error)
 
-	return ret
+func (f ReconcilerFunc) Reconcile(ctx context.Context, foo *Foo,
+	existing *appsv1.Deployment) (*appsv1.Deployment, error) {
+	return f(ctx, foo, existing)
 }
 
-func (c *Controller) startAux() {
-	err := addFooCRD(c.client)
-	if err != nil {
-		c.Errors <- fmt.Errorf("Could not add CRD: %w", err)
-		close(c.Errors)
-		return
+// DefaultReconciler is the Reconciler of NewController.
+var DefaultReconciler Reconciler = ReconcilerFunc(func(ctx context.Context, foo *Foo,
+	existing *appsv1.Deployment) (*appsv1.Deployment, error) {
+	return newDeployment(foo), nil
+})
+
+// NewControllerWithReconciler is like NewController, but the
+// Deployments of the Foos are those returned by r. They are still
+// created, updated and adopted as those of NewController are.
+func NewControllerWithReconciler(client Client, rl ratelimit.RateLimiter,
+	namespace string, r Reconciler) *Controller {
+	return NewControllerWithOptions(client, Options{RateLimiter: rl, Namespace: namespace,
+		AllNamespaces: namespace == "", Reconciler: r})
+}
+
+// reconcilerDesired returns the Config.Desired that asks r for the
+// Deployments of the Foos of kind gvk.
+func reconcilerDesired(r Reconciler, gvk schema.GroupVersionKind) func(context.Context, *Foo,
+	*appsv1.Deployment, bool) (*appsv1.Deployment, error) {
+	return func(ctx context.Context, foo *Foo, existing *appsv1.Deployment,
+		has_existing bool) (*appsv1.Deployment, error) {
+		if !has_existing {
+			existing = nil
+		}
+		deployment, err := r.Reconcile(ctx, foo, existing)
+		if err != nil {
+			return nil, err
+		}
+		if deployment == nil {
+			return nil, fmt.Errorf("Reconciler returned no Deployment for Foo %s", foo.Name)
+		}
+		deployment.Name = foo.Spec.DeploymentName
+		deployment.Namespace = foo.Namespace
+		if metav1.GetControllerOfNoCopy(deployment) == nil {
+			deployment.OwnerReferences = append(deployment.OwnerReferences,
+				*metav1.NewControllerRef(foo, gvk))
+		}
+		return deployment, nil
 	}
+}
 
-	foosCh, stopFoos := c.client.GetResources(Group, Version, c.Namespace, "foos", nil, Foo{})
-	c.stopFoos = stopFoos
+// NewControllerContext is like NewController, but the requests of the
+// controller are made with ctx. Once ctx is done, they are aborted and
+// the controller stops.
+func NewControllerContext(ctx context.Context, client Client,
+	rl ratelimit.RateLimiter, namespace string) *Controller {
+	return NewControllerWithOptions(client, Options{Context: ctx, RateLimiter: rl,
+		Namespace: namespace, AllNamespaces: namespace == ""})
+}
 
-	deploymentsCh, stopDeployments := c.client.GetDeployments(c.Namespace)
-	c.stopDeployments = stopDeployments
+// NewLeaderElectedController is like NewControllerContext, but the
+// controller only adds the CRD and starts watching once election
+// acquires its Lease, so that of several replicas only one
+// synchronizes at a time. If the Lease is lost, RequestStop is called.
+// The election ends once the controller stops. The OnStartedLeading
+// and OnStoppedLeading callbacks of election, if any, are called too.
+// The election logs with Config.Logger unless it has a Logger.
+func NewLeaderElectedController(ctx context.Context, client *kubeapi.KubeClient,
+	rl ratelimit.RateLimiter, namespace string,
+	election leaderelection.Config) *Controller {
+	ctx, cancel := context.WithCancel(ctx)
+	leading := make(chan struct{})
+	c := newGenericController(ctx, cancel, FooConfig(client.WithContext(ctx)), rl, namespace,
+		leading)
 
-	processResources(c, deploymentsCh, foosCh)
+	started, stopped := election.OnStartedLeading, election.OnStoppedLeading
+	election.OnStartedLeading = func() {
+		close(leading)
+		if started != nil {
+			started()
+		}
+	}
+	election.OnStoppedLeading = func() {
+		c.RequestStop()
+		if stopped != nil {
+			stopped()
+		}
+	}
+	if election.Client == nil {
+		election.Client = client
+	}
+	if election.Logger == nil {
+		election.Logger = c.config.Logger
+	}
+
+	electionCtx, stopElection := context.WithCancel(ctx)
+	go func() {
+		<-c.done
+		stopElection()
+	}()
+	go func() {
+		if err := leaderelection.Run(electionCtx, election); err != nil {
+			c.config.Logger.Error(err, "Leader election failed")
+		}
+	}()
+	return c
 }
 
-func (c *Controller) start() {
-	go c.startAux()
+// NewControllerFor is like NewController, but for the Foos identified
+// by names.
+func NewControllerFor(client Client, rl ratelimit.RateLimiter, namespace string,
+	names FooNames) *Controller {
+	return newClientController(context.Background(), client, func(client Client) Config[*Foo,
+		*appsv1.Deployment] {
+		return FooConfigFor(client, names)
+	}, rl, namespace)
 }
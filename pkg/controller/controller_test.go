@@ -1,18 +1,48 @@
 package controller
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/jarcoal/httpmock"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"io"
 	"io/ioutil"
 	appsv1 "k8s.io/api/apps/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	goruntime "runtime"
+	"sample-controller/pkg/events"
+	"sample-controller/pkg/health"
 	"sample-controller/pkg/kubeapi"
+	"sample-controller/pkg/kubeapi/fake"
+	"sample-controller/pkg/leaderelection"
+	"sample-controller/pkg/metrics"
+	"sample-controller/pkg/ratelimit"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func getClient(t *testing.T) (*kubeapi.KubeClient, *httpmock.MockTransport) {
@@ -47,21 +77,58 @@ func (rl *testRateLimiter) GetChan() <-chan struct{} {
 func (rl *testRateLimiter) Stop() {
 }
 
+// step lets the controller synchronize once.
+func (rl *testRateLimiter) step() {
+	// Wait for the controller to ask at least once
+	<-rl.ask
+
+	// Authorize the controller to continue. We still have to keep an eye on rl.ask.
+loop:
+	for {
+		select {
+		case rl.tick <- struct{}{}:
+			break loop
+		case <-rl.ask:
+		}
+	}
+
+	// If the controller issued more requests, clear them.
+	for {
+		select {
+		case <-rl.ask:
+		default:
+			return
+		}
+	}
+}
+
 func runTestController(client *kubeapi.KubeClient) *Controller {
 	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
 	return NewController(client, rl, "default")
 }
 
+// newWatchResponder is like httpmock.NewStringResponder, but the body
+// can be closed while it is read, as a watch does after an error it
+// continues past.
+func newWatchResponder(status int, body string) httpmock.Responder {
+	return func(req *http.Request) (*http.Response, error) {
+		reader := ioutil.NopCloser(strings.NewReader(body))
+		return &http.Response{StatusCode: status, Body: reader}, nil
+	}
+}
+
 func TestCreationError(t *testing.T) {
 	client, server := getClient(t)
 	// FIXME: Add some helper functions
 
-	controller := runTestController(client)
+	// Connecting is retried for a while.
+	controller := runTestController(client.WithConnectRetry(50 * time.Millisecond))
 	err := <-controller.Errors
 	if err == nil {
 		t.Error("expected error")
 	} else {
-		if !strings.HasPrefix(err.Error(), "Could not add CRD: Watch failed: Get ") {
+		if !strings.HasPrefix(err.Error(),
+			"Could not add CRD: Watch failed: Gave up connecting after ") {
 			t.Error("wrong error", err.Error())
 		}
 		if !strings.HasSuffix(err.Error(), "no responder found") {
@@ -95,7 +162,7 @@ func TestCreationError(t *testing.T) {
 		}
 	}
 
-	server.RegisterNoResponder(httpmock.NewStringResponder(201, `{"type": "XYZ"}`))
+	server.RegisterNoResponder(newWatchResponder(201, `{"type": "XYZ"}`))
 	stopController(t, controller)
 	controller = runTestController(client)
 	err = <-controller.Errors
@@ -108,7 +175,7 @@ func TestCreationError(t *testing.T) {
 		}
 	}
 
-	server.RegisterNoResponder(httpmock.NewStringResponder(201, `{"type": "ADDED"}`))
+	server.RegisterNoResponder(newWatchResponder(201, `{"type": "ADDED"}`))
 	stopController(t, controller)
 	controller = runTestController(client)
 	err = <-controller.Errors
@@ -121,28 +188,75 @@ func TestCreationError(t *testing.T) {
 		}
 	}
 	stopController(t, controller)
+}
 
-	server.RegisterNoResponder(httpmock.NewStringResponder(201,
-		`{
-			"type": "DELETED",
-			"object": {}
-		}`))
-	controller = runTestController(client)
-	err = <-controller.Errors
-	if err == nil {
-		t.Error("expected error")
-	} else {
-		expected := "Could not add CRD: Could not decode WatchEvent"
-		if !strings.HasPrefix(err.Error(), expected) {
-			t.Error("wrong error", err.Error())
-		}
+func TestWaitEstablished(t *testing.T) {
+	client, server := getClient(t)
+	established := `{"type": "ADDED", "object": {"status": {"conditions": [
+		{"type": "Established", "status": "True"}]}}}`
+	var watches int32
+	server.RegisterResponder("GET", "=~apiextensions.k8s.io/v1/customresourcedefinitions",
+		func(req *http.Request) (*http.Response, error) {
+			// The first watch ends before the CRD is established.
+			if atomic.AddInt32(&watches, 1) == 1 {
+				return newWatchResponder(200, `{"type": "DELETED", "object": {}}`)(req)
+			}
+			return newWatchResponder(200, established)(req)
+		})
+	if err := waitEstablished(client, "foos.samplecontroller.example.com",
+		5*time.Second); err != nil {
+		t.Error(err)
+	}
+	if n := atomic.LoadInt32(&watches); n != 2 {
+		t.Errorf("Watched %d times, expected 2", n)
+	}
+
+	// A CRD whose names conflict with another is not waited for.
+	server.RegisterResponder("GET", "=~apiextensions.k8s.io/v1/customresourcedefinitions",
+		newWatchResponder(200, `{"type": "MODIFIED", "object": {"status": {"conditions": [
+			{"type": "NamesAccepted", "status": "False", "reason": "MultipleNamesNotAllowed",
+			"message": "\"foos\" is already in use"},
+			{"type": "Established", "status": "False", "reason": "NotAccepted"}]}}}`))
+	err := waitEstablished(client, "foos.samplecontroller.example.com", time.Minute)
+	expected := "CustomResourceDefinition foos.samplecontroller.example.com cannot be " +
+		"established, its names were not accepted: MultipleNamesNotAllowed: " +
+		"\"foos\" is already in use"
+	if err == nil || err.Error() != expected {
+		t.Error("wrong error", err)
+	}
+
+	// A watch that keeps ending is retried until the timeout.
+	server.RegisterResponder("GET", "=~apiextensions.k8s.io/v1/customresourcedefinitions",
+		newWatchResponder(200, `{"type": "DELETED", "object": {}}`))
+	err = waitEstablished(client, "foos.samplecontroller.example.com", 500*time.Millisecond)
+	expected = "CustomResourceDefinition foos.samplecontroller.example.com was not " +
+		"established within 500ms, its watch ended "
+	if err == nil || !strings.HasPrefix(err.Error(), expected) {
+		t.Error("wrong error", err)
+	}
+
+	// We give up once the context of the client is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = waitEstablished(client.WithContext(ctx), "foos.samplecontroller.example.com",
+		time.Minute)
+	if !errors.Is(err, context.Canceled) {
+		t.Error("wrong error", err)
 	}
-	stopController(t, controller)
 }
 
 // FIXME: Create a struct for the return
 func startTestController(t *testing.T) (*Controller,
 	*httpmock.MockTransport, io.Writer, io.Writer) {
+	client, server, foos, deployments := startTestServer(t)
+	controller := runTestController(client)
+	return controller, server, foos, deployments
+}
+
+// startTestServer sets up a server with an established CRD and whose
+// foos and deployments watches read from the returned writers.
+func startTestServer(t *testing.T) (*kubeapi.KubeClient, *httpmock.MockTransport,
+	io.Writer, io.Writer) {
 	client, server := getClient(t)
 
 	server.RegisterNoResponder(httpmock.NewNotFoundResponder(t.Fatal))
@@ -161,23 +275,141 @@ func startTestController(t *testing.T) (*Controller,
 
 	server.RegisterResponder("POST", "/apis/apiextensions.k8s.io/v1/customresourcedefinitions", httpmock.NewStringResponder(201, ""))
 	// FIXME: convert all users of =~ to use fixed path, or at least start with ^
+	// The watch body is closed concurrently with reading it, which httpmock's bodies
+	// don't support.
 	server.RegisterResponder("GET", "=~apiextensions.k8s.io/v1/customresourcedefinitions.*",
-		httpmock.NewStringResponder(200, json))
+		func(req *http.Request) (*http.Response, error) {
+			body := ioutil.NopCloser(strings.NewReader(json))
+			return &http.Response{StatusCode: 200, Body: body}, nil
+		})
 
-	foos := addPipeResponder(server, "=~samplecontroller.example.com/v1alpha1/namespaces/default/foos.*")
+	// Tests that check the status of Foos and the events override
+	// these with fixed paths.
+	server.RegisterResponder("PUT", `=~/foos/[^/]+/status$`,
+		httpmock.NewStringResponder(200, ""))
+	server.RegisterResponder("POST", `=~^/api/v1/namespaces/[^/]+/events$`,
+		httpmock.NewStringResponder(201, ""))
+	// Adding the finalizer.
+	server.RegisterResponder("PUT", `=~/foos/[^/]+$`, httpmock.NewStringResponder(200, ""))
+
+	fooServer := &fooServer{foos: make(map[string][]byte)}
+	server.RegisterResponder("GET",
+		`=~^/apis/samplecontroller.example.com/v1alpha1/namespaces/[^/]+/foos/[^/]+$`,
+		fooServer.get)
+	fooServer.w = addPipeResponder(server, "=~samplecontroller.example.com/v1alpha1/namespaces/default/foos.*")
 	deployments := addPipeResponder(server, "=~apps/v1/namespaces/default/deployments.*")
-	controller := runTestController(client)
+	return client, server, fooServer, deployments
+}
 
-	return controller, server, foos, deployments
+// fooServer passes the watch events written to it to w and answers
+// GETs of the Foos they contain, as the api server would.
+type fooServer struct {
+	w    io.Writer
+	mu   sync.Mutex
+	foos map[string][]byte
+}
+
+func (s *fooServer) Write(data []byte) (int, error) {
+	var we metav1.WatchEvent
+	var obj struct {
+		Metadata metav1.ObjectMeta `json:"metadata"`
+	}
+	if json.Unmarshal(data, &we) == nil && json.Unmarshal(we.Object.Raw, &obj) == nil {
+		key := obj.Metadata.Namespace + "/" + obj.Metadata.Name
+		s.mu.Lock()
+		if we.Type == "DELETED" {
+			delete(s.foos, key)
+		} else {
+			s.foos[key] = we.Object.Raw
+		}
+		s.mu.Unlock()
+	}
+	return s.w.Write(data)
+}
+
+func (s *fooServer) get(req *http.Request) (*http.Response, error) {
+	// The path is /apis/<group>/<version>/namespaces/<namespace>/foos/<name>
+	parts := strings.Split(req.URL.Path, "/")
+	s.mu.Lock()
+	data, ok := s.foos[parts[5]+"/"+parts[7]]
+	s.mu.Unlock()
+	if !ok {
+		return httpmock.NewStringResponse(404, ""), nil
+	}
+	return httpmock.NewBytesResponse(200, data), nil
 }
 
-func stopController(t *testing.T, c *Controller) {
+func stopController[T, O metav1.Object](t *testing.T, c *GenericController[T, O]) {
 	c.RequestStop()
 	for err := range c.Errors {
 		t.Errorf("unxpected error %s", err)
 	}
 }
 
+func TestFinalizer(t *testing.T) {
+	controller, server, foos, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+
+	// A Foo deleted before we add the finalizer is left alone. There
+	// is no responder for its Deployment.
+	server.RegisterResponder("PUT",
+		"/apis/samplecontroller.example.com/v1alpha1/namespaces/uvw/foos/ghi",
+		httpmock.NewStringResponder(404, "not found"))
+	gone := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "ghi", Namespace: "uvw", UID: "5678"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	foos.Write(marshal(t, "ADDED", &gone))
+	rl.step()
+
+	puts := make(chan *Foo, 1)
+	server.RegisterResponder("PUT",
+		"/apis/samplecontroller.example.com/v1alpha1/namespaces/xyz/foos/abc",
+		func(req *http.Request) (*http.Response, error) {
+			foo := &Foo{}
+			if err := json.NewDecoder(req.Body).Decode(foo); err != nil {
+				t.Fatal("Could not decode foo: ", err)
+			}
+			puts <- foo
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		httpmock.NewStringResponder(201, ""))
+	deleted := make(chan struct{}, 1)
+	server.RegisterResponder("DELETE", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		func(req *http.Request) (*http.Response, error) {
+			deleted <- struct{}{}
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	// The finalizer is added on first sight.
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	if added := <-puts; len(added.Finalizers) != 1 || added.Finalizers[0] != FooFinalizer {
+		t.Error("Finalizer not added: ", added.Finalizers)
+	}
+	deployment := newDeploymentFor(&foo, DefaultFooNames.GVK)
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+
+	// Once deleted, the Deployment is deleted and the finalizer
+	// removed.
+	now := metav1.Now()
+	foo.DeletionTimestamp = &now
+	foo.Finalizers = []string{"other", FooFinalizer}
+	foos.Write(marshal(t, "MODIFIED", &foo))
+	rl.step()
+	<-deleted
+	if removed := <-puts; len(removed.Finalizers) != 1 || removed.Finalizers[0] != "other" {
+		t.Error("Finalizer not removed: ", removed.Finalizers)
+	}
+	stopController(t, controller)
+}
+
 func TestBrokenFoo(t *testing.T) {
 	controller, _, foos, _ := startTestController(t)
 
@@ -201,7 +433,7 @@ func TestBrokenDeployment(t *testing.T) {
 		t.Error("expected error")
 	} else {
 		if !strings.HasPrefix(err.Error(),
-			"Reading deployments: Could not decode WatchEvent") {
+			"Reading Deployments: Could not decode WatchEvent") {
 			t.Error("wrong error", err.Error())
 		}
 	}
@@ -209,6 +441,39 @@ func TestBrokenDeployment(t *testing.T) {
 	stopController(t, controller)
 }
 
+func TestUndecodableObject(t *testing.T) {
+	controller, server, foos, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+	posts := make(chan *appsv1.Deployment, 1)
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		func(req *http.Request) (*http.Response, error) {
+			dep := &appsv1.Deployment{}
+			if err := json.NewDecoder(req.Body).Decode(dep); err != nil {
+				t.Fatal("Could not decode deployment: ", err)
+			}
+			posts <- dep
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+
+	// Objects that cannot be decoded are skipped, the watches go on.
+	foos.Write([]byte(`{"type": "ADDED", "object": {"spec": {"replicas": "x"}}}`))
+	foos.Write([]byte(`{"type": "BOOKMARK", "object": {}}`))
+	deployments.Write([]byte(`{"type": "ADDED", "object": {"spec": {"replicas": "x"}}}`))
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	if deployment := <-posts; deployment.Name != "bar" {
+		t.Error("Wrong deployment: ", deployment.Name)
+	}
+	if !controller.Running() {
+		t.Error("The controller stopped")
+	}
+	stopController(t, controller)
+}
+
 func marshal(t *testing.T, Type string, obj interface{}) []byte {
 	data, err := json.Marshal(obj)
 	if err != nil {
@@ -228,6 +493,7 @@ func marshal(t *testing.T, Type string, obj interface{}) []byte {
 func TestFoo(t *testing.T) {
 	r, w := io.Pipe()
 	log.SetOutput(w)
+	defer log.SetOutput(os.Stderr)
 	var buf [1024]byte
 
 	controller, server, foos, deployments := startTestController(t)
@@ -287,10 +553,10 @@ func TestFoo(t *testing.T) {
 			t.Error("Wrong repilca number: ", *spec.Replicas)
 		}
 		checkLabels := func(labels map[string]string) {
-			if len(labels) != 1 {
+			if len(labels) != 2 {
 				t.Error("Wrong MatchLabels: ", labels)
 			}
-			if labels["controller"] != "abc" {
+			if labels["controller"] != "abc" || labels[FooUIDLabel] != string(foo.UID) {
 				t.Error("Wrong MatchLabels: ", labels)
 			}
 		}
@@ -319,42 +585,19 @@ func TestFoo(t *testing.T) {
 
 	foos.Write(marshal(t, "ADDED", &foo))
 
-	step := func() {
-		// Wait for the controller to ask at least once
-		<-rl.ask
-
-		// Authorize the controller to continue. We still have to keep an eye on rl.ask.
-	loop:
-		for {
-			select {
-			case rl.tick <- struct{}{}:
-				break loop
-			case <-rl.ask:
-			}
-		}
-
-		// If the controller issued more requests, clear them.
-		for {
-			select {
-			case <-rl.ask:
-			default:
-				return
-			}
-		}
-	}
-	step()
+	rl.step()
 	<-deploymentOK
 
 	deployments.Write(marshal(t, "ADDED", &deployment))
 
-	step()
+	rl.step()
 
 	server.RegisterResponder("PUT",
 		"/apis/apps/v1/namespaces/xyz/deployments/"+foo.Spec.DeploymentName, checkDeployment)
 
 	foo.Spec.Replicas = 3
 	foos.Write(marshal(t, "ADDED", &foo))
-	step()
+	rl.step()
 	<-deploymentOK
 	n, err := r.Read(buf[:])
 	data := buf[:n]
@@ -363,7 +606,7 @@ func TestFoo(t *testing.T) {
 		t.Errorf("wrong warning: '%s'", string(data))
 	}
 	// Test retry
-	step()
+	rl.step()
 	<-deploymentOK
 	n, err = r.Read(buf[:])
 	data = buf[:n]
@@ -376,23 +619,23 @@ func TestFoo(t *testing.T) {
 
 	foo.Spec.Replicas = 2
 	foos.Write(marshal(t, "ADDED", &foo))
-	step()
+	rl.step()
 	<-deploymentOK
 	deployments.Write(marshal(t, "ADDED", &deployment))
-	step()
+	rl.step()
 
 	// The deployment is recreated if deleted
 	deployments.Write(marshal(t, "DELETED", &deployment))
-	step()
+	rl.step()
 	<-deploymentOK
 	deployments.Write(marshal(t, "ADDED", &deployment))
-	step()
+	rl.step()
 
 	// check that nothing happens
 	deployments.Write(marshal(t, "ADDED", &deployment))
-	step()
+	rl.step()
 
-	// check that we create a new deployment and delete the old one
+	// check that we delete the old deployment and create a new one
 	foo.Spec.DeploymentName = "zed"
 	foos.Write(marshal(t, "ADDED", &foo))
 	deleteOK := make(chan struct{})
@@ -402,41 +645,5341 @@ func TestFoo(t *testing.T) {
 	}
 	server.RegisterResponder("DELETE", "/apis/apps/v1/namespaces/xyz/deployments/bar",
 		deleteFunc)
-	step()
-	<-deploymentOK
+	rl.step()
 	<-deleteOK
+	<-deploymentOK
 
 	deployments.Write(marshal(t, "ADDED", &deployment))
-	step()
+	rl.step()
 
 	deployment.Name = "bar"
 	deployments.Write(marshal(t, "DELETED", &deployment))
 	deployment.Name = "zed"
-	step()
+	rl.step()
 
 	// Change UID so that ownership test fails
 	deployment.OwnerReferences[0].UID = "wrong"
-	// Change owner kind to test that we still consider it
+	// Change owner kind. The new version is not ours, but the old one
+	// was, so we still check it
 	deployment.OwnerReferences[0].Kind = "Bar"
 
 	deployments.Write(marshal(t, "ADDED", &deployment))
 
-	step()
+	rl.step()
 
 	n, err = r.Read(buf[:])
 	if err != nil {
 		t.Fatal("ReadError", err)
 	}
 	data = buf[:n]
-	if !strings.HasSuffix(string(data), "Deployment xyz:zed is not owned by us.\n") {
+	if !strings.Contains(string(data), "Not owned by us reconcileID=") ||
+		!strings.HasSuffix(string(data),
+			" kind=Foo namespace=xyz name=abc ownedKind=Deployment ownedName=zed\n") {
 		t.Errorf("wrong warning: %s", data)
 	}
 
 	foos.Write(marshal(t, "DELETED", &foo))
-	step()
+	rl.step()
+
+	controller.RequestStop()
+	for err := range controller.Errors {
+		t.Errorf("unxpected error %s", err)
+	}
+}
+
+func TestThrottled(t *testing.T) {
+	controller, server, foos, _ := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+
+	posts := make(chan time.Time)
+	throttled := true
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		func(req *http.Request) (*http.Response, error) {
+			posts <- time.Now()
+			if throttled {
+				throttled = false
+				resp := httpmock.NewStringResponse(429, "slow down")
+				resp.Header.Set("Retry-After", "1")
+				return resp, nil
+			}
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	first := <-posts
+
+	// A new event for the Foo doesn't cut the delay short.
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+
+	// The controller asks for a tick only once the Retry-After
+	// delay expired.
+	rl.step()
+	second := <-posts
+	if delay := second.Sub(first); delay < time.Second {
+		t.Errorf("retried after %s, before the suggested delay", delay)
+	}
+
+	stopController(t, controller)
+}
+
+func TestCollisionDelay(t *testing.T) {
+	c := &GenericController[*Foo, *appsv1.Deployment]{config: Config[*Foo,
+		*appsv1.Deployment]{CollisionBackoff: time.Second}}
+	collisionDelay := func(n int) time.Duration {
+		return c.collided(n).RequeueAfter
+	}
+	// Two items colliding at the same time retry at different times.
+	if a, b := collisionDelay(1), collisionDelay(1); a == b {
+		t.Error("The delays are not jittered: ", a, b)
+	}
+	for n, expected := range map[int]time.Duration{
+		1:  time.Second,
+		3:  4 * time.Second,
+		20: maxCollisionBackoff,
+	} {
+		delay := collisionDelay(n)
+		if delay < expected*8/10 || delay > expected*12/10 {
+			t.Errorf("Wrong delay after %d collisions: %s", n, delay)
+		}
+	}
+}
 
+func TestOwnershipConflictError(t *testing.T) {
+	client, server, foos, deployments := startTestServer(t)
+	config := FooConfig(client)
+	config.ConflictRetries = 2
+	config.CollisionBackoff = time.Millisecond
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(config, rl, "default")
+	posts := make(chan string, 2)
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		func(req *http.Request) (*http.Response, error) {
+			deployment := &appsv1.Deployment{}
+			if err := json.NewDecoder(req.Body).Decode(deployment); err != nil {
+				t.Error("Could not decode deployment: ", err)
+			}
+			posts <- deployment.Name
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+
+	other := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "def", Namespace: "xyz", UID: "5678"},
+		Spec:       FooSpec{DeploymentName: "qux", Replicas: 1},
+	}
+	deployment := newDeployment(&other)
+	isController := true
+	deployment.OwnerReferences = []metav1.OwnerReference{{APIVersion: "example.com/v1",
+		Kind: "Other", Name: "other", UID: "9999", Controller: &isController}}
+	// Not ours, so it doesn't ask for a tick.
+	deployments.Write(marshal(t, "ADDED", deployment))
+	foos.Write(marshal(t, "ADDED", &other))
+	<-rl.ask
+	foos.Write(marshal(t, "ADDED", &Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}))
+	<-rl.ask
+	rl.tick <- struct{}{}
+	// The unrelated Foo is synchronized.
+	if name := <-posts; name != "bar" {
+		t.Errorf("Expected bar to be created, got %s", name)
+	}
+
+	// The conflict is only reported on the second check.
+	select {
+	case err := <-controller.Errors:
+		t.Fatal("Reported too early: ", err)
+	default:
+	}
+	rl.step()
+	select {
+	case err := <-controller.Errors:
+		var conflict *OwnershipConflictError
+		if !errors.As(err, &conflict) {
+			t.Fatalf("Expected an *OwnershipConflictError, got %v", err)
+		}
+		want := OwnershipConflictError{Kind: "Deployment", Namespace: "xyz", Name: "qux",
+			ActualOwner: "Other other"}
+		if *conflict != want {
+			t.Errorf("Got %+v, want %+v", *conflict, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The conflict was not reported")
+	}
+	if !controller.Running() {
+		t.Error("The controller stopped")
+	}
+
+	// It keeps checking until it stops.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-rl.ask:
+			case rl.tick <- struct{}{}:
+			case <-done:
+				return
+			}
+		}
+	}()
+	stopController(t, controller)
+	if len(posts) != 0 {
+		t.Error("Unexpected POST of ", <-posts)
+	}
+}
+
+func TestWait(t *testing.T) {
+	controller, _, _, _ := startTestController(t)
+
+	// Stopping is safe even if the controller is still starting
+	// and if done more than once.
+	controller.RequestStop()
+	controller.RequestStop()
+	controller.Wait()
+
+	if _, ok := <-controller.Errors; ok {
+		t.Error("Errors should be closed once Wait returns")
+	}
+}
+
+func TestStopDuringSynchronize(t *testing.T) {
+	controller, server, foos, _ := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+
+	posting := make(chan struct{})
+	release := make(chan struct{})
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		func(req *http.Request) (*http.Response, error) {
+			close(posting)
+			<-release
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+
+	// synchronize is now blocked in the POST
+	<-posting
+	stopped := make(chan struct{})
+	go func() {
+		controller.RequestStop()
+		controller.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("the controller stopped in the middle of synchronize")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(release)
+	<-stopped
+	if _, ok := <-controller.Errors; ok {
+		t.Error("Errors should be closed once Wait returns")
+	}
+}
+
+func TestControllerContext(t *testing.T) {
+	client, server, foos, _ := startTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewControllerContext(ctx, client, rl, "default")
+
+	// The api server hangs.
+	posting := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		func(req *http.Request) (*http.Response, error) {
+			close(posting)
+			<-release
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	<-posting
+
+	// Cancelling the context aborts the POST and stops the
+	// controller, without an error.
+	cancel()
+	if err, ok := <-controller.Errors; ok {
+		t.Error("Unexpected error: ", err)
+	}
+	controller.Wait()
+}
+
+func TestLeaderElection(t *testing.T) {
+	client, server, _, _ := startTestServer(t)
+
+	// The Lease is held by another replica that died.
+	var mu sync.Mutex
+	other := "other"
+	lease, err := json.Marshal(&coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: "lock", Namespace: "default", ResourceVersion: "1"},
+		Spec:       coordinationv1.LeaseSpec{HolderIdentity: &other},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failing int32
+	acquired := make(chan struct{})
+	leasePath := "/apis/coordination.k8s.io/v1/namespaces/default/leases/lock"
+	server.RegisterResponder("GET", leasePath, func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return httpmock.NewBytesResponse(200, lease), nil
+	})
+	server.RegisterResponder("PUT", leasePath, func(req *http.Request) (*http.Response, error) {
+		if atomic.LoadInt32(&failing) == 1 {
+			return httpmock.NewStringResponse(500, ""), nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := ioutil.ReadAll(req.Body)
+		lease = body
+		select {
+		case <-acquired:
+		default:
+			close(acquired)
+		}
+		return httpmock.NewBytesResponse(200, body), nil
+	})
+	// The CRD is only added once we are the leader.
+	server.RegisterResponder("POST", "/apis/apiextensions.k8s.io/v1/customresourcedefinitions",
+		func(req *http.Request) (*http.Response, error) {
+			select {
+			case <-acquired:
+			default:
+				t.Error("CRD added before acquiring the Lease")
+			}
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewLeaderElectedController(context.Background(), client, rl, "default",
+		leaderelection.Config{
+			Name:          "lock",
+			Namespace:     "default",
+			Identity:      "me",
+			LeaseDuration: 200 * time.Millisecond,
+			RenewDeadline: 100 * time.Millisecond,
+			RetryPeriod:   20 * time.Millisecond,
+		})
+	<-acquired
+	if !controller.Running() {
+		t.Error("controller should be running")
+	}
+
+	// Once the Lease can't be renewed, the controller stops.
+	atomic.StoreInt32(&failing, 1)
+	for err := range controller.Errors {
+		t.Error("Unexpected error: ", err)
+	}
+	controller.Wait()
+}
+
+func TestRunning(t *testing.T) {
+	controller, _, foos, _ := startTestController(t)
+	if !controller.Running() {
+		t.Error("controller should be running")
+	}
+
+	foos.Write([]byte("broken"))
+	// Don't read the error yet, the controller is dead anyway.
+	deadline := time.Now().Add(5 * time.Second)
+	for controller.Running() {
+		if time.Now().After(deadline) {
+			t.Fatal("controller still running after a fatal error")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := <-controller.Errors; err == nil {
+		t.Error("expected error")
+	}
+	stopController(t, controller)
+	if controller.Running() {
+		t.Error("controller should not be running once stopped")
+	}
+}
+
+// A GenericController for types other than Foo and Deployment.
+type testPrimary struct {
+	metav1.ObjectMeta
+	Owned string
+}
+
+type testOwned struct {
+	metav1.ObjectMeta
+	Value string
+}
+
+func TestGenericController(t *testing.T) {
+	gvk := schema.GroupVersionKind{Group: "test.example.com", Version: "v1", Kind: "TestPrimary"}
+	primaries := make(chan kubeapi.WatchEvent)
+	owned := make(chan kubeapi.WatchEvent)
+	added := make(chan *testOwned)
+	watch := func(ch chan kubeapi.WatchEvent) WatchFunc {
+		return func(string, string) (<-chan kubeapi.WatchEvent, chan<- struct{}) {
+			stop := make(chan struct{})
+			go func() {
+				<-stop
+				close(ch)
+			}()
+			return ch, stop
+		}
+	}
+	unexpected := func(o *testOwned) error {
+		t.Error("unexpected call for ", o.Name)
+		return nil
+	}
+	config := Config[*testPrimary, *testOwned]{
+		GVK:       gvk,
+		OwnedKind: "TestOwned",
+		AddCRD:    func() error { return nil },
+		Primary:   Resource[*testPrimary]{Watch: watch(primaries)},
+		Owned: Resource[*testOwned]{
+			Watch: watch(owned),
+			Add: func(o *testOwned) error {
+				added <- o
+				return nil
+			},
+			Update: unexpected,
+			Delete: unexpected,
+		},
+		OwnedName: func(p *testPrimary) string { return p.Owned },
+		NewOwned: func(p *testPrimary) *testOwned {
+			ref := metav1.NewControllerRef(p, gvk)
+			meta := metav1.ObjectMeta{Name: p.Owned,
+				OwnerReferences: []metav1.OwnerReference{*ref}}
+			return &testOwned{ObjectMeta: meta, Value: p.Name}
+		},
+		Equal: func(existing, desired *testOwned) bool {
+			return existing.Value == desired.Value
+		},
+	}
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(config, rl, "default")
+
+	primaries <- kubeapi.WatchEvent{Item: &testPrimary{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc"}, Owned: "def"}}
+	rl.step()
+	o := <-added
+	if o.Name != "def" || o.Value != "abc" {
+		t.Errorf("wrong owned resource: %v", o)
+	}
+	if !metav1.IsControlledBy(o, &testPrimary{ObjectMeta: metav1.ObjectMeta{Name: "abc"}}) {
+		t.Error("owned resource is not controlled by its primary")
+	}
+
+	controller.RequestStop()
+	for err := range controller.Errors {
+		t.Errorf("unxpected error %s", err)
+	}
+}
+
+func TestResyncPeriod(t *testing.T) {
+	gvk := schema.GroupVersionKind{Group: "test.example.com", Version: "v1", Kind: "TestPrimary"}
+	primaries := make(chan kubeapi.WatchEvent)
+	owned := make(chan kubeapi.WatchEvent)
+	watch := func(ch chan kubeapi.WatchEvent) WatchFunc {
+		return func(string, string) (<-chan kubeapi.WatchEvent, chan<- struct{}) {
+			stop := make(chan struct{})
+			go func() {
+				<-stop
+				close(ch)
+			}()
+			return ch, stop
+		}
+	}
+	// Set once the owned resource is edited by hand, without a watch
+	// event reporting it.
+	var drifted int32
+	updated := make(chan *testOwned, 1)
+	config := Config[*testPrimary, *testOwned]{
+		GVK:       gvk,
+		OwnedKind: "TestOwned",
+		AddCRD:    func() error { return nil },
+		Primary:   Resource[*testPrimary]{Watch: watch(primaries)},
+		Owned: Resource[*testOwned]{
+			Watch: watch(owned),
+			Add: func(o *testOwned) error {
+				t.Error("unexpected add of ", o.Name)
+				return nil
+			},
+			Update: func(o *testOwned) error {
+				atomic.StoreInt32(&drifted, 0)
+				updated <- o
+				return nil
+			},
+			Delete: func(o *testOwned) error {
+				t.Error("unexpected delete of ", o.Name)
+				return nil
+			},
+		},
+		OwnedName: func(p *testPrimary) string { return p.Owned },
+		NewOwned: func(p *testPrimary) *testOwned {
+			ref := metav1.NewControllerRef(p, gvk)
+			meta := metav1.ObjectMeta{Name: p.Owned,
+				OwnerReferences: []metav1.OwnerReference{*ref}}
+			return &testOwned{ObjectMeta: meta, Value: p.Name}
+		},
+		Equal: func(existing, desired *testOwned) bool {
+			return existing.Value == desired.Value && atomic.LoadInt32(&drifted) == 0
+		},
+		ResyncPeriod: 10 * time.Millisecond,
+	}
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(config, rl, "default")
+
+	primary := &testPrimary{ObjectMeta: metav1.ObjectMeta{Name: "abc", UID: "1234"},
+		Owned: "def"}
+	owned <- kubeapi.WatchEvent{Item: config.NewOwned(primary)}
+	rl.step()
+	primaries <- kubeapi.WatchEvent{Item: primary}
+	rl.step()
+
+	atomic.StoreInt32(&drifted, 1)
+	rl.step()
+	if o := <-updated; o.Name != "def" || o.Value != "abc" {
+		t.Errorf("wrong owned resource: %v", o)
+	}
+
+	// Let the resyncs go on until the controller stops.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-rl.ask:
+			case <-done:
+				return
+			}
+		}
+	}()
 	controller.RequestStop()
 	for err := range controller.Errors {
 		t.Errorf("unxpected error %s", err)
 	}
 }
+
+func TestPanic(t *testing.T) {
+	gvk := schema.GroupVersionKind{Group: "test.example.com", Version: "v1", Kind: "TestPrimary"}
+	primaries := make(chan kubeapi.WatchEvent)
+	owned := make(chan kubeapi.WatchEvent)
+	watch := func(ch chan kubeapi.WatchEvent) WatchFunc {
+		return func(string, string) (<-chan kubeapi.WatchEvent, chan<- struct{}) {
+			stop := make(chan struct{})
+			go func() {
+				<-stop
+				close(ch)
+			}()
+			return ch, stop
+		}
+	}
+	var panicked int32
+	added := make(chan *testOwned, 1)
+	logger := &testLogger{}
+	config := Config[*testPrimary, *testOwned]{
+		Logger:    logger,
+		GVK:       gvk,
+		OwnedKind: "TestOwned",
+		AddCRD:    func() error { return nil },
+		Primary:   Resource[*testPrimary]{Watch: watch(primaries)},
+		Owned: Resource[*testOwned]{
+			Watch: watch(owned),
+			Add: func(o *testOwned) error {
+				added <- o
+				return nil
+			},
+			Update: func(o *testOwned) error {
+				t.Error("unexpected update of ", o.Name)
+				return nil
+			},
+			Delete: func(o *testOwned) error {
+				t.Error("unexpected delete of ", o.Name)
+				return nil
+			},
+		},
+		OwnedName: func(p *testPrimary) string { return p.Owned },
+		// The first synchronization panics.
+		NewOwned: func(p *testPrimary) *testOwned {
+			if atomic.CompareAndSwapInt32(&panicked, 0, 1) {
+				panic("bad object")
+			}
+			return &testOwned{ObjectMeta: metav1.ObjectMeta{Name: p.Owned}, Value: p.Name}
+		},
+		Equal: func(existing, desired *testOwned) bool {
+			return existing.Value == desired.Value
+		},
+		FailureBackoff: time.Millisecond,
+	}
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(config, rl, "default")
+
+	// Objects of the wrong type are skipped.
+	owned <- kubeapi.WatchEvent{Item: "wrong"}
+	primaries <- kubeapi.WatchEvent{Item: 42}
+
+	primaries <- kubeapi.WatchEvent{Item: &testPrimary{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", UID: "1234"}, Owned: "def"}}
+	// It is retried once the backoff expires.
+	for i := 0; i < 2; i++ {
+		<-rl.ask
+		rl.tick <- struct{}{}
+	}
+	if o := <-added; o.Name != "def" || o.Value != "abc" {
+		t.Errorf("wrong owned resource: %v", o)
+	}
+
+	controller.RequestStop()
+	for err := range controller.Errors {
+		t.Errorf("unxpected error %s", err)
+	}
+	var msgs []string
+	logger.mu.Lock()
+	for _, e := range logger.entries {
+		if e.level == "error" {
+			msgs = append(msgs, e.msg+": "+e.err.Error())
+		}
+	}
+	logger.mu.Unlock()
+	want := []string{
+		"Skipping an object of the wrong type: Got a string",
+		"Skipping an object of the wrong type: Got a int",
+		"Recovered: Synchronize panicked: bad object",
+	}
+	for _, w := range want {
+		found := false
+		for _, m := range msgs {
+			found = found || m == w
+		}
+		if !found {
+			t.Errorf("%q was not logged, got %q", w, msgs)
+		}
+	}
+}
+
+func TestGenericControllerMissingConfig(t *testing.T) {
+	defer func() {
+		if r := recover(); r != "controller: Config.AddCRD is required" {
+			t.Errorf("wrong panic: %v", r)
+		}
+	}()
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	NewGenericController(Config[*testPrimary, *testOwned]{}, rl, "default")
+}
+
+func TestScaleStep(t *testing.T) {
+	client, server, foos, deployments := startTestServer(t)
+	config := FooConfig(client)
+	config.Progress = ScaleStep(2)
+	config.ProgressInterval = 200 * time.Millisecond
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(config, rl, "default")
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 6},
+	}
+	deployment := newDeployment(&foo)
+	// Don't share the replicas with foo
+	replicas := int32(1)
+	deployment.Spec.Replicas = &replicas
+
+	puts := make(chan *appsv1.Deployment)
+	server.RegisterResponder("PUT", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		func(req *http.Request) (*http.Response, error) {
+			dep := &appsv1.Deployment{}
+			if err := json.NewDecoder(req.Body).Decode(dep); err != nil {
+				t.Fatal("Could not decode deployment: ", err)
+			}
+			puts <- dep
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+
+	for i, expected := range []int32{3, 5, 6} {
+		if i != 0 {
+			// Synchronize the deployment event, which is
+			// skipped until ProgressInterval expires, and
+			// then the delayed step.
+			rl.step()
+			rl.step()
+		}
+		deployment = <-puts
+		if *deployment.Spec.Replicas != expected {
+			t.Errorf("expected %d replicas, got %d", expected, *deployment.Spec.Replicas)
+		}
+		deployments.Write(marshal(t, "ADDED", deployment))
+	}
+	// The target was reached, so there is nothing left to do.
+	rl.step()
+
+	stopController(t, controller)
+}
+
+// eventually waits for cond to be true.
+func eventually(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReconciler(t *testing.T) {
+	client, server, foos, deployments := startTestServer(t)
+	existings := make(chan *appsv1.Deployment, 2)
+	reconciler := ReconcilerFunc(func(ctx context.Context, foo *Foo,
+		existing *appsv1.Deployment) (*appsv1.Deployment, error) {
+		existings <- existing
+		deployment := newDeployment(foo)
+		deployment.Name = "ignored"
+		deployment.OwnerReferences = nil
+		deployment.Spec.Template.Spec.Containers[0].Image = "busybox"
+		return deployment, nil
+	})
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewControllerWithReconciler(client, rl, "default", reconciler)
+	posts := make(chan *appsv1.Deployment, 1)
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		func(req *http.Request) (*http.Response, error) {
+			deployment := &appsv1.Deployment{}
+			if err := json.NewDecoder(req.Body).Decode(deployment); err != nil {
+				t.Error("Could not decode deployment: ", err)
+			}
+			posts <- deployment
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	if existing := <-existings; existing != nil {
+		t.Error("Expected no existing Deployment, got ", existing)
+	}
+	deployment := <-posts
+	if deployment.Name != "bar" || deployment.Namespace != "xyz" ||
+		!metav1.IsControlledBy(deployment, &foo) {
+		t.Errorf("Wrong Deployment: %s/%s %v", deployment.Namespace, deployment.Name,
+			deployment.OwnerReferences)
+	}
+	if image := deployment.Spec.Template.Spec.Containers[0].Image; image != "busybox" {
+		t.Errorf("Got image %s, want busybox", image)
+	}
+
+	// The next synchronization gets the existing Deployment, which
+	// already matches.
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+	if existing := <-existings; existing == nil || existing.Name != "bar" {
+		t.Error("Expected the existing Deployment, got ", existing)
+	}
+
+	stopController(t, controller)
+	if len(posts) != 0 {
+		t.Error("Unexpected POST of ", (<-posts).Name)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	// The zero Options give the controller of NewController.
+	var posted []*appsv1.Deployment
+	for _, start := range []func(*kubeapi.KubeClient, ratelimit.RateLimiter) *Controller{
+		func(client *kubeapi.KubeClient, rl ratelimit.RateLimiter) *Controller {
+			return NewController(client, rl, "default")
+		},
+		func(client *kubeapi.KubeClient, rl ratelimit.RateLimiter) *Controller {
+			return NewControllerWithOptions(client, Options{RateLimiter: rl})
+		},
+	} {
+		client, server, foos, _ := startTestServer(t)
+		rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+		controller := start(client, rl)
+		if controller.Namespace != "default" {
+			t.Errorf("Watching namespace %q, want default", controller.Namespace)
+		}
+		posts := make(chan *appsv1.Deployment, 1)
+		server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+			func(req *http.Request) (*http.Response, error) {
+				deployment := &appsv1.Deployment{}
+				if err := json.NewDecoder(req.Body).Decode(deployment); err != nil {
+					t.Error("Could not decode deployment: ", err)
+				}
+				posts <- deployment
+				return httpmock.NewStringResponse(201, ""), nil
+			})
+
+		foo := Foo{
+			ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+			Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+		}
+		foos.Write(marshal(t, "ADDED", &foo))
+		rl.step()
+		posted = append(posted, <-posts)
+		stopController(t, controller)
+	}
+	if !reflect.DeepEqual(posted[0], posted[1]) {
+		t.Errorf("Got %+v, want %+v", posted[1], posted[0])
+	}
+
+	// Without a rate limiter, the default one is used.
+	client, _, _, _ := startTestServer(t)
+	controller := NewControllerWithOptions(client, Options{})
+	if controller.Namespace != "default" || controller.rl == nil {
+		t.Errorf("Wrong defaults: namespace %q, rate limiter %v", controller.Namespace,
+			controller.rl)
+	}
+	stopController(t, controller)
+}
+
+func TestFakeServer(t *testing.T) {
+	// The controller and the api server it talks to, without mocks.
+	client, server := fake.NewClient()
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "default"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	if err := client.Post(Group, Version, "default", "foos", &foo); err != nil {
+		t.Fatal(err)
+	}
+	controller := NewController(client,
+		ratelimit.NewExponentialRateLimiter(time.Millisecond, time.Millisecond), "default")
+
+	deployment := func() *appsv1.Deployment {
+		var ret appsv1.Deployment
+		ok, err := server.Get("/apis/apps/v1/namespaces/default/deployments/bar", &ret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return nil
+		}
+		return &ret
+	}
+	eventually(t, func() bool { return deployment() != nil })
+	if d := deployment(); *d.Spec.Replicas != 1 || metav1.GetControllerOf(d) == nil ||
+		metav1.GetControllerOf(d).Name != "abc" {
+		t.Errorf("Wrong deployment: %+v", d)
+	}
+
+	if err := client.Patch(Group, Version, "default", "foos/abc", types.MergePatchType,
+		[]byte(`{"spec": {"replicas": 2}}`)); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return *deployment().Spec.Replicas == 2 })
+
+	// The finalizer is removed once the controller deleted the
+	// Deployment.
+	if err := client.Delete(Group, Version, "default", "foos/abc"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool {
+		return len(server.Names("/apis/"+Group+"/"+Version+"/foos")) == 0
+	})
+	if deployment() != nil {
+		t.Error("The deployment should be deleted")
+	}
+	stopController(t, controller)
+}
+
+func TestDeploymentRecreated(t *testing.T) {
+	client, server := fake.NewClient()
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "default"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 3},
+	}
+	if err := client.Post(Group, Version, "default", "foos", &foo); err != nil {
+		t.Fatal(err)
+	}
+	controller := NewController(client,
+		ratelimit.NewExponentialRateLimiter(time.Millisecond, time.Millisecond), "default")
+	defer stopController(t, controller)
+
+	deployment := func() *appsv1.Deployment {
+		var ret appsv1.Deployment
+		ok, err := server.Get("/apis/apps/v1/namespaces/default/deployments/bar", &ret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return nil
+		}
+		return &ret
+	}
+	eventually(t, func() bool { return deployment() != nil })
+	first := deployment()
+	if err := client.DeleteDeployment(first); err != nil {
+		t.Fatal(err)
+	}
+
+	// The delete event requeues abc, which creates bar again.
+	eventually(t, func() bool {
+		d := deployment()
+		return d != nil && d.UID != first.UID
+	})
+	d := deployment()
+	owner := metav1.GetControllerOf(d)
+	if owner == nil || owner.Name != "abc" || owner.UID != first.OwnerReferences[0].UID ||
+		*d.Spec.Replicas != 3 {
+		t.Errorf("Wrong recreated deployment: %+v", d)
+	}
+	eventually(t, func() bool {
+		for _, name := range server.Names("/api/v1/events") {
+			var ev corev1.Event
+			namespace, name := splitKey(name)
+			if _, err := server.Get("/api/v1/namespaces/"+namespace+"/events/"+name,
+				&ev); err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasPrefix(ev.Message, "Recreated deleted Deployment bar ") {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestDeploymentDeletedWithFoo(t *testing.T) {
+	// Without our finalizer, the Deployment of a Foo being deleted
+	// is not created again.
+	client, server := fake.NewClient()
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "default",
+			Finalizers: []string{"example.com/keep"}},
+		Spec: FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	if err := client.Post(Group, Version, "default", "foos", &foo); err != nil {
+		t.Fatal(err)
+	}
+	config := FooConfig(client)
+	config.Finalizer = ""
+	// Signals once the controller got the Foo being deleted.
+	deleting := make(chan struct{}, 1)
+	watch := config.Primary.Watch
+	config.Primary.Watch = func(namespace, resourceVersion string) (<-chan kubeapi.WatchEvent,
+		chan<- struct{}) {
+		events, stop := watch(namespace, resourceVersion)
+		out := make(chan kubeapi.WatchEvent)
+		go func() {
+			defer close(out)
+			for ev := range events {
+				out <- ev
+				if foo, ok := ev.Item.(*Foo); ok && foo.DeletionTimestamp != nil {
+					select {
+					case deleting <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}()
+		return out, stop
+	}
+	controller := NewGenericController(config,
+		ratelimit.NewExponentialRateLimiter(time.Millisecond, time.Millisecond), "default")
+	defer stopController(t, controller)
+
+	const deploymentPath = "/apis/apps/v1/namespaces/default/deployments/bar"
+	var deployment appsv1.Deployment
+	eventually(t, func() bool {
+		ok, err := server.Get(deploymentPath, &deployment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	})
+	if err := client.Delete(Group, Version, "default", "foos/abc"); err != nil {
+		t.Fatal(err)
+	}
+	<-deleting
+	if err := client.DeleteDeployment(&deployment); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if ok, err := server.Get(deploymentPath, &deployment); err != nil || ok {
+		t.Error("The deployment of a Foo being deleted was created again: ", err)
+	}
+}
+
+func TestCheckNamespace(t *testing.T) {
+	client, server := fake.NewClient()
+	rl := ratelimit.NewExponentialRateLimiter(time.Millisecond, time.Millisecond)
+
+	// A missing namespace stops the controller.
+	controller := NewControllerWithOptions(client, Options{RateLimiter: rl,
+		Namespace: "missing", CheckNamespace: true})
+	err := <-controller.Errors
+	if err == nil || !strings.Contains(err.Error(), "Namespace missing does not exist") {
+		t.Error("Expected a missing namespace error, got ", err)
+	}
+	for err := range controller.Errors {
+		t.Error("Unexpected error: ", err)
+	}
+
+	// Unless it is created.
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "created"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	if err := client.Post(Group, Version, "created", "foos", &foo); err != nil {
+		t.Fatal(err)
+	}
+	controller = NewControllerWithOptions(client, Options{RateLimiter: rl,
+		Namespace: "created", CreateNamespace: true})
+	eventually(t, func() bool {
+		names := server.Names("/apis/apps/v1/deployments")
+		return len(names) == 1 && names[0] == "created/bar"
+	})
+	if names := server.Names("/api/v1/namespaces"); !reflect.DeepEqual(names,
+		[]string{"/created"}) {
+		t.Errorf("Got namespaces %v, want only created", names)
+	}
+	stopController(t, controller)
+
+	// All namespaces are not checked.
+	controller = NewControllerWithOptions(client, Options{RateLimiter: rl,
+		AllNamespaces: true, CheckNamespace: true})
+	eventually(t, func() bool {
+		ok, _ := controller.Healthy()
+		return ok
+	})
+	stopController(t, controller)
+}
+
+func TestCachedFooConfig(t *testing.T) {
+	client, server := fake.NewClient()
+	fooPath := "/apis/" + Group + "/" + Version + "/namespaces/default/foos/abc"
+	var mu sync.Mutex
+	fooGets := 0
+	client = client.WithObserver(func(info kubeapi.RequestInfo) {
+		if info.Method == "GET" && info.Path == fooPath {
+			mu.Lock()
+			fooGets++
+			mu.Unlock()
+		}
+	})
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "default"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	if err := client.Post(Group, Version, "default", "foos", &foo); err != nil {
+		t.Fatal(err)
+	}
+	config, cache := CachedFooConfig(client, FooNames{})
+	// The status updates get the Foo again after a conflict.
+	config.UpdateStatus = nil
+	controller := NewGenericController(config,
+		ratelimit.NewExponentialRateLimiter(time.Millisecond, time.Millisecond), "default")
+
+	replicas := func() int32 {
+		var ret appsv1.Deployment
+		ok, err := server.Get("/apis/apps/v1/namespaces/default/deployments/bar", &ret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return 0
+		}
+		return *ret.Spec.Replicas
+	}
+	eventually(t, func() bool { return replicas() == 1 })
+	if err := client.Patch(Group, Version, "default", "foos/abc", types.MergePatchType,
+		[]byte(`{"spec": {"replicas": 2}}`)); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return replicas() == 2 })
+
+	// The watches filled the cache, which the reconciles read instead
+	// of getting the Foo.
+	eventually(t, func() bool {
+		d, ok := cache.Deployments.Get("default", "bar")
+		return ok && *d.Spec.Replicas == 2
+	})
+	if cached, ok := cache.Foos.Get("default", "abc"); !ok || cached.Spec.Replicas != 2 {
+		t.Errorf("Wrong cached Foo: %+v", cached)
+	}
+	mu.Lock()
+	if fooGets != 0 {
+		t.Errorf("Got the Foo %d times, want 0", fooGets)
+	}
+	mu.Unlock()
+
+	// What is not cached is asked for.
+	if _, err := cache.GetCachedFoo("default", "other"); !isNotFound(err) {
+		t.Error("Expected a not found error, got ", err)
+	}
+	stopController(t, controller)
+}
+
+// mockClient is a Client whose watches are fed by foos and
+// deployments, and whose writes are sent to calls. GetResource returns
+// the last Foo sent.
+type mockClient struct {
+	Client
+	foos, deployments chan kubeapi.WatchEvent
+	calls             chan string
+
+	mu  sync.Mutex
+	foo Foo
+}
+
+// sendFoo sends foo to the watch of the Foos.
+func (m *mockClient) sendFoo(foo Foo) {
+	m.mu.Lock()
+	m.foo = foo
+	m.mu.Unlock()
+	m.foos <- kubeapi.WatchEvent{Item: &foo}
+}
+
+func (m *mockClient) GetResource(group, version, namespace, path string,
+	obj interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	*obj.(*Foo) = m.foo
+	return nil
+}
+
+func newMockClient() *mockClient {
+	return &mockClient{foos: make(chan kubeapi.WatchEvent),
+		deployments: make(chan kubeapi.WatchEvent), calls: make(chan string)}
+}
+
+func (m *mockClient) Context() context.Context {
+	return context.Background()
+}
+
+func (m *mockClient) AddCustomResourceDefinition(
+	crd *apiextensionsv1.CustomResourceDefinition) error {
+	m.calls <- "AddCustomResourceDefinition " + crd.Name
+	return nil
+}
+
+func (m *mockClient) GetCustomResourceDefinitions(name string) (<-chan kubeapi.WatchEvent,
+	chan<- struct{}) {
+	crd := apiextensionsv1.CustomResourceDefinition{}
+	crd.Status.Conditions = []apiextensionsv1.CustomResourceDefinitionCondition{
+		{Type: "Established", Status: apiextensionsv1.ConditionTrue}}
+	ch := make(chan kubeapi.WatchEvent, 1)
+	ch <- kubeapi.WatchEvent{Item: crd}
+	return ch, make(chan struct{})
+}
+
+func (m *mockClient) GetResources(group, version, namespace, path string, query url.Values,
+	v interface{}) (<-chan kubeapi.WatchEvent, chan<- struct{}) {
+	in := m.foos
+	if path == "deployments" {
+		in = m.deployments
+	}
+	out := make(chan kubeapi.WatchEvent)
+	stop := make(chan struct{})
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case ev := <-in:
+				select {
+				case out <- ev:
+				case <-stop:
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return out, stop
+}
+
+func (m *mockClient) UpdateResource(group, version, namespace, path string,
+	obj interface{}) error {
+	m.calls <- "UpdateResource " + path
+	return nil
+}
+
+func (m *mockClient) UpdateResourceStatus(group, version, namespace, path string,
+	obj interface{}) error {
+	m.calls <- "UpdateResourceStatus " + path
+	return nil
+}
+
+func (m *mockClient) AddDeployment(deployment *appsv1.Deployment) error {
+	m.calls <- fmt.Sprintf("AddDeployment %s %d", deployment.Name, *deployment.Spec.Replicas)
+	return nil
+}
+
+func (m *mockClient) UpdateDeployment(deployment *appsv1.Deployment) error {
+	m.calls <- fmt.Sprintf("UpdateDeployment %s %d", deployment.Name,
+		*deployment.Spec.Replicas)
+	return nil
+}
+
+func (m *mockClient) RecordEvent(obj metav1.Object, gvk schema.GroupVersionKind, eventType,
+	reason, message string) error {
+	return nil
+}
+
+func TestMockClient(t *testing.T) {
+	client := newMockClient()
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewController(client, rl, "xyz")
+	expect := func(want ...string) {
+		t.Helper()
+		for _, call := range want {
+			if got := <-client.calls; got != call {
+				t.Fatalf("Got call %q, want %q", got, call)
+			}
+		}
+	}
+	expect("AddCustomResourceDefinition foos.samplecontroller.example.com")
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234",
+			Generation: 1},
+		Spec: FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	client.sendFoo(foo)
+	<-rl.ask
+	rl.tick <- struct{}{}
+	expect("UpdateResource foos/abc", "AddDeployment bar 1")
+
+	// The Deployment is seen and the status written.
+	added := foo
+	added.Finalizers = []string{FooFinalizer}
+	client.sendFoo(added)
+	<-rl.ask
+	client.deployments <- kubeapi.WatchEvent{Item: newDeploymentFor(&added,
+		DefaultFooNames.GVK)}
+	<-rl.ask
+	rl.tick <- struct{}{}
+	expect("UpdateResourceStatus foos/abc")
+
+	scaled := added
+	scaled.Generation = 2
+	scaled.Spec.Replicas = 3
+	client.sendFoo(scaled)
+	<-rl.ask
+	rl.tick <- struct{}{}
+	expect("UpdateDeployment bar 3")
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-rl.ask:
+			case <-client.calls:
+			case <-done:
+				return
+			}
+		}
+	}()
+	stopController(t, controller)
+	close(done)
+}
+
+func TestDeadLetters(t *testing.T) {
+	client, server, foos, _ := startTestServer(t)
+	config := FooConfig(client)
+	config.MaxRetries = 2
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(config, rl, "default")
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	status := 500
+	posts := make(chan struct{})
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		func(req *http.Request) (*http.Response, error) {
+			resp := httpmock.NewStringResponse(status, "")
+			posts <- struct{}{}
+			return resp, nil
+		})
+
+	if err := controller.RetryDeadLetter("xyz/abc"); err == nil {
+		t.Error("expected error retrying a healthy item")
+	}
+
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	<-posts
+	rl.step()
+	<-posts
+	eventually(t, func() bool { return len(controller.DeadLetters()) == 1 })
+	dead := controller.DeadLetters()[0]
+	if dead.Key != "xyz/abc" || dead.Failures != 2 || dead.LastError == nil {
+		t.Errorf("wrong dead letter: %v", dead)
+	}
+
+	status = 201
+	if err := controller.RetryDeadLetter("xyz/abc"); err != nil {
+		t.Error(err)
+	}
+	rl.step()
+	<-posts
+	if len(controller.DeadLetters()) != 0 {
+		t.Error("the retried item should not be a dead letter")
+	}
+
+	stopController(t, controller)
+}
+
+func TestDeadLetterDegraded(t *testing.T) {
+	client, server := fake.NewClient()
+	var mu sync.Mutex
+	posts := 0
+	client = client.WithObserver(func(info kubeapi.RequestInfo) {
+		if info.Method == "POST" && strings.HasSuffix(info.Path, "/deployments") {
+			mu.Lock()
+			posts++
+			mu.Unlock()
+		}
+	})
+	countPosts := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return posts
+	}
+	const deployments = "/apis/apps/v1/namespaces/default/deployments"
+	for i := 0; i < 3; i++ {
+		server.Fail("POST", deployments, http.StatusInternalServerError)
+	}
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "default"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	if err := client.Post(Group, Version, "default", "foos", &foo); err != nil {
+		t.Fatal(err)
+	}
+	controller := NewControllerWithOptions(client, Options{MaxRetries: 2,
+		RateLimiter: ratelimit.NewExponentialRateLimiter(time.Millisecond, time.Millisecond)})
+
+	// After two failures, the Foo is Degraded and no longer retried.
+	fooPath := "/apis/" + Group + "/" + Version + "/namespaces/default/foos/abc"
+	degraded := func() *metav1.Condition {
+		var current Foo
+		if _, err := server.Get(fooPath, &current); err != nil {
+			t.Fatal(err)
+		}
+		return meta.FindStatusCondition(current.Status.Conditions, ConditionDegraded)
+	}
+	eventually(t, func() bool {
+		cond := degraded()
+		return cond != nil && cond.Reason == ReasonRetriesExhausted
+	})
+	if want := "Gave up after 2 failures: "; !strings.HasPrefix(degraded().Message, want) {
+		t.Errorf("Got message %q, want it to start with %q", degraded().Message, want)
+	}
+	if events := server.Names("/api/v1/events"); len(events) == 0 {
+		t.Error("No event recorded")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := countPosts(); n != 2 {
+		t.Errorf("Tried to create the Deployment %d times, want 2", n)
+	}
+
+	// A spec change tries again, which fails once more before
+	// succeeding.
+	if err := client.Patch(Group, Version, "default", "foos/abc", types.MergePatchType,
+		[]byte(`{"spec": {"replicas": 2}}`)); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool {
+		var d appsv1.Deployment
+		ok, err := server.Get(deployments+"/bar", &d)
+		return err == nil && ok && *d.Spec.Replicas == 2
+	})
+	eventually(t, func() bool { return degraded() == nil })
+	if n := countPosts(); n != 4 {
+		t.Errorf("Tried to create the Deployment %d times, want 4", n)
+	}
+	stopController(t, controller)
+}
+
+func TestDeadLetterResync(t *testing.T) {
+	client, server := fake.NewClient()
+	const deployments = "/apis/apps/v1/namespaces/default/deployments"
+	server.Fail("POST", deployments, http.StatusInternalServerError)
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "default"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	if err := client.Post(Group, Version, "default", "foos", &foo); err != nil {
+		t.Fatal(err)
+	}
+	controller := NewControllerWithOptions(client, Options{MaxRetries: 1,
+		ResyncPeriod: 100 * time.Millisecond,
+		RateLimiter:  ratelimit.NewExponentialRateLimiter(time.Millisecond, time.Millisecond)})
+
+	// The dead letter is tried again on the next resync.
+	eventually(t, func() bool { return len(controller.DeadLetters()) == 1 })
+	eventually(t, func() bool {
+		ok, err := server.Get(deployments+"/bar", &appsv1.Deployment{})
+		return err == nil && ok
+	})
+	if dead := controller.DeadLetters(); len(dead) != 0 {
+		t.Error("Unexpected dead letters: ", dead)
+	}
+	stopController(t, controller)
+}
+
+func TestFailureBackoff(t *testing.T) {
+	client, server, foos, _ := startTestServer(t)
+	config := FooConfig(client)
+	config.FailureBackoff = 10 * time.Millisecond
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(config, rl, "default")
+
+	// The first POST of bar0 fails.
+	var failed int32
+	posts := make(chan string, 3)
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		func(req *http.Request) (*http.Response, error) {
+			deployment := &appsv1.Deployment{}
+			if err := json.NewDecoder(req.Body).Decode(deployment); err != nil {
+				t.Fatal("Could not decode deployment: ", err)
+			}
+			posts <- deployment.Name
+			if deployment.Name == "bar0" && atomic.CompareAndSwapInt32(&failed, 0, 1) {
+				return httpmock.NewStringResponse(500, ""), nil
+			}
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+	next := func() string {
+		select {
+		case name := <-posts:
+			return name
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for a POST")
+			return ""
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		foos.Write(marshal(t, "ADDED", &Foo{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("abc%d", i), Namespace: "xyz"},
+			Spec:       FooSpec{DeploymentName: fmt.Sprintf("bar%d", i), Replicas: 1},
+		}))
+		<-rl.ask
+	}
+
+	// Both are synchronized, no matter which one is first.
+	rl.tick <- struct{}{}
+	if a, b := next(), next(); !(a == "bar0" && b == "bar1" || a == "bar1" && b == "bar0") {
+		t.Errorf("Expected bar0 and bar1 to be created, got %s and %s", a, b)
+	}
+	// Once the delay expires, bar0 is retried on its own.
+	rl.step()
+	if name := next(); name != "bar0" {
+		t.Errorf("Expected bar0 to be retried, got %s", name)
+	}
+
+	stopController(t, controller)
+}
+
+func TestProgressDeadline(t *testing.T) {
+	client, server, foos, deployments := startTestServer(t)
+	config := FooConfig(client)
+	recorder := events.NewFakeRecorder(1)
+	config.Recorder = recorder
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(config, rl, "default")
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	deployment := newDeployment(&foo)
+	deployment.Status.Conditions = []appsv1.DeploymentCondition{{
+		Type:    appsv1.DeploymentProgressing,
+		Status:  corev1.ConditionFalse,
+		Reason:  ReasonProgressDeadlineExceeded,
+		Message: `ReplicaSet "bar-1234" has timed out progressing.`,
+	}}
+
+	statuses := make(chan *Foo, 1)
+	server.RegisterResponder("PUT",
+		"/apis/samplecontroller.example.com/v1alpha1/namespaces/xyz/foos/abc/status",
+		func(req *http.Request) (*http.Response, error) {
+			updated := &Foo{}
+			if err := json.NewDecoder(req.Body).Decode(updated); err != nil {
+				t.Fatal("Could not decode foo: ", err)
+			}
+			statuses <- updated
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+
+	updated := <-statuses
+	if len(updated.Status.Conditions) != 2 {
+		t.Fatal("Wrong conditions: ", updated.Status.Conditions)
+	}
+	for i, ty := range []string{ConditionReady, ConditionProgressing} {
+		cond := updated.Status.Conditions[i]
+		if cond.Type != ty || cond.Status != metav1.ConditionFalse ||
+			cond.Reason != ReasonProgressDeadlineExceeded ||
+			cond.Message != deployment.Status.Conditions[0].Message {
+			t.Error("Wrong condition: ", cond)
+		}
+	}
+	if updated.APIVersion != Group+"/"+Version || updated.Kind != Kind {
+		t.Error("Wrong type: ", updated.TypeMeta)
+	}
+
+	event := <-recorder.Events
+	if event.Type != corev1.EventTypeWarning || event.Reason != ReasonProgressDeadlineExceeded {
+		t.Error("Wrong event: ", event.Type, event.Reason)
+	}
+	// The message identifies the synchronization that recorded it.
+	messageRE := regexp.MustCompile(`^ReplicaSet "bar-1234" has timed out progressing\. ` +
+		`\(reconcile [0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}\)$`)
+	if !messageRE.MatchString(event.Message) {
+		t.Error("Wrong event message: ", event.Message)
+	}
+	involved := event.InvolvedObject
+	if involved.Kind != Kind || involved.Name != "abc" || involved.Namespace != "xyz" ||
+		involved.UID != foo.UID {
+		t.Error("Wrong involved object: ", involved)
+	}
+
+	// Once the status is written, it is not written again and no
+	// new event is recorded.
+	foos.Write(marshal(t, "ADDED", updated))
+	rl.step()
+
+	stopController(t, controller)
+	if len(statuses) != 0 || len(recorder.Events) != 0 {
+		t.Error("Unexpected status update or event")
+	}
+}
+
+func TestConditionMapper(t *testing.T) {
+	client, server, foos, deployments := startTestServer(t)
+	config := FooConfig(client)
+	config.UpdateStatus = FooStatusUpdater(client, FooStatusOptions{
+		ConditionMapper: func(deployment *appsv1.Deployment) metav1.Condition {
+			return metav1.Condition{Status: metav1.ConditionTrue, Reason: "Custom",
+				Message: deployment.Name}
+		},
+	})
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(config, rl, "default")
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", Generation: 3},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	statuses := make(chan *Foo, 1)
+	server.RegisterResponder("PUT",
+		"/apis/samplecontroller.example.com/v1alpha1/namespaces/xyz/foos/abc/status",
+		func(req *http.Request) (*http.Response, error) {
+			updated := &Foo{}
+			if err := json.NewDecoder(req.Body).Decode(updated); err != nil {
+				t.Fatal("Could not decode foo: ", err)
+			}
+			statuses <- updated
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	deployments.Write(marshal(t, "ADDED", newDeployment(&foo)))
+	rl.step()
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+
+	updated := <-statuses
+	if len(updated.Status.Conditions) != 2 ||
+		updated.Status.Conditions[1].Type != ConditionProgressing {
+		t.Fatal("Wrong conditions: ", updated.Status.Conditions)
+	}
+	cond := updated.Status.Conditions[0]
+	if cond.Type != ConditionReady || cond.Status != metav1.ConditionTrue ||
+		cond.Reason != "Custom" || cond.Message != "bar" || cond.ObservedGeneration != 3 ||
+		cond.LastTransitionTime.IsZero() {
+		t.Error("Wrong condition: ", cond)
+	}
+
+	stopController(t, controller)
+}
+
+func TestFooConditions(t *testing.T) {
+	client, server, foos, deployments := startTestServer(t)
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(FooConfig(client), rl, "default")
+
+	statuses := make(chan *Foo, 1)
+	server.RegisterResponder("PUT",
+		"/apis/samplecontroller.example.com/v1alpha1/namespaces/xyz/foos/abc/status",
+		func(req *http.Request) (*http.Response, error) {
+			updated := &Foo{}
+			if err := json.NewDecoder(req.Body).Decode(updated); err != nil {
+				t.Fatal("Could not decode foo: ", err)
+			}
+			statuses <- updated
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+	var putStatus int32 = 500
+	server.RegisterResponder("PUT", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		func(req *http.Request) (*http.Response, error) {
+			return httpmock.NewStringResponse(int(atomic.LoadInt32(&putStatus)), ""), nil
+		})
+	// check returns the condition of type ty of foo, after checking
+	// its status and reason.
+	check := func(foo *Foo, ty string, status metav1.ConditionStatus,
+		reason string) metav1.Condition {
+		t.Helper()
+		cond := meta.FindStatusCondition(foo.Status.Conditions, ty)
+		if cond == nil {
+			t.Fatalf("No %s condition: %v", ty, foo.Status.Conditions)
+		}
+		if cond.Status != status || cond.Reason != reason {
+			t.Errorf("Wrong %s condition: %v", ty, cond)
+		}
+		return *cond
+	}
+	old := metav1.NewTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	age := func(foo *Foo) {
+		for i := range foo.Status.Conditions {
+			foo.Status.Conditions[i].LastTransitionTime = old
+		}
+	}
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 3},
+	}
+	deployment := newDeployment(&foo)
+	deployment.Status = appsv1.DeploymentStatus{Replicas: 3, UpdatedReplicas: 3,
+		AvailableReplicas: 1}
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+
+	// Scaling up.
+	updated := <-statuses
+	check(updated, ConditionReady, metav1.ConditionFalse, "Unavailable")
+	check(updated, ConditionProgressing, metav1.ConditionTrue, "Scaling")
+	age(updated)
+	foos.Write(marshal(t, "ADDED", updated))
+	rl.step()
+
+	// Scaled up. Both conditions changed.
+	deployment.Status.AvailableReplicas = 3
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+	updated = <-statuses
+	ready := check(updated, ConditionReady, metav1.ConditionTrue, "Available")
+	progressing := check(updated, ConditionProgressing, metav1.ConditionFalse, "Stable")
+	if ready.LastTransitionTime.Equal(&old) || progressing.LastTransitionTime.Equal(&old) {
+		t.Error("The transition times were not updated")
+	}
+	age(updated)
+
+	// The Deployment cannot be updated. Only Degraded changes.
+	updated.Spec.Replicas = 4
+	foos.Write(marshal(t, "ADDED", updated))
+	// Not rl.step, which could swallow the ask of the retry.
+	<-rl.ask
+	rl.tick <- struct{}{}
+	updated = <-statuses
+	degraded := check(updated, ConditionDegraded, metav1.ConditionTrue, ReasonReconcileError)
+	if !strings.Contains(degraded.Message, "code=500") {
+		t.Error("Wrong message: ", degraded.Message)
+	}
+	ready = check(updated, ConditionReady, metav1.ConditionTrue, "Available")
+	if !ready.LastTransitionTime.Equal(&old) {
+		t.Error("The transition time of Ready was updated")
+	}
+
+	// Once synchronized, it is no longer degraded.
+	atomic.StoreInt32(&putStatus, 200)
+	<-rl.ask
+	rl.tick <- struct{}{}
+	foos.Write(marshal(t, "ADDED", updated))
+	rl.step()
+	deployment = newDeployment(updated)
+	deployment.Status = appsv1.DeploymentStatus{Replicas: 4, UpdatedReplicas: 4,
+		AvailableReplicas: 4}
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+	updated = <-statuses
+	if cond := meta.FindStatusCondition(updated.Status.Conditions, ConditionDegraded); cond != nil {
+		t.Error("Still degraded: ", cond)
+	}
+	check(updated, ConditionReady, metav1.ConditionTrue, "Available")
+
+	stopController(t, controller)
+}
+
+func TestSnapshot(t *testing.T) {
+	controller, _, foos, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+	snapshot := func() ControllerSnapshot {
+		t.Helper()
+		s, err := controller.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	check := func(got, want []string) {
+		t.Helper()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Got %v, want %v", got, want)
+		}
+	}
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	deployments.Write(marshal(t, "ADDED", newDeployment(&foo)))
+	<-rl.ask
+	s := snapshot()
+	check(s.Primaries, []string{})
+	check(s.Owned, []string{"xyz/bar"})
+	check(s.Todo, []string{"xyz/abc"})
+
+	foos.Write(marshal(t, "ADDED", &foo))
+	<-rl.ask
+	check(snapshot().Primaries, []string{"xyz/abc"})
+
+	rl.tick <- struct{}{}
+	eventually(t, func() bool {
+		return len(snapshot().Todo) == 0
+	})
+	stopController(t, controller)
+	if _, err := controller.Snapshot(); err == nil {
+		t.Error("Expected an error once stopped")
+	}
+}
+
+func TestSummary(t *testing.T) {
+	controller, server, foos, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		httpmock.NewStringResponder(500, "no"))
+
+	// abc already has its Deployment, creating that of def fails.
+	abc := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	def := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "def", Namespace: "xyz", UID: "5678"},
+		Spec:       FooSpec{DeploymentName: "qux", Replicas: 1},
+	}
+	deployments.Write(marshal(t, "ADDED", newDeployment(&abc)))
+	<-rl.ask
+	foos.Write(marshal(t, "ADDED", &abc))
+	<-rl.ask
+	rl.tick <- struct{}{}
+	eventually(t, func() bool {
+		s, err := controller.Snapshot()
+		return err == nil && len(s.Todo) == 0
+	})
+	foos.Write(marshal(t, "ADDED", &def))
+	<-rl.ask
+	rl.tick <- struct{}{}
+	// The failure asks to be retried.
+	<-rl.ask
+	stopController(t, controller)
+
+	want := ControllerSummary{Reconciled: 1, Errors: 1, Pending: []string{"xyz/def"}}
+	if got := controller.Summary(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+}
+
+func TestDeleteWithoutNamespace(t *testing.T) {
+	controller, _, foos, _ := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+
+	foos.Write(marshal(t, "ADDED", &Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "default", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}))
+	<-rl.ask
+	// The watched namespace is that of the deleted Foo, which has
+	// only a name.
+	foos.Write([]byte(`{"type": "DELETED", "object": {"metadata": {"name": "abc"},
+		"spec": "bad"}}`))
+	<-rl.ask
+	s, err := controller.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Primaries) != 0 || !reflect.DeepEqual(s.Todo, []string{"default/abc"}) {
+		t.Errorf("Wrong snapshot after the delete: %+v", s)
+	}
+
+	stopController(t, controller)
+}
+
+func TestDeploymentNameConflict(t *testing.T) {
+	client, server, foos, _ := startTestServer(t)
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(FooConfig(client), rl, "default")
+
+	posts := make(chan *appsv1.Deployment, 2)
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		func(req *http.Request) (*http.Response, error) {
+			dep := &appsv1.Deployment{}
+			if err := json.NewDecoder(req.Body).Decode(dep); err != nil {
+				t.Fatal("Could not decode deployment: ", err)
+			}
+			posts <- dep
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+	statuses := make(chan *Foo, 10)
+	server.RegisterResponder("PUT",
+		"/apis/samplecontroller.example.com/v1alpha1/namespaces/xyz/foos/other/status",
+		func(req *http.Request) (*http.Response, error) {
+			updated := &Foo{}
+			if err := json.NewDecoder(req.Body).Decode(updated); err != nil {
+				t.Fatal("Could not decode foo: ", err)
+			}
+			statuses <- updated
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+	reasons := make(chan string, 10)
+	server.RegisterResponder("POST", "/api/v1/namespaces/xyz/events",
+		func(req *http.Request) (*http.Response, error) {
+			event := &corev1.Event{}
+			if err := json.NewDecoder(req.Body).Decode(event); err != nil {
+				t.Fatal("Could not decode event: ", err)
+			}
+			reasons <- event.InvolvedObject.Name + ":" + event.Reason
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+
+	// Both want Deployment bar, the oldest gets it.
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	winner := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234",
+			CreationTimestamp: metav1.NewTime(created)},
+		Spec: FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	loser := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "xyz", UID: "5678",
+			CreationTimestamp: metav1.NewTime(created.Add(time.Hour))},
+		Spec: FooSpec{DeploymentName: "bar", Replicas: 2},
+	}
+	// Not rl.step, which could swallow the ask of the second Foo.
+	foos.Write(marshal(t, "ADDED", &loser))
+	<-rl.ask
+	foos.Write(marshal(t, "ADDED", &winner))
+	<-rl.ask
+	rl.tick <- struct{}{}
+	deployment := <-posts
+	if !metav1.IsControlledBy(deployment, &winner) {
+		t.Error("The Deployment is not controlled by the winner: ",
+			deployment.OwnerReferences)
+	}
+	updated := <-statuses
+	cond := meta.FindStatusCondition(updated.Status.Conditions, ConditionDegraded)
+	if cond == nil || cond.Status != metav1.ConditionTrue ||
+		cond.Reason != ReasonDeploymentNameConflict ||
+		cond.Message != "DeploymentName conflict with Foo abc" {
+		t.Error("Wrong Degraded condition: ", cond)
+	}
+	for reason := range reasons {
+		if reason == "other:"+ReasonNameConflict {
+			break
+		}
+		if strings.HasPrefix(reason, "other:") {
+			t.Error("Unexpected event: ", reason)
+		}
+	}
+
+	// Once the winner is gone, the loser gets the Deployment.
+	foos.Write(marshal(t, "DELETED", &winner))
+	rl.step()
+	deployment = <-posts
+	if !metav1.IsControlledBy(deployment, &loser) || *deployment.Spec.Replicas != 2 {
+		t.Error("Wrong Deployment: ", deployment.OwnerReferences, *deployment.Spec.Replicas)
+	}
+	stopController(t, controller)
+	if len(posts) != 0 {
+		t.Error("Unexpected Deployment: ", <-posts)
+	}
+}
+
+func TestValidateFoo(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		spec FooSpec
+		err  string
+	}{
+		{"valid", FooSpec{DeploymentName: "bar.baz-1", Replicas: 1}, ""},
+		{"no replicas", FooSpec{DeploymentName: "bar", Replicas: 0}, ""},
+		{"max replicas", FooSpec{DeploymentName: "bar", Replicas: 10}, ""},
+		{"empty name", FooSpec{Replicas: 1}, `Invalid deploymentName ""`},
+		{"upper case name", FooSpec{DeploymentName: "Bar", Replicas: 1},
+			`Invalid deploymentName "Bar"`},
+		{"underscore in name", FooSpec{DeploymentName: "bar_baz", Replicas: 1},
+			`Invalid deploymentName "bar_baz"`},
+		{"long name", FooSpec{DeploymentName: strings.Repeat("a", 254), Replicas: 1},
+			"Invalid deploymentName"},
+		{"negative replicas", FooSpec{DeploymentName: "bar", Replicas: -1},
+			"Invalid replicas -1: must be between 0 and 10"},
+		{"too many replicas", FooSpec{DeploymentName: "bar", Replicas: 11},
+			"Invalid replicas 11: must be between 0 and 10"},
+		{"external replicas", FooSpec{DeploymentName: "bar", Replicas: 11,
+			ExternalReplicas: true}, ""},
+	} {
+		err := FooValidator(10)(&Foo{Spec: test.spec})
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		case test.err != "" && (err == nil || !strings.HasPrefix(err.Error(), test.err)):
+			t.Errorf("%s: got error %v, want %s", test.name, err, test.err)
+		}
+	}
+}
+
+func TestInvalidFoo(t *testing.T) {
+	controller, server, foos, _ := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+	statuses := make(chan *Foo, 1)
+	server.RegisterResponder("PUT",
+		"/apis/samplecontroller.example.com/v1alpha1/namespaces/xyz/foos/abc/status",
+		func(req *http.Request) (*http.Response, error) {
+			updated := &Foo{}
+			if err := json.NewDecoder(req.Body).Decode(updated); err != nil {
+				t.Error("Could not decode foo: ", err)
+			}
+			statuses <- updated
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+	reasons := make(chan string, 1)
+	server.RegisterResponder("POST", "/api/v1/namespaces/xyz/events",
+		func(req *http.Request) (*http.Response, error) {
+			event := &corev1.Event{}
+			if err := json.NewDecoder(req.Body).Decode(event); err != nil {
+				t.Error("Could not decode event: ", err)
+			}
+			reasons <- event.Reason
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+
+	// No Deployment is created, as there is no POST responder.
+	foos.Write(marshal(t, "ADDED", &Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "Bar", Replicas: 1},
+	}))
+	rl.step()
+	if reason := <-reasons; reason != ReasonInvalid {
+		t.Errorf("Got event %s, want %s", reason, ReasonInvalid)
+	}
+	updated := <-statuses
+	cond := meta.FindStatusCondition(updated.Status.Conditions, ConditionDegraded)
+	if cond == nil || cond.Status != metav1.ConditionTrue || cond.Reason != ReasonInvalidSpec ||
+		!strings.HasPrefix(cond.Message, `Invalid deploymentName "Bar"`) {
+		t.Error("Wrong Degraded condition: ", cond)
+	}
+
+	stopController(t, controller)
+}
+
+func TestFooDeletedDuringReconcile(t *testing.T) {
+	controller, server, foos, _ := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	// The Foo is deleted after the watch reported it, but before we
+	// hear about the deletion.
+	gets := make(chan struct{}, 1)
+	server.RegisterResponder("GET",
+		"/apis/samplecontroller.example.com/v1alpha1/namespaces/xyz/foos/abc",
+		func(req *http.Request) (*http.Response, error) {
+			gets <- struct{}{}
+			return httpmock.NewStringResponse(404, ""), nil
+		})
+	posts := make(chan struct{}, 1)
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		func(req *http.Request) (*http.Response, error) {
+			posts <- struct{}{}
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+
+	stopController(t, controller)
+	if len(gets) != 1 {
+		t.Error("The Foo was not checked before creating its Deployment")
+	}
+	if len(posts) != 0 {
+		t.Error("A Deployment was created for a deleted Foo")
+	}
+}
+
+func TestFooRecreated(t *testing.T) {
+	controller, server, foos, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+	recorded := make(chan *corev1.Event, 4)
+	server.RegisterResponder("POST", "/api/v1/namespaces/xyz/events",
+		func(req *http.Request) (*http.Response, error) {
+			event := &corev1.Event{}
+			if err := json.NewDecoder(req.Body).Decode(event); err != nil {
+				t.Error("Could not decode event: ", err)
+			}
+			recorded <- event
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+	writes := make(chan *appsv1.Deployment, 1)
+	write := func(req *http.Request) (*http.Response, error) {
+		deployment := &appsv1.Deployment{}
+		if err := json.NewDecoder(req.Body).Decode(deployment); err != nil {
+			t.Error("Could not decode deployment: ", err)
+		}
+		writes <- deployment
+		return httpmock.NewStringResponse(201, ""), nil
+	}
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments", write)
+	server.RegisterResponder("PUT", "/apis/apps/v1/namespaces/xyz/deployments/bar", write)
+
+	// The Foo was deleted and created again, before the garbage
+	// collector deleted the Deployment of the previous one.
+	old := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "old"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	foo := old
+	foo.UID = "new"
+	stale := newDeployment(&old)
+	deployments.Write(marshal(t, "ADDED", stale))
+	<-rl.ask
+	foos.Write(marshal(t, "ADDED", &foo))
+	<-rl.ask
+	rl.tick <- struct{}{}
+	event := <-recorded
+	if event.Reason != ReasonOwnershipConflict || !strings.HasPrefix(event.Message,
+		"Deployment bar is controlled by a previous Foo with the same name") {
+		t.Error("Wrong event: ", event.Reason, event.Message)
+	}
+
+	// Once it is gone, the Foo gets its own.
+	deployments.Write(marshal(t, "DELETED", stale))
+	rl.step()
+	deployment := <-writes
+	if !metav1.IsControlledBy(deployment, &foo) {
+		t.Error("Wrong owner: ", deployment.OwnerReferences)
+	}
+
+	// Without BlockOwnerDeletion, the controller reference is fixed.
+	no := false
+	deployment.OwnerReferences[0].BlockOwnerDeletion = &no
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+	deployment = <-writes
+	if ref := metav1.GetControllerOf(deployment); ref == nil || ref.UID != "new" ||
+		ref.BlockOwnerDeletion == nil || !*ref.BlockOwnerDeletion {
+		t.Error("Wrong controller reference: ", deployment.OwnerReferences)
+	}
+
+	stopController(t, controller)
+	if len(writes) != 0 {
+		t.Error("Unexpected write: ", (<-writes).OwnerReferences)
+	}
+}
+
+func TestDeleteLeftover(t *testing.T) {
+	controller, server, foos, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+	deletes := make(chan struct{}, 1)
+	server.RegisterResponder("DELETE", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		func(req *http.Request) (*http.Response, error) {
+			deletes <- struct{}{}
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	foos.Write(marshal(t, "ADDED", &foo))
+	<-rl.ask
+	deployments.Write(marshal(t, "ADDED", newDeployment(&foo)))
+	<-rl.ask
+	rl.tick <- struct{}{}
+
+	// The Deployment is deleted once the Foo is, without waiting for
+	// the garbage collector.
+	foos.Write(marshal(t, "DELETED", &foo))
+	rl.step()
+	select {
+	case <-deletes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The Deployment of the deleted Foo was not deleted")
+	}
+
+	stopController(t, controller)
+}
+
+func TestAllNamespaces(t *testing.T) {
+	client, server, _, _ := startTestServer(t)
+	foos := addPipeResponder(server, `=~^/apis/samplecontroller\.example\.com/v1alpha1/foos`)
+	deployments := addPipeResponder(server, `=~^/apis/apps/v1/deployments`)
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewController(client, rl, "")
+
+	// Two Foos with the same name own Deployments with the same
+	// name, in different namespaces.
+	posts := make(chan *appsv1.Deployment, 2)
+	namespaced := []Foo{
+		{ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "one", UID: "1111"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "two", UID: "2222"}},
+	}
+	for i := range namespaced {
+		foo := &namespaced[i]
+		foo.Spec = FooSpec{DeploymentName: "bar", Replicas: 1}
+		namespace := foo.Namespace
+		server.RegisterResponder("GET",
+			"/apis/samplecontroller.example.com/v1alpha1/namespaces/"+namespace+"/foos/abc",
+			httpmock.NewJsonResponderOrPanic(200, foo))
+		server.RegisterResponder("POST", "/apis/apps/v1/namespaces/"+namespace+"/deployments",
+			func(req *http.Request) (*http.Response, error) {
+				deployment := &appsv1.Deployment{}
+				if err := json.NewDecoder(req.Body).Decode(deployment); err != nil {
+					t.Fatal("Could not decode deployment: ", err)
+				}
+				posts <- deployment
+				return httpmock.NewStringResponse(201, ""), nil
+			})
+	}
+
+	for _, foo := range namespaced {
+		foos.Write(marshal(t, "ADDED", &foo))
+		rl.step()
+		deployment := <-posts
+		if deployment.Namespace != foo.Namespace || deployment.Name != "bar" ||
+			deployment.OwnerReferences[0].UID != foo.UID {
+			t.Error("Wrong deployment: ", deployment.ObjectMeta)
+		}
+	}
+
+	// Each Deployment is seen as that of its Foo.
+	for _, foo := range namespaced {
+		deployments.Write(marshal(t, "ADDED", newDeployment(&foo)))
+		rl.step()
+	}
+	puts := make(chan struct{}, 1)
+	server.RegisterResponder("PUT", "/apis/apps/v1/namespaces/one/deployments/bar",
+		func(req *http.Request) (*http.Response, error) {
+			puts <- struct{}{}
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+	namespaced[0].Spec.Replicas = 2
+	foos.Write(marshal(t, "MODIFIED", &namespaced[0]))
+	rl.step()
+	<-puts
+
+	stopController(t, controller)
+	if len(posts) != 0 {
+		t.Error("Unexpected deployment: ", (<-posts).ObjectMeta)
+	}
+}
+
+type logEntry struct {
+	level  string
+	err    error
+	msg    string
+	fields map[string]interface{}
+}
+
+// testLogger is a Logger that records what is logged.
+type testLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+func (l *testLogger) add(level string, err error, msg string, keysAndValues []interface{}) {
+	fields := make(map[string]interface{})
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fields[keysAndValues[i].(string)] = keysAndValues[i+1]
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, logEntry{level, err, msg, fields})
+}
+
+func (l *testLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.add("info", nil, msg, keysAndValues)
+}
+
+func (l *testLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	l.add("error", err, msg, keysAndValues)
+}
+
+func (l *testLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.add("debug", nil, msg, keysAndValues)
+}
+
+func TestLogger(t *testing.T) {
+	client, server, foos, deployments := startTestServer(t)
+	config := FooConfig(client)
+	config.CollisionPolicy = CollisionFail
+	logger := &testLogger{}
+	config.Logger = logger
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(config, rl, "default")
+	server.RegisterResponder("PUT",
+		"/apis/samplecontroller.example.com/v1alpha1/namespaces/xyz/foos/abc/status",
+		httpmock.NewStringResponder(200, ""))
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	deployment := newDeployment(&foo)
+	deployment.OwnerReferences = nil
+	deployments.Write(marshal(t, "ADDED", deployment))
+	deployments.Write(marshal(t, "ADDED", deployment))
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	// The synchronization is done once the controller stops.
+	stopController(t, controller)
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	for _, e := range logger.entries {
+		if e.level != "error" || e.msg != "Not owned by us, giving up" {
+			continue
+		}
+		if e.err == nil || e.err.Error() != "Deployment bar already exists and has no controller" {
+			t.Error("Wrong error: ", e.err)
+		}
+		expected := map[string]interface{}{"kind": "Foo", "namespace": "xyz", "name": "abc",
+			"ownedKind": "Deployment", "ownedName": "bar"}
+		for k, v := range expected {
+			if e.fields[k] != v {
+				t.Errorf("Wrong %s: %v", k, e.fields[k])
+			}
+		}
+		if id, _ := e.fields["reconcileID"].(string); id == "" {
+			t.Error("Missing reconcileID")
+		}
+		return
+	}
+	t.Error("The conflict was not logged: ", logger.entries)
+}
+
+func TestFormatLog(t *testing.T) {
+	got := formatLog("Synchronize failed", []interface{}{"namespace", "xyz", "count", 3, "odd"})
+	if expected := "Synchronize failed namespace=xyz count=3 odd=<missing>"; got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	client, server, foos, deployments := startTestServer(t)
+	config := FooConfig(client)
+	config.DryRun = true
+	config.Finalizer = "samplecontroller.example.com/cleanup"
+	logger := &testLogger{}
+	config.Logger = logger
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(config, rl, "default")
+
+	created := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	updated := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "def", Namespace: "xyz", UID: "5678"},
+		Spec:       FooSpec{DeploymentName: "baz", Replicas: 1},
+	}
+	// Each event asks for a tick, which is only given once the
+	// controller knows about all of them.
+	deployments.Write(marshal(t, "ADDED", newDeployment(&updated)))
+	<-rl.ask
+	updated.Spec.Replicas = 3
+	foos.Write(marshal(t, "ADDED", &updated))
+	<-rl.ask
+	foos.Write(marshal(t, "ADDED", &created))
+	<-rl.ask
+	rl.tick <- struct{}{}
+	stopController(t, controller)
+
+	for route, n := range server.GetCallCountInfo() {
+		if n != 0 && !strings.HasPrefix(route, "GET ") {
+			t.Errorf("Expected no writes, got %d %s", n, route)
+		}
+	}
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	var create, update bool
+	for _, e := range logger.entries {
+		switch {
+		case e.msg == "Would create" && e.fields["name"] == "bar":
+			create = true
+		case e.msg == "Would update" && e.fields["ownedName"] == "baz":
+			update = true
+			diff, _ := e.fields["diff"].([]string)
+			found := false
+			for _, d := range diff {
+				found = found || d == "spec.replicas: 1 -> 3"
+			}
+			if !found {
+				t.Errorf("Wrong diff: %q", diff)
+			}
+		}
+	}
+	if !create || !update {
+		t.Error("The changes were not logged: ", logger.entries)
+	}
+}
+
+func TestObjectDiff(t *testing.T) {
+	existing := map[string]interface{}{"spec": map[string]interface{}{"replicas": 1,
+		"paused": true}, "status": map[string]interface{}{"replicas": 1}}
+	desired := map[string]interface{}{"spec": map[string]interface{}{"replicas": 3,
+		"paused": true, "image": "nginx"}}
+	diff, err := objectDiff(existing, desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{`spec.image: <none> -> "nginx"`, "spec.replicas: 1 -> 3"}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Expected %q, got %q", expected, diff)
+	}
+}
+
+func TestCollisionPolicy(t *testing.T) {
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	isController := true
+	other := metav1.OwnerReference{APIVersion: "example.com/v1", Kind: "Other",
+		Name: "other", UID: "5678", Controller: &isController}
+
+	start := func(policy CollisionPolicy, refs []metav1.OwnerReference) (*Controller,
+		*httpmock.MockTransport, *testRateLimiter) {
+		client, server, foos, deployments := startTestServer(t)
+		config := FooConfig(client)
+		config.CollisionPolicy = policy
+		rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+		controller := NewGenericController(config, rl, "default")
+
+		deployment := newDeployment(&foo)
+		deployment.OwnerReferences = refs
+		deployment.Spec.Selector = &metav1.LabelSelector{
+			MatchLabels: map[string]string{"controller": "abc", "app": "web"},
+		}
+		deployment.Spec.Template.Labels = map[string]string{"controller": "abc", "app": "web"}
+		// The Deployment is not ours, so it doesn't ask for a
+		// tick. The second write only returns once the
+		// controller has received the first one.
+		deployments.Write(marshal(t, "ADDED", deployment))
+		deployments.Write(marshal(t, "ADDED", deployment))
+		foos.Write(marshal(t, "ADDED", &foo))
+		return controller, server, rl
+	}
+
+	fail := func(t *testing.T, policy CollisionPolicy, refs []metav1.OwnerReference,
+		message string) {
+		controller, server, rl := start(policy, refs)
+		statuses := make(chan *Foo, 1)
+		server.RegisterResponder("PUT",
+			"/apis/samplecontroller.example.com/v1alpha1/namespaces/xyz/foos/abc/status",
+			func(req *http.Request) (*http.Response, error) {
+				updated := &Foo{}
+				if err := json.NewDecoder(req.Body).Decode(updated); err != nil {
+					t.Fatal("Could not decode foo: ", err)
+				}
+				statuses <- updated
+				return httpmock.NewStringResponse(200, ""), nil
+			})
+		rl.step()
+		updated := <-statuses
+		if len(updated.Status.Conditions) != 1 ||
+			updated.Status.Conditions[0].Reason != ReasonDeploymentNotOwned ||
+			updated.Status.Conditions[0].Message != message {
+			t.Error("Wrong conditions: ", updated.Status.Conditions)
+		}
+		stopController(t, controller)
+	}
+	t.Run("Fail", func(t *testing.T) {
+		fail(t, CollisionFail, []metav1.OwnerReference{other},
+			"Deployment bar is controlled by something else")
+	})
+	t.Run("FailOrphan", func(t *testing.T) {
+		fail(t, CollisionFail, nil, "Deployment bar already exists and has no controller")
+	})
+	t.Run("AdoptOrphansControlled", func(t *testing.T) {
+		fail(t, CollisionAdoptOrphans, []metav1.OwnerReference{other},
+			"Deployment bar is controlled by something else")
+	})
+
+	t.Run("ForceAdoptIncompatible", func(t *testing.T) {
+		client, _, foos, deployments := startTestServer(t)
+		config := FooConfig(client)
+		config.CollisionPolicy = CollisionForceAdopt
+		recorder := events.NewFakeRecorder(1)
+		config.Recorder = recorder
+		rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+		controller := NewGenericController(config, rl, "default")
+
+		// This selector would not select the pods we create.
+		deployment := newDeployment(&foo)
+		deployment.OwnerReferences = []metav1.OwnerReference{other}
+		deployment.Spec.Selector = &metav1.LabelSelector{
+			MatchLabels: map[string]string{"controller": "other"},
+		}
+		deployment.Spec.Template.Labels = map[string]string{"controller": "other"}
+		deployments.Write(marshal(t, "ADDED", deployment))
+		deployments.Write(marshal(t, "ADDED", deployment))
+		foos.Write(marshal(t, "ADDED", &foo))
+		rl.step()
+
+		event := <-recorder.Events
+		if event.Type != corev1.EventTypeWarning || event.Reason != "AdoptionRefused" {
+			t.Error("Wrong event: ", event)
+		}
+		stopController(t, controller)
+	})
+
+	adopt := func(t *testing.T, policy CollisionPolicy, refs []metav1.OwnerReference) {
+		controller, server, rl := start(policy, refs)
+		puts := make(chan *appsv1.Deployment, 1)
+		server.RegisterResponder("PUT", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+			func(req *http.Request) (*http.Response, error) {
+				dep := &appsv1.Deployment{}
+				if err := json.NewDecoder(req.Body).Decode(dep); err != nil {
+					t.Fatal("Could not decode deployment: ", err)
+				}
+				puts <- dep
+				return httpmock.NewStringResponse(200, ""), nil
+			})
+		rl.step()
+		dep := <-puts
+		owner := metav1.GetControllerOf(dep)
+		if owner == nil || owner.UID != foo.UID || len(dep.OwnerReferences) != 1 {
+			t.Error("Wrong OwnerReferences: ", dep.OwnerReferences)
+		}
+		// The existing selector is kept, and the pod labels still
+		// match it.
+		sel := dep.Spec.Selector
+		if len(sel.MatchLabels) != 2 || sel.MatchLabels["app"] != "web" ||
+			dep.Spec.Template.Labels["app"] != "web" ||
+			dep.Spec.Template.Labels["controller"] != "abc" {
+			t.Error("Wrong labels: ", sel.MatchLabels, dep.Spec.Template.Labels)
+		}
+		stopController(t, controller)
+	}
+	t.Run("ForceAdopt", func(t *testing.T) {
+		adopt(t, CollisionForceAdopt, []metav1.OwnerReference{other})
+	})
+	t.Run("AdoptOrphans", func(t *testing.T) {
+		notController := metav1.OwnerReference{APIVersion: "example.com/v1", Kind: "Other",
+			Name: "other", UID: "5678"}
+		adopt(t, CollisionAdoptOrphans, []metav1.OwnerReference{notController})
+	})
+}
+
+func TestUnknownStatusFields(t *testing.T) {
+	controller, server, foos, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+
+	// Written by a newer version of the controller.
+	data := `{
+		"metadata": {"name": "abc", "namespace": "xyz", "uid": "1234"},
+		"spec": {"deploymentName": "bar", "replicas": 1},
+		"status": {"conditions": [], "future": {"a": [1, 2]}}
+	}`
+	foo := &Foo{}
+	if err := json.Unmarshal([]byte(data), foo); err != nil {
+		t.Fatal("Could not decode foo: ", err)
+	}
+
+	statuses := make(chan map[string]json.RawMessage, 1)
+	server.RegisterResponder("PUT",
+		"/apis/samplecontroller.example.com/v1alpha1/namespaces/xyz/foos/abc/status",
+		func(req *http.Request) (*http.Response, error) {
+			var updated struct {
+				Status map[string]json.RawMessage `json:"status"`
+			}
+			if err := json.NewDecoder(req.Body).Decode(&updated); err != nil {
+				t.Fatal("Could not decode foo: ", err)
+			}
+			statuses <- updated.Status
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	deployments.Write(marshal(t, "ADDED", newDeployment(foo)))
+	rl.step()
+	foos.Write(marshal(t, "ADDED", json.RawMessage(data)))
+	rl.step()
+
+	status := <-statuses
+	if string(status["future"]) != `{"a":[1,2]}` {
+		t.Errorf("Unknown field not preserved: %s", status["future"])
+	}
+	var conditions []metav1.Condition
+	if err := json.Unmarshal(status["conditions"], &conditions); err != nil ||
+		len(conditions) != 2 || conditions[0].Type != ConditionReady ||
+		conditions[1].Type != ConditionProgressing {
+		t.Errorf("Wrong conditions: %s", status["conditions"])
+	}
+
+	stopController(t, controller)
+}
+
+func TestAvailableReplicas(t *testing.T) {
+	controller, server, foos, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234",
+			ResourceVersion: "1"},
+		Spec: FooSpec{DeploymentName: "bar", Replicas: 2},
+	}
+	deployment := newDeployment(&foo)
+	deployment.Status.AvailableReplicas = 2
+
+	// The Foo changed after we heard about it, so the first status
+	// update conflicts and the Foo is fetched again.
+	latest := foo
+	latest.ResourceVersion = "7"
+	server.RegisterResponder("GET",
+		"/apis/samplecontroller.example.com/v1alpha1/namespaces/xyz/foos/abc",
+		httpmock.NewJsonResponderOrPanic(200, &latest))
+	statuses := make(chan *Foo, 2)
+	server.RegisterResponder("PUT",
+		"/apis/samplecontroller.example.com/v1alpha1/namespaces/xyz/foos/abc/status",
+		func(req *http.Request) (*http.Response, error) {
+			updated := &Foo{}
+			if err := json.NewDecoder(req.Body).Decode(updated); err != nil {
+				t.Fatal("Could not decode foo: ", err)
+			}
+			statuses <- updated
+			if updated.ResourceVersion == "1" {
+				return httpmock.NewStringResponse(409, ""), nil
+			}
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+
+	if updated := <-statuses; updated.ResourceVersion != "1" {
+		t.Error("Wrong first update: ", updated.ResourceVersion)
+	}
+	updated := <-statuses
+	if updated.ResourceVersion != "7" || updated.Status.AvailableReplicas != 2 {
+		t.Error("Wrong status update: ", updated.ResourceVersion, updated.Status)
+	}
+
+	stopController(t, controller)
+}
+
+func TestAvailabilityStatus(t *testing.T) {
+	controller, server, foos, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234",
+			ResourceVersion: "1", Generation: 1},
+		Spec: FooSpec{DeploymentName: "bar", Replicas: 2},
+	}
+	deployment := newDeployment(&foo)
+	statuses := make(chan *Foo, 2)
+	server.RegisterResponder("PUT",
+		"/apis/samplecontroller.example.com/v1alpha1/namespaces/xyz/foos/abc/status",
+		func(req *http.Request) (*http.Response, error) {
+			updated := &Foo{}
+			if err := json.NewDecoder(req.Body).Decode(updated); err != nil {
+				t.Fatal("Could not decode foo: ", err)
+			}
+			statuses <- updated
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	updated := <-statuses
+	if ready := meta.FindStatusCondition(updated.Status.Conditions, ConditionReady); ready == nil ||
+		ready.Status != metav1.ConditionFalse || updated.Status.AvailableReplicas != 0 {
+		t.Error("Wrong status: ", updated.Status)
+	}
+
+	// The Foo follows the availability of its Deployment.
+	deployment.Status.AvailableReplicas = 2
+	deployments.Write(marshal(t, "MODIFIED", deployment))
+	rl.step()
+	updated = <-statuses
+	if ready := meta.FindStatusCondition(updated.Status.Conditions, ConditionReady); ready == nil ||
+		ready.Status != metav1.ConditionTrue || updated.Status.AvailableReplicas != 2 {
+		t.Error("Wrong status: ", updated.Status)
+	}
+
+	// Our status update is not synchronized again, unlike the Foo
+	// added after it.
+	updated.ResourceVersion = "2"
+	foos.Write(marshal(t, "MODIFIED", updated))
+	other := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "def", Namespace: "xyz", UID: "5678",
+			ResourceVersion: "3", Generation: 1},
+		Spec: FooSpec{DeploymentName: "baz", Replicas: 1},
+	}
+	foos.Write(marshal(t, "ADDED", &other))
+	<-rl.ask
+	stopDrain := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-rl.ask:
+			case <-stopDrain:
+				return
+			}
+		}
+	}()
+	snapshot, err := controller.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(snapshot.Todo, []string{"xyz/def"}) {
+		t.Error("Wrong items to synchronize: ", snapshot.Todo)
+	}
+
+	stopController(t, controller)
+	close(stopDrain)
+}
+
+func TestRetryFailed(t *testing.T) {
+	client, server, foos, deployments := startTestServer(t)
+	config := FooConfig(client)
+	config.MaxRetries = 2
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(config, rl, "default")
+
+	failing := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	healthy := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "def", Namespace: "xyz"},
+		Spec:       FooSpec{DeploymentName: "zed", Replicas: 1},
+	}
+	posts := make(chan string, 2)
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		func(req *http.Request) (*http.Response, error) {
+			dep := &appsv1.Deployment{}
+			if err := json.NewDecoder(req.Body).Decode(dep); err != nil {
+				t.Fatal("Could not decode deployment: ", err)
+			}
+			resp := httpmock.NewStringResponse(429, "slow down")
+			// Much longer than the test
+			resp.Header.Set("Retry-After", "3600")
+			posts <- dep.Name
+			return resp, nil
+		})
+
+	deployments.Write(marshal(t, "ADDED", newDeployment(&healthy)))
+	rl.step()
+	foos.Write(marshal(t, "ADDED", &healthy))
+	rl.step()
+	foos.Write(marshal(t, "ADDED", &failing))
+	rl.step()
+	if name := <-posts; name != "bar" {
+		t.Error("Wrong deployment: ", name)
+	}
+
+	// Only the failing item is retried, without waiting for the
+	// Retry-After delay.
+	if err := controller.RetryFailed(); err != nil {
+		t.Error(err)
+	}
+	rl.step()
+	if name := <-posts; name != "bar" {
+		t.Error("Wrong deployment: ", name)
+	}
+
+	stopController(t, controller)
+	if len(posts) != 0 {
+		t.Error("Unexpected deployment: ", <-posts)
+	}
+	if len(controller.DeadLetters()) != 0 {
+		t.Error("The failure count was not reset")
+	}
+}
+
+func TestPodAnnotations(t *testing.T) {
+	controller, server, foos, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec: FooSpec{DeploymentName: "bar", Replicas: 1, PodAnnotations: map[string]string{
+			"prometheus.io/scrape": "true",
+			"prometheus.io/port":   "8080",
+		}},
+	}
+	restartedAt := "kubectl.kubernetes.io/restartedAt"
+	deployment := newDeployment(&foo)
+	deployment.Spec.Template.Annotations = map[string]string{
+		"prometheus.io/scrape": "false",
+		restartedAt:            "2021-01-01T00:00:00Z",
+	}
+
+	puts := make(chan *appsv1.Deployment, 1)
+	server.RegisterResponder("PUT", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		func(req *http.Request) (*http.Response, error) {
+			dep := &appsv1.Deployment{}
+			if err := json.NewDecoder(req.Body).Decode(dep); err != nil {
+				t.Fatal("Could not decode deployment: ", err)
+			}
+			puts <- dep
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+
+	deployment = <-puts
+	annotations := deployment.Spec.Template.Annotations
+	if len(annotations) != 3 || annotations["prometheus.io/scrape"] != "true" ||
+		annotations["prometheus.io/port"] != "8080" ||
+		annotations[restartedAt] != "2021-01-01T00:00:00Z" {
+		t.Error("Wrong annotations: ", annotations)
+	}
+
+	// A restart doesn't make the Deployment differ from the Foo.
+	deployment.Spec.Template.Annotations[restartedAt] = "2021-01-02T00:00:00Z"
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+
+	stopController(t, controller)
+	if len(puts) != 0 {
+		t.Error("Unexpected update: ", (<-puts).Spec.Template.Annotations)
+	}
+}
+
+func TestPodLabels(t *testing.T) {
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec: FooSpec{DeploymentName: "bar", Replicas: 1, PodLabels: map[string]string{
+			"app":        "web",
+			"controller": "other",
+		}},
+	}
+	deployment := newDeployment(&foo)
+	expected := map[string]string{"controller": "abc", FooUIDLabel: "1234"}
+	if sel := deployment.Spec.Selector.MatchLabels; !reflect.DeepEqual(sel, expected) {
+		t.Error("Wrong selector: ", sel)
+	}
+	expected["app"] = "web"
+	if labels := deployment.Spec.Template.Labels; !reflect.DeepEqual(labels, expected) {
+		t.Error("Wrong pod labels: ", labels)
+	}
+
+	controller, server, foos, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+	puts := make(chan *appsv1.Deployment, 1)
+	server.RegisterResponder("PUT", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		func(req *http.Request) (*http.Response, error) {
+			dep := &appsv1.Deployment{}
+			if err := json.NewDecoder(req.Body).Decode(dep); err != nil {
+				t.Fatal("Could not decode deployment: ", err)
+			}
+			puts <- dep
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	// A Deployment created before the selector had the UID keeps its
+	// selector when the pod labels change.
+	old := newDeployment(&foo)
+	old.Spec.Selector = &metav1.LabelSelector{
+		MatchLabels: map[string]string{"controller": "abc"}}
+	old.Spec.Template.Labels = map[string]string{"controller": "abc"}
+	old.Annotations[SpecHashAnnotation] = specHash(old)
+	deployments.Write(marshal(t, "ADDED", old))
+	rl.step()
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	stopController(t, controller)
+
+	deployment = <-puts
+	sel := deployment.Spec.Selector.MatchLabels
+	if !reflect.DeepEqual(sel, old.Spec.Selector.MatchLabels) {
+		t.Error("The selector changed: ", sel)
+	}
+	if labels := deployment.Spec.Template.Labels; !reflect.DeepEqual(labels, expected) {
+		t.Error("Wrong pod labels: ", labels)
+	}
+}
+
+func TestFooMetadata(t *testing.T) {
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234",
+			Labels: map[string]string{
+				"team":          "a",
+				"controller":    "other",
+				Group + "/mine": "x",
+			},
+			Annotations: map[string]string{
+				"cost-center": "42",
+				"kubectl.kubernetes.io/last-applied-configuration": "{}",
+				SpecHashAnnotation: "bogus",
+			},
+		},
+		Spec: FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	deployment := newDeployment(&foo)
+	if labels := deployment.Labels; !reflect.DeepEqual(labels, map[string]string{"team": "a"}) {
+		t.Error("Wrong labels: ", labels)
+	}
+	expected := map[string]string{"cost-center": "42", SpecHashAnnotation: specHash(deployment)}
+	if annotations := deployment.Annotations; !reflect.DeepEqual(annotations, expected) {
+		t.Error("Wrong annotations: ", annotations)
+	}
+
+	controller, server, foos, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+	puts := make(chan *appsv1.Deployment, 1)
+	server.RegisterResponder("PUT", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		func(req *http.Request) (*http.Response, error) {
+			dep := &appsv1.Deployment{}
+			if err := json.NewDecoder(req.Body).Decode(dep); err != nil {
+				t.Fatal("Could not decode deployment: ", err)
+			}
+			puts <- dep
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	// Labels others added don't make the Deployment differ.
+	deployment.Labels["extra"] = "1"
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+
+	// A changed label does.
+	foo.Labels["team"] = "b"
+	foos.Write(marshal(t, "MODIFIED", &foo))
+	rl.step()
+	stopController(t, controller)
+
+	deployment = <-puts
+	if team := deployment.Labels["team"]; team != "b" {
+		t.Errorf("Got team %q, want b", team)
+	}
+	if len(puts) != 0 {
+		t.Error("Unexpected update: ", (<-puts).Labels)
+	}
+}
+
+func TestContainerDefaults(t *testing.T) {
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	containers := newDeployment(&foo).Spec.Template.Spec.Containers
+	if len(containers) != 1 || containers[0].Name != DefaultContainerName ||
+		containers[0].Image != DefaultImage {
+		t.Error("Wrong default containers: ", containers)
+	}
+
+	foo.Spec.ContainerName = "web"
+	foo.Spec.Image = "httpd:2.4"
+	containers = newDeployment(&foo).Spec.Template.Spec.Containers
+	if len(containers) != 1 || containers[0].Name != "web" || containers[0].Image != "httpd:2.4" {
+		t.Error("Wrong containers: ", containers)
+	}
+}
+
+func TestImageChange(t *testing.T) {
+	controller, server, foos, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	deployment := newDeployment(&foo)
+
+	puts := make(chan *appsv1.Deployment, 1)
+	server.RegisterResponder("PUT", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		func(req *http.Request) (*http.Response, error) {
+			dep := &appsv1.Deployment{}
+			if err := json.NewDecoder(req.Body).Decode(dep); err != nil {
+				t.Fatal("Could not decode deployment: ", err)
+			}
+			puts <- dep
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+
+	// Only the image changes.
+	foo.Spec.Image = "nginx:1.19"
+	foos.Write(marshal(t, "MODIFIED", &foo))
+	rl.step()
+
+	deployment = <-puts
+	containers := deployment.Spec.Template.Spec.Containers
+	if len(containers) != 1 || containers[0].Name != DefaultContainerName ||
+		containers[0].Image != "nginx:1.19" {
+		t.Error("Wrong containers: ", containers)
+	}
+
+	// Once updated, the Deployment matches the Foo.
+	deployments.Write(marshal(t, "MODIFIED", deployment))
+	rl.step()
+
+	stopController(t, controller)
+	if len(puts) != 0 {
+		t.Error("Unexpected update: ", (<-puts).Spec.Template.Spec.Containers)
+	}
+}
+
+func TestUpdateConflict(t *testing.T) {
+	controller, server, foos, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	deployment := newDeployment(&foo)
+	deployment.ResourceVersion = "5"
+
+	// The first update is from a stale Deployment, which someone
+	// else updated since.
+	puts := make(chan *appsv1.Deployment, 2)
+	server.RegisterResponder("PUT", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		func(req *http.Request) (*http.Response, error) {
+			dep := &appsv1.Deployment{}
+			if err := json.NewDecoder(req.Body).Decode(dep); err != nil {
+				t.Error("Could not decode deployment: ", err)
+			}
+			puts <- dep
+			if dep.ResourceVersion != "6" {
+				return httpmock.NewStringResponse(409, ""), nil
+			}
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+	current := deployment.DeepCopy()
+	current.ResourceVersion = "6"
+	server.RegisterResponder("GET", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		httpmock.NewJsonResponderOrPanic(200, current))
+
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+
+	foo.Spec.Replicas = 2
+	foos.Write(marshal(t, "MODIFIED", &foo))
+	rl.step()
+	if dep := <-puts; dep.ResourceVersion != "5" {
+		t.Errorf("First update from version %s, want 5", dep.ResourceVersion)
+	}
+	// It is retried from the current Deployment.
+	dep := <-puts
+	if dep.ResourceVersion != "6" || *dep.Spec.Replicas != 2 {
+		t.Errorf("Wrong retry: version %s, %d replicas", dep.ResourceVersion,
+			*dep.Spec.Replicas)
+	}
+
+	stopController(t, controller)
+	if len(puts) != 0 {
+		t.Error("Unexpected update: ", (<-puts).ResourceVersion)
+	}
+}
+
+func TestReplicasPatch(t *testing.T) {
+	client, server, foos, deployments := startTestServer(t)
+	config := FooConfig(client)
+	config.MinimalPatch = ReplicasPatch
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(config, rl, "default")
+
+	patches := make(chan map[string]interface{}, 1)
+	server.RegisterResponder("PATCH", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		func(req *http.Request) (*http.Response, error) {
+			if ty := req.Header.Get("Content-Type"); ty != string(types.MergePatchType) {
+				t.Error("Wrong content type: ", ty)
+			}
+			var patch map[string]interface{}
+			if err := json.NewDecoder(req.Body).Decode(&patch); err != nil {
+				t.Error("Could not decode the patch: ", err)
+			}
+			patches <- patch
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+	puts := make(chan *appsv1.Deployment, 1)
+	server.RegisterResponder("PUT", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		func(req *http.Request) (*http.Response, error) {
+			dep := &appsv1.Deployment{}
+			if err := json.NewDecoder(req.Body).Decode(dep); err != nil {
+				t.Error("Could not decode deployment: ", err)
+			}
+			puts <- dep
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	deployments.Write(marshal(t, "ADDED", newDeployment(&foo)))
+	rl.step()
+
+	// Only the replicas change, so only they are patched.
+	foo.Spec.Replicas = 3
+	scaled := newDeployment(&foo)
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	expected := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				SpecHashAnnotation: scaled.Annotations[SpecHashAnnotation],
+			},
+		},
+		"spec": map[string]interface{}{"replicas": float64(3)},
+	}
+	if patch := <-patches; !reflect.DeepEqual(patch, expected) {
+		t.Errorf("Got patch %v, want %v", patch, expected)
+	}
+
+	// A new image is not only a replicas change.
+	foo.Spec.Image = "busybox"
+	foos.Write(marshal(t, "MODIFIED", &foo))
+	rl.step()
+	deployment := <-puts
+	if image := deployment.Spec.Template.Spec.Containers[0].Image; image != "busybox" ||
+		*deployment.Spec.Replicas != 3 {
+		t.Errorf("Wrong update: image %s, %d replicas", image, *deployment.Spec.Replicas)
+	}
+
+	stopController(t, controller)
+	if len(patches) != 0 {
+		t.Error("Unexpected patch: ", <-patches)
+	}
+}
+
+func TestResourcesChange(t *testing.T) {
+	controller, server, foos, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	deployment := newDeployment(&foo)
+	resources := deployment.Spec.Template.Spec.Containers[0].Resources
+	if len(resources.Limits) != 0 || len(resources.Requests) != 0 {
+		t.Error("Unexpected resources: ", resources)
+	}
+
+	puts := make(chan *appsv1.Deployment, 1)
+	server.RegisterResponder("PUT", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		func(req *http.Request) (*http.Response, error) {
+			dep := &appsv1.Deployment{}
+			if err := json.NewDecoder(req.Body).Decode(dep); err != nil {
+				t.Fatal("Could not decode deployment: ", err)
+			}
+			puts <- dep
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+
+	// Only the resources change.
+	foo.Spec.Resources = &corev1.ResourceRequirements{
+		Limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m")},
+	}
+	foos.Write(marshal(t, "MODIFIED", &foo))
+	rl.step()
+
+	deployment = <-puts
+	limits := deployment.Spec.Template.Spec.Containers[0].Resources.Limits
+	if cpu := limits[corev1.ResourceCPU]; len(limits) != 1 || cpu.String() != "500m" {
+		t.Error("Wrong limits: ", limits)
+	}
+
+	// Once updated, the Deployment matches the Foo.
+	deployments.Write(marshal(t, "MODIFIED", deployment))
+	rl.step()
+
+	stopController(t, controller)
+	if len(puts) != 0 {
+		t.Error("Unexpected update: ", (<-puts).Spec.Template.Spec.Containers)
+	}
+
+	// Quantities are compared by value.
+	existing := corev1.ResourceRequirements{
+		Limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("0.5")},
+	}
+	if !resourcesEqual(existing, *foo.Spec.Resources) {
+		t.Error("0.5 and 500m differ")
+	}
+	if !resourcesEqual(existing, corev1.ResourceRequirements{}) {
+		t.Error("Resources set by others were not left alone")
+	}
+}
+
+func TestImagePullSecrets(t *testing.T) {
+	controller, server, foos, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	deployment := newDeployment(&foo)
+	if spec := deployment.Spec.Template.Spec; spec.ImagePullSecrets != nil ||
+		spec.ServiceAccountName != "" {
+		t.Error("Unexpected pull secrets or service account: ", spec)
+	}
+
+	puts := make(chan *appsv1.Deployment, 1)
+	server.RegisterResponder("PUT", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		func(req *http.Request) (*http.Response, error) {
+			dep := &appsv1.Deployment{}
+			if err := json.NewDecoder(req.Body).Decode(dep); err != nil {
+				t.Fatal("Could not decode deployment: ", err)
+			}
+			puts <- dep
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	// Those others set are left alone.
+	deployment.Spec.Template.Spec.ServiceAccountName = "other"
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+
+	// Adding a pull secret and a service account updates the
+	// Deployment.
+	foo.Spec.ImagePullSecrets = []string{"regcred"}
+	foo.Spec.ServiceAccountName = "builder"
+	foos.Write(marshal(t, "MODIFIED", &foo))
+	rl.step()
+
+	deployment = <-puts
+	spec := deployment.Spec.Template.Spec
+	if want := []corev1.LocalObjectReference{{Name: "regcred"}}; !reflect.DeepEqual(
+		spec.ImagePullSecrets, want) || spec.ServiceAccountName != "builder" {
+		t.Errorf("Got pull secrets %v and service account %q, want %v and builder",
+			spec.ImagePullSecrets, spec.ServiceAccountName, want)
+	}
+
+	// Once updated, the Deployment matches the Foo.
+	deployments.Write(marshal(t, "MODIFIED", deployment))
+	rl.step()
+
+	stopController(t, controller)
+	if len(puts) != 0 {
+		t.Error("Unexpected update: ", (<-puts).Spec.Template.Spec)
+	}
+}
+
+func TestUpdateKeepsStrategy(t *testing.T) {
+	controller, server, foos, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+
+	puts := make(chan *appsv1.Deployment, 1)
+	server.RegisterResponder("PUT", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		func(req *http.Request) (*http.Response, error) {
+			dep := &appsv1.Deployment{}
+			if err := json.NewDecoder(req.Body).Decode(dep); err != nil {
+				t.Fatal("Could not decode deployment: ", err)
+			}
+			puts <- dep
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	// The rollout settings of the Deployment were set by someone
+	// else.
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	deployment := newDeployment(&foo)
+	maxSurge := intstr.FromInt(3)
+	history, deadline := int32(2), int32(100)
+	deployment.Spec.Strategy = appsv1.DeploymentStrategy{
+		Type:          appsv1.RollingUpdateDeploymentStrategyType,
+		RollingUpdate: &appsv1.RollingUpdateDeployment{MaxSurge: &maxSurge},
+	}
+	deployment.Spec.RevisionHistoryLimit = &history
+	deployment.Spec.ProgressDeadlineSeconds = &deadline
+	deployment.Spec.MinReadySeconds = 5
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+
+	// A new image updates the Deployment, keeping them.
+	foo.Spec.Image = "nginx:1.25"
+	foos.Write(marshal(t, "MODIFIED", &foo))
+	rl.step()
+	updated := <-puts
+	spec := updated.Spec
+	if image := spec.Template.Spec.Containers[0].Image; image != "nginx:1.25" {
+		t.Errorf("Got image %s, want nginx:1.25", image)
+	}
+	if !reflect.DeepEqual(spec.Strategy, deployment.Spec.Strategy) ||
+		*spec.RevisionHistoryLimit != history || *spec.ProgressDeadlineSeconds != deadline ||
+		spec.MinReadySeconds != 5 {
+		t.Errorf("The rollout settings were not kept: %+v", spec)
+	}
+
+	deployments.Write(marshal(t, "MODIFIED", updated))
+	rl.step()
+	stopController(t, controller)
+	if len(puts) != 0 {
+		t.Error("Unexpected update: ", (<-puts).Spec)
+	}
+}
+
+func TestUpdateApply(t *testing.T) {
+	client, server, foos, deployments := startTestServer(t)
+	config := FooConfig(client)
+	config.UpdateStrategy = UpdateApply
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(config, rl, "default")
+
+	type patch struct {
+		contentType string
+		query       url.Values
+		deployment  *appsv1.Deployment
+	}
+	patches := make(chan patch, 1)
+	server.RegisterResponder("PATCH", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		func(req *http.Request) (*http.Response, error) {
+			dep := &appsv1.Deployment{}
+			if err := json.NewDecoder(req.Body).Decode(dep); err != nil {
+				t.Fatal("Could not decode deployment: ", err)
+			}
+			patches <- patch{req.Header.Get("Content-Type"), req.URL.Query(), dep}
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	// An HPA scaled the Deployment.
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1, ExternalReplicas: true},
+	}
+	deployment := newDeployment(&foo)
+	if deployment.Spec.Replicas != nil {
+		t.Error("Unexpected replicas: ", *deployment.Spec.Replicas)
+	}
+	replicas := int32(5)
+	deployment.Spec.Replicas = &replicas
+	deployment.ResourceVersion = "42"
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+
+	// Only the image changes.
+	foo.Spec.Image = "nginx:1.19"
+	foos.Write(marshal(t, "MODIFIED", &foo))
+	rl.step()
+	stopController(t, controller)
+
+	p := <-patches
+	if p.contentType != kubeapi.ApplyPatchType {
+		t.Error("Wrong content type: ", p.contentType)
+	}
+	if p.query.Get("fieldManager") != FieldManager || p.query.Get("force") != "true" {
+		t.Error("Wrong query: ", p.query)
+	}
+	if p.deployment.APIVersion != "apps/v1" || p.deployment.Kind != "Deployment" ||
+		p.deployment.ResourceVersion != "" {
+		t.Error("Wrong patch: ", p.deployment.TypeMeta, p.deployment.ResourceVersion)
+	}
+	if image := p.deployment.Spec.Template.Spec.Containers[0].Image; image != "nginx:1.19" {
+		t.Error("Wrong image: ", image)
+	}
+	if r := p.deployment.Spec.Replicas; r == nil || *r != replicas {
+		t.Error("The replicas of the HPA were not kept: ", r)
+	}
+	if len(patches) != 0 {
+		t.Error("Unexpected patch: ", (<-patches).deployment.Spec)
+	}
+}
+
+func TestSpecHash(t *testing.T) {
+	controller, server, foos, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+
+	writes := make(chan *appsv1.Deployment, 1)
+	write := func(req *http.Request) (*http.Response, error) {
+		dep := &appsv1.Deployment{}
+		if err := json.NewDecoder(req.Body).Decode(dep); err != nil {
+			t.Fatal("Could not decode deployment: ", err)
+		}
+		writes <- dep
+		return httpmock.NewStringResponse(200, ""), nil
+	}
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments", write)
+	server.RegisterResponder("PUT", "/apis/apps/v1/namespaces/xyz/deployments/bar", write)
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234",
+			ResourceVersion: "1"},
+		Spec: FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	deployment := <-writes
+	hash := deployment.Annotations[SpecHashAnnotation]
+	if hash == "" || hash != specHash(deployment) {
+		t.Error("Wrong spec hash: ", hash)
+	}
+
+	// Neither the new Deployment nor an unchanged Foo are written
+	// again.
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+	foo.ResourceVersion = "2"
+	foos.Write(marshal(t, "MODIFIED", &foo))
+	rl.step()
+	// Preview is answered once the synchronization is done.
+	if _, err := controller.Preview("xyz", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if len(writes) != 0 {
+		t.Fatal("Unexpected write: ", (<-writes).Annotations)
+	}
+
+	// A Deployment written for another spec is updated.
+	deployment.Annotations[SpecHashAnnotation] = "old"
+	deployments.Write(marshal(t, "MODIFIED", deployment))
+	rl.step()
+	if updated := <-writes; updated.Annotations[SpecHashAnnotation] != hash {
+		t.Error("Spec hash not updated: ", updated.Annotations)
+	}
+	stopController(t, controller)
+}
+
+func TestNilReplicas(t *testing.T) {
+	controller, server, foos, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 2},
+	}
+	// As written by another tool.
+	deployment := newDeployment(&foo)
+	deployment.Spec.Replicas = nil
+
+	puts := make(chan *appsv1.Deployment, 1)
+	server.RegisterResponder("PUT", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		func(req *http.Request) (*http.Response, error) {
+			dep := &appsv1.Deployment{}
+			if err := json.NewDecoder(req.Body).Decode(dep); err != nil {
+				t.Fatal("Could not decode deployment: ", err)
+			}
+			puts <- dep
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	if dep := <-puts; dep.Spec.Replicas == nil || *dep.Spec.Replicas != 2 {
+		t.Error("Replicas not corrected: ", dep.Spec.Replicas)
+	}
+	stopController(t, controller)
+}
+
+func TestNegativeReplicas(t *testing.T) {
+	foo := &Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: -1},
+	}
+	if replicas := *newDeployment(foo).Spec.Replicas; replicas != 0 {
+		t.Error("Wrong replicas: ", replicas)
+	}
+	if replicas := *newReplicaSet(foo).Spec.Replicas; replicas != 0 {
+		t.Error("Wrong replica set replicas: ", replicas)
+	}
+
+	existing := newDeployment(foo)
+	existing.Spec.Replicas = nil
+	foo.Spec.Replicas = 5
+	if next, done := ScaleStep(1)(existing, newDeployment(foo)); !done ||
+		*next.Spec.Replicas != 5 {
+		t.Error("Wrong step from nil replicas: ", *next.Spec.Replicas, done)
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	client, server, foos, _ := startTestServer(t)
+	config := FooConfig(client)
+	config.Workers = 3
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(config, rl, "default")
+
+	// The api server only answers once all the Deployments are being
+	// created.
+	var mu sync.Mutex
+	inFlight := 0
+	allIn := make(chan struct{})
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			inFlight++
+			if inFlight == config.Workers {
+				close(allIn)
+			}
+			mu.Unlock()
+			select {
+			case <-allIn:
+			case <-time.After(5 * time.Second):
+				t.Error("Deployments not created concurrently")
+			}
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+
+	// Queue all the Foos before letting the controller synchronize.
+	stopAsks := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-rl.ask:
+			case <-stopAsks:
+				return
+			}
+		}
+	}()
+	for i := 0; i < config.Workers; i++ {
+		foo := Foo{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprint("abc", i), Namespace: "xyz"},
+			Spec:       FooSpec{DeploymentName: fmt.Sprint("bar", i), Replicas: 1},
+		}
+		foos.Write(marshal(t, "ADDED", &foo))
+	}
+	eventually(t, func() bool {
+		_, err := controller.Preview("xyz", fmt.Sprint("abc", config.Workers-1))
+		return err == nil
+	})
+	close(stopAsks)
+	rl.tick <- struct{}{}
+	<-allIn
+
+	stopController(t, controller)
+}
+
+func TestPreview(t *testing.T) {
+	controller, _, foos, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	restartedAt := "kubectl.kubernetes.io/restartedAt"
+	deployment := newDeployment(&foo)
+	deployment.ResourceVersion = "42"
+	deployment.Spec.Template.Annotations = map[string]string{restartedAt: "now"}
+
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+
+	if _, err := controller.Preview("other", "abc"); err == nil {
+		t.Error("Expected an error for a Foo in another namespace")
+	}
+	preview, err := controller.Preview("xyz", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Name != "bar" || *preview.Spec.Replicas != 1 || preview.ResourceVersion != "42" ||
+		preview.Spec.Template.Annotations[restartedAt] != "now" {
+		t.Error("Wrong preview: ", preview)
+	}
+
+	stopController(t, controller)
+	if _, err := controller.Preview("xyz", "abc"); err == nil {
+		t.Error("Expected an error from a stopped controller")
+	}
+}
+
+func TestSoftMaxReplicas(t *testing.T) {
+	client, server, foos, deployments := startTestServer(t)
+	config := FooConfig(client)
+	config.UpdateStatus = FooStatusUpdater(client, FooStatusOptions{SoftMaxReplicas: 10})
+	recorder := events.NewFakeRecorder(2)
+	config.Recorder = recorder
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(config, rl, "default")
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1000},
+	}
+	statuses := make(chan *Foo, 2)
+	server.RegisterResponder("PUT",
+		"/apis/samplecontroller.example.com/v1alpha1/namespaces/xyz/foos/abc/status",
+		func(req *http.Request) (*http.Response, error) {
+			updated := &Foo{}
+			if err := json.NewDecoder(req.Body).Decode(updated); err != nil {
+				t.Fatal("Could not decode foo: ", err)
+			}
+			statuses <- updated
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	deployments.Write(marshal(t, "ADDED", newDeployment(&foo)))
+	rl.step()
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+
+	updated := <-statuses
+	cond := meta.FindStatusCondition(updated.Status.Conditions, ConditionHighReplicaCount)
+	if cond == nil || cond.Status != metav1.ConditionTrue {
+		t.Error("Wrong conditions: ", updated.Status.Conditions)
+	}
+	event := <-recorder.Events
+	if event.Type != corev1.EventTypeWarning || event.Reason != ConditionHighReplicaCount {
+		t.Error("Wrong event: ", event)
+	}
+
+	// The warning is throttled.
+	foos.Write(marshal(t, "ADDED", updated))
+	rl.step()
+
+	stopController(t, controller)
+	if len(statuses) != 0 || len(recorder.Events) != 0 {
+		t.Error("Unexpected status update or event")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	run := func(t *testing.T, drain bool) int {
+		client, server, foos, _ := startTestServer(t)
+		config := FooConfig(client)
+		config.DrainOnShutdown = drain
+		rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+		controller := NewGenericController(config, rl, "default")
+		posts := make(chan struct{}, 1)
+		server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+			func(req *http.Request) (*http.Response, error) {
+				posts <- struct{}{}
+				return httpmock.NewStringResponse(201, ""), nil
+			})
+
+		// Queue the Foo, but don't let it be synchronized.
+		foos.Write(marshal(t, "ADDED", &foo))
+		<-rl.ask
+
+		go func() {
+			for err := range controller.Errors {
+				t.Errorf("unxpected error %s", err)
+			}
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown := make(chan error)
+		go func() {
+			shutdown <- controller.Shutdown(ctx)
+		}()
+		if drain {
+			rl.step()
+		}
+		if err := <-shutdown; err != nil {
+			t.Error(err)
+		}
+		return len(posts)
+	}
+
+	t.Run("Drain", func(t *testing.T) {
+		if run(t, true) != 1 {
+			t.Error("The queued Foo was not synchronized")
+		}
+	})
+	t.Run("NoDrain", func(t *testing.T) {
+		if run(t, false) != 0 {
+			t.Error("The queued Foo was synchronized")
+		}
+	})
+}
+
+// checkLeaks fails t if, once the goroutines that are winding down
+// are given time to finish, more than before are left.
+func checkLeaks(t *testing.T, before int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for goruntime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			buf = buf[:goruntime.Stack(buf, true)]
+			t.Fatalf("%d goroutines leaked:\n%s", goruntime.NumGoroutine()-before, buf)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	controller, _, foos, _ := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+	handler := health.NewHandler(controller)
+	readyz := func() int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+		return rec.Code
+	}
+
+	// Once an event is read, the watches are started.
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	foos.Write(marshal(t, "ADDED", &foo))
+	<-rl.ask
+	if ok, err := controller.Healthy(); !ok {
+		t.Error("Not healthy: ", err)
+	}
+	if code := readyz(); code != http.StatusOK {
+		t.Errorf("Expected ready, got %d", code)
+	}
+
+	status := metav1.Status{Code: 500, Message: "boom"}
+	foos.Write(marshal(t, "ERROR", &status))
+	if err := <-controller.Errors; err == nil {
+		t.Fatal("Expected the watch to fail")
+	}
+	if ok, err := controller.Healthy(); ok || err == nil ||
+		!strings.HasPrefix(err.Error(), "Reading Foos: ") {
+		t.Error("Wrong health after the watch failed: ", ok, err)
+	}
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected not ready, got %d", code)
+	}
+	for range controller.Errors {
+	}
+}
+
+func TestStartStopLeaks(t *testing.T) {
+	before := goruntime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		controller, server, foos, _ := startTestController(t)
+		rl := controller.rl.(*testRateLimiter)
+		server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+			httpmock.NewStringResponder(201, ""))
+		foo := Foo{
+			ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+			Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+		}
+		foos.Write(marshal(t, "ADDED", &foo))
+		rl.step()
+		stopController(t, controller)
+	}
+	checkLeaks(t, before)
+}
+
+func TestShutdownMidReconcile(t *testing.T) {
+	// run queues two Foos, shuts the controller down while the first
+	// one is being synchronized, and returns what Shutdown returned
+	// and how many Deployments were created.
+	run := func(t *testing.T, drainTimeout, timeout time.Duration,
+		post httpmock.Responder) (error, int32) {
+		before := goruntime.NumGoroutine()
+		client, server, foos, _ := startTestServer(t)
+		rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+		// Requests are aborted once the controller gives up.
+		controller := newClientController(context.Background(), client,
+			func(client *kubeapi.KubeClient) Config[*Foo, *appsv1.Deployment] {
+				config := FooConfig(client)
+				config.DrainOnShutdown = true
+				config.DrainTimeout = drainTimeout
+				return config
+			}, rl, "default")
+		var posts int32
+		server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+			func(req *http.Request) (*http.Response, error) {
+				atomic.AddInt32(&posts, 1)
+				return post(req)
+			})
+
+		for i := 0; i < 2; i++ {
+			foos.Write(marshal(t, "ADDED", &Foo{
+				ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("abc%d", i),
+					Namespace: "xyz"},
+				Spec: FooSpec{DeploymentName: fmt.Sprintf("bar%d", i), Replicas: 1},
+			}))
+			<-rl.ask
+		}
+
+		errs := make(chan struct{})
+		go func() {
+			defer close(errs)
+			for range controller.Errors {
+			}
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		shutdown := make(chan error)
+		go func() {
+			shutdown <- controller.Shutdown(ctx)
+		}()
+		rl.step()
+		err := <-shutdown
+		controller.Wait()
+		<-errs
+		// The pipes of startTestServer were closed by the watches.
+		checkLeaks(t, before)
+		return err, atomic.LoadInt32(&posts)
+	}
+
+	t.Run("DrainTimeout", func(t *testing.T) {
+		// The first Deployment is created after the drain timed
+		// out, so the second Foo is abandoned.
+		err, posts := run(t, 10*time.Millisecond, 5*time.Second,
+			func(req *http.Request) (*http.Response, error) {
+				time.Sleep(50 * time.Millisecond)
+				return httpmock.NewStringResponse(201, ""), nil
+			})
+		var abandoned *AbandonedError
+		if !errors.As(err, &abandoned) || len(abandoned.Items) != 1 {
+			t.Fatalf("Expected one abandoned item, got %v", err)
+		}
+		if posts != 1 {
+			t.Errorf("Expected 1 Deployment to be created, got %d", posts)
+		}
+	})
+	t.Run("Deadline", func(t *testing.T) {
+		// The first Deployment is never created, so the request
+		// is aborted once the context of Shutdown is done.
+		err, posts := run(t, 0, 50*time.Millisecond,
+			func(req *http.Request) (*http.Response, error) {
+				<-req.Context().Done()
+				return nil, req.Context().Err()
+			})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected the deadline to be exceeded, got %v", err)
+		}
+		if posts != 1 {
+			t.Errorf("Expected 1 Deployment to be created, got %d", posts)
+		}
+	})
+}
+
+func TestSelectors(t *testing.T) {
+	controller, server, foos, _ := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+
+	posts := make(chan struct{}, 1)
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		func(req *http.Request) (*http.Response, error) {
+			posts <- struct{}{}
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz",
+			Labels: map[string]string{"group": "a"}},
+		Spec: FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	sel := labels.SelectorFromSet(labels.Set{"group": "a"})
+	if n, err := controller.PauseSelector(labels.Everything()); n != 0 || err != nil {
+		t.Error("Nothing should be paused: ", n, err)
+	}
+
+	// Pause the Foo before it is synchronized.
+	foos.Write(marshal(t, "ADDED", &foo))
+	<-rl.ask
+	if n, err := controller.PauseSelector(sel); n != 1 || err != nil {
+		t.Error("Wrong number of paused Foos: ", n, err)
+	}
+	if n, err := controller.ResyncSelector(sel); n != 1 || err != nil {
+		t.Error("Wrong number of resynced Foos: ", n, err)
+	}
+	rl.step()
+
+	other := labels.SelectorFromSet(labels.Set{"group": "b"})
+	if n, err := controller.ResumeSelector(other); n != 0 || err != nil {
+		t.Error("Nothing should be resumed: ", n, err)
+	}
+	if n, err := controller.ResumeSelector(sel); n != 1 || err != nil {
+		t.Error("Wrong number of resumed Foos: ", n, err)
+	}
+	rl.step()
+	<-posts
+
+	stopController(t, controller)
+	if len(posts) != 0 {
+		t.Error("The paused Foo was synchronized")
+	}
+}
+
+// queueLatencySamples returns how many times metrics.QueueLatency was
+// observed for Deployments.
+func queueLatencySamples(t *testing.T) uint64 {
+	m := &dto.Metric{}
+	observer := metrics.QueueLatency.WithLabelValues("Deployment")
+	if err := observer.(prometheus.Metric).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.Histogram.GetSampleCount()
+}
+
+func TestQueueLatency(t *testing.T) {
+	controller, server, foos, _ := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		httpmock.NewStringResponder(201, ""))
+
+	before := queueLatencySamples(t)
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	stopController(t, controller)
+
+	if n := queueLatencySamples(t) - before; n != 1 {
+		t.Errorf("expected 1 queue latency sample, got %d", n)
+	}
+}
+
+// scrapeMetric returns the value of the sample of metrics.Handler
+// whose name and labels are sample.
+func scrapeMetric(t *testing.T, sample string) float64 {
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if !strings.HasPrefix(line, sample+" ") {
+			continue
+		}
+		var value float64
+		if _, err := fmt.Sscan(strings.TrimPrefix(line, sample+" "), &value); err != nil {
+			t.Fatal("Could not parse sample: ", line)
+		}
+		return value
+	}
+	return 0
+}
+
+func TestReconcileMetrics(t *testing.T) {
+	controller, server, foos, _ := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		httpmock.NewStringResponder(500, "broken"))
+
+	errors := `foo_reconcile_total{controller="Deployment",result="error"}`
+	durations := `foo_reconcile_duration_seconds_count{controller="Deployment"}`
+	beforeErrors := scrapeMetric(t, errors)
+	beforeDurations := scrapeMetric(t, durations)
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	foos.Write(marshal(t, "ADDED", &foo))
+	// Not rl.step, which could swallow the ask of the retry.
+	<-rl.ask
+	rl.tick <- struct{}{}
+	// The failure asks for a tick to retry.
+	<-rl.ask
+	stopController(t, controller)
+
+	if n := scrapeMetric(t, errors) - beforeErrors; n != 1 {
+		t.Errorf("expected 1 more error, got %v", n)
+	}
+	if n := scrapeMetric(t, durations) - beforeDurations; n != 1 {
+		t.Errorf("expected 1 more duration sample, got %v", n)
+	}
+	// The item is still queued to be retried.
+	if depth := scrapeMetric(t, `foo_workqueue_depth{controller="Deployment"}`); depth != 1 {
+		t.Errorf("expected a queue depth of 1, got %v", depth)
+	}
+}
+
+// testMetrics is a metrics.Recorder that counts the reconciles.
+type testMetrics struct {
+	mu      sync.Mutex
+	results map[string]int
+}
+
+func (m *testMetrics) ObserveQueueLatency(d time.Duration)      {}
+func (m *testMetrics) ObserveReconcileDuration(d time.Duration) {}
+func (m *testMetrics) SetWorkqueueDepth(n int)                  {}
+
+func (m *testMetrics) CountReconcile(result string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.results[result]++
+}
+
+func TestMetricsRecorder(t *testing.T) {
+	client, server, foos, _ := startTestServer(t)
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		httpmock.NewStringResponder(201, ""))
+	config := FooConfig(client)
+	recorder := &testMetrics{results: make(map[string]int)}
+	config.Metrics = recorder
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(config, rl, "default")
+
+	// The reconciles of a controller with its own Recorder are not
+	// counted in the default metrics.
+	successes := `foo_reconcile_total{controller="Deployment",result="success"}`
+	before := scrapeMetric(t, successes)
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	stopController(t, controller)
+
+	if recorder.results[metrics.ResultSuccess] != 1 || recorder.results[metrics.ResultError] != 0 {
+		t.Errorf("Wrong results: %v", recorder.results)
+	}
+	if n := scrapeMetric(t, successes) - before; n != 0 {
+		t.Errorf("Expected no new default sample, got %v", n)
+	}
+}
+
+func TestPDB(t *testing.T) {
+	client, server, foos, _ := startTestServer(t)
+	pdbs := addPipeResponder(server, "=~policy/v1/namespaces/default/poddisruptionbudgets.*")
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewPDBController(client, rl, "default")
+
+	minAvailable := intstr.FromInt(2)
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec: FooSpec{DeploymentName: "bar", Replicas: 3,
+			PDB: &PDBSpec{MinAvailable: &minAvailable}},
+	}
+	requests := make(chan *policyv1beta1.PodDisruptionBudget, 1)
+	respond := func(req *http.Request) (*http.Response, error) {
+		pdb := &policyv1beta1.PodDisruptionBudget{}
+		if err := json.NewDecoder(req.Body).Decode(pdb); err != nil {
+			t.Fatal("Could not decode PodDisruptionBudget: ", err)
+		}
+		requests <- pdb
+		return httpmock.NewStringResponse(200, ""), nil
+	}
+	server.RegisterResponder("POST", "/apis/policy/v1/namespaces/xyz/poddisruptionbudgets",
+		respond)
+	server.RegisterResponder("PUT", "/apis/policy/v1/namespaces/xyz/poddisruptionbudgets/bar",
+		respond)
+	deletes := make(chan struct{}, 1)
+	server.RegisterResponder("DELETE",
+		"/apis/policy/v1/namespaces/xyz/poddisruptionbudgets/bar",
+		func(req *http.Request) (*http.Response, error) {
+			deletes <- struct{}{}
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	pdb := <-requests
+	if pdb.Name != "bar" || pdb.Spec.MinAvailable.IntValue() != 2 ||
+		pdb.Spec.MaxUnavailable != nil || pdb.Spec.Selector.MatchLabels["controller"] != "abc" {
+		t.Error("Wrong PodDisruptionBudget: ", pdb)
+	}
+	if owner := metav1.GetControllerOf(pdb); owner == nil || owner.UID != foo.UID {
+		t.Error("Wrong OwnerReferences: ", pdb.OwnerReferences)
+	}
+	pdbs.Write(marshal(t, "ADDED", pdb))
+	rl.step()
+
+	// Drift is corrected.
+	maxUnavailable := intstr.FromString("50%")
+	pdb.Spec.MinAvailable = nil
+	pdb.Spec.MaxUnavailable = &maxUnavailable
+	pdbs.Write(marshal(t, "ADDED", pdb))
+	rl.step()
+	pdb = <-requests
+	if pdb.Spec.MinAvailable.IntValue() != 2 || pdb.Spec.MaxUnavailable != nil {
+		t.Error("Wrong PodDisruptionBudget: ", pdb)
+	}
+	pdbs.Write(marshal(t, "ADDED", pdb))
+	rl.step()
+
+	// Turning it off deletes the PodDisruptionBudget.
+	foo.Spec.PDB = nil
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	<-deletes
+
+	stopController(t, controller)
+}
+
+func TestService(t *testing.T) {
+	client, server, foos, _ := startTestServer(t)
+	services := addPipeResponder(server, "=~^/api/v1/namespaces/default/services")
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewServiceController(client, rl, "default")
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1, Port: 8080, Service: true},
+	}
+	requests := make(chan *corev1.Service, 1)
+	respond := func(req *http.Request) (*http.Response, error) {
+		service := &corev1.Service{}
+		if err := json.NewDecoder(req.Body).Decode(service); err != nil {
+			t.Fatal("Could not decode Service: ", err)
+		}
+		requests <- service
+		return httpmock.NewStringResponse(200, ""), nil
+	}
+	server.RegisterResponder("POST", "/api/v1/namespaces/xyz/services", respond)
+	server.RegisterResponder("PUT", "/api/v1/namespaces/xyz/services/bar", respond)
+	deletes := make(chan struct{}, 1)
+	server.RegisterResponder("DELETE", "/api/v1/namespaces/xyz/services/bar",
+		func(req *http.Request) (*http.Response, error) {
+			deletes <- struct{}{}
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+	checkPort := func(service *corev1.Service, port int32) {
+		t.Helper()
+		if len(service.Spec.Ports) != 1 || service.Spec.Ports[0].Port != port ||
+			service.Spec.Ports[0].TargetPort.IntValue() != int(port) {
+			t.Error("Wrong ports: ", service.Spec.Ports)
+		}
+	}
+
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	service := <-requests
+	if service.Name != "bar" || service.Spec.Type != corev1.ServiceTypeClusterIP ||
+		!reflect.DeepEqual(service.Spec.Selector, podSelector(&foo).MatchLabels) {
+		t.Error("Wrong Service: ", service)
+	}
+	checkPort(service, 8080)
+	if owner := metav1.GetControllerOf(service); owner == nil || owner.UID != foo.UID {
+		t.Error("Wrong OwnerReferences: ", service.OwnerReferences)
+	}
+	// As the api server would.
+	service.Spec.ClusterIP = "10.0.0.1"
+	service.Spec.Ports[0].NodePort = 0
+	services.Write(marshal(t, "ADDED", service))
+	rl.step()
+
+	// Changing the port updates the Service, keeping its cluster IP.
+	foo.Spec.Port = 9090
+	foos.Write(marshal(t, "MODIFIED", &foo))
+	rl.step()
+	service = <-requests
+	checkPort(service, 9090)
+	if service.Spec.ClusterIP != "10.0.0.1" {
+		t.Error("The cluster IP changed: ", service.Spec.ClusterIP)
+	}
+	services.Write(marshal(t, "MODIFIED", service))
+	rl.step()
+
+	// Turning it off deletes the Service.
+	foo.Spec.Service = false
+	foos.Write(marshal(t, "MODIFIED", &foo))
+	rl.step()
+	<-deletes
+
+	stopController(t, controller)
+	if len(requests) != 0 {
+		t.Error("Unexpected request: ", <-requests)
+	}
+}
+
+func TestPortChange(t *testing.T) {
+	controller, server, foos, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+	puts := make(chan *appsv1.Deployment, 1)
+	server.RegisterResponder("PUT", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		func(req *http.Request) (*http.Response, error) {
+			dep := &appsv1.Deployment{}
+			if err := json.NewDecoder(req.Body).Decode(dep); err != nil {
+				t.Fatal("Could not decode deployment: ", err)
+			}
+			puts <- dep
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1, Port: 8080},
+	}
+	old := newDeployment(&foo)
+	ports := old.Spec.Template.Spec.Containers[0].Ports
+	if len(ports) != 1 || ports[0].ContainerPort != 8080 || ports[0].Protocol != "TCP" {
+		t.Error("Wrong container ports: ", ports)
+	}
+	deployments.Write(marshal(t, "ADDED", old))
+	rl.step()
+
+	foo.Spec.Port = 9090
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	stopController(t, controller)
+
+	deployment := <-puts
+	ports = deployment.Spec.Template.Spec.Containers[0].Ports
+	if len(ports) != 1 || ports[0].ContainerPort != 9090 {
+		t.Error("Wrong container ports: ", ports)
+	}
+}
+
+func TestWatchRestart(t *testing.T) {
+	client, server, _, _ := startTestServer(t)
+
+	// Each watch of deployments gets its own pipe.
+	type watchRequest struct {
+		resourceVersion string
+		w               *io.PipeWriter
+	}
+	watches := make(chan watchRequest, 1)
+	server.RegisterResponder("GET", "=~apps/v1/namespaces/default/deployments.*",
+		func(req *http.Request) (*http.Response, error) {
+			r, w := io.Pipe()
+			watches <- watchRequest{req.URL.Query().Get("resourceVersion"), w}
+			return &http.Response{StatusCode: 200, Body: r}, nil
+		})
+	controller := runTestController(client)
+
+	watch := <-watches
+	if watch.resourceVersion != "" {
+		t.Error("The first watch should not have a resource version: ", watch.resourceVersion)
+	}
+	deployment := appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "bar", Namespace: "xyz", ResourceVersion: "5"},
+	}
+	// The deployment is not ours, so write it twice to know that the
+	// controller got it.
+	watch.w.Write(marshal(t, "ADDED", &deployment))
+	watch.w.Write(marshal(t, "ADDED", &deployment))
+
+	// The api server ends the watch, which is resumed.
+	watch.w.Close()
+	watch = <-watches
+	if watch.resourceVersion != "5" {
+		t.Error("The watch should resume from 5: ", watch.resourceVersion)
+	}
+
+	// If the resource version is too old, it starts from scratch.
+	status := metav1.Status{Status: metav1.StatusFailure, Code: http.StatusGone,
+		Reason: metav1.StatusReasonExpired}
+	watch.w.Write(marshal(t, "ERROR", &status))
+	watch = <-watches
+	if watch.resourceVersion != "" {
+		t.Error("The watch should start from scratch: ", watch.resourceVersion)
+	}
+
+	stopController(t, controller)
+}
+
+func TestWatchSelectors(t *testing.T) {
+	client, server, _, _ := startTestServer(t)
+
+	options := kubeapi.ListOptions{LabelSelector: "tier=frontend", FieldSelector: "metadata.name!=x"}
+	if query := options.Query(url.Values{"resourceVersion": []string{"5"}}).Encode(); query !=
+		"fieldSelector=metadata.name%21%3Dx&labelSelector=tier%3Dfrontend&resourceVersion=5" {
+		t.Error("Wrong query: ", query)
+	}
+
+	// Each watch of Foos gets its own pipe.
+	type watchRequest struct {
+		query url.Values
+		w     *io.PipeWriter
+	}
+	watches := make(chan watchRequest, 1)
+	// The same paths as startTestServer, to replace its responders.
+	server.RegisterResponder("GET", "=~samplecontroller.example.com/v1alpha1/namespaces/default/foos.*",
+		func(req *http.Request) (*http.Response, error) {
+			r, w := io.Pipe()
+			watches <- watchRequest{req.URL.Query(), w}
+			return &http.Response{StatusCode: 200, Body: r}, nil
+		})
+	deploymentQueries := make(chan url.Values, 2)
+	server.RegisterResponder("GET", "=~apps/v1/namespaces/default/deployments.*",
+		func(req *http.Request) (*http.Response, error) {
+			deploymentQueries <- req.URL.Query()
+			r, _ := io.Pipe()
+			return &http.Response{StatusCode: 200, Body: r}, nil
+		})
+
+	owned := kubeapi.ListOptions{LabelSelector: "owner=foo"}
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(SelectedFooConfig(client, DefaultFooNames, options, owned),
+		rl, "default")
+
+	if query := <-deploymentQueries; query.Get("labelSelector") != "owner=foo" ||
+		query.Get("fieldSelector") != "" {
+		t.Error("Wrong Deployment selectors: ", query)
+	}
+	watch := <-watches
+	if watch.query.Get("labelSelector") != "tier=frontend" ||
+		watch.query.Get("fieldSelector") != "metadata.name!=x" {
+		t.Error("Wrong Foo selectors: ", watch.query)
+	}
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", ResourceVersion: "5"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		httpmock.NewStringResponder(201, ""))
+	watch.w.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+
+	// Resumed watches and those after a 410 keep the selectors.
+	watch.w.Close()
+	watch = <-watches
+	if watch.query.Get("resourceVersion") != "5" ||
+		watch.query.Get("labelSelector") != "tier=frontend" {
+		t.Error("Wrong resumed query: ", watch.query)
+	}
+	status := metav1.Status{Status: metav1.StatusFailure, Code: http.StatusGone,
+		Reason: metav1.StatusReasonExpired}
+	watch.w.Write(marshal(t, "ERROR", &status))
+	watch = <-watches
+	if watch.query.Get("resourceVersion") != "" ||
+		watch.query.Get("labelSelector") != "tier=frontend" {
+		t.Error("Wrong query after 410: ", watch.query)
+	}
+
+	stopController(t, controller)
+}
+
+func TestListAndWatch(t *testing.T) {
+	client, server := getClient(t)
+	server.RegisterNoResponder(httpmock.NewNotFoundResponder(t.Fatal))
+
+	deployment := func(name, rv string) *appsv1.Deployment {
+		return &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "xyz",
+			ResourceVersion: rv}}
+	}
+	list := func(rv string, items ...*appsv1.Deployment) *http.Response {
+		ret := appsv1.DeploymentList{ListMeta: metav1.ListMeta{ResourceVersion: rv}}
+		for _, item := range items {
+			ret.Items = append(ret.Items, *item)
+		}
+		resp, err := httpmock.NewJsonResponse(200, &ret)
+		if err != nil {
+			t.Fatal("Could not encode list: ", err)
+		}
+		return resp
+	}
+	gone := `{"type": "ERROR", "object": {"kind": "Status", "code": 410,
+		"reason": "Expired", "message": "too old resource version: 10 (15)"}}`
+	r, w := io.Pipe()
+	defer w.Close()
+
+	requests := make(chan string, 5)
+	calls := 0
+	server.RegisterResponder("GET", "/apis/apps/v1/namespaces/xyz/deployments",
+		func(req *http.Request) (*http.Response, error) {
+			query := req.URL.Query()
+			requests <- query.Get("watch") + "@" + query.Get("resourceVersion")
+			calls++
+			switch calls {
+			case 1:
+				return list("10", deployment("a", "1"), deployment("b", "2")), nil
+			case 2:
+				return httpmock.NewStringResponse(200, string(marshal(t, "ADDED",
+					deployment("c", "11")))+gone), nil
+			case 3:
+				return list("20", deployment("a", "1"), deployment("c", "11")), nil
+			case 4:
+				return httpmock.NewStringResponse(200, string(marshal(t, "MODIFIED",
+					deployment("a", "21")))), nil
+			}
+			return &http.Response{StatusCode: 200, Body: r}, nil
+		})
+
+	events, stop := client.ListAndWatch("apps", "v1", "xyz", "deployments", nil,
+		&appsv1.Deployment{})
+	for _, want := range []string{"a@1", "b@2", "c@11", "a@1", "c@11", "-b@2", "a@21"} {
+		ev := <-events
+		if ev.Err != nil {
+			t.Fatal("Unexpected error: ", ev.Err)
+		}
+		item := ev.Item.(*appsv1.Deployment)
+		got := item.Name + "@" + item.ResourceVersion
+		if ev.IsDelete {
+			got = "-" + got
+		}
+		if got != want {
+			t.Errorf("Got %s, want %s", got, want)
+		}
+	}
+
+	// The watch is resumed after the api server ends it, and the
+	// list is redone only after it is gone.
+	for _, want := range []string{"@", "true@10", "@", "true@20", "true@21"} {
+		if got := <-requests; got != want {
+			t.Errorf("Got request %s, want %s", got, want)
+		}
+	}
+
+	close(stop)
+	if ev, ok := <-events; ok {
+		t.Error("Unexpected event: ", ev)
+	}
+}
+
+func TestMinReconcileInterval(t *testing.T) {
+	client, server, foos, deployments := startTestServer(t)
+	config := FooConfig(client)
+	config.MinReconcileInterval = 500 * time.Millisecond
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(config, rl, "default")
+
+	requests := make(chan *appsv1.Deployment, 2)
+	respond := func(req *http.Request) (*http.Response, error) {
+		deployment := &appsv1.Deployment{}
+		if err := json.NewDecoder(req.Body).Decode(deployment); err != nil {
+			t.Fatal("Could not decode deployment: ", err)
+		}
+		requests <- deployment
+		return httpmock.NewStringResponse(200, ""), nil
+	}
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments", respond)
+	server.RegisterResponder("PUT", "/apis/apps/v1/namespaces/xyz/deployments/bar", respond)
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	deployment := <-requests
+	start := time.Now()
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+
+	// Rapid changes are coalesced in one synchronization.
+	for i := 2; i <= 4; i++ {
+		foo.Spec.Replicas = int32(i)
+		foos.Write(marshal(t, "ADDED", &foo))
+		rl.step()
+	}
+	rl.step()
+	deployment = <-requests
+	if *deployment.Spec.Replicas != 4 {
+		t.Error("Wrong number of replicas: ", *deployment.Spec.Replicas)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Error("Synchronized too soon: ", elapsed)
+	}
+
+	stopController(t, controller)
+	if len(requests) != 0 {
+		t.Error("Unexpected request: ", <-requests)
+	}
+}
+
+func TestMinAge(t *testing.T) {
+	client, server, foos, _ := startTestServer(t)
+	config := FooConfig(client)
+	config.MinAge = time.Hour
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(config, rl, "default")
+
+	posts := make(chan struct{}, 1)
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		func(req *http.Request) (*http.Response, error) {
+			posts <- struct{}{}
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+
+	// The creation timestamp is decoded from the watch, so this one
+	// has to wait a bit. It only has a precision of seconds.
+	created := time.Now().Add(-time.Hour + 2*time.Second).Truncate(time.Second)
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz",
+			CreationTimestamp: metav1.NewTime(created)},
+		Spec: FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	if len(posts) != 0 {
+		t.Error("The Foo is too new to be synchronized")
+	}
+
+	rl.step()
+	<-posts
+	if age := time.Since(created); age < time.Hour {
+		t.Error("Synchronized too soon: ", age)
+	}
+
+	// An old enough Foo is synchronized right away.
+	foo.Name = "def"
+	foo.Spec.DeploymentName = "baz"
+	foo.CreationTimestamp = metav1.NewTime(time.Now().Add(-2 * time.Hour))
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		func(req *http.Request) (*http.Response, error) {
+			posts <- struct{}{}
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	<-posts
+
+	stopController(t, controller)
+}
+
+func TestCRDUpdate(t *testing.T) {
+	client, server, _, _ := startTestServer(t)
+
+	// A minimal api server for the CRD.
+	var stored *apiextensionsv1.CustomResourceDefinition
+	decode := func(req *http.Request) *apiextensionsv1.CustomResourceDefinition {
+		crd := &apiextensionsv1.CustomResourceDefinition{}
+		if err := json.NewDecoder(req.Body).Decode(crd); err != nil {
+			t.Fatal("Could not decode CRD: ", err)
+		}
+		return crd
+	}
+	server.RegisterResponder("POST", "/apis/apiextensions.k8s.io/v1/customresourcedefinitions",
+		func(req *http.Request) (*http.Response, error) {
+			crd := decode(req)
+			if stored != nil {
+				return httpmock.NewStringResponse(409, "AlreadyExists"), nil
+			}
+			crd.ResourceVersion = "1"
+			stored = crd
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+	path := "/apis/apiextensions.k8s.io/v1/customresourcedefinitions/bars.bar.example.com"
+	server.RegisterResponder("GET", path,
+		func(req *http.Request) (*http.Response, error) {
+			return httpmock.NewJsonResponse(200, stored)
+		})
+	server.RegisterResponder("PUT", path,
+		func(req *http.Request) (*http.Response, error) {
+			crd := decode(req)
+			if crd.ResourceVersion != stored.ResourceVersion {
+				return httpmock.NewStringResponse(409, "Conflict"), nil
+			}
+			crd.ResourceVersion = "2"
+			stored = crd
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	spec := func(field string) apiextensionsv1.CustomResourceDefinitionSpec {
+		return apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: "bar.example.com",
+			Names: apiextensionsv1.CustomResourceDefinitionNames{Kind: "Bar", Plural: "bars"},
+			Scope: apiextensionsv1.NamespaceScoped,
+			Versions: []apiextensionsv1.CustomResourceDefinitionVersion{{
+				Name: "v1", Served: true, Storage: true,
+				Schema: &apiextensionsv1.CustomResourceValidation{
+					OpenAPIV3Schema: &apiextensionsv1.JSONSchemaProps{
+						Type: "object",
+						Properties: map[string]apiextensionsv1.JSONSchemaProps{
+							field: apiextensionsv1.JSONSchemaProps{Type: "string"},
+						},
+					},
+				},
+			}},
+		}
+	}
+	if err := addCRD(client, spec("old")); err != nil {
+		t.Fatal("Could not add CRD: ", err)
+	}
+	if err := addCRD(client, spec("new")); err != nil {
+		t.Fatal("Could not add CRD again: ", err)
+	}
+
+	if stored.ResourceVersion != "2" {
+		t.Fatal("CRD not updated: ", stored.ResourceVersion)
+	}
+	properties := stored.Spec.Versions[0].Schema.OpenAPIV3Schema.Properties
+	if _, ok := properties["new"]; !ok || len(properties) != 1 {
+		t.Error("Wrong schema: ", properties)
+	}
+}
+
+// validate checks value against the parts of schema the Foo CRD uses,
+// as the api server would, and applies the defaults.
+func validate(schema *apiextensionsv1.JSONSchemaProps, value interface{}, path string) []string {
+	var errs []string
+	if schema.XIntOrString {
+		switch v := value.(type) {
+		case float64:
+		case string:
+			if schema.Pattern != "" && !regexp.MustCompile(schema.Pattern).MatchString(v) {
+				errs = append(errs, path+": does not match "+schema.Pattern)
+			}
+		default:
+			errs = append(errs, path+": not an integer or string")
+		}
+		return errs
+	}
+	switch schema.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return []string{path + ": not an object"}
+		}
+		for _, name := range schema.Required {
+			if _, ok := obj[name]; !ok {
+				errs = append(errs, path+"."+name+": required")
+			}
+		}
+		for name, prop := range schema.Properties {
+			v, ok := obj[name]
+			if !ok && prop.Default != nil {
+				if err := json.Unmarshal(prop.Default.Raw, &v); err != nil {
+					errs = append(errs, path+"."+name+": bad default")
+				}
+				obj[name] = v
+			} else if !ok {
+				continue
+			}
+			prop := prop
+			errs = append(errs, validate(&prop, v, path+"."+name)...)
+		}
+		if schema.AdditionalProperties != nil && schema.AdditionalProperties.Schema != nil {
+			for name, v := range obj {
+				errs = append(errs, validate(schema.AdditionalProperties.Schema, v,
+					path+"."+name)...)
+			}
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return []string{path + ": not an array"}
+		}
+		for i, v := range items {
+			errs = append(errs, validate(schema.Items.Schema, v, fmt.Sprintf("%s[%d]", path,
+				i))...)
+		}
+	case "integer":
+		n, ok := value.(float64)
+		if !ok || n != float64(int64(n)) {
+			return []string{path + ": not an integer"}
+		}
+		if schema.Minimum != nil && n < *schema.Minimum {
+			errs = append(errs, path+": below minimum")
+		}
+		if schema.Maximum != nil && n > *schema.Maximum {
+			errs = append(errs, path+": above maximum")
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return []string{path + ": not a string"}
+		}
+		if schema.MaxLength != nil && int64(len(str)) > *schema.MaxLength {
+			errs = append(errs, path+": too long")
+		}
+		if schema.Pattern != "" && !regexp.MustCompile(schema.Pattern).MatchString(str) {
+			errs = append(errs, path+": does not match "+schema.Pattern)
+		}
+	}
+	return errs
+}
+
+func TestPrinterColumns(t *testing.T) {
+	client, server, _, _ := startTestServer(t)
+	var crd *apiextensionsv1.CustomResourceDefinition
+	server.RegisterResponder("POST", "/apis/apiextensions.k8s.io/v1/customresourcedefinitions",
+		func(req *http.Request) (*http.Response, error) {
+			crd = &apiextensionsv1.CustomResourceDefinition{}
+			if err := json.NewDecoder(req.Body).Decode(crd); err != nil {
+				t.Fatal("Could not decode CRD: ", err)
+			}
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+	if err := addFooCRD(client, DefaultFooNames); err != nil {
+		t.Fatal("Could not add CRD: ", err)
+	}
+
+	expected := []apiextensionsv1.CustomResourceColumnDefinition{
+		{Name: "Deployment", Type: "string", JSONPath: ".spec.deploymentName"},
+		{Name: "Replicas", Type: "integer", JSONPath: ".spec.replicas"},
+		{Name: "Ready", Type: "string", JSONPath: `.status.conditions[?(@.type=="Ready")].status`},
+		{Name: "Reason", Type: "string", JSONPath: `.status.conditions[?(@.type=="Ready")].reason`},
+		{Name: "Available", Type: "integer", JSONPath: ".status.availableReplicas"},
+		{Name: "Age", Type: "date", JSONPath: ".metadata.creationTimestamp"},
+	}
+	columns := crd.Spec.Versions[0].AdditionalPrinterColumns
+	if !reflect.DeepEqual(columns, expected) {
+		t.Errorf("Wrong printer columns: %v", columns)
+	}
+	// The paths must point to fields of the schema.
+	schema := crd.Spec.Versions[0].Schema.OpenAPIV3Schema
+	filter := regexp.MustCompile(`\[[^]]*\]`)
+	for _, col := range columns {
+		path := filter.ReplaceAllString(col.JSONPath, "")
+		parts := strings.Split(strings.TrimPrefix(path, "."), ".")
+		if parts[0] == "metadata" {
+			continue
+		}
+		prop := *schema
+		for _, part := range parts {
+			if prop.Items != nil {
+				prop = *prop.Items.Schema
+			}
+			next, ok := prop.Properties[part]
+			if !ok {
+				// Any field is accepted.
+				if prop.XPreserveUnknownFields == nil || !*prop.XPreserveUnknownFields {
+					t.Errorf("%s: no %s in the schema", col.Name, part)
+				}
+				break
+			}
+			prop = next
+		}
+	}
+}
+
+func TestFooCRDVersions(t *testing.T) {
+	client, server, _, _ := startTestServer(t)
+	var crd *apiextensionsv1.CustomResourceDefinition
+	server.RegisterResponder("POST", "/apis/apiextensions.k8s.io/v1/customresourcedefinitions",
+		func(req *http.Request) (*http.Response, error) {
+			crd = &apiextensionsv1.CustomResourceDefinition{}
+			if err := json.NewDecoder(req.Body).Decode(crd); err != nil {
+				t.Fatal("Could not decode CRD: ", err)
+			}
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+	if err := addFooCRD(client, DefaultFooNames); err != nil {
+		t.Fatal("Could not add CRD: ", err)
+	}
+
+	versions := crd.Spec.Versions
+	if len(versions) != 2 || versions[0].Name != "v1alpha1" || versions[1].Name != "v1beta1" {
+		t.Fatal("Wrong versions: ", versions)
+	}
+	var storage []string
+	for _, v := range versions {
+		if !v.Served {
+			t.Errorf("%s is not served", v.Name)
+		}
+		if v.Storage {
+			storage = append(storage, v.Name)
+		}
+	}
+	if len(storage) != 1 || storage[0] != Version {
+		t.Error("Wrong storage versions: ", storage)
+	}
+	// With the None strategy, the schemas must match.
+	if crd.Spec.Conversion == nil ||
+		crd.Spec.Conversion.Strategy != apiextensionsv1.NoneConverter {
+		t.Error("Wrong conversion: ", crd.Spec.Conversion)
+	}
+	if !reflect.DeepEqual(versions[0].Schema, versions[1].Schema) {
+		t.Error("The schemas of the versions differ")
+	}
+
+	// Other versions are not served for other FooNames.
+	names := FooNames{GVK: schema.GroupVersionKind{Group: "example.com", Version: "v1",
+		Kind: "Bar"}, Plural: "bars"}
+	if err := addFooCRD(client, names); err != nil {
+		t.Fatal("Could not add CRD: ", err)
+	}
+	if len(crd.Spec.Versions) != 1 || crd.Spec.Versions[0].Name != "v1" ||
+		!crd.Spec.Versions[0].Storage {
+		t.Error("Wrong versions: ", crd.Spec.Versions)
+	}
+}
+
+func TestOwnerRefVersion(t *testing.T) {
+	controller, server, _, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+	deletes := make(chan struct{}, 1)
+	server.RegisterResponder("DELETE", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		func(req *http.Request) (*http.Response, error) {
+			deletes <- struct{}{}
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	// A Deployment whose owner reference was written with another
+	// version of the Foo API is still ours.
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	deployment := newDeployment(&foo)
+	deployment.OwnerReferences[0].APIVersion = Group + "/v1beta1"
+	deployments.Write(marshal(t, "ADDED", deployment))
+	select {
+	case <-rl.ask:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The Deployment was not considered ours")
+	}
+	rl.tick <- struct{}{}
+	// As the Foo doesn't exist, it is deleted.
+	<-deletes
+
+	stopController(t, controller)
+}
+
+func TestCRDValidation(t *testing.T) {
+	client, server, _, _ := startTestServer(t)
+
+	// An api server that validates Foos with the schema of the CRD.
+	var crd *apiextensionsv1.CustomResourceDefinition
+	server.RegisterResponder("POST", "/apis/apiextensions.k8s.io/v1/customresourcedefinitions",
+		func(req *http.Request) (*http.Response, error) {
+			crd = &apiextensionsv1.CustomResourceDefinition{}
+			if err := json.NewDecoder(req.Body).Decode(crd); err != nil {
+				t.Fatal("Could not decode CRD: ", err)
+			}
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+	created := make(chan map[string]interface{}, 1)
+	server.RegisterResponder("POST", "/apis/samplecontroller.example.com/v1alpha1/namespaces/xyz/foos",
+		func(req *http.Request) (*http.Response, error) {
+			var foo map[string]interface{}
+			if err := json.NewDecoder(req.Body).Decode(&foo); err != nil {
+				t.Fatal("Could not decode foo: ", err)
+			}
+			schema := crd.Spec.Versions[0].Schema.OpenAPIV3Schema
+			if errs := validate(schema, foo, ""); len(errs) != 0 {
+				return httpmock.NewStringResponse(422, strings.Join(errs, ", ")), nil
+			}
+			created <- foo
+			return httpmock.NewJsonResponse(201, foo)
+		})
+	if err := addFooCRD(client, DefaultFooNames); err != nil {
+		t.Fatal("Could not add CRD: ", err)
+	}
+
+	post := func(spec map[string]interface{}) error {
+		foo := map[string]interface{}{
+			"apiVersion": "samplecontroller.example.com/v1alpha1",
+			"kind":       "Foo",
+			"metadata":   map[string]interface{}{"name": "abc", "namespace": "xyz"},
+			"spec":       spec,
+		}
+		return client.Post(Group, Version, "xyz", "foos", foo)
+	}
+
+	// replicas defaults to 1.
+	if err := post(map[string]interface{}{"deploymentName": "bar.baz-1"}); err != nil {
+		t.Fatal("Valid Foo rejected: ", err)
+	}
+	spec := (<-created)["spec"].(map[string]interface{})
+	if replicas := spec["replicas"]; replicas != float64(1) {
+		t.Error("Wrong default replicas: ", replicas)
+	}
+
+	resources := map[string]interface{}{
+		"limits":   map[string]interface{}{"cpu": "500m", "memory": "128Mi"},
+		"requests": map[string]interface{}{"cpu": 0.5, "memory": "64Mi"},
+	}
+	if err := post(map[string]interface{}{"deploymentName": "bar",
+		"resources": resources}); err != nil {
+		t.Fatal("Valid resources rejected: ", err)
+	}
+	<-created
+
+	if err := post(map[string]interface{}{"deploymentName": "bar", "port": 8080,
+		"service": true}); err != nil {
+		t.Fatal("Valid port rejected: ", err)
+	}
+	<-created
+
+	if err := post(map[string]interface{}{"deploymentName": "bar",
+		"imagePullSecrets":   []string{"regcred", "other.regcred"},
+		"serviceAccountName": "builder"}); err != nil {
+		t.Fatal("Valid pull secrets and service account rejected: ", err)
+	}
+	<-created
+
+	for _, spec := range []map[string]interface{}{
+		{"replicas": 1},
+		{"deploymentName": "", "replicas": 1},
+		{"deploymentName": "Bar", "replicas": 1},
+		{"deploymentName": strings.Repeat("a", 254), "replicas": 1},
+		{"deploymentName": "bar", "replicas": -1},
+		{"deploymentName": "bar", "replicas": MaxFooReplicas + 1},
+		{"deploymentName": "bar", "resources": map[string]interface{}{
+			"limits": map[string]interface{}{"cpu": "lots"}}},
+		{"deploymentName": "bar", "resources": map[string]interface{}{
+			"requests": "1Gi"}},
+		{"deploymentName": "bar", "port": 0},
+		{"deploymentName": "bar", "port": 65536},
+		{"deploymentName": "bar", "imagePullSecrets": "regcred"},
+		{"deploymentName": "bar", "imagePullSecrets": []string{"Reg_Cred"}},
+		{"deploymentName": "bar", "serviceAccountName": "Builder"},
+	} {
+		err := post(spec)
+		var re *kubeapi.RequestError
+		if !errors.As(err, &re) || re.StatusCode != 422 {
+			t.Errorf("Invalid Foo %v not rejected: %v", spec, err)
+		}
+	}
+}
+
+func TestFooNames(t *testing.T) {
+	client, server, _, deployments := startTestServer(t)
+	names := FooNames{
+		GVK:    schema.GroupVersionKind{Group: "bar.example.com", Version: "v1", Kind: "Bar"},
+		Plural: "bars",
+	}
+	crds := make(chan *apiextensionsv1.CustomResourceDefinition, 1)
+	server.RegisterResponder("POST", "/apis/apiextensions.k8s.io/v1/customresourcedefinitions",
+		func(req *http.Request) (*http.Response, error) {
+			crd := &apiextensionsv1.CustomResourceDefinition{}
+			if err := json.NewDecoder(req.Body).Decode(crd); err != nil {
+				t.Fatal("Could not decode CRD: ", err)
+			}
+			crds <- crd
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+	bars := addPipeResponder(server, "=~bar.example.com/v1/namespaces/default/bars.*")
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	server.RegisterResponder("GET", "/apis/bar.example.com/v1/namespaces/xyz/bars/abc",
+		func(req *http.Request) (*http.Response, error) {
+			data, err := json.Marshal(&foo)
+			if err != nil {
+				t.Fatal("Marshal failed", err)
+			}
+			return httpmock.NewBytesResponse(200, data), nil
+		})
+	posts := make(chan *appsv1.Deployment, 1)
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		func(req *http.Request) (*http.Response, error) {
+			deployment := &appsv1.Deployment{}
+			if err := json.NewDecoder(req.Body).Decode(deployment); err != nil {
+				t.Fatal("Could not decode deployment: ", err)
+			}
+			posts <- deployment
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+	// Adding the finalizer.
+	server.RegisterResponder("PUT", "/apis/bar.example.com/v1/namespaces/xyz/bars/abc",
+		httpmock.NewStringResponder(200, ""))
+	statuses := make(chan *Foo, 1)
+	server.RegisterResponder("PUT", "/apis/bar.example.com/v1/namespaces/xyz/bars/abc/status",
+		func(req *http.Request) (*http.Response, error) {
+			updated := &Foo{}
+			if err := json.NewDecoder(req.Body).Decode(updated); err != nil {
+				t.Fatal("Could not decode foo: ", err)
+			}
+			statuses <- updated
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewControllerFor(client, rl, "default", names)
+	crd := <-crds
+	if crd.Name != "bars.bar.example.com" || crd.Spec.Names.Kind != "Bar" ||
+		crd.Spec.Versions[0].Name != "v1" {
+		t.Error("Wrong CRD: ", crd.Name, crd.Spec.Names, crd.Spec.Versions[0].Name)
+	}
+
+	bars.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	deployment := <-posts
+	owner := metav1.GetControllerOf(deployment)
+	if owner == nil || owner.APIVersion != "bar.example.com/v1" || owner.Kind != "Bar" {
+		t.Error("Wrong controller reference: ", owner)
+	}
+
+	// The Deployment is recognized as ours.
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+	if updated := <-statuses; updated.APIVersion != "bar.example.com/v1" ||
+		updated.Kind != "Bar" {
+		t.Error("Wrong type of the status update: ", updated.TypeMeta)
+	}
+
+	stopController(t, controller)
+}
+
+func TestUpdateMergeManaged(t *testing.T) {
+	client, server, foos, deployments := startTestServer(t)
+	config := FooConfig(client)
+	config.UpdateStrategy = UpdateMergeManaged
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(config, rl, "default")
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 3},
+	}
+	// A webhook added a sidecar and a volume to the live Deployment,
+	// which the watch has not reported yet.
+	old := foo
+	old.Spec.Replicas = 1
+	deployment := newDeployment(&old)
+	deployment.ResourceVersion = "6"
+	live := deployment.DeepCopy()
+	live.ResourceVersion = "7"
+	podSpec := &live.Spec.Template.Spec
+	podSpec.Containers[0].Image = "nginx:old"
+	podSpec.Containers = append(podSpec.Containers,
+		corev1.Container{Name: "sidecar", Image: "proxy"})
+	podSpec.Volumes = []corev1.Volume{{Name: "certs"}}
+	server.RegisterResponder("GET", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		func(req *http.Request) (*http.Response, error) {
+			data, err := json.Marshal(live)
+			if err != nil {
+				t.Fatal("Marshal failed", err)
+			}
+			return httpmock.NewBytesResponse(200, data), nil
+		})
+	puts := make(chan *appsv1.Deployment, 1)
+	server.RegisterResponder("PUT", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		func(req *http.Request) (*http.Response, error) {
+			updated := &appsv1.Deployment{}
+			if err := json.NewDecoder(req.Body).Decode(updated); err != nil {
+				t.Fatal("Could not decode deployment: ", err)
+			}
+			puts <- updated
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	deployments.Write(marshal(t, "ADDED", deployment))
+	rl.step()
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+
+	updated := <-puts
+	containers := updated.Spec.Template.Spec.Containers
+	if *updated.Spec.Replicas != 3 || updated.ResourceVersion != "7" {
+		t.Error("Wrong replicas or resource version: ", *updated.Spec.Replicas,
+			updated.ResourceVersion)
+	}
+	if len(containers) != 2 || containers[0].Image != "nginx:latest" ||
+		containers[1].Name != "sidecar" {
+		t.Error("Wrong containers: ", containers)
+	}
+	if volumes := updated.Spec.Template.Spec.Volumes; len(volumes) != 1 {
+		t.Error("The volume was not kept: ", volumes)
+	}
+	if owner := metav1.GetControllerOf(updated); owner == nil || owner.UID != foo.UID {
+		t.Error("Wrong controller reference: ", updated.OwnerReferences)
+	}
+
+	stopController(t, controller)
+}
+
+func TestSelectorChangeRecreate(t *testing.T) {
+	client, server, foos, deployments := startTestServer(t)
+	config := FooConfig(client)
+	config.SelectorChangePolicy = SelectorChangeRecreate
+	recorder := events.NewFakeRecorder(1)
+	config.Recorder = recorder
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(config, rl, "default")
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	// Its selector needs a value of our label we no longer set.
+	old := newDeployment(&foo)
+	old.Spec.Selector = &metav1.LabelSelector{
+		MatchLabels: map[string]string{"controller": "1234"}}
+	old.Spec.Template.Labels = map[string]string{"controller": "1234"}
+
+	deletes := make(chan struct{}, 1)
+	server.RegisterResponder("DELETE", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		func(req *http.Request) (*http.Response, error) {
+			deletes <- struct{}{}
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+	posts := make(chan *appsv1.Deployment, 1)
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		func(req *http.Request) (*http.Response, error) {
+			deployment := &appsv1.Deployment{}
+			if err := json.NewDecoder(req.Body).Decode(deployment); err != nil {
+				t.Fatal("Could not decode deployment: ", err)
+			}
+			posts <- deployment
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+
+	deployments.Write(marshal(t, "ADDED", old))
+	rl.step()
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	<-deletes
+	if event := <-recorder.Events; event.Reason != "Recreating" {
+		t.Error("Wrong event: ", event)
+	}
+
+	deployments.Write(marshal(t, "DELETED", old))
+	rl.step()
+	created := <-posts
+	if created.Spec.Selector.MatchLabels["controller"] != "abc" {
+		t.Error("Wrong selector: ", created.Spec.Selector)
+	}
+
+	stopController(t, controller)
+}
+
+func TestEvents(t *testing.T) {
+	client, server, foos, deployments := startTestServer(t)
+	config := FooConfig(client)
+	config.CollisionPolicy = CollisionFail
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(config, rl, "default")
+
+	recorded := make(chan *corev1.Event, 1)
+	server.RegisterResponder("POST", "/api/v1/namespaces/xyz/events",
+		func(req *http.Request) (*http.Response, error) {
+			event := &corev1.Event{}
+			if err := json.NewDecoder(req.Body).Decode(event); err != nil {
+				t.Fatal("Could not decode event: ", err)
+			}
+			recorded <- event
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		httpmock.NewStringResponder(201, ""))
+	server.RegisterResponder("PUT", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		httpmock.NewStringResponder(200, ""))
+
+	checkEvent := func(foo *Foo, eventType, reason, message string) {
+		t.Helper()
+		event := <-recorded
+		if event.Namespace != "xyz" || !strings.HasPrefix(event.Name, foo.Name+".") {
+			t.Error("Wrong event metadata: ", event.ObjectMeta)
+		}
+		involved := event.InvolvedObject
+		if involved.APIVersion != Group+"/"+Version || involved.Kind != Kind ||
+			involved.Namespace != foo.Namespace || involved.Name != foo.Name ||
+			involved.UID != foo.UID || involved.ResourceVersion != foo.ResourceVersion {
+			t.Error("Wrong involved object: ", involved)
+		}
+		if event.Type != eventType || event.Reason != reason ||
+			!strings.HasPrefix(event.Message, message+" (reconcile ") {
+			t.Error("Wrong event: ", event.Type, event.Reason, event.Message)
+		}
+		if event.Source.Component != "sample-controller" || event.Count != 1 ||
+			event.FirstTimestamp.IsZero() {
+			t.Error("Wrong event source: ", event.Source, event.Count, event.FirstTimestamp)
+		}
+	}
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234",
+			ResourceVersion: "5"},
+		Spec: FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	checkEvent(&foo, corev1.EventTypeNormal, "SyncedDeployment", "Created Deployment bar")
+
+	deployments.Write(marshal(t, "ADDED", newDeployment(&foo)))
+	rl.step()
+	foo.ResourceVersion = "6"
+	foo.Spec.Replicas = 2
+	foos.Write(marshal(t, "MODIFIED", &foo))
+	rl.step()
+	checkEvent(&foo, corev1.EventTypeNormal, "ScaledDeployment", "Updated Deployment bar")
+
+	other := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "def", Namespace: "xyz", UID: "5678",
+			ResourceVersion: "7"},
+		Spec: FooSpec{DeploymentName: "qux", Replicas: 1},
+	}
+	deployment := newDeployment(&other)
+	isController := true
+	deployment.OwnerReferences = []metav1.OwnerReference{{APIVersion: "example.com/v1",
+		Kind: "Other", Name: "other", UID: "9999", Controller: &isController}}
+	// Not ours, so it doesn't ask for a tick.
+	deployments.Write(marshal(t, "ADDED", deployment))
+	deployments.Write(marshal(t, "ADDED", deployment))
+	foos.Write(marshal(t, "ADDED", &other))
+	rl.step()
+	checkEvent(&other, corev1.EventTypeWarning, "OwnershipConflict",
+		"Deployment qux is controlled by something else")
+
+	stopController(t, controller)
+	if len(recorded) != 0 {
+		t.Error("Unexpected event: ", <-recorded)
+	}
+}
+
+func TestReplicaSet(t *testing.T) {
+	client, server, foos, _ := startTestServer(t)
+	replicaSets := addPipeResponder(server, "=~apps/v1/namespaces/default/replicasets.*")
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewReplicaSetController(client, rl, "default")
+
+	requests := make(chan *appsv1.ReplicaSet, 1)
+	respond := func(req *http.Request) (*http.Response, error) {
+		replicaSet := &appsv1.ReplicaSet{}
+		if err := json.NewDecoder(req.Body).Decode(replicaSet); err != nil {
+			t.Fatal("Could not decode ReplicaSet: ", err)
+		}
+		requests <- replicaSet
+		return httpmock.NewStringResponse(200, ""), nil
+	}
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/replicasets", respond)
+	server.RegisterResponder("PUT", "/apis/apps/v1/namespaces/xyz/replicasets/bar", respond)
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 2},
+	}
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	replicaSet := <-requests
+	if replicaSet.Name != "bar" || *replicaSet.Spec.Replicas != 2 ||
+		replicaSet.Spec.Selector.MatchLabels["controller"] != "abc" {
+		t.Error("Wrong ReplicaSet: ", replicaSet)
+	}
+	if owner := metav1.GetControllerOf(replicaSet); owner == nil || owner.UID != foo.UID {
+		t.Error("Wrong OwnerReferences: ", replicaSet.OwnerReferences)
+	}
+	replicaSets.Write(marshal(t, "ADDED", replicaSet))
+	rl.step()
+
+	// Scaling the Foo updates the ReplicaSet.
+	foo.Spec.Replicas = 5
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	if replicaSet = <-requests; *replicaSet.Spec.Replicas != 5 {
+		t.Error("Wrong replicas: ", *replicaSet.Spec.Replicas)
+	}
+
+	stopController(t, controller)
+}
+
+func TestPollOnly(t *testing.T) {
+	client, server, _, _ := startTestServer(t)
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234",
+			ResourceVersion: "1"},
+		Spec: FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	list := func(obj interface{}) httpmock.Responder {
+		return func(req *http.Request) (*http.Response, error) {
+			if req.URL.Query().Get("watch") != "" {
+				t.Error("Unexpected watch: ", req.URL)
+			}
+			data, err := json.Marshal(obj)
+			if err != nil {
+				t.Fatal("Marshal failed", err)
+			}
+			return httpmock.NewBytesResponse(200, data), nil
+		}
+	}
+	server.RegisterResponder("GET",
+		"/apis/samplecontroller.example.com/v1alpha1/namespaces/default/foos",
+		list(FooList{Items: []Foo{foo}}))
+	server.RegisterResponder("GET",
+		"/apis/samplecontroller.example.com/v1alpha1/namespaces/xyz/foos/abc", list(&foo))
+	server.RegisterResponder("GET", "/apis/apps/v1/namespaces/default/deployments",
+		list(appsv1.DeploymentList{}))
+	posts := make(chan struct{}, 1)
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		func(req *http.Request) (*http.Response, error) {
+			posts <- struct{}{}
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+
+	config := PollOnlyFooConfig(client, DefaultFooNames, 10*time.Millisecond)
+	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
+	controller := NewGenericController(config, rl, "default")
+	rl.step()
+	<-posts
+
+	// Unchanged Foos are not reported again, but the webhook can
+	// ask for a synchronization.
+	trigger := &WebhookTrigger{Enqueue: controller.Enqueue}
+	post := func(body string) int {
+		req := httptest.NewRequest("POST", "/reconcile", strings.NewReader(body))
+		resp := httptest.NewRecorder()
+		trigger.ServeHTTP(resp, req)
+		return resp.Code
+	}
+	if code := post(`{"namespace": "xyz", "name": "abc"}`); code != http.StatusAccepted {
+		t.Error("Wrong status code: ", code)
+	}
+	rl.step()
+	<-posts
+	if code := post(`{"namespace": "xyz", "name": "def"}`); code != http.StatusNotFound {
+		t.Error("Wrong status code for an unknown Foo: ", code)
+	}
+	if code := post(`[]`); code != http.StatusBadRequest {
+		t.Error("Wrong status code for a bad body: ", code)
+	}
+
+	stopController(t, controller)
+	if code := post(`{"namespace": "xyz", "name": "abc"}`); code != http.StatusServiceUnavailable {
+		t.Error("Wrong status code once stopped: ", code)
+	}
+}
+
+func TestPollOnlyListError(t *testing.T) {
+	client, server, _, _ := startTestServer(t)
+	server.RegisterResponder("GET",
+		"/apis/samplecontroller.example.com/v1alpha1/namespaces/default/foos",
+		httpmock.NewStringResponder(500, ""))
+	server.RegisterResponder("GET", "/apis/apps/v1/namespaces/default/deployments",
+		httpmock.NewStringResponder(200, "{}"))
+
+	config := PollOnlyFooConfig(client, DefaultFooNames, 10*time.Millisecond)
+	logger := &testLogger{}
+	config.Logger = logger
+	controller := NewGenericController(config,
+		ratelimit.NewExponentialRateLimiter(time.Millisecond, time.Millisecond), "default")
+	// The failed lists are logged and retried.
+	eventually(t, func() bool {
+		logger.mu.Lock()
+		defer logger.mu.Unlock()
+		n := 0
+		for _, e := range logger.entries {
+			if e.msg == "Could not list, will retry" && e.fields["kind"] == "Foo" {
+				n++
+			}
+		}
+		return n >= 2
+	})
+	stopController(t, controller)
+}
+
+func TestRenameAfterRestart(t *testing.T) {
+	controller, server, foos, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+
+	requests := make(chan string, 2)
+	server.RegisterResponder("DELETE", "/apis/apps/v1/namespaces/xyz/deployments/bar",
+		func(req *http.Request) (*http.Response, error) {
+			requests <- "DELETE " + req.URL.Path
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		func(req *http.Request) (*http.Response, error) {
+			requests <- "POST " + req.URL.Path
+			return httpmock.NewStringResponse(201, ""), nil
+		})
+
+	// The Foo was renamed while we were not running.
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	deployments.Write(marshal(t, "ADDED", newDeployment(&foo)))
+	rl.step()
+	foo.Spec.DeploymentName = "zed"
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+
+	if req := <-requests; req != "DELETE /apis/apps/v1/namespaces/xyz/deployments/bar" {
+		t.Error("The old Deployment should be deleted first: ", req)
+	}
+	if req := <-requests; req != "POST /apis/apps/v1/namespaces/xyz/deployments" {
+		t.Error("The new Deployment should be created: ", req)
+	}
+	deployments.Write(marshal(t, "ADDED", newDeployment(&foo)))
+	rl.step()
+
+	// A Deployment of a previous Foo with the same name is left to
+	// the garbage collector, even when the Foo synchronizes.
+	old := foo
+	old.UID = "5678"
+	old.Spec.DeploymentName = "baz"
+	deployments.Write(marshal(t, "ADDED", newDeployment(&old)))
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+
+	stopController(t, controller)
+	if len(requests) != 0 {
+		t.Error("Unexpected request: ", <-requests)
+	}
+}
+
+func TestSpoofedOwnerReference(t *testing.T) {
+	controller, server, foos, deployments := startTestController(t)
+	rl := controller.rl.(*testRateLimiter)
+	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments",
+		httpmock.NewStringResponder(201, ""))
+
+	foo := Foo{
+		ObjectMeta: metav1.ObjectMeta{Name: "abc", Namespace: "xyz", UID: "1234"},
+		Spec:       FooSpec{DeploymentName: "bar", Replicas: 1},
+	}
+	foos.Write(marshal(t, "ADDED", &foo))
+	rl.step()
+	deployments.Write(marshal(t, "ADDED", newDeployment(&foo)))
+	rl.step()
+
+	isController := true
+	for _, ref := range []metav1.OwnerReference{
+		// A Foo of another group
+		{APIVersion: "other.example.com/v1", Kind: Kind, Name: "abc", UID: "1234",
+			Controller: &isController},
+		// A previous Foo with the same name
+		{APIVersion: Group + "/" + Version, Kind: Kind, Name: "abc", UID: "5678",
+			Controller: &isController},
+	} {
+		deployment := appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "xyz",
+				OwnerReferences: []metav1.OwnerReference{ref}},
+		}
+		// Once the second write returns the controller got the first
+		// one, and would be asking for a tick if it took it as ours.
+		deployments.Write(marshal(t, "ADDED", &deployment))
+		deployments.Write(marshal(t, "ADDED", &deployment))
+		select {
+		case <-rl.ask:
+			t.Error("The Deployment was taken as ours: ", ref)
+			rl.step()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	stopController(t, controller)
+}
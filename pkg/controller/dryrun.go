@@ -0,0 +1,181 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"reflect"
+	"sample-controller/pkg/events"
+	"sort"
+)
+
+// dryRun returns config with every function that writes to the api
+// server replaced by one that only logs what it would do, see
+// Config.DryRun.
+func dryRun[T, O metav1.Object](config Config[T, O]) Config[T, O] {
+	logger := config.Logger
+	kind, ownedKind := config.GVK.Kind, config.OwnedKind
+	fields := func(kind string, obj metav1.Object, keysAndValues ...interface{}) []interface{} {
+		return append([]interface{}{"kind", kind, "namespace", obj.GetNamespace(),
+			"name", obj.GetName()}, keysAndValues...)
+	}
+
+	config.AddCRD = func() error {
+		logger.Info("Would add the CRD", "kind", kind)
+		return nil
+	}
+	if config.Primary.Update != nil {
+		config.Primary.Update = func(primary T) error {
+			logger.Info("Would update", fields(kind, primary,
+				"finalizers", primary.GetFinalizers())...)
+			return nil
+		}
+	}
+	config.Owned.Add = func(owned O) error {
+		logger.Info("Would create", fields(ownedKind, owned)...)
+		return nil
+	}
+	// processOneItem logs the diff, which needs the existing O.
+	config.Owned.Update = func(owned O) error {
+		return nil
+	}
+	if config.Owned.Apply != nil {
+		config.Owned.Apply = config.Owned.Update
+	}
+	if config.Owned.Patch != nil {
+		config.Owned.Patch = func(owned O, patch []byte) error {
+			return nil
+		}
+	}
+	config.Owned.Delete = func(owned O) error {
+		logger.Info("Would delete", fields(ownedKind, owned)...)
+		return nil
+	}
+	if config.UpdateStatus != nil {
+		config.UpdateStatus = func(primary T, owned O, recorder events.Recorder) error {
+			logger.Debug("Would update the status", fields(kind, primary)...)
+			return nil
+		}
+	}
+	if config.ReportCollision != nil {
+		config.ReportCollision = func(primary T, owned O) error {
+			logger.Info("Would report the collision", fields(kind, primary,
+				"ownedName", owned.GetName())...)
+			return nil
+		}
+	}
+	if config.ReportConflict != nil {
+		config.ReportConflict = func(primary, winner T) error {
+			logger.Info("Would report the conflict", fields(kind, primary,
+				"winner", winner.GetName())...)
+			return nil
+		}
+	}
+	if config.ReportInvalid != nil {
+		config.ReportInvalid = func(primary T, err error) error {
+			logger.Info("Would report it invalid", fields(kind, primary, "error", err)...)
+			return nil
+		}
+	}
+	if config.ReportError != nil {
+		config.ReportError = func(primary T, err error) error {
+			logger.Info("Would report the error", fields(kind, primary, "error", err)...)
+			return nil
+		}
+	}
+	if config.ReportDeadLetter != nil {
+		config.ReportDeadLetter = func(primary T, failures int, err error) error {
+			logger.Info("Would report the dead letter", fields(kind, primary,
+				"failures", failures, "error", err)...)
+			return nil
+		}
+	}
+	if config.Cleanup != nil {
+		config.Cleanup = func(primary T) error {
+			logger.Info("Would clean up", fields(kind, primary)...)
+			return nil
+		}
+	}
+	if config.Recorder != nil {
+		config.Recorder = dryRunRecorder{logger}
+	}
+	return config
+}
+
+// dryRunRecorder logs the events it is asked to record.
+type dryRunRecorder struct {
+	logger Logger
+}
+
+func (r dryRunRecorder) RecordEvent(obj metav1.Object, gvk schema.GroupVersionKind,
+	eventType, reason, message string) error {
+	r.logger.Debug("Would record event", "kind", gvk.Kind, "namespace", obj.GetNamespace(),
+		"name", obj.GetName(), "type", eventType, "reason", reason, "message", message)
+	return nil
+}
+
+// objectDiff returns the fields of desired that differ from existing,
+// as "path: old -> new" sorted by path. The status is ignored, as it is
+// not ours to write.
+func objectDiff(existing, desired interface{}) ([]string, error) {
+	var old, new map[string]interface{}
+	for _, obj := range []struct {
+		from interface{}
+		to   *map[string]interface{}
+	}{{existing, &old}, {desired, &new}} {
+		data, err := json.Marshal(obj.from)
+		if err != nil {
+			return nil, fmt.Errorf("Could not encode: %w", err)
+		}
+		if err := json.Unmarshal(data, obj.to); err != nil {
+			return nil, fmt.Errorf("Could not decode: %w", err)
+		}
+	}
+	delete(old, "status")
+	delete(new, "status")
+	var diff []string
+	diffValues("", old, new, &diff)
+	sort.Strings(diff)
+	return diff, nil
+}
+
+func diffValues(path string, old, new interface{}, diff *[]string) {
+	if new_map, ok := new.(map[string]interface{}); ok {
+		if old_map, ok := old.(map[string]interface{}); ok {
+			for key, value := range new_map {
+				child := key
+				if path != "" {
+					child = path + "." + key
+				}
+				diffValues(child, old_map[key], value, diff)
+			}
+			return
+		}
+	}
+	if !reflect.DeepEqual(old, new) {
+		*diff = append(*diff, fmt.Sprintf("%s: %s -> %s", path, diffString(old),
+			diffString(new)))
+	}
+}
+
+func diffString(value interface{}) string {
+	if value == nil {
+		return "<none>"
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// logDiff logs how updating existing to desired would change it.
+func (c *GenericController[T, O]) logDiff(id, item string, existing, desired O) {
+	diff, err := objectDiff(existing, desired)
+	if err != nil {
+		c.config.Logger.Error(err, "Could not compute the diff", c.ownedFields(id, item, existing)...)
+		return
+	}
+	c.config.Logger.Info("Would update", c.ownedFields(id, item, existing, "diff", diff)...)
+}
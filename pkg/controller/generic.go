@@ -0,0 +1,2356 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"net/http"
+	"reflect"
+	"runtime/debug"
+	"sample-controller/pkg/events"
+	"sample-controller/pkg/kubeapi"
+	"sample-controller/pkg/metrics"
+	"sample-controller/pkg/ratelimit"
+	"sample-controller/pkg/workqueue"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WatchFunc starts watching a resource in namespace. If
+// resourceVersion is not empty, the watch starts after it. The
+// returned channel is closed when the watch ends, either because the
+// second channel was closed or because the api server ended it.
+type WatchFunc func(namespace, resourceVersion string) (<-chan kubeapi.WatchEvent,
+	chan<- struct{})
+
+// Resource describes how a GenericController accesses one kind of
+// resource. Watch must produce WatchEvents whose Items are of type
+// T. Watches that end on their own are started again. Add, Update and
+// Delete are only used for owned resources, where they are required,
+// except that Update also writes the finalizers of primaries, see
+// Config.Finalizer.
+type Resource[T metav1.Object] struct {
+	Watch  WatchFunc
+	Add    func(T) error
+	Update func(T) error
+	Delete func(T) error
+	// Apply is optional and only used for owned resources with
+	// UpdateApply. It does a server-side apply of the resource.
+	Apply func(T) error
+	// Patch is optional and only used for owned resources with
+	// Config.MinimalPatch. It patches the resource with a JSON merge
+	// patch.
+	Patch func(obj T, patch []byte) error
+
+	// Get is optional. For primaries, it fetches a primary from the
+	// api server right before creating the resource it owns, so that
+	// we don't create it for a primary that was deleted after we last
+	// heard about it. It must return a *kubeapi.RequestError with
+	// http.StatusNotFound if the primary doesn't exist. It is also
+	// how we make sure a primary is gone before deleting the
+	// resources it still controls, instead of waiting for the
+	// Kubernetes garbage collector. For owned resources, it fetches
+	// the live one before a merge, see UpdateMergeManaged.
+	Get func(namespace, name string) (T, error)
+}
+
+// UpdateStrategy says how an existing O is updated.
+type UpdateStrategy int
+
+const (
+	// UpdateReplace writes the desired O, after Config.Preserve.
+	// Only the fields of the existing O that Preserve copies are
+	// kept, the others set by someone else are reset. Use
+	// UpdateMergeManaged or UpdateApply to keep them.
+	UpdateReplace UpdateStrategy = iota
+	// UpdateMergeManaged fetches the live O with Owned.Get and
+	// writes the result of Config.Merge, so that the fields set by
+	// others, such as mutating webhooks, are kept. Without
+	// Owned.Get, the O from the watch is merged.
+	UpdateMergeManaged
+	// UpdateApply writes the desired O, after Config.Preserve, with
+	// Owned.Apply, so that the api server only makes us own the
+	// fields set in it and keeps the ones others manage. No
+	// resource version is needed.
+	UpdateApply
+)
+
+// CollisionPolicy says what to do when the O a T should own exists
+// but is controlled by something else.
+type CollisionPolicy int
+
+const (
+	// CollisionSkip leaves the O alone and checks it again on the
+	// next synchronization.
+	CollisionSkip CollisionPolicy = iota
+	// CollisionFail reports the collision with
+	// Config.ReportCollision and doesn't check again until T is
+	// modified.
+	CollisionFail
+	// CollisionForceAdopt replaces the controller reference of the O
+	// with one to T. This takes the O away from its current owner, so
+	// it must be explicitly requested. If Config.CanAdopt refuses, a
+	// Warning event is recorded and the O is left alone as with
+	// CollisionSkip.
+	CollisionForceAdopt
+	// CollisionAdoptOrphans adopts an O that has no controller
+	// reference, as CollisionForceAdopt does, and handles one
+	// controlled by something else as CollisionFail does.
+	CollisionAdoptOrphans
+)
+
+// SelectorChangePolicy says what to do when an existing O would need a
+// different selector, which cannot be changed in place.
+type SelectorChangePolicy int
+
+const (
+	// SelectorChangeError fails the synchronization, which is
+	// retried like any other error.
+	SelectorChangeError SelectorChangePolicy = iota
+	// SelectorChangeRecreate deletes the O and creates it again once
+	// the watch reports the deletion. Whatever the O runs is down
+	// in between.
+	SelectorChangeRecreate
+)
+
+// Config describes a custom resource T and how it owns a resource
+// O. T and O are in practice pointers to structs embedding
+// metav1.ObjectMeta. All the functions are required unless documented
+// otherwise.
+type Config[T, O metav1.Object] struct {
+	// GVK identifies T. NewOwned must set a controller reference
+	// with it, and only owner references matching it are
+	// considered ours.
+	GVK schema.GroupVersionKind
+
+	// OwnedKind is the kind of O, used in log and error messages.
+	OwnedKind string
+
+	// AddCRD registers T with the api server.
+	AddCRD func() error
+
+	// CheckNamespace is optional. If set, it is called with the
+	// watched namespace, unless all of them are, after AddCRD. An
+	// error stops the controller, as when the namespace doesn't
+	// exist.
+	CheckNamespace func(namespace string) error
+
+	Primary Resource[T]
+	Owned   Resource[O]
+
+	// OwnedName returns the name of the O that T should own.
+	OwnedName func(T) string
+	// NewOwned returns the O we want T to own. It must set a
+	// controller reference to T. It is only optional with Desired.
+	NewOwned func(T) O
+	// Desired is optional. If set, it is used instead of NewOwned,
+	// for an O that depends on the existing one, if has_existing, or
+	// that might not be computable. Errors are retried like those of
+	// Update. ctx is that of the controller.
+	Desired func(ctx context.Context, primary T, existing O, has_existing bool) (O, error)
+	// Wants is optional. If set and it returns false, T should own no
+	// O, and an existing one controlled by T is deleted.
+	Wants func(T) bool
+	// Equal reports whether an existing O already matches the
+	// desired one, in which case no update is needed.
+	Equal func(existing, desired O) bool
+
+	// Preserve is optional. If set, it is called before updating an
+	// existing O with desired, to copy to desired the parts of
+	// existing that are not managed by the controller.
+	Preserve func(existing, desired O)
+
+	// UpdateStrategy is UpdateReplace by default.
+	UpdateStrategy UpdateStrategy
+	// Merge is required with UpdateMergeManaged. It returns live with
+	// the fields managed by the controller taken from desired.
+	Merge func(live, desired O) O
+	// MinimalPatch is optional and not used with UpdateApply. If set
+	// and it returns a JSON merge patch that brings existing to
+	// desired, the O is updated with Owned.Patch instead of a
+	// replacement, so that a small change, like the replicas, doesn't
+	// rewrite what we don't manage.
+	MinimalPatch func(existing, desired O) (patch []byte, ok bool)
+
+	// Progress is optional. If set, it is called before updating an
+	// existing O and returns the O to write, which can be an
+	// intermediate step towards desired. done reports whether that
+	// O reaches desired.
+	Progress func(existing, desired O) (next O, done bool)
+	// MaxRetries, if positive, is how many consecutive times we try
+	// to synchronize an item that fails before giving up on it. It
+	// is then kept as a dead letter, see DeadLetters, until its T is
+	// modified, the next resync, see ResyncPeriod, or it is retried
+	// with RetryDeadLetter.
+	MaxRetries int
+	// FailureBackoff, if positive, is how long to wait before
+	// retrying an item that failed, doubled with each consecutive
+	// failure up to maxFailureBackoff. The other items are still
+	// synchronized. With zero, a failure ends the synchronization,
+	// which is retried as a whole once the rate limiter allows it.
+	FailureBackoff time.Duration
+
+	// UpdateStatus is optional. If set, it is called once the O of a
+	// T matches the desired one, so that the status of T can reflect
+	// that of O. Errors are retried like those of Update. recorder is
+	// Recorder, and logs the events it could not record with Logger.
+	UpdateStatus func(primary T, owned O, recorder events.Recorder) error
+
+	// CollisionPolicy is CollisionSkip by default.
+	CollisionPolicy CollisionPolicy
+	// CollisionBackoff, if positive, is how long to wait before
+	// checking again an O that is not ours, with CollisionSkip or
+	// when CanAdopt refuses. The wait doubles with each consecutive
+	// collision, up to maxCollisionBackoff, and is jittered so that
+	// many items colliding at once don't retry in lockstep. With
+	// zero, the O is checked again on the next synchronization.
+	CollisionBackoff time.Duration
+	// ConflictRetries, if positive, is how many consecutive times an
+	// O that is not ours is checked with CollisionSkip before an
+	// *OwnershipConflictError is sent on the Errors channel, once
+	// per conflict. Unlike the other errors, it doesn't stop the
+	// controller, which keeps checking.
+	ConflictRetries int
+	// CanAdopt is optional and only used with CollisionForceAdopt and
+	// CollisionAdoptOrphans. It returns why an O controlled by
+	// something else cannot be adopted by T, or nil if it can.
+	CanAdopt func(primary T, existing O) error
+	// ReportCollision is optional and only used with CollisionFail and
+	// CollisionAdoptOrphans, typically to set a condition on T. owned
+	// is the O controlled by something else.
+	ReportCollision func(primary T, owned O) error
+	// Validate is optional. If set and it returns an error, T is
+	// not synchronized until it is modified. The error is logged,
+	// recorded as a ReasonInvalid event and passed to ReportInvalid.
+	Validate func(T) error
+	// ReportInvalid is optional and only used with Validate,
+	// typically to set a condition on T.
+	ReportInvalid func(primary T, err error) error
+	// ReportConflict is optional. If set, it is called for a T that
+	// wants the same O as another T, winner, which gets it instead,
+	// typically to set a condition on T. See claimant for how the
+	// winner is picked.
+	ReportConflict func(primary, winner T) error
+	// ReportError is optional. If set, it is called with the error
+	// of each synchronization of T that fails, typically to set a
+	// condition on T.
+	ReportError func(primary T, err error) error
+	// ReportDeadLetter is optional. If set, it is called instead of
+	// ReportError when the controller gives up on T after failures
+	// consecutive failures, the last one with err, see MaxRetries.
+	ReportDeadLetter func(primary T, failures int, err error) error
+
+	// CheckSelector is optional. If set, it returns why existing
+	// cannot be updated to desired without changing its selector, or
+	// nil if it can. SelectorChangePolicy, SelectorChangeError by
+	// default, says what to do then.
+	CheckSelector        func(existing, desired O) error
+	SelectorChangePolicy SelectorChangePolicy
+
+	// Recorder is optional. If set, Events about T are recorded with
+	// it.
+	Recorder events.Recorder
+
+	// Logger is optional. By default, StdLogger is used.
+	Logger Logger
+	// Metrics is optional. By default, the metrics of the metrics
+	// package are recorded with OwnedKind as the controller label.
+	Metrics metrics.Recorder
+
+	// DryRun makes the controller only log the writes it would make,
+	// such as creating an O or the diff of updating one, without
+	// making them. Events are still watched and items synchronized.
+	// No finalizer is added then.
+	DryRun bool
+
+	// DrainOnShutdown makes Shutdown finish synchronizing the items
+	// already queued before stopping.
+	DrainOnShutdown bool
+
+	// DrainTimeout, if positive, bounds how long Shutdown drains the
+	// queue, even if its context allows more. No item is started
+	// after that, but those in flight are given the rest of the
+	// context to finish.
+	DrainTimeout time.Duration
+
+	// ProgressInterval is how long to wait after a step that is not
+	// done before synchronizing the item again. With zero, the next
+	// step happens as soon as the item is synchronized again, which
+	// is usually when the watch reports the update.
+	ProgressInterval time.Duration
+
+	// MinReconcileInterval, if positive, is the minimum time between
+	// two synchronizations of the same item. Changes in between are
+	// coalesced into one synchronization once the interval expires.
+	// Unlike the delays after failures, it applies to every item.
+	MinReconcileInterval time.Duration
+
+	// MinAge, if positive, is how old, according to its creation
+	// timestamp, a T must be before it is synchronized. It gives
+	// other controllers and webhooks a chance to settle a new T
+	// first.
+	MinAge time.Duration
+
+	// ResyncPeriod, if positive, is how often every cached T is
+	// queued, even if no watch event says it changed. It corrects
+	// drift, such as an O modified by hand, that we would otherwise
+	// miss.
+	ResyncPeriod time.Duration
+
+	// Workers is how many items are synchronized at once, 1 by
+	// default. An item is never synchronized by two workers at once.
+	// With more than one, the functions of the Config, such as
+	// UpdateStatus, are called concurrently for different items.
+	Workers int
+
+	// Finalizer is optional. If set, it is added to every T with
+	// Primary.Update, so that a deleted T is kept until we clean up
+	// after it: its O is deleted, Cleanup is called and then the
+	// finalizer is removed.
+	Finalizer string
+	// Cleanup is optional and only used with Finalizer. It releases
+	// what a deleted T had outside of its O. Errors are retried like
+	// those of Update.
+	Cleanup func(primary T) error
+}
+
+// check panics if a required function is missing, as otherwise we
+// would only find out deep inside synchronize.
+func (config *Config[T, O]) check() {
+	missing := func(name string) {
+		panic(fmt.Sprintf("controller: Config.%s is required", name))
+	}
+	switch {
+	case config.AddCRD == nil:
+		missing("AddCRD")
+	case config.Primary.Watch == nil:
+		missing("Primary.Watch")
+	case config.Owned.Watch == nil:
+		missing("Owned.Watch")
+	case config.Owned.Add == nil:
+		missing("Owned.Add")
+	case config.Owned.Update == nil:
+		missing("Owned.Update")
+	case config.Owned.Delete == nil:
+		missing("Owned.Delete")
+	case config.OwnedName == nil:
+		missing("OwnedName")
+	case config.NewOwned == nil && config.Desired == nil:
+		missing("NewOwned")
+	case config.Equal == nil:
+		missing("Equal")
+	case config.UpdateStrategy == UpdateMergeManaged && config.Merge == nil:
+		missing("Merge")
+	case config.UpdateStrategy == UpdateApply && config.Owned.Apply == nil:
+		missing("Owned.Apply")
+	case config.MinimalPatch != nil && config.Owned.Patch == nil:
+		missing("Owned.Patch")
+	case config.Finalizer != "" && config.Primary.Update == nil:
+		missing("Primary.Update")
+	}
+}
+
+// GenericController keeps the resources of type O owned by the
+// custom resources of type T in sync with them.
+type GenericController[T, O metav1.Object] struct {
+	// Namespace is the one watched, or empty for all of them.
+	Namespace string
+	// Errors receives the error that stopped the controller, and the
+	// *OwnershipConflictErrors of Config.ConflictRetries.
+	Errors chan error
+
+	// mu protects the stop channels, which are set by the
+	// controller goroutine and closed by RequestStop.
+	mu            sync.Mutex
+	stopRequested bool
+	stopPrimaries chan<- struct{}
+	stopOwned     chan<- struct{}
+	// stopped is closed by RequestStop.
+	stopped chan struct{}
+
+	// leading, if not nil, is closed once the controller may start,
+	// see NewLeaderElectedController.
+	leading <-chan struct{}
+
+	// done is closed once the controller goroutine has returned.
+	done chan struct{}
+	// abandoned holds the items left in todo when a drain gave up. It
+	// is only written by the controller goroutine before done is
+	// closed.
+	abandoned []string
+
+	// running is 1 while the controller goroutine is processing, see
+	// Running. Only accessed atomically.
+	running int32
+
+	// summary is only written by the controller goroutine before
+	// done is closed.
+	summary ControllerSummary
+
+	// healthMu protects watching and failure, which are written by
+	// the controller goroutine and read by Healthy.
+	healthMu sync.Mutex
+	// watching is set once the watches are started.
+	watching bool
+	// failure is the error that stopped the controller, if any.
+	failure error
+
+	// deadMu protects dead, which is written by the controller
+	// goroutine and read by DeadLetters.
+	deadMu sync.Mutex
+	dead   map[string]FailedItem
+
+	// retry receives the dead letters to retry.
+	retry chan string
+	// retryFailed receives the requests of RetryFailed.
+	retryFailed chan struct{}
+	// previews receives the requests of Preview.
+	previews chan previewRequest[O]
+	// snapshots receives the requests of Snapshot.
+	snapshots chan chan ControllerSnapshot
+	// drain receives the deadline of Shutdown with DrainOnShutdown.
+	drain chan (<-chan struct{})
+	// selections receives the requests of PauseSelector,
+	// ResumeSelector and ResyncSelector.
+	selections chan selectionRequest
+	// enqueues receives the requests of Enqueue.
+	enqueues chan enqueueRequest
+
+	rl ratelimit.RateLimiter
+
+	// ctx is the context of the requests of the Foo controllers,
+	// see NewControllerContext. Once it is done, the controller
+	// stops. Shutdown cancels it once it is done waiting.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	config Config[T, O]
+}
+
+// FailedItem is an item the controller gave up on after
+// Config.MaxRetries failures.
+type FailedItem struct {
+	// Key is the namespace/name of the T.
+	Key      string
+	Failures int
+	// LastError is the error of the last failure.
+	LastError error
+	// Since is when the controller gave up.
+	Since time.Time
+}
+
+// NewGenericController starts a controller for config that watches
+// namespace, or all namespaces if it is empty. Errors are reported on
+// the Errors channel, which is closed once the controller stops. It
+// panics if config is missing a required function.
+func NewGenericController[T, O metav1.Object](config Config[T, O], rl ratelimit.RateLimiter,
+	namespace string) *GenericController[T, O] {
+	ctx, cancel := context.WithCancel(context.Background())
+	return newGenericController(ctx, cancel, config, rl, namespace, nil)
+}
+
+// newClientController is like NewGenericController with the Config
+// returned by newConfig, whose requests are made with a context
+// derived from parent.
+func newClientController[T, O metav1.Object, C Client](parent context.Context, client C,
+	newConfig func(C) Config[T, O], rl ratelimit.RateLimiter,
+	namespace string) *GenericController[T, O] {
+	ctx, cancel := context.WithCancel(parent)
+	return newGenericController(ctx, cancel, newConfig(withContext(client, ctx)), rl, namespace,
+		nil)
+}
+
+// newGenericController is NewGenericController with the context of the
+// requests of config. If leading is not nil, the controller waits for
+// it to be closed before adding the CRD and watching.
+func newGenericController[T, O metav1.Object](ctx context.Context, cancel context.CancelFunc,
+	config Config[T, O], rl ratelimit.RateLimiter, namespace string,
+	leading <-chan struct{}) *GenericController[T, O] {
+	config.check()
+	if config.Logger == nil {
+		config.Logger = StdLogger{}
+	}
+	if config.Metrics == nil {
+		config.Metrics = metrics.ForController(config.OwnedKind)
+	}
+	if config.DryRun {
+		config = dryRun(config)
+	}
+	ret := &GenericController[T, O]{ctx: ctx, cancel: cancel, leading: leading}
+
+	errors := make(chan error)
+	ret.Errors = errors
+	ret.done = make(chan struct{})
+	ret.stopped = make(chan struct{})
+	ret.dead = make(map[string]FailedItem)
+	ret.retry = make(chan string)
+	ret.retryFailed = make(chan struct{})
+	ret.previews = make(chan previewRequest[O])
+	ret.snapshots = make(chan chan ControllerSnapshot)
+	ret.drain = make(chan (<-chan struct{}))
+	ret.selections = make(chan selectionRequest)
+	ret.enqueues = make(chan enqueueRequest)
+
+	ret.rl = rl
+	ret.config = config
+	ret.Namespace = namespace
+
+	ret.start()
+
+	return ret
+}
+
+// RequestStop asks the controller to stop. It is done once c.Errors
+// is closed, see Wait. It is safe to call RequestStop more than once
+// and before the controller has started watching. A synchronization
+// in progress is completed first; to abort its requests, use Shutdown
+// or the context of NewControllerContext.
+func (c *GenericController[T, O]) RequestStop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopRequested {
+		return
+	}
+	c.stopRequested = true
+	close(c.stopped)
+	c.closeStops()
+}
+
+// Shutdown stops the controller and waits for it to be done, or for
+// ctx to be done, in which case it returns ctx.Err() and the requests
+// in flight are aborted. With Config.DrainOnShutdown, the controller
+// stops reading watch events but first synchronizes the queued items,
+// until there are none left or ctx (or Config.DrainTimeout) is done.
+// The items it gave up on are reported with an *AbandonedError. As
+// with Wait, c.Errors must be drained.
+func (c *GenericController[T, O]) Shutdown(ctx context.Context) error {
+	// Once we are done waiting, abort what is left.
+	defer c.cancel()
+	if c.config.DrainOnShutdown {
+		drainCtx := ctx
+		if c.config.DrainTimeout > 0 {
+			var cancel context.CancelFunc
+			drainCtx, cancel = context.WithTimeout(ctx, c.config.DrainTimeout)
+			defer cancel()
+		}
+		select {
+		case c.drain <- drainCtx.Done():
+		case <-c.done:
+		case <-ctx.Done():
+		}
+	}
+	// While draining the controller ignores the watches, so it is OK
+	// to stop them now.
+	c.RequestStop()
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		select {
+		case <-c.done:
+		default:
+			return ctx.Err()
+		}
+	}
+	if len(c.abandoned) != 0 {
+		return &AbandonedError{Items: c.abandoned}
+	}
+	return nil
+}
+
+// OwnershipConflictError reports an O that a T should own but that
+// is controlled by something else, after Config.ConflictRetries.
+type OwnershipConflictError struct {
+	// Kind, Namespace and Name are those of the O.
+	Kind      string
+	Namespace string
+	Name      string
+	// ActualOwner is the name of the controller of the O, or empty
+	// if it has none.
+	ActualOwner string
+}
+
+func (e *OwnershipConflictError) Error() string {
+	if e.ActualOwner == "" {
+		return fmt.Sprintf("%s %s/%s has no controller", e.Kind, e.Namespace, e.Name)
+	}
+	return fmt.Sprintf("%s %s/%s is controlled by %s", e.Kind, e.Namespace, e.Name,
+		e.ActualOwner)
+}
+
+// AbandonedError is returned by Shutdown when draining gave up before
+// every queued item was synchronized.
+type AbandonedError struct {
+	// Items are the keys of the items that were not synchronized.
+	Items []string
+}
+
+func (e *AbandonedError) Error() string {
+	return fmt.Sprintf("Gave up draining %d items", len(e.Items))
+}
+
+// stopping reports whether the controller should stop because of
+// RequestStop or its context. It must be called with c.mu held.
+func (c *GenericController[T, O]) stopping() bool {
+	return c.stopRequested || c.ctx.Err() != nil
+}
+
+// closeStops must be called with c.mu held.
+func (c *GenericController[T, O]) closeStops() {
+	if c.stopPrimaries != nil {
+		close(c.stopPrimaries)
+	}
+	if c.stopOwned != nil {
+		close(c.stopOwned)
+	}
+}
+
+// Running reports whether the controller goroutine is still
+// processing resources. It is false once the controller stopped,
+// either because of RequestStop or because of a fatal error, even if
+// that error has not been read from c.Errors yet.
+func (c *GenericController[T, O]) Running() bool {
+	return atomic.LoadInt32(&c.running) == 1
+}
+
+// Healthy reports whether the controller is watching both the
+// primaries and the owned resources. If not, the error says why. It is
+// false before the watches start, for example while waiting for
+// leader election, and once the controller stopped, in particular
+// after a watch failed.
+func (c *GenericController[T, O]) Healthy() (bool, error) {
+	c.healthMu.Lock()
+	defer c.healthMu.Unlock()
+	switch {
+	case c.failure != nil:
+		return false, c.failure
+	case !c.watching:
+		return false, errors.New("Not watching yet")
+	case !c.Running():
+		return false, errors.New("Stopped")
+	}
+	return true, nil
+}
+
+// Wait blocks until the controller goroutine has returned. By then
+// c.Errors is closed. Note that the controller blocks on reporting
+// errors, so c.Errors must be drained for Wait to return.
+func (c *GenericController[T, O]) Wait() {
+	<-c.done
+}
+
+// DeadLetters returns a snapshot of the items the controller gave up
+// on.
+func (c *GenericController[T, O]) DeadLetters() []FailedItem {
+	c.deadMu.Lock()
+	defer c.deadMu.Unlock()
+	ret := make([]FailedItem, 0, len(c.dead))
+	for _, item := range c.dead {
+		ret = append(ret, item)
+	}
+	return ret
+}
+
+// RetryDeadLetter puts a dead letter back in the work queue, with its
+// failure count reset. key is the FailedItem.Key.
+func (c *GenericController[T, O]) RetryDeadLetter(key string) error {
+	c.deadMu.Lock()
+	_, ok := c.dead[key]
+	delete(c.dead, key)
+	c.deadMu.Unlock()
+	if !ok {
+		return fmt.Errorf("%s is not a dead letter", key)
+	}
+	select {
+	case c.retry <- key:
+		return nil
+	case <-c.done:
+		return fmt.Errorf("Controller stopped")
+	}
+}
+
+// RetryFailed puts back in the work queue, with their failure counts
+// reset, all the items whose last synchronization failed, including
+// those waiting to be retried after a delay and the dead letters.
+// Other items are left alone.
+func (c *GenericController[T, O]) RetryFailed() error {
+	select {
+	case c.retryFailed <- struct{}{}:
+		return nil
+	case <-c.done:
+		return fmt.Errorf("Controller stopped")
+	}
+}
+
+type previewRequest[O metav1.Object] struct {
+	namespace, name string
+	reply           chan previewReply[O]
+}
+
+type previewReply[O metav1.Object] struct {
+	owned O
+	err   error
+}
+
+// Preview returns the O the controller would write for the cached T
+// with the given namespace and name, without writing it. If the O
+// already exists, this is the update that would be done, even if
+// Equal says none is needed.
+func (c *GenericController[T, O]) Preview(namespace, name string) (O, error) {
+	req := previewRequest[O]{namespace, name, make(chan previewReply[O], 1)}
+	select {
+	case c.previews <- req:
+		reply := <-req.reply
+		return reply.owned, reply.err
+	case <-c.done:
+		var zero O
+		return zero, fmt.Errorf("Controller stopped")
+	}
+}
+
+func (c *GenericController[T, O]) preview(status *controllerStatus[T, O],
+	req previewRequest[O]) previewReply[O] {
+	primary, ok := status.primaries[key(req.namespace, req.name)]
+	if !ok {
+		return previewReply[O]{err: fmt.Errorf("%s %s:%s not found", c.config.GVK.Kind,
+			req.namespace, req.name)}
+	}
+	if c.config.Wants != nil && !c.config.Wants(primary) {
+		return previewReply[O]{err: fmt.Errorf("%s %s:%s should own no %s",
+			c.config.GVK.Kind, req.namespace, req.name, c.config.OwnedKind)}
+	}
+	existing, has_existing := status.owned[c.ownedKey(primary)]
+	desired, err := c.desired(primary, existing, has_existing)
+	if err != nil {
+		return previewReply[O]{err: err}
+	}
+	if has_existing {
+		if desired, _, err = c.prepareUpdate(existing, desired); err != nil {
+			return previewReply[O]{err: err}
+		}
+	}
+	return previewReply[O]{owned: desired}
+}
+
+// desired returns the O primary wants, see Config.Desired.
+func (c *GenericController[T, O]) desired(primary T, existing O, has_existing bool) (O, error) {
+	if c.config.Desired != nil {
+		return c.config.Desired(c.ctx, primary, existing, has_existing)
+	}
+	return c.config.NewOwned(primary), nil
+}
+
+// ControllerSnapshot is a copy of what the controller knows, see
+// Snapshot. The keys are namespace/name, sorted.
+type ControllerSnapshot struct {
+	// Primaries are the keys of the cached Ts.
+	Primaries []string
+	// Owned are the keys of the cached Os.
+	Owned []string
+	// Todo are the keys of the Ts waiting to be synchronized.
+	Todo []string
+}
+
+// Snapshot returns a copy of what the controller knows, for tests and
+// debugging. It is taken between two synchronizations, so Todo is
+// what the next one will go over.
+func (c *GenericController[T, O]) Snapshot() (ControllerSnapshot, error) {
+	reply := make(chan ControllerSnapshot, 1)
+	select {
+	case c.snapshots <- reply:
+		return <-reply, nil
+	case <-c.done:
+		return ControllerSnapshot{}, fmt.Errorf("Controller stopped")
+	}
+}
+
+func (status *controllerStatus[T, O]) snapshot() ControllerSnapshot {
+	ret := ControllerSnapshot{
+		Primaries: make([]string, 0, len(status.primaries)),
+		Owned:     make([]string, 0, len(status.owned)),
+		Todo:      make([]string, 0, len(status.todo)),
+	}
+	for k := range status.primaries {
+		ret.Primaries = append(ret.Primaries, k)
+	}
+	for k := range status.owned {
+		ret.Owned = append(ret.Owned, k)
+	}
+	for k := range status.todo {
+		ret.Todo = append(ret.Todo, k)
+	}
+	sort.Strings(ret.Primaries)
+	sort.Strings(ret.Owned)
+	sort.Strings(ret.Todo)
+	return ret
+}
+
+// ControllerSummary is what the controller did until it stopped, see
+// Summary.
+type ControllerSummary struct {
+	// Reconciled is how many synchronizations of a T succeeded.
+	Reconciled int
+	// Errors is how many failed.
+	Errors int
+	// Pending are the sorted keys of the Ts that were waiting to be
+	// synchronized.
+	Pending []string
+}
+
+// Summary waits for the controller to stop, as Wait does, and returns
+// what it did.
+func (c *GenericController[T, O]) Summary() ControllerSummary {
+	<-c.done
+	return c.summary
+}
+
+// ErrNotFound is wrapped by the errors about a T the controller
+// doesn't know of.
+var ErrNotFound = errors.New("not found")
+
+type enqueueRequest struct {
+	namespace, name string
+	reply           chan error
+}
+
+// Enqueue asks the controller to synchronize the T with the given
+// namespace and name, as if the watch had reported a change to it. It
+// fails with ErrNotFound if the controller doesn't know of that T,
+// for example because it was created after the last list of a
+// PollWatch.
+func (c *GenericController[T, O]) Enqueue(namespace, name string) error {
+	req := enqueueRequest{namespace, name, make(chan error, 1)}
+	select {
+	case c.enqueues <- req:
+		return <-req.reply
+	case <-c.done:
+		return fmt.Errorf("Controller stopped")
+	}
+}
+
+type selectionOp int
+
+const (
+	pauseOp selectionOp = iota
+	resumeOp
+	resyncOp
+)
+
+type selectionRequest struct {
+	op    selectionOp
+	sel   labels.Selector
+	reply chan int
+}
+
+func (c *GenericController[T, O]) selection(op selectionOp, sel labels.Selector) (int, error) {
+	req := selectionRequest{op, sel, make(chan int, 1)}
+	select {
+	case c.selections <- req:
+		return <-req.reply, nil
+	case <-c.done:
+		return 0, fmt.Errorf("Controller stopped")
+	}
+}
+
+// PauseSelector stops synchronizing the cached Ts whose labels match
+// sel, until they are resumed with ResumeSelector. It returns how many
+// were paused.
+func (c *GenericController[T, O]) PauseSelector(sel labels.Selector) (int, error) {
+	return c.selection(pauseOp, sel)
+}
+
+// ResumeSelector synchronizes again the paused Ts whose labels match
+// sel. It returns how many were resumed.
+func (c *GenericController[T, O]) ResumeSelector(sel labels.Selector) (int, error) {
+	return c.selection(resumeOp, sel)
+}
+
+// ResyncSelector queues the cached Ts whose labels match sel, even if
+// nothing changed. Paused ones are still skipped. It returns how many
+// were queued.
+func (c *GenericController[T, O]) ResyncSelector(sel labels.Selector) (int, error) {
+	return c.selection(resyncOp, sel)
+}
+
+func (c *GenericController[T, O]) applySelection(status *controllerStatus[T, O],
+	req selectionRequest) int {
+	n := 0
+	for name, primary := range status.primaries {
+		if !req.sel.Matches(labels.Set(primary.GetLabels())) {
+			continue
+		}
+		_, paused := status.paused[name]
+		switch req.op {
+		case pauseOp:
+			status.paused[name] = struct{}{}
+		case resumeOp:
+			if !paused {
+				continue
+			}
+			delete(status.paused, name)
+			status.enqueue(name)
+		case resyncOp:
+			status.enqueue(name)
+		}
+		n++
+	}
+	return n
+}
+
+func (c *GenericController[T, O]) isDead(key string) bool {
+	c.deadMu.Lock()
+	defer c.deadMu.Unlock()
+	_, ok := c.dead[key]
+	return ok
+}
+
+// revive forgets that key is a dead letter.
+func (c *GenericController[T, O]) revive(key string) {
+	c.deadMu.Lock()
+	defer c.deadMu.Unlock()
+	delete(c.dead, key)
+}
+
+// key returns the key of the resource with the given namespace and
+// name in the maps of controllerStatus, which can have resources of
+// several namespaces.
+func key(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+func objectKey(obj metav1.Object) string {
+	return key(obj.GetNamespace(), obj.GetName())
+}
+
+// ownedKey returns the key of the O that primary should own, which is
+// in the same namespace.
+func (c *GenericController[T, O]) ownedKey(primary T) string {
+	return key(primary.GetNamespace(), c.config.OwnedName(primary))
+}
+
+// The maps are keyed by namespace/name, see key.
+type controllerStatus[T, O metav1.Object] struct {
+	// Map from name to the custom resource
+	primaries map[string]T
+
+	// Map from the name to the owned resource
+	owned map[string]O
+
+	// Set of names of primaries we have to check
+	todo map[string]struct{}
+
+	// Set of names of owned resources that might be orphans, that
+	// is, controlled by a primary that now owns another one. See
+	// deleteOrphans.
+	orphans map[string]struct{}
+
+	// Names of primaries that will be added back to todo after a
+	// delay. processResources calls Done once it added them.
+	delayed *workqueue.Queue
+
+	// How many consecutive times synchronizing each primary failed,
+	// for Config.FailureBackoff and Config.MaxRetries
+	failures *workqueue.Backoff
+
+	// Map from a name of a primary to how many consecutive times its
+	// O was not ours, for Config.CollisionBackoff and
+	// Config.ConflictRetries
+	collisions map[string]int
+
+	// Set of names of primaries that are not synchronized, see
+	// PauseSelector
+	paused map[string]struct{}
+
+	// Set of names of owned resources deleted while their primary
+	// still wanted them, so that creating them again is a recreate
+	deleted map[string]struct{}
+
+	// Map from the names in todo to when they were added, for
+	// metrics.QueueLatency
+	queued map[string]time.Time
+
+	// Map from a name of a primary to when it was last synchronized,
+	// for Config.MinReconcileInterval
+	reconciled map[string]time.Time
+}
+
+// enqueue adds name to todo.
+func (status *controllerStatus[T, O]) enqueue(name string) {
+	if _, ok := status.todo[name]; !ok {
+		status.todo[name] = struct{}{}
+		status.queued[name] = time.Now()
+	}
+}
+
+func newControllerStatus[T, O metav1.Object](
+	failureBackoff time.Duration) controllerStatus[T, O] {
+	return controllerStatus[T, O]{
+		primaries:  make(map[string]T),
+		owned:      make(map[string]O),
+		todo:       make(map[string]struct{}),
+		orphans:    make(map[string]struct{}),
+		delayed:    workqueue.New(),
+		failures:   workqueue.NewBackoff(failureBackoff, maxFailureBackoff),
+		collisions: make(map[string]int),
+		paused:     make(map[string]struct{}),
+		deleted:    make(map[string]struct{}),
+		queued:     make(map[string]time.Time),
+		reconciled: make(map[string]time.Time),
+	}
+}
+
+// reconcileResult is the outcome of processOneItem. With Requeue the
+// item stays in todo and is retried on the next synchronization. With
+// RequeueAfter the item is not synchronized again, even if there are
+// new watch events for it, until that delay expires. It is then
+// retried once the rate limiter allows. Err is the error, if any, that
+// caused the retry. Collisions, if positive, is how many consecutive
+// times the O was not ours, for Config.CollisionBackoff and
+// Config.ConflictRetries.
+type reconcileResult struct {
+	Requeue      bool
+	RequeueAfter time.Duration
+	Err          error
+	Collisions   int
+}
+
+// resultFromError converts the error of a request to the api
+// server. If the server is throttling us, we retry after the delay it
+// suggested.
+func resultFromError(err error) reconcileResult {
+	var re *kubeapi.RequestError
+	if errors.As(err, &re) && re.StatusCode == http.StatusTooManyRequests && re.RetryAfter > 0 {
+		return reconcileResult{RequeueAfter: re.RetryAfter, Err: err}
+	}
+	return reconcileResult{Err: err}
+}
+
+// itemWork is what processOneItem needs from the controllerStatus to
+// synchronize an item. It is copied before, so that the workers of
+// Config.Workers don't access the controllerStatus.
+type itemWork[T, O metav1.Object] struct {
+	item         string
+	primary      T
+	has_primary  bool
+	existing     O
+	has_existing bool
+	// winner is the T that gets the O primary wants, if it is not
+	// primary.
+	winner     T
+	has_winner bool
+	// leftovers are the Os still controlled by the T of item, if
+	// it has no primary.
+	leftovers  []O
+	collisions int
+	// failures is how many times in a row item failed before.
+	failures int
+	// recreate is whether the O primary wants was deleted under it.
+	recreate bool
+}
+
+func (c *GenericController[T, O]) newItemWork(status *controllerStatus[T, O],
+	item string) itemWork[T, O] {
+	work := itemWork[T, O]{item: item, collisions: status.collisions[item],
+		failures: status.failures.NumRequeues(item)}
+	work.primary, work.has_primary = status.primaries[item]
+	if work.has_primary {
+		work.existing, work.has_existing = status.owned[c.ownedKey(work.primary)]
+		_, work.recreate = status.deleted[c.ownedKey(work.primary)]
+		winner := c.claimant(status, work.primary, work.existing, work.has_existing)
+		if objectKey(winner) != item {
+			work.winner, work.has_winner = winner, true
+		}
+		return work
+	}
+	for _, owned := range status.owned {
+		cont := metav1.GetControllerOfNoCopy(owned)
+		if cont != nil && c.isPrimaryRef(*cont) && key(owned.GetNamespace(), cont.Name) == item {
+			work.leftovers = append(work.leftovers, owned)
+		}
+	}
+	return work
+}
+
+// claimant returns which of the Ts that want the same O as primary
+// gets it: the one controlling existing, if any, or else the oldest,
+// by creation timestamp and then by name.
+func (c *GenericController[T, O]) claimant(status *controllerStatus[T, O], primary T,
+	existing O, has_existing bool) T {
+	ownedKey := c.ownedKey(primary)
+	winner := primary
+	for _, other := range status.primaries {
+		if c.ownedKey(other) != ownedKey || (c.config.Wants != nil && !c.config.Wants(other)) {
+			continue
+		}
+		if has_existing && metav1.IsControlledBy(existing, other) {
+			return other
+		}
+		if older(other, winner) {
+			winner = other
+		}
+	}
+	return winner
+}
+
+// older reports whether a was created before b, or at the same time
+// with a smaller name.
+func older(a, b metav1.Object) bool {
+	createdA, createdB := a.GetCreationTimestamp(), b.GetCreationTimestamp()
+	if !createdA.Equal(&createdB) {
+		return createdA.Before(&createdB)
+	}
+	return a.GetName() < b.GetName()
+}
+
+// enqueueRivals queues the other Ts that want the same O as primary,
+// which might get it now that primary was deleted or renamed.
+func (c *GenericController[T, O]) enqueueRivals(status *controllerStatus[T, O], primary T) {
+	ownedKey := c.ownedKey(primary)
+	for primaryKey, other := range status.primaries {
+		if c.ownedKey(other) == ownedKey && primaryKey != objectKey(primary) {
+			status.enqueue(primaryKey)
+		}
+	}
+}
+
+// recoverOneItem is processOneItem, but a panic is logged and
+// reported as a failure of the item, retried like any other, instead
+// of crashing the controller.
+func (c *GenericController[T, O]) recoverOneItem(work itemWork[T, O],
+	id string) (res reconcileResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := fmt.Errorf("Synchronize panicked: %v", r)
+			c.config.Logger.Error(err, "Recovered", c.itemFields(id, work.item,
+				"stack", string(debug.Stack()))...)
+			res = reconcileResult{Err: err}
+		}
+	}()
+	return c.processOneItem(work, id)
+}
+
+// processOneItem synchronizes an item. id identifies this
+// synchronization in logs and events.
+func (c *GenericController[T, O]) processOneItem(work itemWork[T, O], id string) reconcileResult {
+	item, collisions := work.item, work.collisions
+	primary, has_primary := work.primary, work.has_primary
+	if !has_primary {
+		return c.deleteLeftovers(work, id)
+	}
+
+	if c.config.Finalizer != "" && primary.GetDeletionTimestamp() != nil {
+		return c.finalize(work, id)
+	}
+
+	if c.config.Validate != nil {
+		if err := c.config.Validate(primary); err != nil {
+			return c.invalid(id, item, primary, err)
+		}
+	}
+
+	if work.has_winner {
+		return c.nameConflict(id, item, primary, work.winner)
+	}
+
+	if wait := c.ageWait(primary); wait > 0 {
+		c.config.Logger.Info("Too new, waiting", c.itemFields(id, item, "wait", wait)...)
+		return reconcileResult{RequeueAfter: wait}
+	}
+
+	if c.config.Finalizer != "" && !c.config.DryRun && !c.hasFinalizer(primary) {
+		if gone, err := c.setFinalizer(primary, true); err != nil {
+			return resultFromError(err)
+		} else if gone {
+			// We will get a delete event for it.
+			return reconcileResult{}
+		}
+	}
+
+	if c.config.Wants != nil && !c.config.Wants(primary) {
+		existing := work.existing
+		if work.has_existing && metav1.IsControlledBy(existing, primary) {
+			c.config.Logger.Info("Deleting", c.ownedFields(id, item, existing)...)
+			if err := c.config.Owned.Delete(existing); err != nil {
+				return resultFromError(err)
+			}
+		}
+		return reconcileResult{}
+	}
+
+	existing, has_existing := work.existing, work.has_existing
+	desired, err := c.desired(primary, existing, has_existing)
+	if err != nil {
+		return resultFromError(err)
+	}
+	if has_existing {
+		adopt := false
+		if !metav1.IsControlledBy(existing, primary) {
+			policy := c.config.CollisionPolicy
+			if policy == CollisionAdoptOrphans {
+				policy = CollisionFail
+				if metav1.GetControllerOfNoCopy(existing) == nil {
+					policy = CollisionForceAdopt
+				}
+			}
+			switch policy {
+			case CollisionForceAdopt:
+				if c.config.CanAdopt != nil {
+					if err := c.config.CanAdopt(primary, existing); err != nil {
+						c.config.Logger.Error(err, "Not adopting",
+							c.ownedFields(id, item, existing)...)
+						c.recordEvent(id, primary, corev1.EventTypeWarning,
+							"AdoptionRefused", err.Error())
+						return c.collided(collisions + 1)
+					}
+				}
+				c.config.Logger.Info("Adopting", c.ownedFields(id, item, existing)...)
+				// desired has our controller reference.
+				adopt = true
+			case CollisionFail:
+				c.config.Logger.Error(errors.New(notOursMessage(c.config.OwnedKind, existing)),
+					"Not owned by us, giving up", c.ownedFields(id, item, existing)...)
+				c.ownershipConflict(id, primary, existing)
+				if c.config.ReportCollision != nil {
+					if err := c.config.ReportCollision(primary, existing); err != nil {
+						return resultFromError(err)
+					}
+				}
+				return reconcileResult{}
+			default:
+				c.config.Logger.Info("Not owned by us", c.ownedFields(id, item, existing)...)
+				if collisions == 0 {
+					// Not again on every retry.
+					c.ownershipConflict(id, primary, existing)
+				}
+				if collisions+1 == c.config.ConflictRetries {
+					c.reportConflict(existing)
+				}
+				return c.collided(collisions + 1)
+			}
+		}
+		// CanAdopt checks an O we adopt.
+		if !adopt && c.config.CheckSelector != nil {
+			if err := c.config.CheckSelector(existing, desired); err != nil {
+				return c.selectorChanged(id, primary, existing, err)
+			}
+		}
+		if !adopt && c.config.Equal(existing, desired) {
+			if c.config.UpdateStatus != nil {
+				var recorder events.Recorder
+				if c.config.Recorder != nil {
+					recorder = statusRecorder[T, O]{reconcileRecorder{c.config.Recorder, id}, c}
+				}
+				if err := c.config.UpdateStatus(primary, existing, recorder); err != nil {
+					return resultFromError(err)
+				}
+			}
+			return reconcileResult{}
+		}
+	}
+
+	done := true
+	if has_existing {
+		if desired, done, err = c.prepareUpdate(existing, desired); err != nil {
+			return resultFromError(err)
+		}
+		if c.config.DryRun {
+			c.logDiff(id, item, existing, desired)
+		}
+		if c.config.UpdateStrategy == UpdateApply {
+			err = c.config.Owned.Apply(desired)
+		} else if patch, ok := c.minimalPatch(existing, desired); ok {
+			err = c.config.Owned.Patch(existing, patch)
+		} else {
+			desired, done, err = c.update(id, item, primary, existing, desired, done)
+		}
+	} else {
+		if primary.GetDeletionTimestamp() != nil {
+			// Without our finalizer, the O can be deleted
+			// before primary is.
+			c.config.Logger.Info("Being deleted, not creating the owned object",
+				c.itemFields(id, item, "ownedKind", c.config.OwnedKind)...)
+			return reconcileResult{}
+		}
+		if gone, err := c.primaryGone(primary); err != nil {
+			return resultFromError(err)
+		} else if gone {
+			// We will get a delete event for it.
+			c.config.Logger.Info("Deleted, not creating the owned object",
+				c.itemFields(id, item, "ownedKind", c.config.OwnedKind)...)
+			return reconcileResult{}
+		}
+		err = c.config.Owned.Add(desired)
+	}
+	if err != nil {
+		if has_existing {
+			c.recordEvent(id, primary, corev1.EventTypeWarning, ReasonUpdateFailed+c.config.OwnedKind,
+				fmt.Sprintf("Could not update %s %s: %s", c.config.OwnedKind, desired.GetName(), err))
+		} else {
+			c.recordEvent(id, primary, corev1.EventTypeWarning, ReasonCreateFailed+c.config.OwnedKind,
+				fmt.Sprintf("Could not create %s %s: %s", c.config.OwnedKind, desired.GetName(), err))
+		}
+		return resultFromError(err)
+	}
+	if has_existing {
+		c.recordEvent(id, primary, corev1.EventTypeNormal, ReasonScaled+c.config.OwnedKind,
+			fmt.Sprintf("Updated %s %s", c.config.OwnedKind, desired.GetName()))
+	} else if work.recreate {
+		c.recordEvent(id, primary, corev1.EventTypeNormal, ReasonSynced+c.config.OwnedKind,
+			fmt.Sprintf("Recreated deleted %s %s", c.config.OwnedKind, desired.GetName()))
+	} else {
+		c.recordEvent(id, primary, corev1.EventTypeNormal, ReasonSynced+c.config.OwnedKind,
+			fmt.Sprintf("Created %s %s", c.config.OwnedKind, desired.GetName()))
+	}
+	if !done {
+		return reconcileResult{RequeueAfter: c.config.ProgressInterval}
+	}
+	return reconcileResult{}
+}
+
+// Reasons of the events recorded about a T when writing its O. All but
+// ReasonOwnershipConflict, ReasonNameConflict and ReasonInvalid are
+// followed by Config.OwnedKind, as in "SyncedDeployment".
+const (
+	ReasonSynced            = "Synced"
+	ReasonScaled            = "Scaled"
+	ReasonCreateFailed      = "CreateFailed"
+	ReasonUpdateFailed      = "UpdateFailed"
+	ReasonOwnershipConflict = "OwnershipConflict"
+	ReasonNameConflict      = "NameConflict"
+	ReasonInvalid           = "Invalid"
+)
+
+// invalid refuses to synchronize primary, which Config.Validate
+// rejected with err.
+func (c *GenericController[T, O]) invalid(id, item string, primary T,
+	err error) reconcileResult {
+	c.config.Logger.Error(err, "Not synchronizing an invalid "+c.config.GVK.Kind,
+		c.itemFields(id, item)...)
+	c.recordEvent(id, primary, corev1.EventTypeWarning, ReasonInvalid, err.Error())
+	if c.config.ReportInvalid != nil {
+		if err := c.config.ReportInvalid(primary, err); err != nil {
+			return resultFromError(err)
+		}
+	}
+	return reconcileResult{}
+}
+
+// nameConflict refuses to synchronize primary, whose O is wanted by
+// winner too. It is synchronized again once winner is deleted or
+// wants another O.
+func (c *GenericController[T, O]) nameConflict(id, item string, primary,
+	winner T) reconcileResult {
+	message := fmt.Sprintf("%s %s is also wanted by %s %s", c.config.OwnedKind,
+		c.config.OwnedName(primary), c.config.GVK.Kind, winner.GetName())
+	c.config.Logger.Error(errors.New(message), "Not synchronizing",
+		c.itemFields(id, item, "winner", winner.GetName())...)
+	c.recordEvent(id, primary, corev1.EventTypeWarning, ReasonNameConflict, message)
+	if c.config.ReportConflict != nil {
+		if err := c.config.ReportConflict(primary, winner); err != nil {
+			return resultFromError(err)
+		}
+	}
+	return reconcileResult{}
+}
+
+// ownershipConflict records that existing, the O of primary, is not
+// controlled by primary.
+func (c *GenericController[T, O]) ownershipConflict(id string, primary T, existing O) {
+	message := notOursMessage(c.config.OwnedKind, existing)
+	if c.controlledByPrevious(primary, existing) {
+		message = fmt.Sprintf("%s %s is controlled by a previous %s with the same name",
+			c.config.OwnedKind, existing.GetName(), c.config.GVK.Kind)
+	}
+	c.recordEvent(id, primary, corev1.EventTypeWarning, ReasonOwnershipConflict, message)
+}
+
+// controlledByPrevious reports whether existing is controlled by a T
+// with the name of primary but another UID, one that was deleted and
+// created again. Until the Kubernetes garbage collector deletes it,
+// existing is not ours.
+func (c *GenericController[T, O]) controlledByPrevious(primary T, existing O) bool {
+	cont := metav1.GetControllerOfNoCopy(existing)
+	return cont != nil && c.isPrimaryRef(*cont) && cont.Name == primary.GetName() &&
+		cont.UID != primary.GetUID()
+}
+
+// notOursMessage explains why existing, of kind, is not ours.
+func notOursMessage(kind string, existing metav1.Object) string {
+	if metav1.GetControllerOfNoCopy(existing) == nil {
+		return fmt.Sprintf("%s %s already exists and has no controller", kind,
+			existing.GetName())
+	}
+	return fmt.Sprintf("%s %s is controlled by something else", kind, existing.GetName())
+}
+
+// reportConflict sends an *OwnershipConflictError about existing on
+// c.Errors, unless the controller is aborted first.
+func (c *GenericController[T, O]) reportConflict(existing O) {
+	err := &OwnershipConflictError{Kind: c.config.OwnedKind,
+		Namespace: existing.GetNamespace(), Name: existing.GetName()}
+	if cont := metav1.GetControllerOfNoCopy(existing); cont != nil {
+		err.ActualOwner = cont.Kind + " " + cont.Name
+	}
+	select {
+	case c.Errors <- err:
+	case <-c.ctx.Done():
+	}
+}
+
+// collided returns the result of the nth consecutive synchronization
+// of an item whose O is not ours. With Config.CollisionBackoff, it is
+// retried after that doubled n-1 times, up to maxCollisionBackoff, plus
+// or minus 20%.
+func (c *GenericController[T, O]) collided(n int) reconcileResult {
+	if c.config.CollisionBackoff <= 0 {
+		return reconcileResult{Requeue: true, Collisions: n}
+	}
+	delay := workqueue.ExponentialDelay(c.config.CollisionBackoff, maxCollisionBackoff, n-1)
+	return reconcileResult{RequeueAfter: workqueue.Jitter(delay, 0.2), Collisions: n}
+}
+
+// selectorChanged applies Config.SelectorChangePolicy to existing,
+// which cannot be updated because of err.
+func (c *GenericController[T, O]) selectorChanged(id string, primary T, existing O,
+	err error) reconcileResult {
+	if c.config.SelectorChangePolicy != SelectorChangeRecreate {
+		return reconcileResult{Err: err}
+	}
+	c.config.Logger.Info("Recreating",
+		c.ownedFields(id, objectKey(primary), existing, "reason", err)...)
+	if err := c.config.Owned.Delete(existing); err != nil {
+		return resultFromError(err)
+	}
+	c.recordEvent(id, primary, corev1.EventTypeNormal, "Recreating",
+		fmt.Sprintf("Deleted %s %s to create it with a new selector: %s", c.config.OwnedKind,
+			existing.GetName(), err))
+	// The deletion event from the watch brings us back to create it.
+	return reconcileResult{}
+}
+
+// recordEvent records an event about primary, if there is a
+// Config.Recorder.
+func (c *GenericController[T, O]) recordEvent(id string, primary T, eventType, reason,
+	message string) {
+	if c.config.Recorder == nil {
+		return
+	}
+	recorder := reconcileRecorder{c.config.Recorder, id}
+	if err := recorder.RecordEvent(primary, c.config.GVK, eventType, reason, message); err != nil {
+		c.config.Logger.Error(err, "Could not record event",
+			c.itemFields(id, objectKey(primary), "reason", reason)...)
+	}
+}
+
+// statusRecorder is the Recorder given to Config.UpdateStatus. It logs
+// the events that could not be recorded, as UpdateStatus has no way to
+// report them.
+type statusRecorder[T, O metav1.Object] struct {
+	reconcileRecorder
+	c *GenericController[T, O]
+}
+
+func (r statusRecorder[T, O]) RecordEvent(obj metav1.Object, gvk schema.GroupVersionKind,
+	eventType, reason, message string) error {
+	err := r.reconcileRecorder.RecordEvent(obj, gvk, eventType, reason, message)
+	if err != nil {
+		r.c.config.Logger.Error(err, "Could not record event",
+			r.c.itemFields(r.id, objectKey(obj), "reason", reason)...)
+	}
+	return err
+}
+
+// prepareUpdate returns the O to write to update existing towards
+// desired, and whether it reaches desired.
+func (c *GenericController[T, O]) prepareUpdate(existing, desired O) (O, bool, error) {
+	done := true
+	if c.config.UpdateStrategy == UpdateMergeManaged {
+		if c.config.Owned.Get != nil {
+			live, err := c.config.Owned.Get(existing.GetNamespace(), existing.GetName())
+			if err != nil {
+				return desired, false, fmt.Errorf("Could not get %s %s:%s: %w",
+					c.config.OwnedKind, existing.GetNamespace(), existing.GetName(), err)
+			}
+			existing = live
+		}
+		desired = c.config.Merge(existing, desired)
+	} else if c.config.Preserve != nil {
+		c.config.Preserve(existing, desired)
+	}
+	if c.config.Progress != nil {
+		desired, done = c.config.Progress(existing, desired)
+	}
+	if c.config.UpdateStrategy != UpdateApply {
+		desired.SetResourceVersion(existing.GetResourceVersion())
+	}
+	return desired, done, nil
+}
+
+// minimalPatch returns the Config.MinimalPatch from existing to
+// desired, if there is one.
+func (c *GenericController[T, O]) minimalPatch(existing, desired O) ([]byte, bool) {
+	if c.config.MinimalPatch == nil {
+		return nil, false
+	}
+	return c.config.MinimalPatch(existing, desired)
+}
+
+// maxUpdateConflicts is how many times update computes the update
+// again after a conflict before giving up.
+const maxUpdateConflicts = 3
+
+// update writes desired, the update of existing, which prepareUpdate
+// reported done or not. If existing was stale, so that the api server
+// reports a conflict, the update is computed again from the current O
+// fetched with Owned.Get. It returns what it wrote last.
+func (c *GenericController[T, O]) update(id, item string, primary T, existing, desired O,
+	done bool) (O, bool, error) {
+	err := c.config.Owned.Update(desired)
+	for conflicts := 0; isConflict(err) && c.config.Owned.Get != nil &&
+		conflicts < maxUpdateConflicts; conflicts++ {
+		c.config.Logger.Info("Conflict, updating the current one",
+			c.ownedFields(id, item, existing)...)
+		namespace, name := existing.GetNamespace(), existing.GetName()
+		if existing, err = c.config.Owned.Get(namespace, name); err != nil {
+			return desired, false, fmt.Errorf("Could not get %s %s:%s: %w",
+				c.config.OwnedKind, namespace, name, err)
+		}
+		if !metav1.IsControlledBy(existing, primary) {
+			// The watch brings us back to it.
+			return desired, false, errors.New(notOursMessage(c.config.OwnedKind, existing))
+		}
+		if desired, err = c.desired(primary, existing, true); err != nil {
+			return desired, false, err
+		}
+		if c.config.Equal(existing, desired) {
+			return desired, done, nil
+		}
+		if desired, done, err = c.prepareUpdate(existing, desired); err != nil {
+			return desired, false, err
+		}
+		err = c.config.Owned.Update(desired)
+	}
+	return desired, done, err
+}
+
+func (c *GenericController[T, O]) hasFinalizer(primary T) bool {
+	for _, f := range primary.GetFinalizers() {
+		if f == c.config.Finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// setFinalizer adds or removes our finalizer from primary. It reports
+// whether primary no longer exists. primary is only changed if the
+// update succeeds.
+func (c *GenericController[T, O]) setFinalizer(primary T, add bool) (bool, error) {
+	old := primary.GetFinalizers()
+	var finalizers []string
+	for _, f := range old {
+		if f != c.config.Finalizer {
+			finalizers = append(finalizers, f)
+		}
+	}
+	if add {
+		finalizers = append(finalizers, c.config.Finalizer)
+	}
+	primary.SetFinalizers(finalizers)
+	err := c.config.Primary.Update(primary)
+	if err != nil {
+		primary.SetFinalizers(old)
+	}
+	if isNotFound(err) {
+		return true, nil
+	}
+	return false, err
+}
+
+// finalize cleans up after primary, which is being deleted, and
+// removes our finalizer so that the deletion can complete.
+func (c *GenericController[T, O]) finalize(work itemWork[T, O], id string) reconcileResult {
+	primary := work.primary
+	if !c.hasFinalizer(primary) {
+		// Already done, we are waiting for the delete event.
+		return reconcileResult{}
+	}
+	existing := work.existing
+	if work.has_existing && metav1.IsControlledBy(existing, primary) {
+		c.config.Logger.Info("Deleting", c.ownedFields(id, work.item, existing)...)
+		if err := c.config.Owned.Delete(existing); err != nil && !isNotFound(err) {
+			return resultFromError(err)
+		}
+	}
+	if c.config.Cleanup != nil {
+		if err := c.config.Cleanup(primary); err != nil {
+			return resultFromError(err)
+		}
+	}
+	c.config.Logger.Info("Removing finalizer",
+		c.itemFields(id, work.item, "finalizer", c.config.Finalizer)...)
+	// If it is already gone, there is nothing left to do.
+	_, err := c.setFinalizer(primary, false)
+	return resultFromError(err)
+}
+
+// deleteLeftovers deletes the Os of work, whose T is gone, rather
+// than leaving them to the Kubernetes garbage collector, which might
+// be disabled or lagging. As we might not have heard about the T yet,
+// we only do so once Primary.Get confirms it is gone.
+func (c *GenericController[T, O]) deleteLeftovers(work itemWork[T, O], id string) reconcileResult {
+	for _, owned := range work.leftovers {
+		cont := metav1.GetControllerOfNoCopy(owned)
+		gone, err := c.uidGone(owned.GetNamespace(), cont.Name, cont.UID)
+		if err != nil {
+			return resultFromError(err)
+		}
+		if !gone {
+			continue
+		}
+		c.config.Logger.Info("Deleting leftover", c.ownedFields(id, work.item, owned)...)
+		if err := c.config.Owned.Delete(owned); err != nil && !isNotFound(err) {
+			return resultFromError(err)
+		}
+	}
+	return reconcileResult{}
+}
+
+// primaryGone reports whether primary no longer exists in the api
+// server, or was replaced by a new one with the same name.
+func (c *GenericController[T, O]) primaryGone(primary T) (bool, error) {
+	return c.uidGone(primary.GetNamespace(), primary.GetName(), primary.GetUID())
+}
+
+// uidGone reports whether the primary namespace/name with uid no
+// longer exists in the api server. Without Primary.Get, we can't
+// tell, and it is assumed to exist.
+func (c *GenericController[T, O]) uidGone(namespace, name string, uid types.UID) (bool, error) {
+	if c.config.Primary.Get == nil {
+		return false, nil
+	}
+	current, err := c.config.Primary.Get(namespace, name)
+	var re *kubeapi.RequestError
+	if errors.As(err, &re) && re.StatusCode == http.StatusNotFound {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return current.GetUID() != uid, nil
+}
+
+// itemResult is the outcome of synchronizing an item.
+type itemResult struct {
+	item string
+	id   string
+	res  reconcileResult
+}
+
+// synchronize synchronizes the items in todo, up to Config.Workers at
+// a time. Once one fails, or stop is closed, no more are started, and
+// the error is returned once those in flight are done.
+func (c *GenericController[T, O]) synchronize(status *controllerStatus[T, O],
+	stop <-chan struct{}) error {
+	c.deleteOrphans(status)
+
+	workers := c.config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	results := make(chan itemResult, workers)
+	inFlight := 0
+	var firstErr error
+	finishOne := func() {
+		r := <-results
+		inFlight--
+		if err := c.finishItem(status, r); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+dispatch:
+	for item := range status.todo {
+		if inFlight == workers {
+			finishOne()
+		}
+		if firstErr != nil {
+			break
+		}
+		select {
+		case <-stop:
+			break dispatch
+		default:
+		}
+		queuedAt := status.queued[item]
+		delete(status.queued, item)
+		if status.delayed.Pending(item) {
+			// It is added back to todo once the delay expires.
+			delete(status.todo, item)
+			continue
+		}
+		if c.isDead(item) {
+			delete(status.todo, item)
+			continue
+		}
+		if _, paused := status.paused[item]; paused {
+			// It is added back to todo once resumed.
+			delete(status.todo, item)
+			continue
+		}
+		if wait := c.reconcileWait(status, item); wait > 0 {
+			// Any change until then is handled by that
+			// synchronization.
+			delete(status.todo, item)
+			status.delayed.AddAfter(item, wait)
+			continue
+		}
+		if c.config.MinReconcileInterval > 0 {
+			status.reconciled[item] = time.Now()
+		}
+		c.config.Metrics.ObserveQueueLatency(time.Since(queuedAt))
+		id := newReconcileID()
+		// Set again by finishItem if it is still not ours.
+		work := c.newItemWork(status, item)
+		delete(status.collisions, item)
+		inFlight++
+		go func() {
+			res := c.recoverOneItem(work, id)
+			c.reportError(work, id, res.Err)
+			results <- itemResult{work.item, id, res}
+		}()
+	}
+	for inFlight > 0 {
+		finishOne()
+	}
+	return firstErr
+}
+
+// reportError calls Config.ReportError if synchronizing work failed
+// with err, or Config.ReportDeadLetter if finishItem will give up on
+// it, unless we are stopping.
+func (c *GenericController[T, O]) reportError(work itemWork[T, O], id string, err error) {
+	if err == nil || !work.has_primary || c.ctx.Err() != nil {
+		return
+	}
+	if n := work.failures + 1; c.config.MaxRetries > 0 && n >= c.config.MaxRetries &&
+		c.config.ReportDeadLetter != nil {
+		if err := c.config.ReportDeadLetter(work.primary, n, err); err != nil {
+			c.config.Logger.Error(err, "Could not report the dead letter",
+				c.itemFields(id, work.item)...)
+		}
+		return
+	}
+	if c.config.ReportError == nil {
+		return
+	}
+	if err := c.config.ReportError(work.primary, err); err != nil {
+		c.config.Logger.Error(err, "Could not report the error", c.itemFields(id, work.item)...)
+	}
+}
+
+// finishItem updates status with the result of synchronizing an
+// item. It returns the error that should stop the synchronization, if
+// any.
+func (c *GenericController[T, O]) finishItem(status *controllerStatus[T, O], r itemResult) error {
+	item, id, res := r.item, r.id, r.res
+	if res.Collisions > 0 {
+		status.collisions[item] = res.Collisions
+	}
+	var backoff time.Duration
+	if res.Err == nil {
+		c.summary.Reconciled++
+		c.config.Metrics.CountReconcile(metrics.ResultSuccess)
+		c.config.Logger.Debug("Synchronized", c.itemFields(id, item)...)
+		status.failures.Forget(item)
+	} else {
+		c.summary.Errors++
+		c.config.Metrics.CountReconcile(metrics.ResultError)
+		backoff = status.failures.When(item)
+		if n := status.failures.NumRequeues(item); c.config.MaxRetries > 0 &&
+			n >= c.config.MaxRetries {
+			c.config.Logger.Error(res.Err, "Giving up", c.itemFields(id, item, "failures", n)...)
+			status.failures.Forget(item)
+			delete(status.todo, item)
+			c.deadMu.Lock()
+			c.dead[item] = FailedItem{Key: item, Failures: n, LastError: res.Err,
+				Since: time.Now()}
+			c.deadMu.Unlock()
+			return nil
+		}
+	}
+	if res.Err != nil && res.RequeueAfter == 0 && c.config.FailureBackoff > 0 {
+		res.RequeueAfter = backoff
+	}
+	if res.RequeueAfter > 0 {
+		if res.Err != nil {
+			c.config.Logger.Error(res.Err, "Synchronize failed, will retry",
+				c.itemFields(id, item, "retryAfter", res.RequeueAfter)...)
+		}
+		delete(status.todo, item)
+		status.delayed.AddAfter(item, res.RequeueAfter)
+		return nil
+	}
+	if res.Err != nil {
+		status.queued[item] = time.Now()
+		return fmt.Errorf("reconcile %s of %s: %w", id, item, res.Err)
+	}
+	if res.Requeue {
+		// Don't delete from todo so we try again
+		status.queued[item] = time.Now()
+		return nil
+	}
+	delete(status.todo, item)
+	return nil
+}
+
+// deleteOrphans deletes the Os that are controlled by a primary that
+// now wants an O with another name. It runs before the primaries are
+// synchronized, so the old O is gone before the new one is created.
+func (c *GenericController[T, O]) deleteOrphans(status *controllerStatus[T, O]) {
+	for ownedKey := range status.orphans {
+		owned, has_owned := status.owned[ownedKey]
+		if !has_owned {
+			delete(status.orphans, ownedKey)
+			continue
+		}
+		cont := metav1.GetControllerOfNoCopy(owned)
+		if cont == nil {
+			delete(status.orphans, ownedKey)
+			continue
+		}
+		primaryKey := key(owned.GetNamespace(), cont.Name)
+		primary, ok := status.primaries[primaryKey]
+		if !ok {
+			// We might not have heard about it yet.
+			continue
+		}
+		if _, paused := status.paused[primaryKey]; paused {
+			continue
+		}
+		if !metav1.IsControlledBy(owned, primary) || c.ownedKey(primary) == ownedKey {
+			// Owned by a previous primary with the same name,
+			// which the garbage collector takes care of, or
+			// not an orphan.
+			delete(status.orphans, ownedKey)
+			continue
+		}
+		if err := c.config.Owned.Delete(owned); err != nil {
+			// Try again on the next synchronization.
+			c.config.Logger.Error(err, "Could not delete orphan", "kind", c.config.OwnedKind,
+				"namespace", owned.GetNamespace(), "name", owned.GetName())
+			continue
+		}
+		delete(status.orphans, ownedKey)
+	}
+}
+
+// mightBeOrphan reports whether owned is controlled by a primary that
+// might want an O with another name. This is how orphans are found
+// after a restart, when we didn't see the primary being renamed.
+func (c *GenericController[T, O]) mightBeOrphan(status *controllerStatus[T, O],
+	owned O) bool {
+	cont := metav1.GetControllerOfNoCopy(owned)
+	if cont == nil || !c.isPrimaryRef(*cont) {
+		return false
+	}
+	primary, ok := status.primaries[key(owned.GetNamespace(), cont.Name)]
+	return !ok || c.config.OwnedName(primary) != owned.GetName()
+}
+
+// wantedByController reports whether owned is controlled by a known
+// primary, one not being deleted, that wants it.
+func (c *GenericController[T, O]) wantedByController(status *controllerStatus[T, O],
+	owned O) bool {
+	cont := metav1.GetControllerOfNoCopy(owned)
+	if cont == nil || !c.isPrimaryRef(*cont) {
+		return false
+	}
+	primary, ok := status.primaries[key(owned.GetNamespace(), cont.Name)]
+	return ok && primary.GetUID() == cont.UID && primary.GetDeletionTimestamp() == nil &&
+		c.ownedKey(primary) == objectKey(owned)
+}
+
+// isPrimaryRef reports whether ref refers to a T. Any version of the
+// group of T matches, since the api server serves a resource in all
+// the versions of its CRD.
+func (c *GenericController[T, O]) isPrimaryRef(ref metav1.OwnerReference) bool {
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	return err == nil && gv.Group == c.config.GVK.Group && ref.Kind == c.config.GVK.Kind
+}
+
+// ageWait returns how long primary has to wait before it is
+// synchronized because of Config.MinAge. A primary without a creation
+// timestamp is old enough.
+func (c *GenericController[T, O]) ageWait(primary T) time.Duration {
+	created := primary.GetCreationTimestamp()
+	if c.config.MinAge <= 0 || created.IsZero() {
+		return 0
+	}
+	return c.config.MinAge - time.Since(created.Time)
+}
+
+// reconcileWait returns how long item has to wait before it can be
+// synchronized again because of Config.MinReconcileInterval.
+func (c *GenericController[T, O]) reconcileWait(status *controllerStatus[T, O],
+	item string) time.Duration {
+	last, ok := status.reconciled[item]
+	if !ok {
+		return 0
+	}
+	return c.config.MinReconcileInterval - time.Since(last)
+}
+
+// fail reports a fatal error. The controller goroutine must return
+// right after.
+func (c *GenericController[T, O]) fail(err error) {
+	// Clear running first, as nobody might be reading c.Errors.
+	atomic.StoreInt32(&c.running, 0)
+	c.healthMu.Lock()
+	c.failure = err
+	c.healthMu.Unlock()
+	c.Errors <- err
+}
+
+// statusOnly reports whether the change from old to new is only one
+// of the status: the generation, which the api server increments when
+// the spec changes, and the metadata we use are the same. The zero
+// generation of a T that was never stored is taken as unknown.
+func statusOnly[T metav1.Object](old, new T) bool {
+	return new.GetGeneration() != 0 && old.GetGeneration() == new.GetGeneration() &&
+		old.GetResourceVersion() != new.GetResourceVersion() &&
+		reflect.DeepEqual(old.GetLabels(), new.GetLabels()) &&
+		reflect.DeepEqual(old.GetAnnotations(), new.GetAnnotations()) &&
+		reflect.DeepEqual(old.GetFinalizers(), new.GetFinalizers()) &&
+		reflect.DeepEqual(old.GetOwnerReferences(), new.GetOwnerReferences()) &&
+		old.GetDeletionTimestamp().Equal(new.GetDeletionTimestamp())
+}
+
+// processResources goes over the existing primaries and owned
+// resources and synchronizes them.
+func (c *GenericController[T, O]) processResources(ownedCh <-chan kubeapi.WatchEvent,
+	primariesCh <-chan kubeapi.WatchEvent) {
+	defer close(c.Errors)
+	// Runs before closing c.Errors, so that Running is false once
+	// c.Errors is closed.
+	defer atomic.StoreInt32(&c.running, 0)
+
+	status := newControllerStatus[T, O](c.config.FailureBackoff)
+	defer status.delayed.ShutDown()
+	// The keys whose delay expired are handed to us, and are not
+	// handed again before we call Done.
+	delayed := make(chan string)
+	returned := make(chan struct{})
+	defer close(returned)
+	go func() {
+		for {
+			item, shutdown := status.delayed.Get()
+			if shutdown {
+				return
+			}
+			select {
+			case delayed <- item:
+			case <-returned:
+				return
+			}
+		}
+	}()
+	defer func() {
+		c.summary.Pending = status.snapshot().Todo
+	}()
+
+	addTODO := func(owned O) {
+		// Only add to TODO if we own it
+		for _, o := range owned.GetOwnerReferences() {
+			if !c.isPrimaryRef(o) {
+				continue
+			}
+			// If we don't know the primary yet we can't check
+			// the UID, but it is OK to synchronize more often. An
+			// O of a previous primary with the same name still
+			// matters to the current one if it wants that O.
+			primaryKey := key(owned.GetNamespace(), o.Name)
+			if primary, ok := status.primaries[primaryKey]; ok && primary.GetUID() != o.UID &&
+				c.ownedKey(primary) != objectKey(owned) {
+				continue
+			}
+			c.rl.AskTick()
+			status.enqueue(primaryKey)
+			return
+		}
+	}
+
+	// After a drain request the watch channels are set to nil, and
+	// we return once synchronize succeeds or deadline is closed.
+	draining := false
+	var deadline <-chan struct{}
+
+	var resync <-chan time.Time
+	if c.config.ResyncPeriod > 0 {
+		ticker := time.NewTicker(c.config.ResyncPeriod)
+		defer ticker.Stop()
+		resync = ticker.C
+	}
+
+	// The resource versions to resume the watches from
+	ownedRV := ""
+	primariesRV := ""
+
+	for {
+		c.config.Metrics.SetWorkqueueDepth(len(status.todo))
+		select {
+		case d, ok := <-ownedCh:
+			if !ok {
+				ownedCh = c.rewatch(c.config.OwnedKind, c.config.Owned.Watch, &c.stopOwned,
+					ownedRV)
+				break
+			}
+			if d.Err != nil {
+				if ownedRV != "" && isGone(d.Err) {
+					ownedRV = ""
+					ownedCh = c.rewatch(c.config.OwnedKind, c.config.Owned.Watch,
+						&c.stopOwned, ownedRV)
+					break
+				}
+				if kubeapi.IsItemError(d.Err) {
+					c.config.Logger.Error(d.Err, "Skipping an undecodable object",
+						"kind", c.config.OwnedKind)
+					break
+				}
+				if isPollError(d.Err) {
+					c.config.Logger.Error(d.Err, "Could not list, will retry", "kind", c.config.OwnedKind)
+					break
+				}
+				c.fail(fmt.Errorf("Reading %ss: %w", c.config.OwnedKind, d.Err))
+				return
+			}
+			newOwned, ok := d.Item.(O)
+			if !ok {
+				c.config.Logger.Error(fmt.Errorf("Got a %T", d.Item),
+					"Skipping an object of the wrong type", "kind", c.config.OwnedKind)
+				break
+			}
+			ownedRV = newOwned.GetResourceVersion()
+			ownedKey := objectKey(newOwned)
+			oldOwned, ok := status.owned[ownedKey]
+			if d.IsDelete {
+				delete(status.owned, ownedKey)
+				delete(status.orphans, ownedKey)
+				if c.wantedByController(&status, newOwned) {
+					status.deleted[ownedKey] = struct{}{}
+				}
+			} else {
+				delete(status.deleted, ownedKey)
+				status.owned[ownedKey] = newOwned
+				if c.mightBeOrphan(&status, newOwned) {
+					status.orphans[ownedKey] = struct{}{}
+				}
+			}
+
+			addTODO(newOwned)
+			if ok {
+				addTODO(oldOwned)
+			}
+
+		case f, ok := <-primariesCh:
+			if !ok {
+				primariesCh = c.rewatch(c.config.GVK.Kind, c.config.Primary.Watch,
+					&c.stopPrimaries, primariesRV)
+				break
+			}
+			if f.Err != nil {
+				if primariesRV != "" && isGone(f.Err) {
+					primariesRV = ""
+					primariesCh = c.rewatch(c.config.GVK.Kind, c.config.Primary.Watch,
+						&c.stopPrimaries, primariesRV)
+					break
+				}
+				if kubeapi.IsItemError(f.Err) {
+					c.config.Logger.Error(f.Err, "Skipping an undecodable object",
+						"kind", c.config.GVK.Kind)
+					break
+				}
+				if isPollError(f.Err) {
+					c.config.Logger.Error(f.Err, "Could not list, will retry", "kind", c.config.GVK.Kind)
+					break
+				}
+				c.fail(fmt.Errorf("Reading %ss: %w", c.config.GVK.Kind, f.Err))
+				return
+			}
+			newPrimary, ok := f.Item.(T)
+			if !ok {
+				c.config.Logger.Error(fmt.Errorf("Got a %T", f.Item),
+					"Skipping an object of the wrong type", "kind", c.config.GVK.Kind)
+				break
+			}
+			primariesRV = newPrimary.GetResourceVersion()
+			primaryKey := objectKey(newPrimary)
+			oldPrimary, ok := status.primaries[primaryKey]
+			if ok && !f.IsDelete && statusOnly(oldPrimary, newPrimary) {
+				// Most likely our own status update, which
+				// must not synchronize it again.
+				status.primaries[primaryKey] = newPrimary
+				break
+			}
+			c.rl.AskTick()
+
+			if ok && c.config.OwnedName(oldPrimary) != c.config.OwnedName(newPrimary) {
+				status.orphans[c.ownedKey(oldPrimary)] = struct{}{}
+				delete(status.deleted, c.ownedKey(oldPrimary))
+				c.enqueueRivals(&status, oldPrimary)
+			}
+			if ok && f.IsDelete {
+				delete(status.deleted, c.ownedKey(oldPrimary))
+				c.enqueueRivals(&status, oldPrimary)
+			}
+
+			// A modified primary might synchronize now.
+			c.revive(primaryKey)
+			status.failures.Forget(primaryKey)
+
+			if f.IsDelete {
+				delete(status.primaries, primaryKey)
+				delete(status.paused, primaryKey)
+				delete(status.reconciled, primaryKey)
+			} else {
+				status.primaries[primaryKey] = newPrimary
+			}
+			status.enqueue(primaryKey)
+
+		case item := <-delayed:
+			status.delayed.Done(item)
+			c.rl.AskTick()
+			status.enqueue(item)
+
+		case <-resync:
+			// Paused Ts are skipped by synchronize, but dead
+			// letters are tried again.
+			for primaryKey := range status.primaries {
+				c.revive(primaryKey)
+				status.enqueue(primaryKey)
+			}
+			if len(status.primaries) != 0 {
+				c.rl.AskTick()
+			}
+
+		case item := <-c.retry:
+			status.failures.Forget(item)
+			c.rl.AskTick()
+			status.enqueue(item)
+
+		case req := <-c.selections:
+			n := c.applySelection(&status, req)
+			req.reply <- n
+			if n != 0 && req.op != pauseOp {
+				c.rl.AskTick()
+			}
+
+		case req := <-c.previews:
+			req.reply <- c.preview(&status, req)
+
+		case reply := <-c.snapshots:
+			reply <- status.snapshot()
+
+		case req := <-c.enqueues:
+			primaryKey := key(req.namespace, req.name)
+			if _, ok := status.primaries[primaryKey]; !ok {
+				req.reply <- fmt.Errorf("%s %s:%s %w", c.config.GVK.Kind, req.namespace,
+					req.name, ErrNotFound)
+				break
+			}
+			req.reply <- nil
+			c.rl.AskTick()
+			status.enqueue(primaryKey)
+
+		case <-c.retryFailed:
+			c.deadMu.Lock()
+			for item := range c.dead {
+				status.enqueue(item)
+			}
+			n := len(c.dead)
+			c.dead = make(map[string]FailedItem)
+			c.deadMu.Unlock()
+			for _, item := range status.failures.Keys() {
+				status.delayed.Cancel(item)
+				status.failures.Forget(item)
+				status.enqueue(item)
+				n++
+			}
+			c.config.Logger.Info("Retrying failed items", "count", n)
+			if n != 0 {
+				c.rl.AskTick()
+			}
+
+		case deadline = <-c.drain:
+			draining = true
+			ownedCh = nil
+			primariesCh = nil
+			resync = nil
+			if len(status.todo) == 0 {
+				return
+			}
+			c.config.Logger.Info("Draining", "count", len(status.todo))
+			c.rl.AskTick()
+
+		case <-deadline:
+			c.abandon(&status)
+			return
+
+		case <-c.rl.GetChan():
+			start := time.Now()
+			err := c.synchronize(&status, deadline)
+			c.config.Metrics.ObserveReconcileDuration(time.Since(start))
+			if err != nil && c.ctx.Err() != nil {
+				// Our context is done, we are stopping.
+				return
+			}
+			if err != nil {
+				c.config.Logger.Error(err, "Synchronize failed, will retry")
+				c.rl.AskTick()
+			} else if r, ok := c.rl.(ratelimit.Resetter); ok {
+				r.Reset()
+			}
+			if draining && len(status.todo) != 0 && isClosed(deadline) {
+				c.abandon(&status)
+				return
+			}
+			if draining && err == nil {
+				// What is left in todo waits for watch
+				// events, which we no longer read.
+				return
+			}
+		}
+
+		// We are done if both channels were closed
+		if !draining && ownedCh == nil && primariesCh == nil {
+			return
+		}
+	}
+}
+
+// abandon records the items left in todo when a drain gives up.
+func (c *GenericController[T, O]) abandon(status *controllerStatus[T, O]) {
+	for item := range status.todo {
+		c.abandoned = append(c.abandoned, item)
+	}
+	sort.Strings(c.abandoned)
+	c.config.Logger.Info("Stopping with items left to synchronize", "count", len(c.abandoned))
+}
+
+// isClosed reports whether ch is closed, without blocking.
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// rewatch starts watching again after a watch of kind ended. It
+// returns nil if the watch ended because we are stopping. stop points
+// to the stop channel of the watch, which is replaced.
+func (c *GenericController[T, O]) rewatch(kind string, watch WatchFunc, stop *chan<- struct{},
+	resourceVersion string) <-chan kubeapi.WatchEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopping() {
+		return nil
+	}
+	if resourceVersion == "" {
+		c.config.Logger.Info("Watch ended, starting it again", "kind", kind)
+	} else {
+		c.config.Logger.Info("Watch ended, resuming it", "kind", kind,
+			"resourceVersion", resourceVersion)
+	}
+	// Let the old watch release its resources.
+	close(*stop)
+	ch, newStop := watch(c.Namespace, resourceVersion)
+	*stop = newStop
+	return ch
+}
+
+// isGone reports whether err is from a watch resumed from a resource
+// version that is too old.
+func isGone(err error) bool {
+	var re *kubeapi.RequestError
+	return errors.As(err, &re) && re.StatusCode == http.StatusGone
+}
+
+func isConflict(err error) bool {
+	var re *kubeapi.RequestError
+	return errors.As(err, &re) && re.StatusCode == http.StatusConflict
+}
+
+func isNotFound(err error) bool {
+	var re *kubeapi.RequestError
+	return errors.As(err, &re) && re.StatusCode == http.StatusNotFound
+}
+
+func (c *GenericController[T, O]) startAux() {
+	defer close(c.done)
+
+	if c.leading != nil {
+		select {
+		case <-c.leading:
+		case <-c.stopped:
+			c.stopBeforeWatching()
+			return
+		case <-c.ctx.Done():
+			c.stopBeforeWatching()
+			return
+		}
+	}
+
+	err := c.config.AddCRD()
+	// If our context is done, we are just stopping.
+	if err != nil && c.ctx.Err() == nil {
+		c.fail(fmt.Errorf("Could not add CRD: %w", err))
+		close(c.Errors)
+		return
+	}
+	if c.config.CheckNamespace != nil && c.Namespace != "" {
+		if err := c.config.CheckNamespace(c.Namespace); err != nil && c.ctx.Err() == nil {
+			c.fail(fmt.Errorf("Could not check namespace: %w", err))
+			close(c.Errors)
+			return
+		}
+	}
+
+	// Watch only starts goroutines, so it is OK to hold c.mu.
+	c.mu.Lock()
+	if c.stopping() {
+		// RequestStop was called while we were adding the CRD.
+		c.mu.Unlock()
+		c.stopBeforeWatching()
+		return
+	}
+	primariesCh, stopPrimaries := c.config.Primary.Watch(c.Namespace, "")
+	ownedCh, stopOwned := c.config.Owned.Watch(c.Namespace, "")
+	c.stopPrimaries = stopPrimaries
+	c.stopOwned = stopOwned
+	c.mu.Unlock()
+	c.healthMu.Lock()
+	c.watching = true
+	c.healthMu.Unlock()
+
+	c.processResources(ownedCh, primariesCh)
+}
+
+// stopBeforeWatching stops the controller goroutine before it
+// started watching.
+func (c *GenericController[T, O]) stopBeforeWatching() {
+	atomic.StoreInt32(&c.running, 0)
+	close(c.Errors)
+}
+
+func (c *GenericController[T, O]) start() {
+	atomic.StoreInt32(&c.running, 1)
+	go c.startAux()
+}
@@ -0,0 +1,74 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger is what a controller logs with, see Config.Logger. The
+// keysAndValues alternate between a key and its value, as with logr,
+// so that structured loggers can be plugged in.
+type Logger interface {
+	Info(msg string, keysAndValues ...interface{})
+	Error(err error, msg string, keysAndValues ...interface{})
+	Debug(msg string, keysAndValues ...interface{})
+}
+
+// StdLogger is the default Logger. It logs with the standard log
+// package, with the fields after the message. Debug messages are only
+// logged if Verbose is set.
+type StdLogger struct {
+	Verbose bool
+}
+
+func (l StdLogger) Info(msg string, keysAndValues ...interface{}) {
+	log.Print(formatLog(msg, keysAndValues))
+}
+
+func (l StdLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	log.Print(formatLog(msg+": "+err.Error(), keysAndValues))
+}
+
+func (l StdLogger) Debug(msg string, keysAndValues ...interface{}) {
+	if l.Verbose {
+		log.Print(formatLog(msg, keysAndValues))
+	}
+}
+
+// formatLog appends the fields in keysAndValues to msg as key=value.
+func formatLog(msg string, keysAndValues []interface{}) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		var value interface{} = "<missing>"
+		if i+1 < len(keysAndValues) {
+			value = keysAndValues[i+1]
+		}
+		fmt.Fprintf(&b, " %v=%v", keysAndValues[i], value)
+	}
+	return b.String()
+}
+
+// splitKey is the inverse of key.
+func splitKey(k string) (namespace, name string) {
+	namespace, name, _ = strings.Cut(k, "/")
+	return namespace, name
+}
+
+// itemFields returns the fields that identify item, a T, in the logs
+// of the synchronization id, followed by keysAndValues.
+func (c *GenericController[T, O]) itemFields(id, item string,
+	keysAndValues ...interface{}) []interface{} {
+	namespace, name := splitKey(item)
+	return append([]interface{}{"reconcileID", id, "kind", c.config.GVK.Kind,
+		"namespace", namespace, "name", name}, keysAndValues...)
+}
+
+// ownedFields is like itemFields, with the name of owned, an O, as
+// well.
+func (c *GenericController[T, O]) ownedFields(id, item string, owned O,
+	keysAndValues ...interface{}) []interface{} {
+	return c.itemFields(id, item, append([]interface{}{"ownedKind", c.config.OwnedKind,
+		"ownedName", owned.GetName()}, keysAndValues...)...)
+}
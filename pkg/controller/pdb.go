@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"context"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"sample-controller/pkg/kubeapi"
+	"sample-controller/pkg/ratelimit"
+)
+
+// PDBController is the GenericController instantiation that creates
+// a PodDisruptionBudget for each Foo with a Spec.PDB. It uses the
+// policy/v1 API, see kubeapi.AddPodDisruptionBudget.
+type PDBController = GenericController[*Foo, *policyv1beta1.PodDisruptionBudget]
+
+// newPDB returns the PodDisruptionBudget of foo. It has the name of the
+// Deployment and selects its pods.
+func newPDB(foo *Foo) *policyv1beta1.PodDisruptionBudget {
+	ref := metav1.NewControllerRef(foo, fooGVK)
+	return &policyv1beta1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            foo.Spec.DeploymentName,
+			Namespace:       foo.Namespace,
+			OwnerReferences: []metav1.OwnerReference{*ref},
+		},
+		Spec: policyv1beta1.PodDisruptionBudgetSpec{
+			Selector:       podSelector(foo),
+			MinAvailable:   foo.Spec.PDB.MinAvailable,
+			MaxUnavailable: foo.Spec.PDB.MaxUnavailable,
+		},
+	}
+}
+
+func pdbsEqual(existing, desired *policyv1beta1.PodDisruptionBudget) bool {
+	return reflect.DeepEqual(existing.Spec.MinAvailable, desired.Spec.MinAvailable) &&
+		reflect.DeepEqual(existing.Spec.MaxUnavailable, desired.Spec.MaxUnavailable) &&
+		reflect.DeepEqual(existing.Spec.Selector, desired.Spec.Selector)
+}
+
+// PDBConfig returns the configuration used by NewPDBController.
+func PDBConfig(client *kubeapi.KubeClient) Config[*Foo, *policyv1beta1.PodDisruptionBudget] {
+	foos := FooConfig(client)
+	return Config[*Foo, *policyv1beta1.PodDisruptionBudget]{
+		GVK:       fooGVK,
+		OwnedKind: "PodDisruptionBudget",
+		AddCRD:    foos.AddCRD,
+		Primary:   foos.Primary,
+		Owned: Resource[*policyv1beta1.PodDisruptionBudget]{
+			Watch: func(namespace, resourceVersion string) (<-chan kubeapi.WatchEvent,
+				chan<- struct{}) {
+				return client.GetResources("policy", "v1", namespace, "poddisruptionbudgets",
+					watchQuery(resourceVersion), &policyv1beta1.PodDisruptionBudget{})
+			},
+			Add:    client.AddPodDisruptionBudget,
+			Update: client.UpdatePodDisruptionBudget,
+			Delete: client.DeletePodDisruptionBudget,
+		},
+		OwnedName: foos.OwnedName,
+		NewOwned:  newPDB,
+		Wants: func(foo *Foo) bool {
+			return foo.Spec.PDB != nil
+		},
+		Equal:    pdbsEqual,
+		Recorder: client,
+	}
+}
+
+// NewPDBController starts a controller that manages the
+// PodDisruptionBudgets of Foos. It runs alongside the one returned by
+// NewController.
+func NewPDBController(client *kubeapi.KubeClient, rl ratelimit.RateLimiter,
+	namespace string) *PDBController {
+	return newClientController(context.Background(), client, PDBConfig, rl, namespace)
+}
@@ -0,0 +1,99 @@
+package controller
+
+import (
+	"errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sample-controller/pkg/kubeapi"
+	"time"
+)
+
+// PollWatch returns a WatchFunc that lists the resources every
+// interval instead of watching them, for when long lived watches are
+// not possible. It reports the resources that were added, changed or
+// removed since the previous list. A list that fails is logged with
+// Config.Logger and retried after interval. The resource version passed to the WatchFunc
+// is ignored, as the first list reports everything.
+func PollWatch[T metav1.Object](list func(namespace string) ([]T, error),
+	interval time.Duration) WatchFunc {
+	return func(namespace, _ string) (<-chan kubeapi.WatchEvent, chan<- struct{}) {
+		ch := make(chan kubeapi.WatchEvent)
+		stop := make(chan struct{})
+		go poll(list, interval, namespace, ch, stop)
+		return ch, stop
+	}
+}
+
+func poll[T metav1.Object](list func(namespace string) ([]T, error), interval time.Duration,
+	namespace string, out chan<- kubeapi.WatchEvent, stop <-chan struct{}) {
+	defer close(out)
+	send := func(ev kubeapi.WatchEvent) bool {
+		select {
+		case out <- ev:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+
+	// Map from namespace/name to what the previous list returned
+	last := make(map[string]T)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		items, err := list(namespace)
+		if err != nil {
+			if !send(kubeapi.WatchEvent{Err: &pollError{err}}) {
+				return
+			}
+		} else {
+			current := make(map[string]T, len(items))
+			for _, item := range items {
+				key := item.GetNamespace() + "/" + item.GetName()
+				current[key] = item
+				old, ok := last[key]
+				if ok && old.GetResourceVersion() == item.GetResourceVersion() {
+					continue
+				}
+				if !send(kubeapi.WatchEvent{Item: item}) {
+					return
+				}
+			}
+			for key, item := range last {
+				if _, ok := current[key]; ok {
+					continue
+				}
+				if !send(kubeapi.WatchEvent{IsDelete: true, Item: item}) {
+					return
+				}
+			}
+			last = current
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// pollError is the Err of a WatchEvent of a PollWatch whose list
+// failed. The list is retried after the interval, so the watch
+// continues.
+type pollError struct {
+	err error
+}
+
+func (e *pollError) Error() string {
+	return e.err.Error()
+}
+
+func (e *pollError) Unwrap() error {
+	return e.err
+}
+
+// isPollError returns whether err is, or wraps, a *pollError.
+func isPollError(err error) bool {
+	var pe *pollError
+	return errors.As(err, &pe)
+}
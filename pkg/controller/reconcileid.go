@@ -0,0 +1,34 @@
+package controller
+
+import (
+	"crypto/rand"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sample-controller/pkg/events"
+)
+
+// newReconcileID returns a random (version 4) UUID that identifies one
+// synchronization of an item in logs, errors and events.
+func newReconcileID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// reconcileRecorder adds the id of a synchronization to the messages
+// of the events recorded during it.
+type reconcileRecorder struct {
+	events.Recorder
+	id string
+}
+
+func (r reconcileRecorder) RecordEvent(obj metav1.Object, gvk schema.GroupVersionKind,
+	eventType, reason, message string) error {
+	return r.Recorder.RecordEvent(obj, gvk, eventType, reason,
+		fmt.Sprintf("%s (reconcile %s)", message, r.id))
+}
@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"context"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sample-controller/pkg/kubeapi"
+	"sample-controller/pkg/ratelimit"
+)
+
+// ReplicaSetController is the GenericController instantiation that
+// creates a bare ReplicaSet for each Foo, for workloads that don't
+// need the rollouts of a Deployment. It is an alternative to the one
+// returned by NewController, not something to run alongside it, as
+// both use Spec.DeploymentName as the name and select the same pods.
+type ReplicaSetController = GenericController[*Foo, *appsv1.ReplicaSet]
+
+// newReplicaSet returns the ReplicaSet of foo. It has the same pod
+// template as the Deployment newDeployment returns.
+func newReplicaSet(foo *Foo) *appsv1.ReplicaSet {
+	ref := metav1.NewControllerRef(foo, fooGVK)
+	template := newPodTemplate(foo)
+	return &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            foo.Spec.DeploymentName,
+			Namespace:       foo.Namespace,
+			OwnerReferences: []metav1.OwnerReference{*ref},
+		},
+		Spec: appsv1.ReplicaSetSpec{
+			Selector: podSelector(foo),
+			Template: template,
+			Replicas: fooReplicas(foo),
+		},
+	}
+}
+
+func replicaSetsEqual(existing, desired *appsv1.ReplicaSet) bool {
+	return replicasEqual(existing.Spec.Replicas, desired.Spec.Replicas) &&
+		labelsContain(existing.Spec.Template.Labels, desired.Spec.Template.Labels) &&
+		podAnnotationsEqual(existing.Spec.Template.Annotations,
+			desired.Spec.Template.Annotations) &&
+		containersEqual(existing.Spec.Template.Spec.Containers,
+			desired.Spec.Template.Spec.Containers)
+}
+
+// preserveReplicaSet keeps the selector of an existing ReplicaSet, which
+// cannot be changed, its ignored pod annotations and its replicas if
+// we don't manage them.
+func preserveReplicaSet(existing, desired *appsv1.ReplicaSet) {
+	desired.Spec.Selector = existing.Spec.Selector
+	if desired.Spec.Replicas == nil {
+		desired.Spec.Replicas = existing.Spec.Replicas
+	}
+	for k, v := range existing.Spec.Template.Annotations {
+		if !ignoredPodAnnotations[k] {
+			continue
+		}
+		if desired.Spec.Template.Annotations == nil {
+			desired.Spec.Template.Annotations = make(map[string]string)
+		}
+		desired.Spec.Template.Annotations[k] = v
+	}
+}
+
+// ReplicaSetConfig returns the configuration used by
+// NewReplicaSetController.
+func ReplicaSetConfig(client *kubeapi.KubeClient) Config[*Foo, *appsv1.ReplicaSet] {
+	foos := FooConfig(client)
+	return Config[*Foo, *appsv1.ReplicaSet]{
+		GVK:       fooGVK,
+		OwnedKind: "ReplicaSet",
+		AddCRD:    foos.AddCRD,
+		Primary:   foos.Primary,
+		Owned: Resource[*appsv1.ReplicaSet]{
+			Watch: func(namespace, resourceVersion string) (<-chan kubeapi.WatchEvent,
+				chan<- struct{}) {
+				return client.GetResources("apps", "v1", namespace, "replicasets",
+					watchQuery(resourceVersion), &appsv1.ReplicaSet{})
+			},
+			Add:    client.AddReplicaSet,
+			Update: client.UpdateReplicaSet,
+			Delete: client.DeleteReplicaSet,
+		},
+		OwnedName: foos.OwnedName,
+		NewOwned:  newReplicaSet,
+		Equal:     replicaSetsEqual,
+		Preserve:  preserveReplicaSet,
+		Recorder:  client,
+	}
+}
+
+// NewReplicaSetController starts a controller that manages a
+// ReplicaSet, instead of a Deployment, for each Foo.
+func NewReplicaSetController(client *kubeapi.KubeClient, rl ratelimit.RateLimiter,
+	namespace string) *ReplicaSetController {
+	return newClientController(context.Background(), client, ReplicaSetConfig, rl, namespace)
+}
@@ -0,0 +1,11 @@
+package controller
+
+import (
+	"time"
+)
+
+// maxCollisionBackoff caps the delay of Config.CollisionBackoff.
+const maxCollisionBackoff = 5 * time.Minute
+
+// maxFailureBackoff caps the delay of Config.FailureBackoff.
+const maxFailureBackoff = 5 * time.Minute
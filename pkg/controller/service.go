@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sample-controller/pkg/kubeapi"
+	"sample-controller/pkg/ratelimit"
+)
+
+// ServiceController is the GenericController instantiation that
+// creates a ClusterIP Service for each Foo with a Spec.Service.
+type ServiceController = GenericController[*Foo, *corev1.Service]
+
+// newService returns the Service of foo. It has the name of the
+// Deployment and sends Spec.Port to its pods.
+func newService(foo *Foo) *corev1.Service {
+	ref := metav1.NewControllerRef(foo, fooGVK)
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            foo.Spec.DeploymentName,
+			Namespace:       foo.Namespace,
+			OwnerReferences: []metav1.OwnerReference{*ref},
+		},
+		Spec: corev1.ServiceSpec{
+			Type:     corev1.ServiceTypeClusterIP,
+			Selector: podSelector(foo).MatchLabels,
+			Ports: []corev1.ServicePort{{
+				Protocol:   corev1.ProtocolTCP,
+				Port:       foo.Spec.Port,
+				TargetPort: intstr.FromInt(int(foo.Spec.Port)),
+			}},
+		},
+	}
+}
+
+func servicesEqual(existing, desired *corev1.Service) bool {
+	if existing.Spec.Type != desired.Spec.Type ||
+		!apiequality.Semantic.DeepEqual(existing.Spec.Selector, desired.Spec.Selector) ||
+		len(existing.Spec.Ports) != len(desired.Spec.Ports) {
+		return false
+	}
+	// The api server fills in other fields of the ports, such as
+	// their NodePort.
+	for i, port := range desired.Spec.Ports {
+		e := existing.Spec.Ports[i]
+		if e.Protocol != port.Protocol || e.Port != port.Port || e.TargetPort != port.TargetPort {
+			return false
+		}
+	}
+	return true
+}
+
+// preserveService keeps the cluster IP of an existing Service, which
+// cannot be changed.
+func preserveService(existing, desired *corev1.Service) {
+	desired.Spec.ClusterIP = existing.Spec.ClusterIP
+}
+
+// ServiceConfig returns the configuration used by NewServiceController.
+func ServiceConfig(client *kubeapi.KubeClient) Config[*Foo, *corev1.Service] {
+	foos := FooConfig(client)
+	return Config[*Foo, *corev1.Service]{
+		GVK:       fooGVK,
+		OwnedKind: "Service",
+		AddCRD:    foos.AddCRD,
+		Primary:   foos.Primary,
+		Owned: Resource[*corev1.Service]{
+			Watch: func(namespace, resourceVersion string) (<-chan kubeapi.WatchEvent,
+				chan<- struct{}) {
+				return client.GetResources("", "v1", namespace, "services",
+					watchQuery(resourceVersion), &corev1.Service{})
+			},
+			Add:    client.AddService,
+			Update: client.UpdateService,
+			Delete: client.DeleteService,
+		},
+		OwnedName: foos.OwnedName,
+		NewOwned:  newService,
+		Wants: func(foo *Foo) bool {
+			return foo.Spec.Service && foo.Spec.Port != 0
+		},
+		Equal:    servicesEqual,
+		Preserve: preserveService,
+		Recorder: client,
+	}
+}
+
+// NewServiceController starts a controller that manages the Services
+// of Foos. It runs alongside the one returned by NewController.
+func NewServiceController(client *kubeapi.KubeClient, rl ratelimit.RateLimiter,
+	namespace string) *ServiceController {
+	return newClientController(context.Background(), client, ServiceConfig, rl, namespace)
+}
@@ -0,0 +1,383 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"net/http"
+	"reflect"
+	"sample-controller/pkg/events"
+	"sample-controller/pkg/kubeapi"
+	"sync"
+	"time"
+)
+
+// ConditionReady is the type of the Foo condition that reports whether
+// its Deployment is available.
+const ConditionReady = "Ready"
+
+// ReasonProgressDeadlineExceeded is the reason the Deployment
+// controller uses when a rollout makes no progress within
+// progressDeadlineSeconds. We use it for the Ready condition too.
+const ReasonProgressDeadlineExceeded = "ProgressDeadlineExceeded"
+
+// ConditionMapper computes the Ready condition of a Foo from its
+// Deployment. Type, ObservedGeneration and LastTransitionTime are
+// filled in by the controller.
+type ConditionMapper func(*appsv1.Deployment) metav1.Condition
+
+// DefaultConditionMapper is ready once all the replicas of the
+// Deployment are available, and not ready with
+// ReasonProgressDeadlineExceeded if the Deployment stopped
+// progressing.
+func DefaultConditionMapper(deployment *appsv1.Deployment) metav1.Condition {
+	for _, cond := range deployment.Status.Conditions {
+		if cond.Type == appsv1.DeploymentProgressing &&
+			cond.Status == corev1.ConditionFalse &&
+			cond.Reason == ReasonProgressDeadlineExceeded {
+			return metav1.Condition{
+				Status:  metav1.ConditionFalse,
+				Reason:  ReasonProgressDeadlineExceeded,
+				Message: cond.Message,
+			}
+		}
+	}
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	if deployment.Status.AvailableReplicas >= replicas {
+		return metav1.Condition{
+			Status:  metav1.ConditionTrue,
+			Reason:  "Available",
+			Message: "The Deployment is available",
+		}
+	}
+	return metav1.Condition{
+		Status: metav1.ConditionFalse,
+		Reason: "Unavailable",
+		Message: fmt.Sprintf("%d of %d replicas are available",
+			deployment.Status.AvailableReplicas, replicas),
+	}
+}
+
+// ConditionProgressing is the type of the Foo condition that reports
+// whether its Deployment is still scaling or rolling out.
+const ConditionProgressing = "Progressing"
+
+// progressingCondition returns the Progressing condition of a Foo from
+// its Deployment. Type, ObservedGeneration and LastTransitionTime are
+// filled in by the controller.
+func progressingCondition(deployment *appsv1.Deployment) metav1.Condition {
+	for _, cond := range deployment.Status.Conditions {
+		if cond.Type == appsv1.DeploymentProgressing &&
+			cond.Status == corev1.ConditionFalse &&
+			cond.Reason == ReasonProgressDeadlineExceeded {
+			return metav1.Condition{
+				Status:  metav1.ConditionFalse,
+				Reason:  ReasonProgressDeadlineExceeded,
+				Message: cond.Message,
+			}
+		}
+	}
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	status := deployment.Status
+	if status.ObservedGeneration < deployment.Generation || status.Replicas != replicas ||
+		status.UpdatedReplicas != replicas || status.AvailableReplicas != replicas {
+		return metav1.Condition{
+			Status: metav1.ConditionTrue,
+			Reason: "Scaling",
+			Message: fmt.Sprintf("Scaling to %d replicas, %d are available", replicas,
+				status.AvailableReplicas),
+		}
+	}
+	return metav1.Condition{
+		Status:  metav1.ConditionFalse,
+		Reason:  "Stable",
+		Message: fmt.Sprintf("All %d replicas are up to date and available", replicas),
+	}
+}
+
+// ConditionDegraded is the type of the Foo condition that reports the
+// error of the last synchronization that failed. It is removed once
+// the Foo is synchronized.
+const ConditionDegraded = "Degraded"
+
+// ReasonReconcileError is the reason of the Degraded condition of a
+// Foo whose synchronization failed.
+const ReasonReconcileError = "ReconcileError"
+
+// ConditionHighReplicaCount is the type of the Foo condition that
+// reports whether it asks for more replicas than
+// FooStatusOptions.SoftMaxReplicas.
+const ConditionHighReplicaCount = "HighReplicaCount"
+
+// highReplicaCountInterval is the minimum time between two
+// HighReplicaCount events about a Foo.
+const highReplicaCountInterval = 10 * time.Minute
+
+// FooStatusOptions configures FooStatusUpdater.
+type FooStatusOptions struct {
+	// ConditionMapper computes the Ready condition. If nil,
+	// DefaultConditionMapper is used.
+	ConditionMapper ConditionMapper
+
+	// SoftMaxReplicas, if positive, is an advisory maximum of
+	// replicas. Foos that ask for more are still reconciled, but
+	// get the ConditionHighReplicaCount condition and a Warning
+	// event, at most every 10 minutes.
+	SoftMaxReplicas int32
+
+	// Names identify the Foos, see FooConfigFor. If zero,
+	// DefaultFooNames are used.
+	Names FooNames
+}
+
+// FooStatusUpdater returns a Config.UpdateStatus function that sets
+// the conditions of a Foo as configured by options, and removes its
+// Degraded condition. FooConfig uses the zero options. The status is
+// only written when a condition changes, and a Warning event is
+// recorded when the reason of the Ready condition becomes
+// ReasonProgressDeadlineExceeded.
+func FooStatusUpdater(client Client, options FooStatusOptions) func(*Foo,
+	*appsv1.Deployment, events.Recorder) error {
+	mapper := options.ConditionMapper
+	if mapper == nil {
+		mapper = DefaultConditionMapper
+	}
+	names := options.Names.orDefault()
+
+	// Map from the UID of a Foo to when we last warned about its
+	// replicas
+	var mu sync.Mutex
+	warned := make(map[types.UID]time.Time)
+
+	return func(foo *Foo, deployment *appsv1.Deployment, recorder events.Recorder) error {
+		ready := mapper(deployment)
+		ready.Type = ConditionReady
+		progressing := progressingCondition(deployment)
+		progressing.Type = ConditionProgressing
+		conds := []metav1.Condition{ready, progressing}
+		high := options.SoftMaxReplicas > 0 && foo.Spec.Replicas > options.SoftMaxReplicas
+		if options.SoftMaxReplicas > 0 {
+			cond := metav1.Condition{
+				Type:   ConditionHighReplicaCount,
+				Status: metav1.ConditionFalse,
+				Reason: "WithinSoftMax",
+				Message: fmt.Sprintf("%d replicas requested, the soft maximum is %d",
+					foo.Spec.Replicas, options.SoftMaxReplicas),
+			}
+			if high {
+				cond.Status = metav1.ConditionTrue
+				cond.Reason = "AboveSoftMax"
+			}
+			conds = append(conds, cond)
+		}
+
+		old := meta.FindStatusCondition(foo.Status.Conditions, ConditionReady)
+		changed, err := updateFooStatus(client, names, foo, func(status *FooStatus,
+			generation int64) {
+			status.AvailableReplicas = deployment.Status.AvailableReplicas
+			setConditions(status, generation, conds)
+			meta.RemoveStatusCondition(&status.Conditions, ConditionDegraded)
+		})
+		if err != nil {
+			return err
+		}
+
+		if changed && ready.Reason == ReasonProgressDeadlineExceeded &&
+			(old == nil || old.Reason != ReasonProgressDeadlineExceeded) {
+			// The recorder logs the events it could not record, see
+			// Config.UpdateStatus.
+			recordFooEvent(recorder, names, foo, corev1.EventTypeWarning, ready.Reason,
+				ready.Message)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if !high {
+			delete(warned, foo.UID)
+		} else if last, ok := warned[foo.UID]; !ok ||
+			time.Since(last) >= highReplicaCountInterval {
+			warned[foo.UID] = time.Now()
+			recordFooEvent(recorder, names, foo, corev1.EventTypeWarning,
+				ConditionHighReplicaCount, conds[2].Message)
+		}
+		return nil
+	}
+}
+
+func recordFooEvent(recorder events.Recorder, names FooNames, foo *Foo, eventType, reason,
+	message string) error {
+	if recorder == nil {
+		return nil
+	}
+	return recorder.RecordEvent(foo, names.GVK, eventType, reason, message)
+}
+
+// ReasonDeploymentNotOwned is the reason of the Ready condition of a
+// Foo whose Deployment exists but is not controlled by it, with
+// CollisionFail or, if the Deployment has another controller,
+// CollisionAdoptOrphans.
+const ReasonDeploymentNotOwned = "DeploymentNotOwned"
+
+func reportFooCollision(client Client, names FooNames) func(*Foo,
+	*appsv1.Deployment) error {
+	return func(foo *Foo, deployment *appsv1.Deployment) error {
+		cond := metav1.Condition{
+			Type:    ConditionReady,
+			Status:  metav1.ConditionFalse,
+			Reason:  ReasonDeploymentNotOwned,
+			Message: notOursMessage("Deployment", deployment),
+		}
+		_, err := updateFooStatus(client, names, foo, func(status *FooStatus,
+			generation int64) {
+			setConditions(status, generation, []metav1.Condition{cond})
+		})
+		return err
+	}
+}
+
+// ReasonDeploymentNameConflict is the reason of the Degraded condition
+// of a Foo that is not synchronized because another Foo wants the same
+// Deployment and gets it.
+const ReasonDeploymentNameConflict = "DeploymentNameConflict"
+
+func reportFooConflict(client Client, names FooNames) func(*Foo, *Foo) error {
+	return func(foo, winner *Foo) error {
+		cond := metav1.Condition{
+			Type:    ConditionDegraded,
+			Status:  metav1.ConditionTrue,
+			Reason:  ReasonDeploymentNameConflict,
+			Message: fmt.Sprintf("DeploymentName conflict with Foo %s", winner.Name),
+		}
+		_, err := updateFooStatus(client, names, foo, func(status *FooStatus,
+			generation int64) {
+			setConditions(status, generation, []metav1.Condition{cond})
+		})
+		return err
+	}
+}
+
+// ReasonInvalidSpec is the reason of the Degraded condition of a Foo
+// that is not synchronized because FooConfig.Validate rejects it.
+const ReasonInvalidSpec = "InvalidSpec"
+
+func reportFooInvalid(client Client, names FooNames) func(*Foo, error) error {
+	return func(foo *Foo, err error) error {
+		cond := metav1.Condition{
+			Type:    ConditionDegraded,
+			Status:  metav1.ConditionTrue,
+			Reason:  ReasonInvalidSpec,
+			Message: err.Error(),
+		}
+		_, err = updateFooStatus(client, names, foo, func(status *FooStatus,
+			generation int64) {
+			setConditions(status, generation, []metav1.Condition{cond})
+		})
+		return err
+	}
+}
+
+func reportFooError(client Client, names FooNames) func(*Foo, error) error {
+	return func(foo *Foo, err error) error {
+		cond := metav1.Condition{
+			Type:    ConditionDegraded,
+			Status:  metav1.ConditionTrue,
+			Reason:  ReasonReconcileError,
+			Message: err.Error(),
+		}
+		_, err = updateFooStatus(client, names, foo, func(status *FooStatus,
+			generation int64) {
+			setConditions(status, generation, []metav1.Condition{cond})
+		})
+		return err
+	}
+}
+
+// ReasonRetriesExhausted is the reason of the Degraded condition of a
+// Foo the controller gave up on after Config.MaxRetries failures. It
+// is tried again once modified or on the next resync.
+const ReasonRetriesExhausted = "RetriesExhausted"
+
+func reportFooDeadLetter(client Client, names FooNames) func(*Foo, int, error) error {
+	return func(foo *Foo, failures int, err error) error {
+		message := fmt.Sprintf("Gave up after %d failures: %s", failures, err)
+		cond := metav1.Condition{
+			Type:    ConditionDegraded,
+			Status:  metav1.ConditionTrue,
+			Reason:  ReasonRetriesExhausted,
+			Message: message,
+		}
+		eventErr := recordFooEvent(client, names, foo, corev1.EventTypeWarning,
+			ReasonRetriesExhausted, message)
+		_, err = updateFooStatus(client, names, foo, func(status *FooStatus,
+			generation int64) {
+			setConditions(status, generation, []metav1.Condition{cond})
+		})
+		if err != nil {
+			return err
+		}
+		return eventErr
+	}
+}
+
+// maxStatusConflicts is how many times updateFooStatus fetches the Foo
+// again after a conflict before giving up.
+const maxStatusConflicts = 3
+
+// setConditions sets conds in status, with the generation of the Foo
+// they were computed from.
+func setConditions(status *FooStatus, generation int64, conds []metav1.Condition) {
+	for _, cond := range conds {
+		cond.ObservedGeneration = generation
+		meta.SetStatusCondition(&status.Conditions, cond)
+	}
+}
+
+// updateFooStatus writes the status of foo, which is identified by
+// names, as modified by update, unless update changes nothing. It
+// reports whether it wrote it. generation is that of the Foo being
+// updated. If the Foo changed since we last heard about it, it is
+// fetched again and update is applied to its status.
+func updateFooStatus(client Client, names FooNames, foo *Foo,
+	update func(status *FooStatus, generation int64)) (bool, error) {
+	for conflicts := 0; ; conflicts++ {
+		// Don't modify the cached Foo.
+		updated := *foo
+		updated.APIVersion = names.GVK.GroupVersion().String()
+		updated.Kind = names.GVK.Kind
+		updated.Status.Conditions = append([]metav1.Condition(nil), foo.Status.Conditions...)
+		update(&updated.Status, foo.Generation)
+		if reflect.DeepEqual(updated.Status, foo.Status) {
+			return false, nil
+		}
+
+		path := names.Plural + "/" + foo.Name
+		err := client.UpdateResourceStatus(names.GVK.Group, names.GVK.Version, foo.Namespace,
+			path, &updated)
+		var re *kubeapi.RequestError
+		if errors.As(err, &re) && re.StatusCode == http.StatusConflict &&
+			conflicts < maxStatusConflicts {
+			latest := &Foo{}
+			err = client.GetResource(names.GVK.Group, names.GVK.Version, foo.Namespace, path,
+				latest)
+			if err == nil {
+				foo = latest
+				continue
+			}
+		}
+		if err != nil {
+			return false, fmt.Errorf("Could not update the status of Foo %s:%s: %w",
+				foo.Namespace, foo.Name, err)
+		}
+		return true, nil
+	}
+}
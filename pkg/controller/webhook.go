@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// WebhookRequest is the body of a request to a WebhookTrigger.
+type WebhookRequest struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// WebhookTrigger is an http.Handler that asks a controller to
+// synchronize a T when something POSTs a WebhookRequest to it,
+// typically at /reconcile. Combined with PollWatch, it lets changes be
+// handled without waiting for the next list. It replies with 202
+// (Accepted) once the T is queued and with 404 (Not Found) if the
+// controller doesn't know of it.
+type WebhookTrigger struct {
+	// Enqueue is usually the Enqueue method of a GenericController.
+	Enqueue func(namespace, name string) error
+}
+
+func (w *WebhookTrigger) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		resp.Header().Set("Allow", http.MethodPost)
+		http.Error(resp, "Only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	var body WebhookRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Name == "" {
+		http.Error(resp, "The body must be a json object with a namespace and a name",
+			http.StatusBadRequest)
+		return
+	}
+	err := w.Enqueue(body.Namespace, body.Name)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(resp, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(resp, err.Error(), http.StatusServiceUnavailable)
+	default:
+		resp.WriteHeader(http.StatusAccepted)
+	}
+}
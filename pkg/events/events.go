@@ -0,0 +1,57 @@
+package events
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Recorder records Kubernetes Events about an object whose kind is
+// gvk. The eventType is either corev1.EventTypeNormal or
+// corev1.EventTypeWarning. *kubeapi.KubeClient implements it.
+type Recorder interface {
+	RecordEvent(obj metav1.Object, gvk schema.GroupVersionKind,
+		eventType, reason, message string) error
+}
+
+// Event is an event as captured by FakeRecorder.
+type Event struct {
+	InvolvedObject corev1.ObjectReference
+	Type           string
+	Reason         string
+	Message        string
+}
+
+// FakeRecorder is a Recorder for tests. It sends the recorded events
+// on Events, blocking if the channel is full. If Events is nil, they
+// are dropped.
+type FakeRecorder struct {
+	Events chan Event
+}
+
+// NewFakeRecorder returns a FakeRecorder whose Events channel has
+// room for bufferSize events.
+func NewFakeRecorder(bufferSize int) *FakeRecorder {
+	return &FakeRecorder{Events: make(chan Event, bufferSize)}
+}
+
+func (f *FakeRecorder) RecordEvent(obj metav1.Object, gvk schema.GroupVersionKind,
+	eventType, reason, message string) error {
+	if f.Events == nil {
+		return nil
+	}
+	f.Events <- Event{
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion:      gvk.GroupVersion().String(),
+			Kind:            gvk.Kind,
+			Namespace:       obj.GetNamespace(),
+			Name:            obj.GetName(),
+			UID:             obj.GetUID(),
+			ResourceVersion: obj.GetResourceVersion(),
+		},
+		Type:    eventType,
+		Reason:  reason,
+		Message: message,
+	}
+	return nil
+}
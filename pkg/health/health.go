@@ -0,0 +1,46 @@
+// Package health serves the liveness and readiness probes of the
+// controller.
+package health
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Checker is what /readyz checks, such as a controller.
+type Checker interface {
+	// Healthy reports whether the checker is ready and, if not,
+	// why.
+	Healthy() (bool, error)
+}
+
+// NewHandler returns a handler that serves /healthz, which succeeds
+// as long as the process is up, and /readyz, which fails with 503
+// unless every one of checkers is healthy.
+func NewHandler(checkers ...Checker) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		var reasons []string
+		for _, checker := range checkers {
+			if ok, err := checker.Healthy(); !ok {
+				reason := "not ready"
+				if err != nil {
+					reason = err.Error()
+				}
+				reasons = append(reasons, reason)
+			}
+		}
+		if len(reasons) == 0 {
+			fmt.Fprintln(w, "ok")
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, reason := range reasons {
+			fmt.Fprintln(w, reason)
+		}
+	})
+	return mux
+}
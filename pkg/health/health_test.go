@@ -0,0 +1,47 @@
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testChecker struct {
+	ok  bool
+	err error
+}
+
+func (c *testChecker) Healthy() (bool, error) {
+	return c.ok, c.err
+}
+
+func get(t *testing.T, handler http.Handler, path string) (int, string) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestHandler(t *testing.T) {
+	first, second := &testChecker{ok: true}, &testChecker{ok: true}
+	handler := NewHandler(first, second)
+	if code, _ := get(t, handler, "/readyz"); code != http.StatusOK {
+		t.Errorf("Expected ready, got %d", code)
+	}
+
+	second.ok, second.err = false, errors.New("Watch failed")
+	code, body := get(t, handler, "/readyz")
+	if code != http.StatusServiceUnavailable || strings.TrimSpace(body) != "Watch failed" {
+		t.Errorf("Expected 503 with the error, got %d %q", code, body)
+	}
+	// The process is still up.
+	if code, _ := get(t, handler, "/healthz"); code != http.StatusOK {
+		t.Errorf("Expected healthz to succeed, got %d", code)
+	}
+
+	second.ok, second.err = true, nil
+	if code, _ := get(t, handler, "/readyz"); code != http.StatusOK {
+		t.Errorf("Expected ready once recovered, got %d", code)
+	}
+}
@@ -2,75 +2,423 @@ package kubeapi
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
 	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"reflect"
+	"sample-controller/pkg/workqueue"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-const apiPath = "/apis"
-
 // KubeClient represents a client to a kubernetes API server.
 type KubeClient struct {
 	client http.Client
 	url    url.URL
+	// ctx is that of every request, see WithContext.
+	ctx context.Context
+	// pageSize is the limit of the pages of lists, see WithPageSize.
+	pageSize int64
+	// connectRetry is how long watches and lists retry connecting,
+	// see WithConnectRetry.
+	connectRetry time.Duration
+	// fieldManager, if not empty, is the field manager of the
+	// writes, see WithFieldManager.
+	fieldManager string
+	// throttleRetries is how many times a throttled request is
+	// tried again, see WithThrottleRetries.
+	throttleRetries int
+	// limiter, if not nil, is shared by the copies of the client
+	// made since WithRateLimit.
+	limiter *tokenBucket
+	// logger, if not nil, logs the retries, see WithLogger.
+	logger Logger
 }
 
+// DefaultPageSize is how many resources a page of a list has, unless
+// changed with WithPageSize.
+const DefaultPageSize = 500
+
+// DefaultConnectRetry is how long watches and lists retry connecting
+// to the api server before giving up, unless changed with
+// WithConnectRetry.
+const DefaultConnectRetry = time.Minute
+
+const (
+	// The delay before the first retry to connect, which doubles
+	// on every attempt up to maxConnectRetryDelay.
+	connectRetryDelay    = 100 * time.Millisecond
+	maxConnectRetryDelay = 10 * time.Second
+)
+
 // NewClient returns a new KubeClient. The host is a string encoding
 // the url of the api server (https://192.168.39.239:8443 for
 // expample).
 func NewClient(host string, transport http.RoundTripper) (*KubeClient, error) {
-	u, err := url.Parse(host + apiPath + "/")
+	u, err := url.Parse(host + "/")
 	if err != nil {
 		return nil, err
 	}
 	return &KubeClient{client: http.Client{Transport: transport}, url: *u}, nil
 }
 
+// WithContext returns a copy of client whose requests are made with
+// ctx. Once ctx is done, in-flight requests fail and watches end, as if
+// stopped.
+func (client *KubeClient) WithContext(ctx context.Context) *KubeClient {
+	ret := *client
+	ret.ctx = ctx
+	return &ret
+}
+
+// WithPageSize returns a copy of client whose lists, as those of
+// ListAndWatch, are fetched in pages of at most n resources, continuing
+// from one page to the next, so that the api server is not asked for
+// all of them at once. A non positive n means DefaultPageSize.
+func (client *KubeClient) WithPageSize(n int64) *KubeClient {
+	ret := *client
+	ret.pageSize = n
+	return &ret
+}
+
+func (client *KubeClient) listPageSize() int64 {
+	if client.pageSize <= 0 {
+		return DefaultPageSize
+	}
+	return client.pageSize
+}
+
+// WithConnectRetry returns a copy of client whose watches and lists,
+// when they cannot reach the api server, as while a cluster boots,
+// try again with a jittered exponential backoff for up to d before
+// reporting the error. A zero d means DefaultConnectRetry, a negative
+// one reports the first error.
+func (client *KubeClient) WithConnectRetry(d time.Duration) *KubeClient {
+	ret := *client
+	ret.connectRetry = d
+	return &ret
+}
+
+// Logger is what a client logs the requests it tries again with, see
+// WithLogger. The keysAndValues alternate between a key and its value.
+// A controller.Logger is one.
+type Logger interface {
+	Error(err error, msg string, keysAndValues ...interface{})
+}
+
+// WithLogger returns a copy of client that logs its retries with
+// logger instead of the standard log package.
+func (client *KubeClient) WithLogger(logger Logger) *KubeClient {
+	ret := *client
+	ret.logger = logger
+	return &ret
+}
+
+// logError logs err with the Logger of client, if any, or the standard
+// log package.
+func (client *KubeClient) logError(err error, msg string, keysAndValues ...interface{}) {
+	if client.logger != nil {
+		client.logger.Error(err, msg, keysAndValues...)
+		return
+	}
+	var b strings.Builder
+	b.WriteString(msg + ": " + err.Error())
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", keysAndValues[i], keysAndValues[i+1])
+	}
+	log.Print(b.String())
+}
+
+// WithFieldManager returns a copy of client whose creations and
+// updates are made as fieldManager, which the api server records in
+// the managed fields of the resources written. Applies use the field
+// manager they are given.
+func (client *KubeClient) WithFieldManager(fieldManager string) *KubeClient {
+	ret := *client
+	ret.fieldManager = fieldManager
+	return &ret
+}
+
+// FieldManager returns the field manager set by WithFieldManager, if
+// any.
+func (client *KubeClient) FieldManager() string {
+	return client.fieldManager
+}
+
+// WithThrottleRetries returns a copy of client whose requests, when
+// the api server throttles them with a 429, are tried again up to n
+// times, after the Retry-After delay it asked for. Without retries,
+// the default, the RequestError has the delay, which GenericController
+// waits for without blocking a worker.
+func (client *KubeClient) WithThrottleRetries(n int) *KubeClient {
+	ret := *client
+	ret.throttleRetries = n
+	return &ret
+}
+
+// WithRateLimit returns a copy of client that makes at most qps
+// requests per second, in bursts of up to burst, waiting as needed.
+// The limit is shared by the copies made from the returned one. A non
+// positive qps removes the limit.
+func (client *KubeClient) WithRateLimit(qps float64, burst int) *KubeClient {
+	ret := *client
+	ret.limiter = nil
+	if qps > 0 {
+		ret.limiter = newTokenBucket(qps, burst)
+	}
+	return &ret
+}
+
+// tokenBucket holds up to burst tokens, refilled at qps per second. A
+// request takes one, waiting for it if there are none left.
+type tokenBucket struct {
+	qps   float64
+	burst float64
+
+	// mu protects tokens and last.
+	mu sync.Mutex
+	// tokens is how many are left as of last. It is negative once
+	// requests are waiting for tokens to be refilled.
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(qps float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{qps: qps, burst: float64(burst), tokens: float64(burst),
+		last: time.Now()}
+}
+
+// take returns how long to wait for the token it takes.
+func (b *tokenBucket) take() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.qps)
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.qps * float64(time.Second))
+}
+
+// sleep waits for d, or less if the context of client is done, in
+// which case it returns its error.
+func (client *KubeClient) sleep(d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	ctx := client.requestContext()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WithHTTPClient returns a copy of client whose requests are sent with
+// a copy of httpClient, with its transport, TLS configuration and
+// timeouts, instead of the transport given to NewClient. It replaces
+// the transport of earlier calls to WithMiddleware and WithObserver.
+// Note that a Timeout also ends the watches that stay open longer.
+func (client *KubeClient) WithHTTPClient(httpClient *http.Client) *KubeClient {
+	ret := *client
+	ret.client = *httpClient
+	return &ret
+}
+
+// RoundTripperFunc adapts a function to an http.RoundTripper.
+type RoundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// WithMiddleware returns a copy of client whose requests to the api
+// server are sent by the transport wrap returns. It is given the
+// transport of client, which it should send the requests with.
+func (client *KubeClient) WithMiddleware(
+	wrap func(next http.RoundTripper) http.RoundTripper) *KubeClient {
+	ret := *client
+	next := client.client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	ret.client.Transport = wrap(next)
+	return &ret
+}
+
+// RequestInfo describes a request to the api server, see
+// WithObserver. StatusCode is zero when Err is the error of a request
+// that got no response. The Latency of a watch is the time to its
+// response, not the time it was open.
+type RequestInfo struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Latency    time.Duration
+	Err        error
+}
+
+// WithObserver returns a copy of client that calls observe once each
+// of its requests gets a response or fails, as to log them or keep
+// metrics of them.
+func (client *KubeClient) WithObserver(observe func(RequestInfo)) *KubeClient {
+	return client.WithMiddleware(func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := next.RoundTrip(req)
+			info := RequestInfo{Method: req.Method, Path: req.URL.Path,
+				Latency: time.Since(start), Err: err}
+			if err == nil {
+				info.StatusCode = resp.StatusCode
+			}
+			observe(info)
+			return resp, err
+		})
+	})
+}
+
+func (client *KubeClient) connectRetryTime() time.Duration {
+	if client.connectRetry == 0 {
+		return DefaultConnectRetry
+	}
+	return client.connectRetry
+}
+
+// Context returns the context of the requests of client, see
+// WithContext.
+func (client *KubeClient) Context() context.Context {
+	return client.requestContext()
+}
+
+func (client *KubeClient) requestContext() context.Context {
+	if client.ctx == nil {
+		return context.Background()
+	}
+	return client.ctx
+}
+
 // RequestError represents an http reply with an unsuccessful status code.
+// RetryAfter is the delay the server asked us to wait before retrying
+// (from the Retry-After header), or zero if it didn't suggest one.
 type RequestError struct {
 	StatusCode int
 	Body       []byte
+	RetryAfter time.Duration
 }
 
 func (r *RequestError) Error() string {
 	return fmt.Sprintf("http request failed: code=%d body=\"%s\"", r.StatusCode, r.Body)
 }
 
+// parseRetryAfter decodes a Retry-After header, which is either a
+// number of seconds or an http date. Missing or malformed values are
+// returned as zero.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
 func (client *KubeClient) do(method, group, version, namespace, path string, query url.Values,
 	data []byte) (*http.Response, error) {
+	return client.doWithHeader(method, group, version, namespace, path, query, nil, data)
+}
+
+// doWithHeader is like do, with the headers in header.
+func (client *KubeClient) doWithHeader(method, group, version, namespace, path string,
+	query url.Values, header http.Header, data []byte) (*http.Response, error) {
 	url := client.url
-	url.Path += group + "/"
+	if group == "" {
+		// The core group
+		url.Path += "api/"
+	} else {
+		url.Path += "apis/" + group + "/"
+	}
 	url.Path += version + "/"
 	if namespace != "" {
 		url.Path += "namespaces/" + namespace + "/"
 	}
 	url.Path += path
 	url.RawQuery = query.Encode()
-	reader := ioutil.NopCloser(bytes.NewReader(data))
-	req := http.Request{Method: method, URL: &url, Body: reader}
-	resp, err := client.client.Do(&req)
-	if err == nil && !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
-		defer resp.Body.Close()
+	if header == nil {
+		header = http.Header{}
+	}
+	for attempt := 0; ; attempt++ {
+		if client.limiter != nil {
+			if err := client.sleep(client.limiter.take()); err != nil {
+				return nil, err
+			}
+		}
+		reader := ioutil.NopCloser(bytes.NewReader(data))
+		req := (&http.Request{Method: method, URL: &url, Header: header,
+			Body: reader}).WithContext(client.requestContext())
+		resp, err := client.client.Do(req)
+		if err != nil || resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp, err
+		}
 		// Ignore any errors from ReadAll, they are probably not as interesting as the
 		// RequestError
 		body, _ := ioutil.ReadAll(resp.Body)
-		return nil, &RequestError{StatusCode: resp.StatusCode, Body: body}
+		resp.Body.Close()
+		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+		re := &RequestError{StatusCode: resp.StatusCode, Body: body, RetryAfter: retryAfter}
+		if resp.StatusCode != http.StatusTooManyRequests || attempt >= client.throttleRetries {
+			return nil, re
+		}
+		delay := retryAfter
+		if delay == 0 {
+			delay = workqueue.ExponentialDelay(connectRetryDelay, maxConnectRetryDelay, attempt)
+		}
+		client.logError(re, "Throttled, retrying", "method", method, "path", url.Path,
+			"attempt", attempt+1, "delay", delay)
+		if err := client.sleep(delay); err != nil {
+			return nil, re
+		}
 	}
-	return resp, err
 }
 
 // Get does a GET request on a resource. Group is the Kubernetes API
-// group (apiextensions.k8s.io for example). An empty namespace means
-// this is accessing a non namespaced resource (not the default
-// namespace). An unsuccessful response is converted to an error, so
-// this just returns a io.ReadCloser for the body.
+// group (apiextensions.k8s.io for example, or empty for the core
+// group). An empty namespace means this is accessing a non namespaced
+// resource (not the default namespace). An unsuccessful response is
+// converted to an error, so this just returns a io.ReadCloser for the
+// body.
 func (client *KubeClient) Get(group, version, namespace, path string,
 	query url.Values) (io.ReadCloser, error) {
 	resp, err := client.do("GET", group, version, namespace, path, query, nil)
@@ -80,6 +428,55 @@ func (client *KubeClient) Get(group, version, namespace, path string,
 	return resp.Body, nil
 }
 
+// getRetrying is Get, but a request that doesn't reach the api server
+// is tried again, see WithConnectRetry, until stop is closed.
+func (client *KubeClient) getRetrying(group, version, namespace, path string, query url.Values,
+	stop <-chan struct{}) (io.ReadCloser, error) {
+	deadline := time.Now().Add(client.connectRetryTime())
+	for attempt := 0; ; attempt++ {
+		body, err := client.Get(group, version, namespace, path, query)
+		var re *RequestError
+		if err == nil || errors.As(err, &re) || client.connectRetry < 0 ||
+			client.requestContext().Err() != nil {
+			return body, err
+		}
+		delay := workqueue.ExponentialDelay(connectRetryDelay, maxConnectRetryDelay, attempt)
+		delay = workqueue.Jitter(delay, 0.2)
+		if time.Now().Add(delay).After(deadline) {
+			return nil, fmt.Errorf("Gave up connecting after %d attempts: %w", attempt+1, err)
+		}
+		client.logError(err, "Could not connect, retrying", "path", path, "attempt",
+			attempt+1, "delay", delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return nil, err
+		case <-client.requestContext().Done():
+			timer.Stop()
+			return nil, err
+		}
+	}
+}
+
+// GetResource GETs a single resource and decodes it into obj. See Get
+// for the parameters, path is the plural of the resource followed by
+// "/" and its name. A missing resource is a *RequestError with
+// http.StatusNotFound.
+func (client *KubeClient) GetResource(group, version, namespace, path string,
+	obj interface{}) error {
+	body, err := client.Get(group, version, namespace, path, nil)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if err := json.NewDecoder(body).Decode(obj); err != nil {
+		return fmt.Errorf("Could not decode %s: %w", path, err)
+	}
+	return nil
+}
+
 func (client *KubeClient) putOrPost(method, group, version, namespace, path string,
 	obj interface{}) error {
 	data, err := json.Marshal(obj)
@@ -87,7 +484,11 @@ func (client *KubeClient) putOrPost(method, group, version, namespace, path stri
 		return err
 	}
 
-	resp, err := client.do(method, group, version, namespace, path, nil, data)
+	var query url.Values
+	if client.fieldManager != "" {
+		query = url.Values{"fieldManager": []string{client.fieldManager}}
+	}
+	resp, err := client.do(method, group, version, namespace, path, query, data)
 	if err == nil {
 		err = resp.Body.Close()
 	}
@@ -105,6 +506,68 @@ func (client *KubeClient) Put(group, version, namespace, path string, obj interf
 	return client.putOrPost("PUT", group, version, namespace, path, obj)
 }
 
+// UpdateResource replaces a resource other than its status
+// subresource, for example to change its finalizers. See Post for the
+// parameters.
+func (client *KubeClient) UpdateResource(group, version, namespace, path string,
+	obj interface{}) error {
+	return client.putOrPost("PUT", group, version, namespace, path, obj)
+}
+
+// UpdateResourceStatus replaces the status subresource of a
+// resource. See Post for the parameters.
+func (client *KubeClient) UpdateResourceStatus(group, version, namespace, path string,
+	obj interface{}) error {
+	return client.putOrPost("PUT", group, version, namespace, path+"/status", obj)
+}
+
+// ApplyPatchType is the content type of server-side apply patches.
+// Since JSON is YAML, the patches are the json marshaling of objects.
+const ApplyPatchType = "application/apply-patch+yaml"
+
+// Apply does a server-side apply of obj, with a PATCH request on a
+// resource. obj must have its apiVersion and kind. The fields it sets
+// become owned by fieldManager, taking them from other managers if
+// needed, and the fields fieldManager set before but not anymore are
+// removed. If obj has a resourceVersion, it must be the current one.
+// See Post for the other parameters.
+func (client *KubeClient) Apply(group, version, namespace, path, fieldManager string,
+	obj interface{}) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	query := url.Values{"fieldManager": []string{fieldManager}, "force": []string{"true"}}
+	header := http.Header{"Content-Type": []string{ApplyPatchType}}
+	resp, err := client.doWithHeader("PATCH", group, version, namespace, path, query, header,
+		data)
+	if err == nil {
+		err = resp.Body.Close()
+	}
+	return err
+}
+
+// Patch does a PATCH request on a resource with data, a JSON merge
+// patch or a strategic merge patch, as patchType says. Only the fields
+// in data are changed. See Post for the other parameters.
+func (client *KubeClient) Patch(group, version, namespace, path string,
+	patchType types.PatchType, data []byte) error {
+	if patchType != types.MergePatchType && patchType != types.StrategicMergePatchType {
+		return fmt.Errorf("Unsupported patch type %s", patchType)
+	}
+	var query url.Values
+	if client.fieldManager != "" {
+		query = url.Values{"fieldManager": []string{client.fieldManager}}
+	}
+	header := http.Header{"Content-Type": []string{string(patchType)}}
+	resp, err := client.doWithHeader("PATCH", group, version, namespace, path, query, header,
+		data)
+	if err == nil {
+		err = resp.Body.Close()
+	}
+	return err
+}
+
 // Delete does a DELETE request on a resource. See Post for the parameters.
 func (client *KubeClient) Delete(group, version, namespace, path string) error {
 	resp, err := client.do("DELETE", group, version, namespace, path, nil, nil)
@@ -130,13 +593,37 @@ func parseEventType(ty string) (bool, error) {
 // k8s.io/apimachinery/pkg/apis/meta/v1.WatchEvent. Unlike the
 // original, we only differentiate delete/add and the object is
 // decoded instead of a raw json string. Any error obtaining or
-// parsing this event is reported in Err.
+// parsing this event is reported in Err. The watch ends after an
+// error, unless it is an *ItemError. An Item that is a metav1.Object
+// has the namespace of a namespaced watch, even if the api server left
+// it out. The Item of a delete event that cannot be decoded only has
+// the metadata identifying it.
 type WatchEvent struct {
 	IsDelete bool
 	Item     interface{}
 	Err      error
 }
 
+// ItemError is the Err of a WatchEvent whose object could not be
+// decoded. It only affects that object, so the watch continues.
+type ItemError struct {
+	Err error
+}
+
+func (e *ItemError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ItemError) Unwrap() error {
+	return e.Err
+}
+
+// IsItemError returns whether err is, or wraps, an *ItemError.
+func IsItemError(err error) bool {
+	var ie *ItemError
+	return errors.As(err, &ie)
+}
+
 func (client *KubeClient) produceResources(group, version, namespace, path string,
 	query url.Values, v interface{}, out chan<- WatchEvent, stopCh <-chan struct{}) {
 	defer close(out)
@@ -146,27 +633,8 @@ func (client *KubeClient) produceResources(group, version, namespace, path strin
 	}
 	query["watch"] = []string{"true"}
 
-	bodyReader, err := client.Get(group, version, namespace, path, query)
-	if err != nil {
-		out <- WatchEvent{Err: fmt.Errorf("Watch failed: %w", err)}
-		return
-	}
-
-	go func() {
-		_ = <-stopCh
-		// Closing bodyReader is probably the only way to stop
-		// decoder.Decode bellow.
-		err := bodyReader.Close()
-		// The call to Close should not fail. If it does,
-		// there is nothing for us to do but panic. We cannot
-		// send the error to the out channel as it might be
-		// closed. It should also not be ignored, as the loop
-		// bellow might be forever stuck in Decode.
-		if err != nil {
-			panic(err)
-		}
-	}()
-
+	// We stop once the context of the requests is done too.
+	done := client.requestContext().Done()
 	send := func(ev WatchEvent) {
 		// If we were asked to stop, don't send. The event
 		// might be the last error produced by closing
@@ -174,6 +642,8 @@ func (client *KubeClient) produceResources(group, version, namespace, path strin
 		select {
 		case _ = <-stopCh:
 			return
+		case <-done:
+			return
 		default:
 		}
 
@@ -182,40 +652,143 @@ func (client *KubeClient) produceResources(group, version, namespace, path strin
 		select {
 		case _ = <-stopCh:
 			return
+		case <-done:
+			return
 		case out <- ev:
 		}
 	}
 
+	bodyReader, err := client.getRetrying(group, version, namespace, path, query, stopCh)
+	if err != nil {
+		send(WatchEvent{Err: fmt.Errorf("Watch failed: %w", err)})
+		return
+	}
+
+	// finished is closed once we return, so that the goroutine
+	// below doesn't wait for stopCh after the api server ended the
+	// watch.
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-stopCh:
+		case <-done:
+		case <-finished:
+		}
+		// Closing bodyReader is probably the only way to stop
+		// decoder.Decode bellow.
+		err := bodyReader.Close()
+		// The call to Close should not fail. If it does,
+		// there is nothing for us to do but panic. We cannot
+		// send the error to the out channel as it might be
+		// closed. It should also not be ignored, as the loop
+		// bellow might be forever stuck in Decode.
+		if err != nil {
+			panic(err)
+		}
+	}()
+
 	decoder := json.NewDecoder(bodyReader)
 	for {
 		we := metav1.WatchEvent{}
-		if err = decoder.Decode(&we); err != nil {
+		if err = decoder.Decode(&we); err == io.EOF {
+			// The api server ended the watch.
+			return
+		} else if err != nil {
 			err = fmt.Errorf("Could not decode WatchEvent(%s): %w", path, err)
 			send(WatchEvent{Err: err})
 			return
 		}
-		isDelete, err := parseEventType(we.Type)
-		if err != nil {
+		if we.Type == "ERROR" {
+			// The api server ends a watch it cannot continue,
+			// for example from a resource version that is too
+			// old, with a Status.
+			status := metav1.Status{}
+			if err = json.Unmarshal(we.Object.Raw, &status); err != nil {
+				err = fmt.Errorf("Unmarshaling of status failed: %w", err)
+			} else {
+				err = &RequestError{StatusCode: int(status.Code), Body: we.Object.Raw}
+			}
 			send(WatchEvent{Err: err})
 			return
 		}
+		// The stream is still in sync after the errors below,
+		// so the events that follow can be decoded.
+		isDelete, err := parseEventType(we.Type)
+		if err != nil {
+			send(WatchEvent{Err: &ItemError{err}})
+			continue
+		}
 
 		obj := reflect.New(ty)
 		err = json.Unmarshal(we.Object.Raw, obj.Interface())
+		if err != nil && isDelete {
+			// All that matters of a deleted resource is which
+			// one it was.
+			obj, err = deletedObject(ty, we.Object.Raw)
+		}
 		if err != nil {
 			err = fmt.Errorf("Unmarshaling of resource failed: %w", err)
-			send(WatchEvent{Err: err})
-			return
+			send(WatchEvent{Err: &ItemError{err}})
+			continue
+		}
+		if meta, ok := objectMeta(obj); ok && meta.GetNamespace() == "" {
+			// Only cluster scoped resources have no namespace.
+			meta.SetNamespace(namespace)
 		}
 		send(WatchEvent{IsDelete: isDelete, Item: reflect.Indirect(obj).Interface()})
 	}
 }
 
+// objectMeta returns the metav1.Object of obj, a pointer to a value of
+// a type as that of the v of GetResources.
+func objectMeta(obj reflect.Value) (metav1.Object, bool) {
+	if elem := obj.Elem(); elem.Kind() == reflect.Ptr {
+		if elem.IsNil() {
+			return nil, false
+		}
+		meta, ok := elem.Interface().(metav1.Object)
+		return meta, ok
+	}
+	meta, ok := obj.Interface().(metav1.Object)
+	return meta, ok
+}
+
+// deletedObject returns a pointer to a value of type ty, a
+// metav1.Object, with only the metadata in raw, for a deleted resource
+// that could not be decoded otherwise.
+func deletedObject(ty reflect.Type, raw []byte) (reflect.Value, error) {
+	partial := struct {
+		Metadata metav1.ObjectMeta `json:"metadata"`
+	}{}
+	if err := json.Unmarshal(raw, &partial); err != nil {
+		return reflect.Value{}, err
+	}
+	if partial.Metadata.Name == "" {
+		return reflect.Value{}, errors.New("Deleted resource has no name")
+	}
+	obj := reflect.New(ty)
+	if ty.Kind() == reflect.Ptr {
+		obj.Elem().Set(reflect.New(ty.Elem()))
+	}
+	meta, ok := objectMeta(obj)
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("%s is not a metav1.Object", ty)
+	}
+	meta.SetName(partial.Metadata.Name)
+	meta.SetNamespace(partial.Metadata.Namespace)
+	meta.SetUID(partial.Metadata.UID)
+	meta.SetResourceVersion(partial.Metadata.ResourceVersion)
+	meta.SetOwnerReferences(partial.Metadata.OwnerReferences)
+	return obj, nil
+}
+
 // GetResources queries the api server for a particular resource and
 // sends the resulting WatchEvent to a returned channel. It also
 // returns a second channel that should be closed to request
 // GetResources to stop. The type of the resource is identified by
 // v. The produced WatchEvents will have Items of the same type as v.
+// Connecting is retried, see WithConnectRetry.
 func (client *KubeClient) GetResources(group, version, namespace, path string, query url.Values,
 	v interface{}) (<-chan WatchEvent, chan<- struct{}) {
 	ch := make(chan WatchEvent)
@@ -224,9 +797,40 @@ func (client *KubeClient) GetResources(group, version, namespace, path string, q
 	return ch, stop
 }
 
-// GetDeployments queries the api server for deployments. See GetResources for details.
-func (client *KubeClient) GetDeployments(namespace string) (<-chan WatchEvent, chan<- struct{}) {
-	return client.GetResources("apps", "v1", namespace, "deployments", nil,
+// ListOptions restricts the resources of a list or a watch, as the
+// selectors of metav1.ListOptions do. Empty selectors match
+// everything.
+type ListOptions struct {
+	// LabelSelector is, for example, "tier=frontend".
+	LabelSelector string
+	// FieldSelector is, for example, "metadata.name=abc".
+	FieldSelector string
+}
+
+// Query returns query with the selectors of options added. query is
+// not modified.
+func (options ListOptions) Query(query url.Values) url.Values {
+	if options.LabelSelector == "" && options.FieldSelector == "" {
+		return query
+	}
+	ret := url.Values{}
+	for k, vs := range query {
+		ret[k] = vs
+	}
+	if options.LabelSelector != "" {
+		ret.Set("labelSelector", options.LabelSelector)
+	}
+	if options.FieldSelector != "" {
+		ret.Set("fieldSelector", options.FieldSelector)
+	}
+	return ret
+}
+
+// GetDeployments queries the api server for the deployments matching
+// options. See GetResources for details.
+func (client *KubeClient) GetDeployments(namespace string, options ListOptions) (<-chan WatchEvent,
+	chan<- struct{}) {
+	return client.GetResources("apps", "v1", namespace, "deployments", options.Query(nil),
 		appsv1.Deployment{})
 }
 
@@ -235,22 +839,167 @@ func (client *KubeClient) AddDeployment(deployment *appsv1.Deployment) error {
 	return client.Post("apps", "v1", deployment.Namespace, "deployments", deployment)
 }
 
-// UpdateDeployment replaces an existing deployment.
+// GetDeployment fetches the current version of a deployment.
+func (client *KubeClient) GetDeployment(namespace, name string) (*appsv1.Deployment, error) {
+	deployment := &appsv1.Deployment{}
+	err := client.GetResource("apps", "v1", namespace, "deployments/"+name, deployment)
+	return deployment, err
+}
+
+// UpdateDeployment replaces an existing deployment. Its
+// resourceVersion must be the current one, or the update fails with a
+// *RequestError with http.StatusConflict.
 func (client *KubeClient) UpdateDeployment(deployment *appsv1.Deployment) error {
 	return client.Put("apps", "v1", deployment.Namespace, "deployments/"+deployment.Name,
 		deployment)
 }
 
+// PatchDeployment patches a deployment, see Patch.
+func (client *KubeClient) PatchDeployment(namespace, name string, patchType types.PatchType,
+	data []byte) error {
+	return client.Patch("apps", "v1", namespace, "deployments/"+name, patchType, data)
+}
+
+// ApplyDeployment does a server-side apply of deployment as
+// fieldManager, see Apply. Its resourceVersion and managed fields are
+// not sent.
+func (client *KubeClient) ApplyDeployment(deployment *appsv1.Deployment,
+	fieldManager string) error {
+	deployment = deployment.DeepCopy()
+	deployment.APIVersion, deployment.Kind = "apps/v1", "Deployment"
+	deployment.ResourceVersion = ""
+	deployment.ManagedFields = nil
+	return client.Apply("apps", "v1", deployment.Namespace, "deployments/"+deployment.Name,
+		fieldManager, deployment)
+}
+
 // DeleteDeployment deletes a deployment.
 func (client *KubeClient) DeleteDeployment(deployment *appsv1.Deployment) error {
 	return client.Delete("apps", "v1", deployment.Namespace, "deployments/"+deployment.Name)
 }
 
+// AddReplicaSet adds a new replica set.
+func (client *KubeClient) AddReplicaSet(replicaSet *appsv1.ReplicaSet) error {
+	return client.Post("apps", "v1", replicaSet.Namespace, "replicasets", replicaSet)
+}
+
+// UpdateReplicaSet replaces an existing replica set.
+func (client *KubeClient) UpdateReplicaSet(replicaSet *appsv1.ReplicaSet) error {
+	return client.Put("apps", "v1", replicaSet.Namespace, "replicasets/"+replicaSet.Name,
+		replicaSet)
+}
+
+// DeleteReplicaSet deletes a replica set.
+func (client *KubeClient) DeleteReplicaSet(replicaSet *appsv1.ReplicaSet) error {
+	return client.Delete("apps", "v1", replicaSet.Namespace, "replicasets/"+replicaSet.Name)
+}
+
+// AddPodDisruptionBudget adds a new policy/v1 PodDisruptionBudget.
+// The v1beta1 type is used as k8s.io/api v0.19 has no v1 one, but the
+// fields we use are the same.
+func (client *KubeClient) AddPodDisruptionBudget(pdb *policyv1beta1.PodDisruptionBudget) error {
+	return client.Post("policy", "v1", pdb.Namespace, "poddisruptionbudgets", pdb)
+}
+
+// UpdatePodDisruptionBudget replaces an existing PodDisruptionBudget.
+func (client *KubeClient) UpdatePodDisruptionBudget(pdb *policyv1beta1.PodDisruptionBudget) error {
+	return client.Put("policy", "v1", pdb.Namespace, "poddisruptionbudgets/"+pdb.Name, pdb)
+}
+
+// DeletePodDisruptionBudget deletes a PodDisruptionBudget.
+func (client *KubeClient) DeletePodDisruptionBudget(pdb *policyv1beta1.PodDisruptionBudget) error {
+	return client.Delete("policy", "v1", pdb.Namespace, "poddisruptionbudgets/"+pdb.Name)
+}
+
+// GetServices queries the api server for the services matching
+// options. See GetResources for details.
+func (client *KubeClient) GetServices(namespace string, options ListOptions) (<-chan WatchEvent,
+	chan<- struct{}) {
+	return client.GetResources("", "v1", namespace, "services", options.Query(nil),
+		corev1.Service{})
+}
+
+// AddService adds a new service.
+func (client *KubeClient) AddService(service *corev1.Service) error {
+	return client.Post("", "v1", service.Namespace, "services", service)
+}
+
+// UpdateService replaces an existing service. Since the cluster IP of
+// a service cannot be changed, that of service must be the current one.
+func (client *KubeClient) UpdateService(service *corev1.Service) error {
+	return client.Put("", "v1", service.Namespace, "services/"+service.Name, service)
+}
+
+// DeleteService deletes a service.
+func (client *KubeClient) DeleteService(service *corev1.Service) error {
+	return client.Delete("", "v1", service.Namespace, "services/"+service.Name)
+}
+
+// GetNamespace fetches a namespace.
+func (client *KubeClient) GetNamespace(name string) (*corev1.Namespace, error) {
+	namespace := &corev1.Namespace{}
+	err := client.GetResource("", "v1", "", "namespaces/"+name, namespace)
+	return namespace, err
+}
+
+// AddNamespace adds a new namespace.
+func (client *KubeClient) AddNamespace(namespace *corev1.Namespace) error {
+	return client.Post("", "v1", "", "namespaces", namespace)
+}
+
+// RecordEvent creates an Event about obj, whose kind is gvk. The
+// eventType is either corev1.EventTypeNormal or
+// corev1.EventTypeWarning.
+func (client *KubeClient) RecordEvent(obj metav1.Object, gvk schema.GroupVersionKind,
+	eventType, reason, message string) error {
+	namespace := obj.GetNamespace()
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	now := metav1.Now()
+	event := corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", obj.GetName(), now.UnixNano()),
+			Namespace: namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion:      gvk.GroupVersion().String(),
+			Kind:            gvk.Kind,
+			Namespace:       obj.GetNamespace(),
+			Name:            obj.GetName(),
+			UID:             obj.GetUID(),
+			ResourceVersion: obj.GetResourceVersion(),
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         corev1.EventSource{Component: "sample-controller"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	return client.Post("", "v1", namespace, "events", &event)
+}
+
 // AddCustomResourceDefinition adds a new CRD.
 func (client *KubeClient) AddCustomResourceDefinition(crd *apiextensionsv1.CustomResourceDefinition) error {
 	return client.Post("apiextensions.k8s.io", "v1", "", "customresourcedefinitions", crd)
 }
 
+// GetCustomResourceDefinition reads the CRD called name into crd.
+func (client *KubeClient) GetCustomResourceDefinition(name string,
+	crd *apiextensionsv1.CustomResourceDefinition) error {
+	return client.GetResource("apiextensions.k8s.io", "v1", "", "customresourcedefinitions/"+name,
+		crd)
+}
+
+// UpdateCustomResourceDefinition replaces an existing CRD. crd must
+// have the ResourceVersion of the one it replaces.
+func (client *KubeClient) UpdateCustomResourceDefinition(crd *apiextensionsv1.CustomResourceDefinition) error {
+	return client.Put("apiextensions.k8s.io", "v1", "", "customresourcedefinitions/"+crd.Name,
+		crd)
+}
+
 // GetCustomResourceDefinitions queries the api server for CRDs. See GetResources for details.
 func (client *KubeClient) GetCustomResourceDefinitions(name string) (<-chan WatchEvent,
 	chan<- struct{}) {
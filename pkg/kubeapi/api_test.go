@@ -0,0 +1,622 @@
+package kubeapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testObject struct {
+	Name string `json:"name"`
+}
+
+// startWatchServer returns a client of a server that replies to
+// watches with handler, and a function that waits for the goroutines
+// started since to finish.
+func startWatchServer(t *testing.T, handler http.HandlerFunc) (*KubeClient, func()) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	transport := &http.Transport{}
+	client, err := NewClient(server.URL, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := runtime.NumGoroutine()
+	checkLeaks := func() {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			// The connections kept alive have goroutines of
+			// their own.
+			transport.CloseIdleConnections()
+			if runtime.NumGoroutine() <= before {
+				return
+			}
+			if time.Now().After(deadline) {
+				buf := make([]byte, 1<<20)
+				buf = buf[:runtime.Stack(buf, true)]
+				t.Fatalf("%d goroutines leaked:\n%s", runtime.NumGoroutine()-before, buf)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return client, checkLeaks
+}
+
+func TestWatchStopWithoutReading(t *testing.T) {
+	for name, handler := range map[string]http.HandlerFunc{
+		// The error of the request is never read.
+		"Error": func(w http.ResponseWriter, req *http.Request) {
+			http.Error(w, "no", http.StatusInternalServerError)
+		},
+		// The event is decoded, but never read.
+		"Event": func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(`{"type": "ADDED", "object": {"name": "abc"}}`))
+			w.(http.Flusher).Flush()
+			<-req.Context().Done()
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			client, checkLeaks := startWatchServer(t, handler)
+			for i := 0; i < 10; i++ {
+				_, stop := client.GetResources("", "v1", "default", "objects", nil,
+					testObject{})
+				// Give the watch time to block sending.
+				time.Sleep(time.Millisecond)
+				close(stop)
+			}
+			checkLeaks()
+		})
+	}
+}
+
+func TestWatchEndedByServer(t *testing.T) {
+	client, checkLeaks := startWatchServer(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"type": "ADDED", "object": {"name": "abc"}}`))
+	})
+	// stop is deliberately not closed.
+	events, _ := client.GetResources("", "v1", "default", "objects", nil, testObject{})
+	ev := <-events
+	if ev.Err != nil || ev.Item != (testObject{Name: "abc"}) {
+		t.Errorf("Wrong event: %+v", ev)
+	}
+	if _, ok := <-events; ok {
+		t.Error("Expected the watch to end")
+	}
+	checkLeaks()
+}
+
+func TestWatchItemError(t *testing.T) {
+	client, checkLeaks := startWatchServer(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"type": "XYZ", "object": {"name": "abc"}}
+			{"type": "ADDED", "object": {"name": 42}}
+			{"type": "ADDED", "object": {"name": "def"}}`))
+	})
+	events, stop := client.GetResources("", "v1", "default", "objects", nil, testObject{})
+	defer close(stop)
+	for i := 0; i < 2; i++ {
+		if ev := <-events; !IsItemError(ev.Err) {
+			t.Errorf("Expected an ItemError, got %+v", ev)
+		}
+	}
+	if ev := <-events; ev.Err != nil || ev.Item != (testObject{Name: "def"}) {
+		t.Errorf("The watch did not continue: %+v", ev)
+	}
+	if _, ok := <-events; ok {
+		t.Error("Expected the watch to end")
+	}
+	checkLeaks()
+}
+
+func TestWatchDeleteKey(t *testing.T) {
+	client, checkLeaks := startWatchServer(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"type": "DELETED", "object": {"metadata": {"name": "a"}}}
+			{"type": "DELETED", "object": {"metadata": {"name": "b", "namespace": "xyz",
+				"uid": "1234"}, "spec": {"replicas": "bad"}}}
+			{"type": "ADDED", "object": {"metadata": {"name": "c"}, "spec": {"replicas": "bad"}}}
+			{"type": "DELETED", "object": {"spec": {"replicas": "bad"}}}`))
+	})
+	for _, v := range []interface{}{appsv1.Deployment{}, &appsv1.Deployment{}} {
+		events, stop := client.GetResources("apps", "v1", "xyz", "deployments", nil, v)
+		for _, want := range []struct {
+			name, uid string
+		}{{"a", ""}, {"b", "1234"}} {
+			ev := <-events
+			deployment, ok := ev.Item.(*appsv1.Deployment)
+			if !ok {
+				value := ev.Item.(appsv1.Deployment)
+				deployment = &value
+			}
+			if ev.Err != nil || !ev.IsDelete || deployment.Name != want.name ||
+				deployment.Namespace != "xyz" || string(deployment.UID) != want.uid {
+				t.Errorf("Wrong delete of %s: %+v", want.name, ev)
+			}
+		}
+		// Only deletes are decoded from their metadata, and they
+		// need a name.
+		for i := 0; i < 2; i++ {
+			if ev := <-events; !IsItemError(ev.Err) {
+				t.Errorf("Expected an ItemError, got %+v", ev)
+			}
+		}
+		if _, ok := <-events; ok {
+			t.Error("Expected the watch to end")
+		}
+		close(stop)
+	}
+	checkLeaks()
+}
+
+func TestWatchTyped(t *testing.T) {
+	client, checkLeaks := startWatchServer(t, func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/api/v1/namespaces/xyz/objects":
+			w.Write([]byte(`{"type": "ADDED", "object": {"name": "abc"}}
+				broken`))
+		case "/apis/apps/v1/namespaces/xyz/deployments":
+			w.Write([]byte(`{"type": "DELETED", "object": {"metadata": {"name": "bar"}}}`))
+		default:
+			http.NotFound(w, req)
+		}
+	})
+
+	objects, stopObjects := WatchTyped[*testObject](client,
+		schema.GroupVersionResource{Version: "v1", Resource: "objects"}, "xyz", nil)
+	if ev := <-objects; ev.Err != nil || ev.IsDelete || ev.Item.Name != "abc" {
+		t.Errorf("Wrong object event: %+v", ev)
+	}
+	if ev := <-objects; ev.Err == nil {
+		t.Error("Expected an error")
+	}
+	if _, ok := <-objects; ok {
+		t.Error("Watch not ended after an error")
+	}
+	close(stopObjects)
+
+	deployments, stopDeployments := WatchTyped[appsv1.Deployment](client,
+		appsv1.SchemeGroupVersion.WithResource("deployments"), "xyz", nil)
+	if ev := <-deployments; ev.Err != nil || !ev.IsDelete || ev.Item.Name != "bar" {
+		t.Errorf("Wrong Deployment event: %+v", ev)
+	}
+	close(stopDeployments)
+	checkLeaks()
+}
+
+// refusingTransport fails the first refusals requests as if the api
+// server was not reachable.
+type refusingTransport struct {
+	refusals int32
+	attempts int32
+}
+
+func (rt *refusingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if atomic.AddInt32(&rt.attempts, 1) <= rt.refusals {
+		return nil, errors.New("connection refused")
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestWatchConnectRetry(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		w.Write([]byte(`{"type": "ADDED", "object": {"name": "abc"}}`))
+	}))
+	defer server.Close()
+	transport := &refusingTransport{refusals: 2}
+	client, err := NewClient(server.URL, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := &testLogger{}
+
+	events, stop := client.WithLogger(logger).GetResources("", "v1", "default", "objects", nil,
+		testObject{})
+	defer close(stop)
+	if ev := <-events; ev.Err != nil || ev.Item != (testObject{Name: "abc"}) {
+		t.Errorf("Wrong event: %+v", ev)
+	}
+	if n := atomic.LoadInt32(&transport.attempts); n != 3 {
+		t.Errorf("Connected after %d attempts, want 3", n)
+	}
+	if msgs := logger.messages(); len(msgs) != 2 || msgs[0] != "Could not connect, retrying" {
+		t.Errorf("Wrong logs: %q", msgs)
+	}
+
+	// Without retries, the first error is reported.
+	transport = &refusingTransport{refusals: 1}
+	client, err = NewClient(server.URL, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, stop2 := client.WithConnectRetry(-1).GetResources("", "v1", "default", "objects",
+		nil, testObject{})
+	defer close(stop2)
+	if ev := <-events; ev.Err == nil || !strings.HasSuffix(ev.Err.Error(), "connection refused") {
+		t.Errorf("Expected the connection error, got %+v", ev)
+	}
+}
+
+// testLogger is a Logger that records the messages logged.
+type testLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *testLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, msg)
+}
+
+func (l *testLogger) messages() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.msgs...)
+}
+
+func TestFieldManager(t *testing.T) {
+	queries := make(chan url.Values, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		queries <- req.URL.Query()
+	}))
+	defer server.Close()
+	client, err := NewClient(server.URL, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "bar",
+		Namespace: "xyz"}}
+	if err := client.UpdateDeployment(deployment); err != nil {
+		t.Fatal(err)
+	}
+	if query := <-queries; query.Has("fieldManager") {
+		t.Error("Unexpected field manager: ", query)
+	}
+	client = client.WithFieldManager("other")
+	if m := client.FieldManager(); m != "other" {
+		t.Errorf("Got field manager %q, want other", m)
+	}
+	if err := client.UpdateDeployment(deployment); err != nil {
+		t.Fatal(err)
+	}
+	if m := (<-queries).Get("fieldManager"); m != "other" {
+		t.Errorf("Updated as %q, want other", m)
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	bodies := make(chan appsv1.Deployment, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		if req.Method != "POST" || req.URL.Path != "/apis/apps/v1/namespaces/xyz/deployments" {
+			t.Errorf("Unexpected request %s %s", req.Method, req.URL.Path)
+		}
+		var deployment appsv1.Deployment
+		if err := json.NewDecoder(req.Body).Decode(&deployment); err != nil {
+			t.Error(err)
+		}
+		bodies <- deployment
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	client, err := NewClient(server.URL, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The default transport doesn't trust the certificate of the
+	// server, the client of the server does.
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "bar",
+		Namespace: "xyz"}}
+	if err := client.AddDeployment(deployment); err == nil {
+		t.Error("Expected a certificate error")
+	}
+	client = client.WithHTTPClient(server.Client())
+	if err := client.AddDeployment(deployment); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-bodies; got.Name != "bar" {
+		t.Errorf("Wrong deployment: %+v", got)
+	}
+}
+
+func TestObserver(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		if req.Method == "POST" {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	client, err := NewClient(server.URL, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var infos []RequestInfo
+	client = client.WithObserver(func(info RequestInfo) {
+		infos = append(infos, info)
+	})
+
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "bar",
+		Namespace: "xyz"}}
+	if err := client.AddDeployment(deployment); err != nil {
+		t.Fatal(err)
+	}
+	var re *RequestError
+	if err := client.UpdateDeployment(deployment); !errors.As(err, &re) ||
+		re.StatusCode != http.StatusTooManyRequests {
+		t.Error("Expected a 429, got ", err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("Observed %d requests, want 2", len(infos))
+	}
+	for i, want := range []struct {
+		method, path string
+		status       int
+	}{
+		{"POST", "/apis/apps/v1/namespaces/xyz/deployments", http.StatusCreated},
+		{"PUT", "/apis/apps/v1/namespaces/xyz/deployments/bar", http.StatusTooManyRequests},
+	} {
+		info := infos[i]
+		if info.Method != want.method || info.Path != want.path ||
+			info.StatusCode != want.status || info.Err != nil || info.Latency <= 0 {
+			t.Errorf("Wrong request %d: %+v", i, info)
+		}
+	}
+}
+
+func TestThrottleRetries(t *testing.T) {
+	var posts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		if atomic.AddInt32(&posts, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	client, err := NewClient(server.URL, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "bar",
+		Namespace: "xyz"}}
+	// Without retries, the 429 is returned.
+	var re *RequestError
+	if err := client.AddDeployment(deployment); !errors.As(err, &re) ||
+		re.StatusCode != http.StatusTooManyRequests || re.RetryAfter != time.Second {
+		t.Error("Expected a 429, got ", err)
+	}
+
+	atomic.StoreInt32(&posts, 0)
+	start := time.Now()
+	logger := &testLogger{}
+	throttled := client.WithLogger(logger).WithThrottleRetries(2)
+	if err := throttled.AddDeployment(deployment); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := logger.messages(); len(msgs) != 1 || msgs[0] != "Throttled, retrying" {
+		t.Errorf("Wrong logs: %q", msgs)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Retried after %s, before the Retry-After delay", elapsed)
+	}
+	if n := atomic.LoadInt32(&posts); n != 2 {
+		t.Errorf("Got %d POSTs, want 2", n)
+	}
+}
+
+func TestThrottleRetriesCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	client, err := NewClient(server.URL, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The wait for the retry ends with the context.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "bar",
+		Namespace: "xyz"}}
+	start := time.Now()
+	err = client.WithContext(ctx).WithThrottleRetries(1).AddDeployment(deployment)
+	var re *RequestError
+	if !errors.As(err, &re) || re.StatusCode != http.StatusTooManyRequests {
+		t.Error("Expected a 429, got ", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Waited %s after the context was done", elapsed)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	client, err := NewClient(server.URL, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The burst is not delayed, the requests after it are.
+	bucket := newTokenBucket(20, 2)
+	for i := 0; i < 2; i++ {
+		if d := bucket.take(); d != 0 {
+			t.Errorf("Request %d of the burst waits %s", i, d)
+		}
+	}
+	if d := bucket.take(); d <= 0 || d > 50*time.Millisecond {
+		t.Errorf("The request after the burst waits %s, want up to 50ms", d)
+	}
+
+	// Copies share the limit.
+	client = client.WithRateLimit(20, 2)
+	copy := client.WithFieldManager("other")
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "bar",
+		Namespace: "xyz"}}
+	start := time.Now()
+	for _, c := range []*KubeClient{client, client, copy, copy} {
+		if err := c.AddDeployment(deployment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("4 requests at 20 qps took %s", elapsed)
+	}
+	if client.WithRateLimit(0, 0).limiter != nil {
+		t.Error("Expected no limit")
+	}
+}
+
+func TestGetResource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		switch req.URL.Path {
+		case "/apis/apps/v1/namespaces/xyz/deployments/bar":
+			w.Write([]byte(`{"metadata": {"name": "bar", "namespace": "xyz"}}`))
+		case "/apis/apps/v1/namespaces/xyz/deployments/broken":
+			w.Write([]byte(`{"metadata": {"name": 42}}`))
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	client, err := NewClient(server.URL, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deployment := &appsv1.Deployment{}
+	if err := client.GetResource("apps", "v1", "xyz", "deployments/bar",
+		deployment); err != nil {
+		t.Fatal(err)
+	}
+	if deployment.Name != "bar" || deployment.Namespace != "xyz" {
+		t.Errorf("Got %s/%s, want xyz/bar", deployment.Namespace, deployment.Name)
+	}
+
+	var re *RequestError
+	err = client.GetResource("apps", "v1", "xyz", "deployments/missing", &appsv1.Deployment{})
+	if !errors.As(err, &re) || re.StatusCode != http.StatusNotFound {
+		t.Error("Expected a 404, got ", err)
+	}
+
+	err = client.GetResource("apps", "v1", "xyz", "deployments/broken", &appsv1.Deployment{})
+	if err == nil || errors.As(err, &re) ||
+		!strings.HasPrefix(err.Error(), "Could not decode deployments/broken: ") {
+		t.Error("Expected a decode error, got ", err)
+	}
+}
+
+func TestPatchDeployment(t *testing.T) {
+	requests := make(chan *http.Request, 2)
+	bodies := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		requests <- req
+		bodies <- string(body)
+	}))
+	defer server.Close()
+	client, err := NewClient(server.URL, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patch := `{"spec": {"replicas": 3}}`
+	for _, ty := range []types.PatchType{types.MergePatchType, types.StrategicMergePatchType} {
+		if err := client.PatchDeployment("xyz", "bar", ty, []byte(patch)); err != nil {
+			t.Fatal(err)
+		}
+		req, body := <-requests, <-bodies
+		if req.Method != "PATCH" || req.URL.Path != "/apis/apps/v1/namespaces/xyz/deployments/bar" {
+			t.Errorf("Wrong request: %s %s", req.Method, req.URL.Path)
+		}
+		if got := req.Header.Get("Content-Type"); got != string(ty) {
+			t.Errorf("Got content type %s, want %s", got, ty)
+		}
+		if body != patch {
+			t.Error("Wrong patch: ", body)
+		}
+	}
+
+	if err := client.PatchDeployment("xyz", "bar", types.JSONPatchType,
+		[]byte(`[]`)); err == nil {
+		t.Error("Expected an error for a JSON patch")
+	}
+	if len(requests) != 0 {
+		t.Error("Unexpected request: ", (<-requests).Header)
+	}
+}
+
+func TestApplyDeployment(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Error("Could not decode the patch: ", err)
+		}
+		requests <- req
+		bodies <- body
+	}))
+	defer server.Close()
+	client, err := NewClient(server.URL, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "bar",
+		Namespace: "xyz", ResourceVersion: "42"}}
+	if err := client.ApplyDeployment(deployment, "sample-controller"); err != nil {
+		t.Fatal(err)
+	}
+	req, body := <-requests, <-bodies
+	if req.Method != "PATCH" || req.URL.Path != "/apis/apps/v1/namespaces/xyz/deployments/bar" {
+		t.Errorf("Wrong request: %s %s", req.Method, req.URL.Path)
+	}
+	if ty := req.Header.Get("Content-Type"); ty != ApplyPatchType {
+		t.Error("Wrong content type: ", ty)
+	}
+	if query := req.URL.Query(); query.Get("fieldManager") != "sample-controller" ||
+		query.Get("force") != "true" {
+		t.Error("Wrong query: ", query)
+	}
+	metadata, _ := body["metadata"].(map[string]interface{})
+	if body["apiVersion"] != "apps/v1" || body["kind"] != "Deployment" ||
+		metadata["resourceVersion"] != nil {
+		t.Error("Wrong patch: ", body)
+	}
+	if deployment.Kind != "" || deployment.ResourceVersion != "42" {
+		t.Error("The deployment was modified: ", deployment)
+	}
+}
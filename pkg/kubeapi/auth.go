@@ -0,0 +1,126 @@
+package kubeapi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serviceAccountDir is where Kubernetes mounts the credentials of the
+// ServiceAccount of a pod.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// NewClientFromConfig returns a KubeClient for the api server at host
+// that trusts the PEM encoded certificates in caCert, or those of the
+// system if it is empty, and authenticates with the bearer token.
+func NewClientFromConfig(host string, caCert []byte, token string) (*KubeClient, error) {
+	transport, err := newTLSTransport(caCert)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(host, &bearerTransport{base: transport, token: func() (string, error) {
+		return token, nil
+	}})
+}
+
+// NewInClusterClient returns a KubeClient for the api server of the
+// cluster we are running in, authenticated as the ServiceAccount of
+// our pod. The token is read again when the kubelet rotates it.
+func NewInClusterClient() (*KubeClient, error) {
+	return newInClusterClient(serviceAccountDir, os.Getenv)
+}
+
+func newInClusterClient(dir string, getenv func(string) string) (*KubeClient, error) {
+	host, port := getenv("KUBERNETES_SERVICE_HOST"), getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New(
+			"Not running in a cluster: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+	}
+	caCert, err := ioutil.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the CA certificate: %w", err)
+	}
+	transport, err := newTLSTransport(caCert)
+	if err != nil {
+		return nil, err
+	}
+	token := &fileToken{path: filepath.Join(dir, "token")}
+	if _, err := token.get(); err != nil {
+		return nil, err
+	}
+	return NewClient("https://"+net.JoinHostPort(host, port),
+		&bearerTransport{base: transport, token: token.get})
+}
+
+// newTLSTransport returns a transport like http.DefaultTransport that
+// trusts the certificates in caCert, or those of the system if it is
+// empty.
+func newTLSTransport(caCert []byte) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if len(caCert) == 0 {
+		return transport, nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, errors.New("Could not parse the CA certificate")
+	}
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return transport, nil
+}
+
+// bearerTransport sets the Authorization header of every request to
+// the current token.
+type bearerTransport struct {
+	base  http.RoundTripper
+	token func() (string, error)
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.token()
+	if err != nil {
+		return nil, err
+	}
+	// A RoundTripper must not modify the request.
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req)
+}
+
+// fileToken is a token read from a file, and read again once the file
+// is modified.
+type fileToken struct {
+	path string
+
+	mu      sync.Mutex
+	token   string
+	modTime time.Time
+	size    int64
+}
+
+func (f *fileToken) get() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return "", fmt.Errorf("Could not read the token: %w", err)
+	}
+	if f.token != "" && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.token, nil
+	}
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return "", fmt.Errorf("Could not read the token: %w", err)
+	}
+	f.token = strings.TrimSpace(string(data))
+	f.modTime, f.size = info.ModTime(), info.Size()
+	return f.token, nil
+}
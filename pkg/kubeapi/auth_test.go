@@ -0,0 +1,113 @@
+package kubeapi
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startTLSServer returns a TLS server that replies with the
+// Authorization header of each request, and its PEM encoded
+// certificate.
+func startTLSServer(t *testing.T) (*httptest.Server, []byte) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		w.Write([]byte(req.Header.Get("Authorization")))
+	}))
+	t.Cleanup(server.Close)
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+		Bytes: server.Certificate().Raw})
+	return server, caCert
+}
+
+// authorization returns the Authorization header server received.
+func authorization(t *testing.T, client *KubeClient) string {
+	body, err := client.Get("", "v1", "default", "pods", nil)
+	if err != nil {
+		t.Fatal("Request failed: ", err)
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal("Could not read body: ", err)
+	}
+	return string(data)
+}
+
+func TestClientFromConfig(t *testing.T) {
+	server, caCert := startTLSServer(t)
+	client, err := NewClientFromConfig(server.URL, caCert, "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth := authorization(t, client); auth != "Bearer abc" {
+		t.Errorf("Wrong Authorization header: %q", auth)
+	}
+
+	// Without the CA certificate, the server is not trusted.
+	client, err = NewClientFromConfig(server.URL, nil, "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get("", "v1", "default", "pods", nil); err == nil {
+		t.Error("Expected a certificate error")
+	}
+
+	if _, err := NewClientFromConfig(server.URL, []byte("garbage"), "abc"); err == nil {
+		t.Error("Expected an error for a bad CA certificate")
+	}
+}
+
+func TestInClusterClient(t *testing.T) {
+	server, caCert := startTLSServer(t)
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"KUBERNETES_SERVICE_HOST": host, "KUBERNETES_SERVICE_PORT": port}
+	getenv := func(key string) string { return env[key] }
+
+	dir := t.TempDir()
+	tokenPath := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.crt"), caCert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(tokenPath, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	client, err := newInClusterClient(dir, getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth := authorization(t, client); auth != "Bearer first" {
+		t.Errorf("Wrong Authorization header: %q", auth)
+	}
+
+	// The kubelet rotates the token.
+	if err := ioutil.WriteFile(tokenPath, []byte("second\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(tokenPath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if auth := authorization(t, client); auth != "Bearer second" {
+		t.Errorf("The token was not read again: %q", auth)
+	}
+
+	delete(env, "KUBERNETES_SERVICE_HOST")
+	if _, err := newInClusterClient(dir, getenv); err == nil {
+		t.Error("Expected an error outside of a cluster")
+	}
+}
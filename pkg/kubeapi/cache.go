@@ -0,0 +1,85 @@
+package kubeapi
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sync"
+)
+
+// Cache keeps the last version of the resources of type T seen by the
+// watches passed to Watch, by namespace and name, so that they can be
+// read without a request. A resource deleted while no watch was
+// running, for example before a watch lists again, might be kept.
+type Cache[T metav1.Object] struct {
+	mu    sync.RWMutex
+	items map[string]T
+}
+
+// NewCache returns an empty Cache.
+func NewCache[T metav1.Object]() *Cache[T] {
+	return &Cache[T]{items: make(map[string]T)}
+}
+
+// Watch returns the events and the stop channel of a watch, such as
+// one of GetResources, after the cache is updated with each event.
+// The Items of the events must have type T. Closing the returned stop
+// channel closes stop.
+func (c *Cache[T]) Watch(events <-chan WatchEvent, stop chan<- struct{}) (<-chan WatchEvent,
+	chan<- struct{}) {
+	out := make(chan WatchEvent)
+	done := make(chan struct{})
+	go func() {
+		defer close(out)
+		defer close(stop)
+		for {
+			select {
+			case ev, ok := <-events:
+				if !ok {
+					return
+				}
+				c.update(ev)
+				select {
+				case out <- ev:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return out, done
+}
+
+func (c *Cache[T]) update(ev WatchEvent) {
+	if ev.Err != nil {
+		return
+	}
+	item, ok := ev.Item.(T)
+	if !ok {
+		return
+	}
+	key := item.GetNamespace() + "/" + item.GetName()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ev.IsDelete {
+		delete(c.items, key)
+	} else {
+		c.items[key] = item
+	}
+}
+
+// Get returns the cached resource namespace/name, if any. It must
+// not be modified.
+func (c *Cache[T]) Get(namespace, name string) (T, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	item, ok := c.items[namespace+"/"+name]
+	return item, ok
+}
+
+// Len returns how many resources are cached.
+func (c *Cache[T]) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.items)
+}
@@ -0,0 +1,53 @@
+package kubeapi
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	cache := NewCache[*appsv1.Deployment]()
+	events := make(chan WatchEvent)
+	stop := make(chan struct{})
+	out, stopOut := cache.Watch(events, stop)
+
+	deployment := func(name, rv string) *appsv1.Deployment {
+		return &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "xyz",
+			ResourceVersion: rv}}
+	}
+	send := func(ev WatchEvent) {
+		events <- ev
+		if got := <-out; got.Item != ev.Item || got.IsDelete != ev.IsDelete {
+			t.Errorf("Got %+v, want %+v", got, ev)
+		}
+	}
+	version := func(name string) string {
+		d, ok := cache.Get("xyz", name)
+		if !ok {
+			return ""
+		}
+		return d.ResourceVersion
+	}
+
+	send(WatchEvent{Item: deployment("a", "1")})
+	send(WatchEvent{Item: deployment("b", "2")})
+	send(WatchEvent{Item: deployment("a", "3")})
+	if v := version("a"); v != "3" {
+		t.Errorf("Got version %q of a, want 3", v)
+	}
+	send(WatchEvent{IsDelete: true, Item: deployment("b", "4")})
+	if _, ok := cache.Get("xyz", "b"); ok || cache.Len() != 1 {
+		t.Error("Deleted resource still cached")
+	}
+	if _, ok := cache.Get("other", "a"); ok {
+		t.Error("Found a in the wrong namespace")
+	}
+
+	// Stopping the watch stops the one it wraps.
+	close(stopOut)
+	<-stop
+	if _, ok := <-out; ok {
+		t.Error("Events after stopping")
+	}
+}
@@ -0,0 +1,648 @@
+// Package fake provides an in-memory api server, so that controllers
+// built on kubeapi can be tested without a cluster, see NewClient.
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"net/http"
+	"reflect"
+	"sample-controller/pkg/kubeapi"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// object is a resource as decoded from json.
+type object = map[string]interface{}
+
+// Server is an in-memory api server. It is an http.RoundTripper, so
+// that a kubeapi.KubeClient can use it as its transport.
+//
+// It stores any resource, namespaced or not, by the path of its
+// collection, and serves the gets, lists, watches, creations, updates,
+// patches and deletions the api server would, with resource versions,
+// conflicts and finalizers. The status is only written through the
+// status subresource. CustomResourceDefinitions are established as
+// soon as they are created. It doesn't validate the resources, set
+// defaults or collect garbage, and strategic merge patches and applies
+// are done as JSON merge patches.
+type Server struct {
+	mu sync.Mutex
+	// rv is the resource version of the last change.
+	rv int64
+	// uids is how many UIDs were handed out.
+	uids int64
+	// collections maps the path of a collection, such as
+	// /apis/apps/v1/deployments, to its resources by namespace/name.
+	collections map[string]map[string]object
+	// history has every change, in order, to resume watches from.
+	history  []event
+	watchers map[*watcher]struct{}
+	failures []failure
+}
+
+// event is a change to a resource, as sent by watches.
+type event struct {
+	collection string
+	rv         int64
+	Type       string      `json:"type"`
+	Object     interface{} `json:"object"`
+}
+
+type failure struct {
+	method, path string
+	statusCode   int
+}
+
+// NewClient returns a client whose requests are served by a new
+// Server.
+func NewClient() (*kubeapi.KubeClient, *Server) {
+	server := NewServer()
+	client, err := kubeapi.NewClient("http://fake", server)
+	if err != nil {
+		// The url is valid.
+		panic(err)
+	}
+	return client, server
+}
+
+// NewServer returns a Server without resources.
+func NewServer() *Server {
+	return &Server{collections: make(map[string]map[string]object),
+		watchers: make(map[*watcher]struct{})}
+}
+
+// Fail makes the next request with method on path, such as
+// /apis/apps/v1/namespaces/default/deployments, fail with statusCode.
+// Call it n times to fail the n next ones.
+func (s *Server) Fail(method, path string, statusCode int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, failure{method, path, statusCode})
+}
+
+// Get decodes into obj the resource at path, such as
+// /apis/apps/v1/namespaces/default/deployments/bar, and reports
+// whether it exists.
+func (s *Server) Get(path string, obj interface{}) (bool, error) {
+	p, ok := parsePath(path)
+	if !ok || p.name == "" {
+		return false, fmt.Errorf("%s is not the path of a resource", path)
+	}
+	s.mu.Lock()
+	stored, ok := s.collections[p.collection][p.key()]
+	s.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, obj)
+}
+
+// Names returns the namespace/name of the resources of the collection
+// at path, such as /apis/apps/v1/deployments, sorted.
+func (s *Server) Names(path string) []string {
+	p, _ := parsePath(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ret []string
+	for key := range s.collections[p.collection] {
+		ret = append(ret, key)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// resourcePath is a parsed request path.
+type resourcePath struct {
+	// collection is the path of the collection of all namespaces.
+	collection string
+	namespace  string
+	name       string
+	// subresource is "status" or empty.
+	subresource string
+}
+
+func (p resourcePath) key() string {
+	return p.namespace + "/" + p.name
+}
+
+// parsePath parses /api/v1/[namespaces/<namespace>/]<plural>[/<name>[/status]]
+// and the same with /apis/<group>/<version>.
+func parsePath(path string) (resourcePath, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	var prefix int
+	switch {
+	case len(parts) >= 3 && parts[0] == "api":
+		prefix = 2
+	case len(parts) >= 4 && parts[0] == "apis":
+		prefix = 3
+	default:
+		return resourcePath{}, false
+	}
+	ret := resourcePath{}
+	rest := parts[prefix:]
+	if len(rest) >= 3 && rest[0] == "namespaces" {
+		ret.namespace = rest[1]
+		rest = rest[2:]
+	}
+	if len(rest) > 3 || len(rest) == 3 && rest[2] != "status" {
+		return resourcePath{}, false
+	}
+	ret.collection = "/" + strings.Join(append(parts[:prefix:prefix], rest[0]), "/")
+	if len(rest) > 1 {
+		ret.name = rest[1]
+	}
+	if len(rest) > 2 {
+		ret.subresource = rest[2]
+	}
+	return ret, true
+}
+
+// RoundTrip serves req.
+func (s *Server) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	p, ok := parsePath(req.URL.Path)
+	if !ok {
+		return statusResponse(http.StatusNotFound, "NotFound", "No such path %s",
+			req.URL.Path), nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, f := range s.failures {
+		if f.method == req.Method && f.path == req.URL.Path {
+			s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			return statusResponse(f.statusCode, http.StatusText(f.statusCode),
+				"Injected failure"), nil
+		}
+	}
+
+	query := req.URL.Query()
+	switch {
+	case req.Method == "GET" && p.name == "" && query.Get("watch") == "true":
+		return s.watch(req, p, query)
+	case req.Method == "GET" && p.name == "":
+		return s.list(p, query)
+	case req.Method == "GET":
+		stored, ok := s.collections[p.collection][p.key()]
+		if !ok {
+			return notFound(p), nil
+		}
+		return jsonResponse(http.StatusOK, stored), nil
+	case req.Method == "POST" && p.name == "":
+		return s.create(p, body)
+	case req.Method == "PUT" && p.name != "":
+		return s.update(p, body)
+	case req.Method == "PATCH" && p.name != "":
+		return s.patch(p, req.Header.Get("Content-Type"), body)
+	case req.Method == "DELETE" && p.name != "":
+		return s.delete(p)
+	}
+	return statusResponse(http.StatusMethodNotAllowed, "MethodNotAllowed",
+		"%s is not supported on %s", req.Method, req.URL.Path), nil
+}
+
+func (s *Server) create(p resourcePath, body []byte) (*http.Response, error) {
+	obj := object{}
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return statusResponse(http.StatusBadRequest, "BadRequest", "%s", err), nil
+	}
+	meta := metadata(obj)
+	name, _ := meta["name"].(string)
+	if name == "" {
+		return statusResponse(http.StatusUnprocessableEntity, "Invalid",
+			"metadata.name is required"), nil
+	}
+	if p.namespace != "" {
+		meta["namespace"] = p.namespace
+	}
+	p.name = name
+	if _, ok := s.collections[p.collection][p.key()]; ok {
+		return statusResponse(http.StatusConflict, "AlreadyExists", "%s %s already exists",
+			p.collection, p.key()), nil
+	}
+	s.uids++
+	meta["uid"] = fmt.Sprintf("fake-uid-%d", s.uids)
+	meta["creationTimestamp"] = time.Now().UTC().Format(time.RFC3339)
+	meta["generation"] = 1
+	delete(meta, "deletionTimestamp")
+	if strings.HasSuffix(p.collection, "/customresourcedefinitions") {
+		// As the api server does once it serves them.
+		obj["status"] = object{"conditions": []interface{}{
+			object{"type": "NamesAccepted", "status": "True"},
+			object{"type": "Established", "status": "True"},
+		}}
+	}
+	s.store(p, obj, "ADDED")
+	return jsonResponse(http.StatusCreated, obj), nil
+}
+
+func (s *Server) update(p resourcePath, body []byte) (*http.Response, error) {
+	obj := object{}
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return statusResponse(http.StatusBadRequest, "BadRequest", "%s", err), nil
+	}
+	stored, ok := s.collections[p.collection][p.key()]
+	if !ok {
+		return notFound(p), nil
+	}
+	if rv, _ := metadata(obj)["resourceVersion"].(string); rv != "" &&
+		rv != metadata(stored)["resourceVersion"] {
+		return statusResponse(http.StatusConflict, "Conflict",
+			"%s %s was modified, its resource version is not %s", p.collection, p.key(),
+			rv), nil
+	}
+	return s.write(p, stored, obj)
+}
+
+// write replaces stored, the resource at p, with obj, keeping what
+// cannot be written.
+func (s *Server) write(p resourcePath, stored, obj object) (*http.Response, error) {
+	if name, _ := metadata(obj)["name"].(string); name != p.name {
+		return statusResponse(http.StatusBadRequest, "BadRequest",
+			"The name %q doesn't match the path", name), nil
+	}
+	if p.subresource == "status" {
+		updated := clone(stored)
+		updated["status"] = obj["status"]
+		obj = updated
+	} else {
+		obj = clone(obj)
+		if status, ok := stored["status"]; ok {
+			obj["status"] = status
+		} else {
+			delete(obj, "status")
+		}
+	}
+	meta, old := metadata(obj), metadata(stored)
+	for _, k := range []string{"uid", "creationTimestamp", "deletionTimestamp", "generation",
+		"namespace"} {
+		if v, ok := old[k]; ok {
+			meta[k] = v
+		} else {
+			delete(meta, k)
+		}
+	}
+	if !reflect.DeepEqual(obj["spec"], stored["spec"]) {
+		generation, _ := old["generation"].(float64)
+		meta["generation"] = generation + 1
+	}
+	if _, deleting := meta["deletionTimestamp"]; deleting && len(finalizers(meta)) == 0 {
+		s.remove(p, obj)
+		return jsonResponse(http.StatusOK, obj), nil
+	}
+	s.store(p, obj, "MODIFIED")
+	return jsonResponse(http.StatusOK, obj), nil
+}
+
+func (s *Server) patch(p resourcePath, contentType string, body []byte) (*http.Response,
+	error) {
+	switch contentType {
+	case string(types.MergePatchType), string(types.StrategicMergePatchType),
+		kubeapi.ApplyPatchType:
+	default:
+		return statusResponse(http.StatusUnsupportedMediaType, "UnsupportedMediaType",
+			"Unsupported patch type %s", contentType), nil
+	}
+	var patch interface{}
+	if err := json.Unmarshal(body, &patch); err != nil {
+		return statusResponse(http.StatusBadRequest, "BadRequest", "%s", err), nil
+	}
+	stored, ok := s.collections[p.collection][p.key()]
+	if !ok {
+		if contentType == kubeapi.ApplyPatchType && p.subresource == "" {
+			return s.create(p, body)
+		}
+		return notFound(p), nil
+	}
+	patched, ok := mergePatch(clone(stored), patch).(object)
+	if !ok {
+		return statusResponse(http.StatusBadRequest, "BadRequest",
+			"The patch is not an object"), nil
+	}
+	// As for updates, only the status subresource writes the status.
+	return s.write(p, stored, patched)
+}
+
+// mergePatch applies the JSON merge patch patch to target, see RFC
+// 7386.
+func mergePatch(target, patch interface{}) interface{} {
+	fields, ok := patch.(object)
+	if !ok {
+		return patch
+	}
+	ret, ok := target.(object)
+	if !ok {
+		ret = object{}
+	}
+	for k, v := range fields {
+		if v == nil {
+			delete(ret, k)
+		} else {
+			ret[k] = mergePatch(ret[k], v)
+		}
+	}
+	return ret
+}
+
+func (s *Server) delete(p resourcePath) (*http.Response, error) {
+	stored, ok := s.collections[p.collection][p.key()]
+	if !ok {
+		return notFound(p), nil
+	}
+	meta := metadata(stored)
+	if len(finalizers(meta)) == 0 {
+		s.remove(p, stored)
+		return jsonResponse(http.StatusOK, stored), nil
+	}
+	if _, ok := meta["deletionTimestamp"]; ok {
+		return jsonResponse(http.StatusOK, stored), nil
+	}
+	updated := clone(stored)
+	metadata(updated)["deletionTimestamp"] = time.Now().UTC().Format(time.RFC3339)
+	s.store(p, updated, "MODIFIED")
+	return jsonResponse(http.StatusOK, updated), nil
+}
+
+// store sets the resource at p to obj, with a new resource version,
+// and sends an event of type ty to the watchers.
+func (s *Server) store(p resourcePath, obj object, ty string) {
+	s.rv++
+	metadata(obj)["resourceVersion"] = strconv.FormatInt(s.rv, 10)
+	collection, ok := s.collections[p.collection]
+	if !ok {
+		collection = make(map[string]object)
+		s.collections[p.collection] = collection
+	}
+	// Cloning gives the numbers the float64 type of decoded json.
+	collection[p.key()] = clone(obj)
+	s.notify(event{collection: p.collection, rv: s.rv, Type: ty, Object: clone(obj)})
+}
+
+// remove deletes the resource at p, whose last version is obj.
+func (s *Server) remove(p resourcePath, obj object) {
+	s.rv++
+	metadata(obj)["resourceVersion"] = strconv.FormatInt(s.rv, 10)
+	delete(s.collections[p.collection], p.key())
+	s.notify(event{collection: p.collection, rv: s.rv, Type: "DELETED", Object: clone(obj)})
+}
+
+func (s *Server) notify(ev event) {
+	s.history = append(s.history, ev)
+	for w := range s.watchers {
+		if w.matches(ev) {
+			w.push(ev)
+		}
+	}
+}
+
+// selector is what a list or watch selects.
+type selector struct {
+	collection, namespace string
+	labels                labels.Selector
+	fields                fields.Selector
+}
+
+func newSelector(p resourcePath, query map[string][]string) (selector, error) {
+	ret := selector{collection: p.collection, namespace: p.namespace}
+	var err error
+	ret.labels, err = labels.Parse(first(query["labelSelector"]))
+	if err != nil {
+		return ret, err
+	}
+	ret.fields, err = fields.ParseSelector(first(query["fieldSelector"]))
+	return ret, err
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (sel selector) matches(collection string, obj object) bool {
+	meta := metadata(obj)
+	namespace, _ := meta["namespace"].(string)
+	name, _ := meta["name"].(string)
+	if collection != sel.collection || sel.namespace != "" && namespace != sel.namespace {
+		return false
+	}
+	set := labels.Set{}
+	if m, ok := meta["labels"].(object); ok {
+		for k, v := range m {
+			set[k], _ = v.(string)
+		}
+	}
+	return sel.labels.Matches(set) &&
+		sel.fields.Matches(fields.Set{"metadata.name": name, "metadata.namespace": namespace})
+}
+
+func (s *Server) list(p resourcePath, query map[string][]string) (*http.Response, error) {
+	sel, err := newSelector(p, query)
+	if err != nil {
+		return statusResponse(http.StatusBadRequest, "BadRequest", "%s", err), nil
+	}
+	items := []interface{}{}
+	for _, key := range s.sortedKeys(p.collection) {
+		obj := s.collections[p.collection][key]
+		if sel.matches(p.collection, obj) {
+			items = append(items, obj)
+		}
+	}
+	return jsonResponse(http.StatusOK, object{
+		"metadata": object{"resourceVersion": strconv.FormatInt(s.rv, 10)},
+		"items":    items,
+	}), nil
+}
+
+func (s *Server) sortedKeys(collection string) []string {
+	var keys []string
+	for key := range s.collections[collection] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// watcher is a watch in progress.
+type watcher struct {
+	sel selector
+
+	mu    sync.Mutex
+	queue []event
+	// wake has room for one message, sent when queue grows.
+	wake chan struct{}
+	// closed is closed once the body of the watch is.
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (w *watcher) matches(ev event) bool {
+	return w.sel.matches(ev.collection, ev.Object.(object))
+}
+
+func (w *watcher) push(ev event) {
+	w.mu.Lock()
+	w.queue = append(w.queue, ev)
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *watcher) pop() []event {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ret := w.queue
+	w.queue = nil
+	return ret
+}
+
+// watchBody is the body of a watch. Closing it ends the watch.
+type watchBody struct {
+	*io.PipeReader
+	w *watcher
+}
+
+func (b watchBody) Close() error {
+	b.w.once.Do(func() { close(b.w.closed) })
+	return b.PipeReader.Close()
+}
+
+// watch starts a watch of the resources selected by query. Without a
+// resourceVersion, it first sends the current ones as added.
+func (s *Server) watch(req *http.Request, p resourcePath,
+	query map[string][]string) (*http.Response, error) {
+	sel, err := newSelector(p, query)
+	if err != nil {
+		return statusResponse(http.StatusBadRequest, "BadRequest", "%s", err), nil
+	}
+	w := &watcher{sel: sel, wake: make(chan struct{}, 1), closed: make(chan struct{})}
+	rv := first(query["resourceVersion"])
+	if rv == "" || rv == "0" {
+		for _, key := range s.sortedKeys(p.collection) {
+			ev := event{collection: p.collection, Type: "ADDED",
+				Object: clone(s.collections[p.collection][key])}
+			if w.matches(ev) {
+				w.push(ev)
+			}
+		}
+	} else {
+		from, err := strconv.ParseInt(rv, 10, 64)
+		if err != nil {
+			return statusResponse(http.StatusBadRequest, "BadRequest",
+				"Invalid resourceVersion %q", rv), nil
+		}
+		for _, ev := range s.history {
+			if ev.rv > from && w.matches(ev) {
+				w.push(ev)
+			}
+		}
+	}
+	s.watchers[w] = struct{}{}
+
+	r, pw := io.Pipe()
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			delete(s.watchers, w)
+			s.mu.Unlock()
+			pw.Close()
+		}()
+		encoder := json.NewEncoder(pw)
+		for {
+			for _, ev := range w.pop() {
+				if encoder.Encode(&ev) != nil {
+					return
+				}
+			}
+			select {
+			case <-w.wake:
+			case <-w.closed:
+				return
+			case <-req.Context().Done():
+				return
+			}
+		}
+	}()
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{},
+		Body: watchBody{r, w}}, nil
+}
+
+func metadata(obj object) object {
+	meta, ok := obj["metadata"].(object)
+	if !ok {
+		meta = object{}
+		obj["metadata"] = meta
+	}
+	return meta
+}
+
+func finalizers(meta object) []interface{} {
+	ret, _ := meta["finalizers"].([]interface{})
+	return ret
+}
+
+// clone returns a deep copy of obj.
+func clone(obj object) object {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		// It was decoded from json.
+		panic(err)
+	}
+	ret := object{}
+	if err := json.Unmarshal(data, &ret); err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+func jsonResponse(statusCode int, v interface{}) *http.Response {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return &http.Response{StatusCode: statusCode,
+		Header: http.Header{"Content-Type": []string{"application/json"}},
+		Body:   ioutil.NopCloser(strings.NewReader(string(data)))}
+}
+
+// statusResponse returns a metav1.Status, as the api server does for
+// errors.
+func statusResponse(statusCode int, reason, format string, args ...interface{}) *http.Response {
+	return jsonResponse(statusCode, object{
+		"kind":       "Status",
+		"apiVersion": "v1",
+		"status":     "Failure",
+		"reason":     reason,
+		"code":       statusCode,
+		"message":    fmt.Sprintf(format, args...),
+	})
+}
+
+func notFound(p resourcePath) *http.Response {
+	return statusResponse(http.StatusNotFound, "NotFound", "%s %s not found", p.collection,
+		p.key())
+}
@@ -0,0 +1,176 @@
+package fake
+
+import (
+	"errors"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"net/http"
+	"sample-controller/pkg/kubeapi"
+	"testing"
+)
+
+const deployments = "/apis/apps/v1/namespaces/xyz/deployments"
+
+func deployment(name string, replicas int32) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "xyz",
+			Labels: map[string]string{"app": name}},
+		Spec: appsv1.DeploymentSpec{Replicas: &replicas},
+	}
+}
+
+func statusCode(err error) int {
+	var reqErr *kubeapi.RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr.StatusCode
+	}
+	return 0
+}
+
+func TestCRUD(t *testing.T) {
+	client, server := NewClient()
+	if err := client.AddDeployment(deployment("bar", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AddDeployment(deployment("bar", 1)); statusCode(err) != http.StatusConflict {
+		t.Error("Expected a conflict creating bar again, got ", err)
+	}
+
+	existing, err := client.GetDeployment("xyz", "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if existing.UID == "" || existing.ResourceVersion == "" || existing.Generation != 1 {
+		t.Errorf("Wrong metadata of a new resource: %+v", existing.ObjectMeta)
+	}
+
+	// Updates must be of the last version, and only the status
+	// subresource writes the status.
+	stale := existing.DeepCopy()
+	*existing.Spec.Replicas = 2
+	existing.Status.Replicas = 3
+	if err := client.UpdateDeployment(existing); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.UpdateDeployment(stale); statusCode(err) != http.StatusConflict {
+		t.Error("Expected a conflict updating a stale version, got ", err)
+	}
+	get := func() *appsv1.Deployment {
+		var ret appsv1.Deployment
+		if ok, err := server.Get(deployments+"/bar", &ret); !ok || err != nil {
+			t.Fatal("Could not get bar: ", err)
+		}
+		return &ret
+	}
+	stored := get()
+	if *stored.Spec.Replicas != 2 || stored.Status.Replicas != 0 || stored.Generation != 2 {
+		t.Errorf("Wrong update: %+v", stored)
+	}
+	stored.Status.Replicas = 3
+	if err := client.UpdateResourceStatus("apps", "v1", "xyz", "deployments/bar",
+		stored); err != nil {
+		t.Fatal(err)
+	}
+	stored = get()
+	if stored.Status.Replicas != 3 || stored.Generation != 2 {
+		t.Errorf("Wrong status update: %+v", stored)
+	}
+
+	if err := client.PatchDeployment("xyz", "bar", types.MergePatchType,
+		[]byte(`{"spec": {"replicas": 5}, "metadata": {"labels": {"app": null}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	stored = get()
+	if *stored.Spec.Replicas != 5 || len(stored.Labels) != 0 || stored.Status.Replicas != 3 {
+		t.Errorf("Wrong patch: %+v", stored)
+	}
+
+	if err := client.DeleteDeployment(stored); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetDeployment("xyz", "bar"); statusCode(err) != http.StatusNotFound {
+		t.Error("Expected bar to be deleted, got ", err)
+	}
+}
+
+func TestFinalizers(t *testing.T) {
+	client, server := NewClient()
+	bar := deployment("bar", 1)
+	bar.Finalizers = []string{"example.com/finalizer"}
+	if err := client.AddDeployment(bar); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DeleteDeployment(bar); err != nil {
+		t.Fatal(err)
+	}
+	existing, err := client.GetDeployment("xyz", "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if existing.DeletionTimestamp == nil {
+		t.Error("A resource with finalizers should be marked for deletion")
+	}
+	existing.Finalizers = nil
+	if err := client.UpdateDeployment(existing); err != nil {
+		t.Fatal(err)
+	}
+	if names := server.Names("/apis/apps/v1/deployments"); len(names) != 0 {
+		t.Error("The resource should be deleted without finalizers, got ", names)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	client, _ := NewClient()
+	if err := client.AddDeployment(deployment("a", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AddDeployment(deployment("b", 1)); err != nil {
+		t.Fatal(err)
+	}
+	events, stop := client.GetDeployments("xyz", kubeapi.ListOptions{LabelSelector: "app=b"})
+	defer close(stop)
+
+	next := func(isDelete bool, name string) appsv1.Deployment {
+		ev := <-events
+		if ev.Err != nil {
+			t.Fatal("Unexpected error: ", ev.Err)
+		}
+		item := ev.Item.(appsv1.Deployment)
+		if ev.IsDelete != isDelete || item.Name != name {
+			t.Fatalf("Got %s (deleted: %t), want %s (deleted: %t)", item.Name, ev.IsDelete,
+				name, isDelete)
+		}
+		return item
+	}
+	// Only b is selected.
+	b := next(false, "b")
+	*b.Spec.Replicas = 2
+	if err := client.UpdateDeployment(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DeleteDeployment(deployment("a", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AddDeployment(deployment("c", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DeleteDeployment(deployment("b", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if *next(false, "b").Spec.Replicas != 2 {
+		t.Error("The event should have the new version")
+	}
+	next(true, "b")
+}
+
+func TestFail(t *testing.T) {
+	client, server := NewClient()
+	server.Fail("POST", deployments, http.StatusInternalServerError)
+	if err := client.AddDeployment(deployment("bar", 1)); statusCode(err) != 500 {
+		t.Error("Expected the injected failure, got ", err)
+	}
+	if err := client.AddDeployment(deployment("bar", 1)); err != nil {
+		t.Error("Failures should only be injected once, got ", err)
+	}
+}
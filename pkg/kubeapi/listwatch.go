@@ -0,0 +1,217 @@
+package kubeapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+)
+
+// ListAndWatch is like GetResources, but first lists the resources
+// and sends them as added, then watches from the resource version of
+// the list. A watch ended by the api server is resumed from the last
+// resource version seen. If that is too old (410 Gone), the resources
+// are listed again and the ones that are gone are sent as deleted, so
+// no error is reported. A resourceVersion in query skips the first
+// list. The lists are fetched in pages, see WithPageSize. v must be a
+// pointer to a metav1.Object.
+func (client *KubeClient) ListAndWatch(group, version, namespace, path string, query url.Values,
+	v interface{}) (<-chan WatchEvent, chan<- struct{}) {
+	ch := make(chan WatchEvent)
+	stop := make(chan struct{})
+	go client.listAndWatch(group, version, namespace, path, query, v, ch, stop)
+	return ch, stop
+}
+
+// resourceList is the body of a list of any resource.
+type resourceList struct {
+	Metadata metav1.ListMeta   `json:"metadata"`
+	Items    []json.RawMessage `json:"items"`
+}
+
+// errContinueExpired is returned by list if the api server no longer
+// has the list it was continuing, so it has to be started again.
+var errContinueExpired = errors.New("The continue token of the list expired")
+
+// list calls each with the resources, a page at a time, and returns
+// the resource version of the list. It stops early, without an error,
+// if each returns false. Connecting is retried until stop is closed.
+func (client *KubeClient) list(group, version, namespace, path string, query url.Values,
+	ty reflect.Type, stop <-chan struct{}, each func(metav1.Object) bool) (string, error) {
+	pageQuery := url.Values{"limit": []string{strconv.FormatInt(client.listPageSize(), 10)}}
+	for k, vs := range query {
+		pageQuery[k] = vs
+	}
+	for {
+		list := resourceList{}
+		err := client.getList(group, version, namespace, path, pageQuery, stop, &list)
+		var re *RequestError
+		if pageQuery.Get("continue") != "" && errors.As(err, &re) &&
+			re.StatusCode == http.StatusGone {
+			return "", errContinueExpired
+		}
+		if err != nil {
+			return "", err
+		}
+		for _, raw := range list.Items {
+			obj := reflect.New(ty)
+			if err := json.Unmarshal(raw, obj.Interface()); err != nil {
+				return "", fmt.Errorf("Unmarshaling of resource failed: %w", err)
+			}
+			item, ok := reflect.Indirect(obj).Interface().(metav1.Object)
+			if !ok {
+				return "", fmt.Errorf("%s is not a metav1.Object", ty)
+			}
+			if !each(item) {
+				return "", nil
+			}
+		}
+		if list.Metadata.Continue == "" {
+			return list.Metadata.ResourceVersion, nil
+		}
+		pageQuery.Set("continue", list.Metadata.Continue)
+	}
+}
+
+func (client *KubeClient) getList(group, version, namespace, path string, query url.Values,
+	stop <-chan struct{}, list *resourceList) error {
+	body, err := client.getRetrying(group, version, namespace, path, query, stop)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if err := json.NewDecoder(body).Decode(list); err != nil {
+		return fmt.Errorf("Could not decode %s: %w", path, err)
+	}
+	return nil
+}
+
+func objectKey(obj metav1.Object) string {
+	return obj.GetNamespace() + "/" + obj.GetName()
+}
+
+func (client *KubeClient) listAndWatch(group, version, namespace, path string,
+	query url.Values, v interface{}, out chan<- WatchEvent, stopCh <-chan struct{}) {
+	defer close(out)
+	ty := reflect.TypeOf(v)
+	done := client.requestContext().Done()
+	send := func(ev WatchEvent) bool {
+		select {
+		case <-stopCh:
+			return false
+		case <-done:
+			return false
+		case out <- ev:
+			return true
+		}
+	}
+
+	// The queries of the lists and the watches
+	listQuery := url.Values{}
+	for k, vs := range query {
+		if k != "resourceVersion" && k != "watch" {
+			listQuery[k] = vs
+		}
+	}
+	resourceVersion := query.Get("resourceVersion")
+
+	// Map from namespace/name to what we last sent
+	known := make(map[string]metav1.Object)
+	for {
+		if resourceVersion == "" {
+			current := make(map[string]metav1.Object)
+			stopped := false
+			listRV, err := client.list(group, version, namespace, path, listQuery, ty, stopCh,
+				func(item metav1.Object) bool {
+					current[objectKey(item)] = item
+					stopped = !send(WatchEvent{Item: item})
+					return !stopped
+				})
+			if stopped {
+				return
+			}
+			if err == errContinueExpired {
+				// The items already sent are sent again.
+				continue
+			}
+			if err != nil {
+				send(WatchEvent{Err: fmt.Errorf("List failed: %w", err)})
+				return
+			}
+			for key, item := range known {
+				if _, ok := current[key]; ok {
+					continue
+				}
+				if !send(WatchEvent{IsDelete: true, Item: item}) {
+					return
+				}
+			}
+			known = current
+			resourceVersion = listRV
+		}
+
+		watchQuery := url.Values{"resourceVersion": []string{resourceVersion}}
+		for k, vs := range listQuery {
+			watchQuery[k] = vs
+		}
+		events, stop := client.GetResources(group, version, namespace, path, watchQuery, v)
+		var ok bool
+		resourceVersion, ok = forwardWatch(events, stopCh, send, known, resourceVersion)
+		close(stop)
+		if !ok {
+			return
+		}
+	}
+}
+
+// forwardWatch sends the events of a watch started from
+// resourceVersion and records them in known. It returns the resource
+// version to watch from next, empty to list again, and false if we
+// should stop.
+func forwardWatch(events <-chan WatchEvent, stopCh <-chan struct{},
+	send func(WatchEvent) bool, known map[string]metav1.Object,
+	resourceVersion string) (string, bool) {
+	for {
+		select {
+		case <-stopCh:
+			return "", false
+		case ev, ok := <-events:
+			if !ok {
+				// The api server ended the watch.
+				return resourceVersion, true
+			}
+			if ev.Err != nil {
+				var re *RequestError
+				if errors.As(ev.Err, &re) && re.StatusCode == http.StatusGone {
+					return "", true
+				}
+				if IsItemError(ev.Err) {
+					if !send(ev) {
+						return "", false
+					}
+					continue
+				}
+				send(ev)
+				return "", false
+			}
+			item, ok := ev.Item.(metav1.Object)
+			if !ok {
+				send(WatchEvent{Err: fmt.Errorf("%T is not a metav1.Object", ev.Item)})
+				return "", false
+			}
+			resourceVersion = item.GetResourceVersion()
+			if ev.IsDelete {
+				delete(known, objectKey(item))
+			} else {
+				known[objectKey(item)] = item
+			}
+			if !send(ev) {
+				return "", false
+			}
+		}
+	}
+}
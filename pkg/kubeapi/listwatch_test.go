@@ -0,0 +1,130 @@
+package kubeapi
+
+import (
+	"encoding/json"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestListPages(t *testing.T) {
+	deployment := func(name string) appsv1.Deployment {
+		return appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "xyz",
+			ResourceVersion: "1"}}
+	}
+	pages := map[string]appsv1.DeploymentList{
+		"": {ListMeta: metav1.ListMeta{Continue: "second"},
+			Items: []appsv1.Deployment{deployment("a"), deployment("b")}},
+		"second": {ListMeta: metav1.ListMeta{Continue: "third"},
+			Items: []appsv1.Deployment{deployment("c"), deployment("d")}},
+		"third": {ListMeta: metav1.ListMeta{ResourceVersion: "10"},
+			Items: []appsv1.Deployment{deployment("e")}},
+	}
+	watches := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		query := req.URL.Query()
+		if query.Get("watch") == "true" {
+			watches <- query.Get("resourceVersion")
+			w.(http.Flusher).Flush()
+			<-req.Context().Done()
+			return
+		}
+		if limit := query.Get("limit"); limit != "2" {
+			t.Error("Wrong limit: ", limit)
+		}
+		page, ok := pages[query.Get("continue")]
+		if !ok {
+			t.Error("Unexpected continue token: ", query.Get("continue"))
+		}
+		json.NewEncoder(w).Encode(&page)
+	}))
+	defer server.Close()
+	client, err := NewClient(server.URL, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, stop := client.WithPageSize(2).ListAndWatch("apps", "v1", "xyz", "deployments",
+		nil, &appsv1.Deployment{})
+	defer close(stop)
+	for _, want := range []string{"a", "b", "c", "d", "e"} {
+		ev := <-events
+		if ev.Err != nil {
+			t.Fatal("Unexpected error: ", ev.Err)
+		}
+		if name := ev.Item.(*appsv1.Deployment).Name; name != want {
+			t.Errorf("Got %s, want %s", name, want)
+		}
+	}
+	if rv := <-watches; rv != "10" {
+		t.Errorf("Watching from %q, want the version of the last page", rv)
+	}
+}
+
+func TestListPageSize(t *testing.T) {
+	client, err := NewClient("http://localhost", http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := client.listPageSize(); n != DefaultPageSize {
+		t.Errorf("Got page size %d, want %d", n, DefaultPageSize)
+	}
+	if n := client.WithPageSize(10).listPageSize(); n != 10 {
+		t.Errorf("Got page size %d, want 10", n)
+	}
+}
+
+func TestListContinueExpired(t *testing.T) {
+	expired := false
+	lists := make(chan string, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		query := req.URL.Query()
+		if query.Get("watch") == "true" {
+			w.(http.Flusher).Flush()
+			<-req.Context().Done()
+			return
+		}
+		token := query.Get("continue")
+		lists <- token
+		if token == "" {
+			w.Write([]byte(`{"metadata": {"continue": "second"},
+				"items": [{"metadata": {"name": "a"}}]}`))
+			return
+		}
+		if !expired {
+			expired = true
+			http.Error(w, "expired", http.StatusGone)
+			return
+		}
+		w.Write([]byte(`{"metadata": {"resourceVersion": "10"},
+			"items": [{"metadata": {"name": "b"}}]}`))
+	}))
+	defer server.Close()
+	client, err := NewClient(server.URL, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, stop := client.ListAndWatch("apps", "v1", "xyz", "deployments", nil,
+		&appsv1.Deployment{})
+	defer close(stop)
+	// The list starts again once its continue token expires.
+	for _, want := range []string{"a", "a", "b"} {
+		ev := <-events
+		if ev.Err != nil {
+			t.Fatal("Unexpected error: ", ev.Err)
+		}
+		if name := ev.Item.(*appsv1.Deployment).Name; name != want {
+			t.Errorf("Got %s, want %s", name, want)
+		}
+	}
+	for _, want := range []string{"", "second", "", "second"} {
+		if token := <-lists; token != want {
+			t.Errorf("Got continue token %q, want %q", token, want)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package kubeapi
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"net/url"
+)
+
+// TypedEvent is a WatchEvent whose Item has type T.
+type TypedEvent[T any] struct {
+	IsDelete bool
+	Item     T
+	Err      error
+}
+
+// WatchTyped is like GetResources for the resources gvr, but the
+// Items of the events have type T, usually a pointer to a struct. T
+// cannot be an interface type, as its items are decoded into a T.
+func WatchTyped[T any](client *KubeClient, gvr schema.GroupVersionResource, namespace string,
+	query url.Values) (<-chan TypedEvent[T], chan<- struct{}) {
+	var zero T
+	events := make(chan WatchEvent)
+	stop := make(chan struct{})
+	go client.produceResources(gvr.Group, gvr.Version, namespace, gvr.Resource, query, zero,
+		events, stop)
+
+	ch := make(chan TypedEvent[T])
+	go func() {
+		defer close(ch)
+		for ev := range events {
+			typed := TypedEvent[T]{IsDelete: ev.IsDelete, Err: ev.Err}
+			if ev.Err == nil {
+				// produceResources decodes into the type of zero.
+				item, ok := ev.Item.(T)
+				if !ok {
+					typed.Err = fmt.Errorf("Watch of %s produced a %T", gvr.Resource,
+						ev.Item)
+				}
+				typed.Item = item
+			}
+			select {
+			case ch <- typed:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return ch, stop
+}
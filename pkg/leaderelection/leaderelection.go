@@ -0,0 +1,274 @@
+// Package leaderelection elects one of several replicas of a
+// controller as the leader, with a coordination.k8s.io/v1 Lease.
+package leaderelection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"log"
+	"net/http"
+	"sample-controller/pkg/kubeapi"
+	"strings"
+	"time"
+)
+
+// Logger is what an election logs with, see Config.Logger. The
+// keysAndValues alternate between a key and its value. A
+// controller.Logger is one.
+type Logger interface {
+	Info(msg string, keysAndValues ...interface{})
+	Error(err error, msg string, keysAndValues ...interface{})
+}
+
+// stdLogger is the default Logger. It logs with the standard log
+// package, with the fields after the message.
+type stdLogger struct{}
+
+func (stdLogger) Info(msg string, keysAndValues ...interface{}) {
+	log.Print(formatLog(msg, keysAndValues))
+}
+
+func (stdLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	log.Print(formatLog(msg+": "+err.Error(), keysAndValues))
+}
+
+// formatLog appends the fields in keysAndValues to msg as key=value.
+func formatLog(msg string, keysAndValues []interface{}) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", keysAndValues[i], keysAndValues[i+1])
+	}
+	return b.String()
+}
+
+// Config configures an election. All the candidates must use the same
+// Namespace, Name and durations.
+type Config struct {
+	Client *kubeapi.KubeClient
+	// Namespace and Name identify the Lease.
+	Namespace string
+	Name      string
+	// Identity distinguishes this candidate from the others, for
+	// example the name of its pod.
+	Identity string
+
+	// LeaseDuration is how long the others wait after the leader
+	// last renewed the Lease before taking it over. 15 seconds by
+	// default.
+	LeaseDuration time.Duration
+	// RenewDeadline is how long the leader keeps trying to renew
+	// the Lease before giving up leadership. It must be shorter
+	// than LeaseDuration. 10 seconds by default.
+	RenewDeadline time.Duration
+	// RetryPeriod is how often the Lease is tried to be acquired
+	// or renewed. 2 seconds by default.
+	RetryPeriod time.Duration
+
+	// OnStartedLeading is called once the Lease is acquired.
+	OnStartedLeading func()
+	// OnStoppedLeading is called once the Lease is lost, or
+	// released because the context of Run is done.
+	OnStoppedLeading func()
+
+	// Logger is optional. By default, the standard log package is
+	// used.
+	Logger Logger
+}
+
+func (config *Config) setDefaults() {
+	if config.LeaseDuration == 0 {
+		config.LeaseDuration = 15 * time.Second
+	}
+	if config.RenewDeadline == 0 {
+		config.RenewDeadline = 10 * time.Second
+	}
+	if config.RetryPeriod == 0 {
+		config.RetryPeriod = 2 * time.Second
+	}
+	if config.Logger == nil {
+		config.Logger = stdLogger{}
+	}
+}
+
+// elector has the state of a candidate.
+type elector struct {
+	config Config
+	// The Lease as we last read or wrote it, and when that
+	// changed. Expiration is measured with our clock to be
+	// independent of that of the others.
+	observed     *coordinationv1.Lease
+	observedTime time.Time
+}
+
+// Run waits until config.Identity acquires the Lease, calls
+// OnStartedLeading and keeps renewing it. If the Lease could not be
+// renewed for RenewDeadline, OnStoppedLeading is called and Run
+// returns an error. Once ctx is done, a Lease we hold is released so
+// that another candidate can take over right away, and Run returns
+// nil.
+func Run(ctx context.Context, config Config) error {
+	config.setDefaults()
+	e := &elector{config: config}
+	// Our Lease requests must not be cancelled, so we can still
+	// release it once ctx is done.
+	client := config.Client.WithContext(context.Background())
+
+	ticker := time.NewTicker(config.RetryPeriod)
+	defer ticker.Stop()
+	for {
+		acquired, err := e.tryAcquireOrRenew(client)
+		if err != nil {
+			config.Logger.Error(err, "Could not acquire Lease", e.fields()...)
+		}
+		if acquired {
+			break
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+
+	config.Logger.Info("Acquired Lease", e.fields()...)
+	if config.OnStartedLeading != nil {
+		config.OnStartedLeading()
+	}
+	if config.OnStoppedLeading != nil {
+		defer config.OnStoppedLeading()
+	}
+
+	renewed := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if err := e.release(client); err != nil {
+				config.Logger.Error(err, "Could not release Lease", e.fields()...)
+			}
+			return nil
+		}
+		acquired, err := e.tryAcquireOrRenew(client)
+		if acquired {
+			renewed = time.Now()
+			continue
+		}
+		if err != nil {
+			config.Logger.Error(err, "Could not renew Lease", e.fields()...)
+		}
+		if time.Since(renewed) >= config.RenewDeadline {
+			return fmt.Errorf("%s lost Lease %s:%s", config.Identity, config.Namespace,
+				config.Name)
+		}
+	}
+}
+
+// fields identifies the Lease and us in the logs.
+func (e *elector) fields() []interface{} {
+	return []interface{}{"namespace", e.config.Namespace, "name", e.config.Name,
+		"identity", e.config.Identity}
+}
+
+func isStatus(err error, code int) bool {
+	var re *kubeapi.RequestError
+	return errors.As(err, &re) && re.StatusCode == code
+}
+
+// tryAcquireOrRenew writes the Lease with us as the holder, unless
+// another holder renewed it less than LeaseDuration ago. It reports
+// whether we hold it.
+func (e *elector) tryAcquireOrRenew(client *kubeapi.KubeClient) (bool, error) {
+	config := e.config
+	path := "leases/" + config.Name
+	now := metav1.NowMicro()
+
+	lease := &coordinationv1.Lease{}
+	err := client.GetResource("coordination.k8s.io", "v1", config.Namespace, path, lease)
+	if isStatus(err, http.StatusNotFound) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: config.Name, Namespace: config.Namespace},
+		}
+		e.setHolder(lease, now)
+		err := client.Post("coordination.k8s.io", "v1", config.Namespace, "leases", lease)
+		if isStatus(err, http.StatusConflict) {
+			// Someone else created it first.
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		e.observe(lease)
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if e.observed == nil || e.observed.ResourceVersion != lease.ResourceVersion {
+		e.observe(lease)
+	}
+	holder := ""
+	if lease.Spec.HolderIdentity != nil {
+		holder = *lease.Spec.HolderIdentity
+	}
+	if holder != "" && holder != config.Identity &&
+		time.Since(e.observedTime) < config.LeaseDuration {
+		return false, nil
+	}
+
+	e.setHolder(lease, now)
+	err = client.Put("coordination.k8s.io", "v1", config.Namespace, path, lease)
+	if isStatus(err, http.StatusConflict) {
+		// Someone else wrote it since we read it.
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// setHolder makes us the holder of lease, renewed at now.
+func (e *elector) setHolder(lease *coordinationv1.Lease, now metav1.MicroTime) {
+	spec := &lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity != e.config.Identity {
+		transitions := int32(0)
+		if spec.LeaseTransitions != nil {
+			transitions = *spec.LeaseTransitions
+		}
+		if spec.HolderIdentity != nil && *spec.HolderIdentity != "" {
+			transitions++
+		}
+		identity := e.config.Identity
+		spec.HolderIdentity = &identity
+		spec.AcquireTime = &now
+		spec.LeaseTransitions = &transitions
+	}
+	// The Lease has a whole number of seconds.
+	seconds := int32((e.config.LeaseDuration + time.Second - 1) / time.Second)
+	spec.LeaseDurationSeconds = &seconds
+	spec.RenewTime = &now
+}
+
+func (e *elector) observe(lease *coordinationv1.Lease) {
+	e.observed = lease
+	e.observedTime = time.Now()
+}
+
+// release clears the holder of the Lease, if it is still us.
+func (e *elector) release(client *kubeapi.KubeClient) error {
+	config := e.config
+	path := "leases/" + config.Name
+	lease := &coordinationv1.Lease{}
+	err := client.GetResource("coordination.k8s.io", "v1", config.Namespace, path, lease)
+	if err != nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != config.Identity {
+		return nil
+	}
+	empty := ""
+	lease.Spec.HolderIdentity = &empty
+	return client.Put("coordination.k8s.io", "v1", config.Namespace, path, lease)
+}
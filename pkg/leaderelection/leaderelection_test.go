@@ -0,0 +1,171 @@
+package leaderelection
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jarcoal/httpmock"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"net/http"
+	"sample-controller/pkg/kubeapi"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const leasePath = "/apis/coordination.k8s.io/v1/namespaces/default/leases"
+
+// leaseServer stores a single Lease, as the api server would.
+type leaseServer struct {
+	mu    sync.Mutex
+	lease *coordinationv1.Lease
+	rv    int
+}
+
+func (s *leaseServer) holder() (string, int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lease == nil || s.lease.Spec.HolderIdentity == nil {
+		return "", 0
+	}
+	return *s.lease.Spec.HolderIdentity, *s.lease.Spec.LeaseTransitions
+}
+
+func (s *leaseServer) write(req *http.Request, create bool) (*http.Response, error) {
+	lease := &coordinationv1.Lease{}
+	if err := json.NewDecoder(req.Body).Decode(lease); err != nil {
+		return httpmock.NewStringResponse(400, err.Error()), nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if create && s.lease != nil {
+		return httpmock.NewStringResponse(409, "exists"), nil
+	}
+	if !create && (s.lease == nil || lease.ResourceVersion != s.lease.ResourceVersion) {
+		return httpmock.NewStringResponse(409, "conflict"), nil
+	}
+	s.rv++
+	lease.ResourceVersion = strconv.Itoa(s.rv)
+	s.lease = lease
+	return httpmock.NewJsonResponse(200, lease)
+}
+
+func (s *leaseServer) get(req *http.Request) (*http.Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lease == nil {
+		return httpmock.NewStringResponse(404, "not found"), nil
+	}
+	return httpmock.NewJsonResponse(200, s.lease)
+}
+
+// candidate runs an election with a client of s that fails all
+// requests once dead is set.
+type candidate struct {
+	dead     int32
+	started  chan struct{}
+	stopped  chan struct{}
+	returned chan error
+}
+
+func startCandidate(t *testing.T, ctx context.Context, s *leaseServer,
+	identity string) *candidate {
+	c := &candidate{
+		started:  make(chan struct{}),
+		stopped:  make(chan struct{}),
+		returned: make(chan error, 1),
+	}
+	server := httpmock.NewMockTransport()
+	server.RegisterNoResponder(httpmock.NewNotFoundResponder(t.Fatal))
+	alive := func(responder httpmock.Responder) httpmock.Responder {
+		return func(req *http.Request) (*http.Response, error) {
+			if atomic.LoadInt32(&c.dead) == 1 {
+				return httpmock.NewStringResponse(500, "dead"), nil
+			}
+			return responder(req)
+		}
+	}
+	server.RegisterResponder("GET", leasePath+"/lock", alive(s.get))
+	server.RegisterResponder("PUT", leasePath+"/lock",
+		alive(func(req *http.Request) (*http.Response, error) { return s.write(req, false) }))
+	server.RegisterResponder("POST", leasePath,
+		alive(func(req *http.Request) (*http.Response, error) { return s.write(req, true) }))
+	client, err := kubeapi.NewClient("", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{
+		Client:           client,
+		Namespace:        "default",
+		Name:             "lock",
+		Identity:         identity,
+		LeaseDuration:    200 * time.Millisecond,
+		RenewDeadline:    150 * time.Millisecond,
+		RetryPeriod:      20 * time.Millisecond,
+		OnStartedLeading: func() { close(c.started) },
+		OnStoppedLeading: func() { close(c.stopped) },
+	}
+	go func() {
+		c.returned <- Run(ctx, config)
+	}()
+	return c
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestFailover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &leaseServer{}
+
+	a := startCandidate(t, ctx, s, "a")
+	<-a.started
+	b := startCandidate(t, ctx, s, "b")
+
+	// b stands by while a renews the Lease.
+	time.Sleep(400 * time.Millisecond)
+	if isClosed(b.started) {
+		t.Fatal("b started leading while a holds the Lease")
+	}
+	if holder, _ := s.holder(); holder != "a" {
+		t.Fatalf("Lease held by %q, want a", holder)
+	}
+
+	// a can no longer reach the api server: it gives up once its
+	// renew deadline passes and b takes over once the Lease expires.
+	start := time.Now()
+	atomic.StoreInt32(&a.dead, 1)
+	<-a.stopped
+	if err := <-a.returned; err == nil {
+		t.Error("Expected an error once the Lease is lost")
+	}
+	<-b.started
+	// b might have seen the last renewal of a up to a RetryPeriod
+	// before it died.
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Error("b took over before the Lease expired: ", d)
+	}
+	if holder, transitions := s.holder(); holder != "b" || transitions != 1 {
+		t.Errorf("Lease held by %q after %d transitions, want b after 1", holder,
+			transitions)
+	}
+
+	// Once its context is done, b releases the Lease.
+	cancel()
+	<-b.stopped
+	if err := <-b.returned; err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+	if holder, _ := s.holder(); holder != "" {
+		t.Errorf("Lease still held by %q", holder)
+	}
+}
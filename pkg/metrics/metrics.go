@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+// Registry has all the metrics of the controller.
+var Registry = prometheus.NewRegistry()
+
+// The metrics below are labeled with the controller that recorded
+// them, see ForController.
+
+// QueueLatency is how long items wait to be synchronized after being
+// queued.
+var QueueLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "reconcile_queue_latency_seconds",
+	Help:    "How long items wait in the work queue before being synchronized.",
+	Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
+}, []string{"controller"})
+
+// The values of the result label of ReconcileTotal.
+const (
+	ResultSuccess = "success"
+	ResultError   = "error"
+)
+
+// ReconcileTotal counts the synchronizations of items by result.
+var ReconcileTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "foo_reconcile_total",
+	Help: "How many items were synchronized, by result.",
+}, []string{"controller", "result"})
+
+// ReconcileDuration is how long each pass over the work queue takes.
+var ReconcileDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "foo_reconcile_duration_seconds",
+	Help:    "How long synchronizing the queued items takes.",
+	Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
+}, []string{"controller"})
+
+// WorkqueueDepth is how many items are waiting to be synchronized.
+var WorkqueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "foo_workqueue_depth",
+	Help: "How many items are waiting to be synchronized.",
+}, []string{"controller"})
+
+func init() {
+	Registry.MustRegister(QueueLatency, ReconcileTotal, ReconcileDuration, WorkqueueDepth)
+}
+
+// Recorder records the metrics of one controller.
+type Recorder interface {
+	// ObserveQueueLatency records how long an item waited.
+	ObserveQueueLatency(d time.Duration)
+	// CountReconcile counts a synchronization with result
+	// ResultSuccess or ResultError.
+	CountReconcile(result string)
+	// ObserveReconcileDuration records how long a pass over the
+	// work queue took.
+	ObserveReconcileDuration(d time.Duration)
+	// SetWorkqueueDepth records how many items are waiting.
+	SetWorkqueueDepth(n int)
+}
+
+// ForController returns the Recorder of the metrics of Registry whose
+// controller label is name.
+func ForController(name string) Recorder {
+	return controllerRecorder{
+		queueLatency:      QueueLatency.WithLabelValues(name),
+		success:           ReconcileTotal.WithLabelValues(name, ResultSuccess),
+		failure:           ReconcileTotal.WithLabelValues(name, ResultError),
+		reconcileDuration: ReconcileDuration.WithLabelValues(name),
+		depth:             WorkqueueDepth.WithLabelValues(name),
+	}
+}
+
+type controllerRecorder struct {
+	queueLatency      prometheus.Observer
+	success, failure  prometheus.Counter
+	reconcileDuration prometheus.Observer
+	depth             prometheus.Gauge
+}
+
+func (r controllerRecorder) ObserveQueueLatency(d time.Duration) {
+	r.queueLatency.Observe(d.Seconds())
+}
+
+func (r controllerRecorder) CountReconcile(result string) {
+	if result == ResultSuccess {
+		r.success.Inc()
+	} else {
+		r.failure.Inc()
+	}
+}
+
+func (r controllerRecorder) ObserveReconcileDuration(d time.Duration) {
+	r.reconcileDuration.Observe(d.Seconds())
+}
+
+func (r controllerRecorder) SetWorkqueueDepth(n int) {
+	r.depth.Set(float64(n))
+}
+
+// Handler serves the metrics of Registry, to be mounted at /metrics.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
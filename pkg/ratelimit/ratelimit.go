@@ -1,6 +1,10 @@
 package ratelimit
 
-import "time"
+import (
+	"sample-controller/pkg/workqueue"
+	"sync"
+	"time"
+)
 
 // RateLimiter is an interface that encapsulates limiting how often an
 // operation is performed.
@@ -10,7 +14,8 @@ import "time"
 //
 // Implementations send a message on the channel when there has been
 // at least one request and the implementation specific rate limit is
-// satisfied.
+// satisfied. The requests made before it are answered by that one
+// message, so a burst of them costs one tick.
 //
 // Stop the RateLimiter to release resources.
 type RateLimiter interface {
@@ -19,14 +24,56 @@ type RateLimiter interface {
 	Stop()
 }
 
+// rateLimiterImpl has what the RateLimiters have in common. AskTick
+// only wakes up their goroutine when no request is pending, so that a
+// burst of calls costs little more than one.
 type rateLimiterImpl struct {
-	ask  chan struct{}
+	// mu protects pending and last.
+	mu sync.Mutex
+	// pending is set by AskTick and cleared once the tick that
+	// answers it is ready to be sent.
+	pending bool
+	// last is when AskTick was last called.
+	last time.Time
+
+	// wake has room for one message, sent when pending is set.
+	wake chan struct{}
 	tick chan struct{}
 	stop chan struct{}
 }
 
+func newRateLimiterImpl() rateLimiterImpl {
+	return rateLimiterImpl{wake: make(chan struct{}, 1), tick: make(chan struct{}),
+		stop: make(chan struct{})}
+}
+
 func (rl *rateLimiterImpl) AskTick() {
-	rl.ask <- struct{}{}
+	rl.mu.Lock()
+	rl.last = time.Now()
+	wake := !rl.pending
+	rl.pending = true
+	rl.mu.Unlock()
+	if wake {
+		select {
+		case rl.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// lastAsk returns when AskTick was last called.
+func (rl *rateLimiterImpl) lastAsk() time.Time {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.last
+}
+
+// answer clears pending, as the tick is about to be ready. Calls to
+// AskTick from now on ask for another one.
+func (rl *rateLimiterImpl) answer() {
+	rl.mu.Lock()
+	rl.pending = false
+	rl.mu.Unlock()
 }
 
 func (rl *rateLimiterImpl) GetChan() <-chan struct{} {
@@ -39,26 +86,105 @@ func (rl *rateLimiterImpl) Stop() {
 
 // AfterOneSecondIdle returns a RateLimiter that sends a tick after
 // the caller is idle for one second. That is, after one second
-// without a call to AskTick.
+// without a call to AskTick. However many calls come before, only one
+// tick is sent.
 func AfterOneSecondIdle() RateLimiter {
-	ret := &rateLimiterImpl{make(chan struct{}), make(chan struct{}), make(chan struct{})}
+	return afterIdle(time.Second)
+}
+
+func afterIdle(idle time.Duration) RateLimiter {
+	ret := newRateLimiterImpl()
 	go func() {
-		timer := time.NewTimer(1 * time.Second)
+		timer := time.NewTimer(idle)
 		timer.Stop()
 		var tick chan struct{}
 		for {
 			select {
 			case <-ret.stop:
+				timer.Stop()
 				return
-			case <-ret.ask:
-				// We can stop multiple times, so don't use the return from Stop.
+			case <-ret.wake:
+				// The timer is not running: it is only started
+				// here and the requests are pending until it
+				// fires.
+				timer.Reset(idle)
+			case <-timer.C:
+				if wait := time.Until(ret.lastAsk().Add(idle)); wait > 0 {
+					// Asked again meanwhile.
+					timer.Reset(wait)
+					break
+				}
+				ret.answer()
+				// Enable sending on the next loop iteration
+				tick = ret.tick
+			case tick <- struct{}{}:
+				// Disable sending on the next loop iteration
+				tick = nil
+			}
+		}
+	}()
+	return &ret
+}
+
+// Resetter is implemented by RateLimiters whose delay grows with the
+// number of ticks, like the one returned by NewExponentialRateLimiter.
+// Reset goes back to the initial delay. Users should call it after the
+// operation succeeds.
+type Resetter interface {
+	Reset()
+}
+
+type exponentialRateLimiter struct {
+	rateLimiterImpl
+	reset chan struct{}
+	// stopped is closed once the goroutine returns, so that Reset
+	// doesn't block after Stop.
+	stopped chan struct{}
+}
+
+func (rl *exponentialRateLimiter) Reset() {
+	select {
+	case rl.reset <- struct{}{}:
+	case <-rl.stopped:
+	}
+}
+
+// NewExponentialRateLimiter returns a RateLimiter that sends a tick
+// some time after AskTick is called. That is base at first and doubles
+// with every tick, up to max, until Reset is called. Calls to AskTick
+// before the tick is ready are merged into one.
+func NewExponentialRateLimiter(base, max time.Duration) RateLimiter {
+	ret := &exponentialRateLimiter{newRateLimiterImpl(), make(chan struct{}),
+		make(chan struct{})}
+	go func() {
+		defer close(ret.stopped)
+		timer := time.NewTimer(base)
+		timer.Stop()
+		waiting := false
+		n := 0
+		var tick chan struct{}
+		for {
+			select {
+			case <-ret.stop:
 				timer.Stop()
-				select {
-				case <-timer.C:
-				default:
+				return
+			case <-ret.reset:
+				n = 0
+			case <-ret.wake:
+				if !waiting {
+					// Plus or minus 10%, up to max.
+					delay := workqueue.Jitter(workqueue.ExponentialDelay(base, max, n),
+						0.1)
+					if delay > max {
+						delay = max
+					}
+					timer.Reset(delay)
+					waiting = true
+					n++
 				}
-				timer.Reset(1 * time.Second)
 			case <-timer.C:
+				waiting = false
+				ret.answer()
 				// Enable sending on the next loop iteration
 				tick = ret.tick
 			case tick <- struct{}{}:
@@ -0,0 +1,106 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExponentialRateLimiter(t *testing.T) {
+	base := 50 * time.Millisecond
+	rl := NewExponentialRateLimiter(base, 10*base)
+	defer rl.Stop()
+
+	wait := func() time.Duration {
+		start := time.Now()
+		rl.AskTick()
+		// Merged with the first one.
+		rl.AskTick()
+		<-rl.GetChan()
+		return time.Since(start)
+	}
+	if d := wait(); d < base*9/10 {
+		t.Error("First tick too early: ", d)
+	}
+	if d := wait(); d < 2*base*9/10 {
+		t.Error("Second tick too early: ", d)
+	}
+	if d := wait(); d < 4*base*9/10 {
+		t.Error("Third tick too early: ", d)
+	}
+
+	rl.(Resetter).Reset()
+	if d := wait(); d < base*9/10 || d >= 4*base*9/10 {
+		t.Error("Tick after Reset did not start over: ", d)
+	}
+}
+
+func TestResetAfterStop(t *testing.T) {
+	rl := NewExponentialRateLimiter(time.Millisecond, time.Second)
+	rl.Stop()
+	done := make(chan struct{})
+	go func() {
+		rl.(Resetter).Reset()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reset blocked after Stop")
+	}
+}
+
+// checkOneTick fails t unless rl sends exactly one tick within wait
+// after AskTick is called 100 times.
+func checkOneTick(t *testing.T, rl RateLimiter, wait time.Duration) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		rl.AskTick()
+	}
+	select {
+	case <-rl.GetChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("No tick")
+	}
+	select {
+	case <-rl.GetChan():
+		t.Error("The requests were not merged into one tick")
+	case <-time.After(wait):
+	}
+}
+
+func TestAfterIdleMerges(t *testing.T) {
+	idle := 20 * time.Millisecond
+	rl := afterIdle(idle)
+	defer rl.Stop()
+	checkOneTick(t, rl, 5*idle)
+
+	// A request after the tick asks for another one.
+	rl.AskTick()
+	select {
+	case <-rl.GetChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("No tick after the first one")
+	}
+}
+
+func TestExponentialRateLimiterMerges(t *testing.T) {
+	base := 20 * time.Millisecond
+	rl := NewExponentialRateLimiter(base, 10*base)
+	defer rl.Stop()
+	checkOneTick(t, rl, 5*base)
+}
+
+func TestAfterIdleWaitsForIdle(t *testing.T) {
+	idle := 50 * time.Millisecond
+	rl := afterIdle(idle)
+	defer rl.Stop()
+	start := time.Now()
+	rl.AskTick()
+	time.Sleep(idle / 2)
+	// Restarts the wait.
+	rl.AskTick()
+	<-rl.GetChan()
+	if d := time.Since(start); d < idle*3/2 {
+		t.Error("Tick too early: ", d)
+	}
+}
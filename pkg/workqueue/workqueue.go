@@ -0,0 +1,251 @@
+// Package workqueue provides a queue of keys to process, such as the
+// names of the resources a controller has to synchronize.
+package workqueue
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Queue is a work queue of keys that is safe for concurrent use. A key
+// is only queued once, no matter how many times it is added before it
+// is handed out by Get, and it is never handed to two callers of Get
+// at once: a key added while being processed is queued again once
+// Done is called.
+type Queue struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	queue []string
+	// dirty holds the keys that are in queue, or that will be once
+	// Done is called.
+	dirty map[string]struct{}
+	// processing holds the keys handed out by Get and not yet Done.
+	processing map[string]struct{}
+	// delayed holds the keys waiting for AddAfter.
+	delayed  map[string]delayedKey
+	shutdown bool
+}
+
+type delayedKey struct {
+	timer *time.Timer
+	at    time.Time
+}
+
+// New returns an empty Queue.
+func New() *Queue {
+	q := &Queue{dirty: make(map[string]struct{}), processing: make(map[string]struct{}),
+		delayed: make(map[string]delayedKey)}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Add queues key, unless it already is or the queue is shut down.
+func (q *Queue) Add(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.add(key)
+}
+
+func (q *Queue) add(key string) {
+	if q.shutdown {
+		return
+	}
+	if _, ok := q.dirty[key]; ok {
+		return
+	}
+	q.dirty[key] = struct{}{}
+	if _, ok := q.processing[key]; ok {
+		return
+	}
+	q.queue = append(q.queue, key)
+	q.cond.Signal()
+}
+
+// AddAfter adds key once delay has expired. If key was already
+// waiting, it is added at the earliest of the two times.
+func (q *Queue) AddAfter(key string, delay time.Duration) {
+	if delay <= 0 {
+		q.Add(key)
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.shutdown {
+		return
+	}
+	at := time.Now().Add(delay)
+	if d, ok := q.delayed[key]; ok {
+		if !at.Before(d.at) {
+			return
+		}
+		d.timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		// Unless it was replaced by an earlier one.
+		if d, ok := q.delayed[key]; ok && d.timer == timer {
+			delete(q.delayed, key)
+			q.add(key)
+		}
+	})
+	q.delayed[key] = delayedKey{timer, at}
+}
+
+// Get blocks until a key is queued and returns it. The caller must
+// call Done with it once processed. Once the queue is shut down and
+// empty, shutdown is true.
+func (q *Queue) Get() (key string, shutdown bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.queue) == 0 && !q.shutdown {
+		q.cond.Wait()
+	}
+	if len(q.queue) == 0 {
+		return "", true
+	}
+	key, q.queue = q.queue[0], q.queue[1:]
+	q.processing[key] = struct{}{}
+	delete(q.dirty, key)
+	return key, false
+}
+
+// Done marks key as processed. If it was added again meanwhile, it
+// is queued.
+func (q *Queue) Done(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.processing, key)
+	if _, ok := q.dirty[key]; ok {
+		q.queue = append(q.queue, key)
+		q.cond.Signal()
+	}
+}
+
+// Pending reports whether key is waiting for AddAfter or queued, so
+// that it will be handed out by Get.
+func (q *Queue) Pending(key string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.delayed[key]; ok {
+		return true
+	}
+	_, ok := q.dirty[key]
+	return ok
+}
+
+// Cancel removes key from the queue and stops its AddAfter, if any. A
+// key being processed is not queued again by Done.
+func (q *Queue) Cancel(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if d, ok := q.delayed[key]; ok {
+		d.timer.Stop()
+		delete(q.delayed, key)
+	}
+	if _, ok := q.dirty[key]; !ok {
+		return
+	}
+	delete(q.dirty, key)
+	for i, k := range q.queue {
+		if k == key {
+			q.queue = append(q.queue[:i], q.queue[i+1:]...)
+			break
+		}
+	}
+}
+
+// Len returns how many keys are queued.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.queue)
+}
+
+// ShutDown makes the queue ignore new keys, including those waiting
+// for AddAfter, and makes Get return once the queued keys are handed
+// out.
+func (q *Queue) ShutDown() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.shutdown = true
+	for key, d := range q.delayed {
+		d.timer.Stop()
+		delete(q.delayed, key)
+	}
+	q.cond.Broadcast()
+}
+
+// ExponentialDelay returns base doubled n times, up to max.
+func ExponentialDelay(base, max time.Duration, n int) time.Duration {
+	delay := base
+	for i := 0; i < n && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// Jitter returns d plus or minus fraction of it, at random, so that
+// the retries of keys that failed together are spread out.
+func Jitter(d time.Duration, fraction float64) time.Duration {
+	return time.Duration(float64(d) * (1 - fraction + 2*fraction*rand.Float64()))
+}
+
+// Backoff tracks how many consecutive times each key failed, to delay
+// its retries exponentially. It is safe for concurrent use.
+type Backoff struct {
+	base, max time.Duration
+
+	mu       sync.Mutex
+	failures map[string]int
+}
+
+// NewBackoff returns a Backoff whose delays start at base and double
+// with each failure, up to max.
+func NewBackoff(base, max time.Duration) *Backoff {
+	return &Backoff{base: base, max: max, failures: make(map[string]int)}
+}
+
+// When records a failure of key and returns how long to wait before
+// retrying it.
+func (b *Backoff) When(key string) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := b.failures[key]
+	b.failures[key]++
+	return ExponentialDelay(b.base, b.max, n)
+}
+
+// NumRequeues returns how many consecutive times key failed.
+func (b *Backoff) NumRequeues(key string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures[key]
+}
+
+// Keys returns the sorted keys that failed since they were last
+// forgotten.
+func (b *Backoff) Keys() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	keys := make([]string, 0, len(b.failures))
+	for key := range b.failures {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Forget resets the failures of key, once it succeeded.
+func (b *Backoff) Forget(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.failures, key)
+}
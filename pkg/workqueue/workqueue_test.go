@@ -0,0 +1,167 @@
+package workqueue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedup(t *testing.T) {
+	q := New()
+	q.Add("a")
+	q.Add("b")
+	q.Add("a")
+	if n := q.Len(); n != 2 {
+		t.Fatalf("Expected 2 keys, got %d", n)
+	}
+	for _, want := range []string{"a", "b"} {
+		if key, _ := q.Get(); key != want {
+			t.Errorf("Expected %s, got %s", want, key)
+		}
+	}
+
+	// Added while processing, it is only queued again once done.
+	q.Add("a")
+	if n := q.Len(); n != 0 {
+		t.Errorf("Expected a to wait for Done, got %d keys", n)
+	}
+	q.Done("a")
+	q.Done("b")
+	if key, _ := q.Get(); key != "a" {
+		t.Errorf("Expected a, got %s", key)
+	}
+	q.Done("a")
+	if n := q.Len(); n != 0 {
+		t.Errorf("Expected no keys, got %d", n)
+	}
+}
+
+func TestAddAfter(t *testing.T) {
+	q := New()
+	delay := 50 * time.Millisecond
+	start := time.Now()
+	q.AddAfter("a", delay)
+	// The earliest of the two wins.
+	q.AddAfter("a", time.Hour)
+	if n := q.Len(); n != 0 {
+		t.Errorf("Expected a to wait, got %d keys", n)
+	}
+	if key, _ := q.Get(); key != "a" {
+		t.Errorf("Expected a, got %s", key)
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("a was added after %s, expected %s", elapsed, delay)
+	}
+	q.Done("a")
+
+	// An earlier delay replaces a later one.
+	start = time.Now()
+	q.AddAfter("b", time.Hour)
+	q.AddAfter("b", delay)
+	if key, _ := q.Get(); key != "b" {
+		t.Errorf("Expected b, got %s", key)
+	}
+	if elapsed := time.Since(start); elapsed > time.Minute {
+		t.Errorf("b was added after %s", elapsed)
+	}
+	q.Done("b")
+	if n := q.Len(); n != 0 {
+		t.Errorf("b was added twice, got %d keys", n)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	q := New()
+	q.Add("a")
+	q.Add("b")
+	q.AddAfter("c", time.Millisecond)
+	if !q.Pending("a") || !q.Pending("c") || q.Pending("d") {
+		t.Error("Wrong pending keys")
+	}
+	q.Cancel("a")
+	q.Cancel("c")
+	if q.Pending("a") || q.Pending("c") {
+		t.Error("Canceled keys are still pending")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if key, _ := q.Get(); key != "b" {
+		t.Errorf("Expected b, got %s", key)
+	}
+	if n := q.Len(); n != 0 {
+		t.Errorf("Expected no keys, got %d", n)
+	}
+
+	// A key processed and canceled is not queued again.
+	q.Add("b")
+	q.Cancel("b")
+	q.Done("b")
+	if n := q.Len(); n != 0 {
+		t.Errorf("Expected b to be canceled, got %d keys", n)
+	}
+}
+
+func TestShutDown(t *testing.T) {
+	q := New()
+	q.Add("a")
+	q.AddAfter("b", time.Millisecond)
+	q.ShutDown()
+	if key, shutdown := q.Get(); key != "a" || shutdown {
+		t.Errorf("Expected a before shutting down, got %q", key)
+	}
+	done := make(chan bool)
+	go func() {
+		_, shutdown := q.Get()
+		done <- shutdown
+	}()
+	if !<-done {
+		t.Error("Expected Get to report the shutdown")
+	}
+	q.Add("c")
+	if n := q.Len(); n != 0 {
+		t.Errorf("Expected a shut down queue to ignore keys, got %d", n)
+	}
+}
+
+func TestExponentialDelay(t *testing.T) {
+	base := 100 * time.Millisecond
+	max := time.Second
+	for i, want := range []time.Duration{base, 2 * base, 4 * base, 8 * base, max, max} {
+		if delay := ExponentialDelay(base, max, i); delay != want {
+			t.Errorf("Delay %d is %s, want %s", i, delay, want)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	if a, b := Jitter(time.Second, 0.2), Jitter(time.Second, 0.2); a == b {
+		t.Error("The delays are not jittered: ", a, b)
+	}
+	for i := 0; i < 100; i++ {
+		if d := Jitter(time.Second, 0.2); d < 800*time.Millisecond ||
+			d > 1200*time.Millisecond {
+			t.Fatal("Delay out of range: ", d)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	base := 10 * time.Millisecond
+	b := NewBackoff(base, 50*time.Millisecond)
+	for i, want := range []time.Duration{base, 2 * base, 4 * base, 50 * time.Millisecond} {
+		if d := b.When("a"); d != want {
+			t.Errorf("Delay %d is %s, want %s", i, d, want)
+		}
+	}
+	if d := b.When("b"); d != base {
+		t.Errorf("Another key got %s, want %s", d, base)
+	}
+	if n := b.NumRequeues("a"); n != 4 {
+		t.Errorf("Expected 4 requeues, got %d", n)
+	}
+	if keys := b.Keys(); len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Errorf("Expected keys a and b, got %v", keys)
+	}
+	b.Forget("a")
+	if d := b.When("a"); d != base {
+		t.Errorf("After Forget, got %s, want %s", d, base)
+	}
+}